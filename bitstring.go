@@ -23,21 +23,26 @@ package conflux
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
 )
 
+// Bitstring is a string of bits, stored most significant bit first
+// in 64-bit words so that keys can be compared and taken apart a word
+// at a time. It is serialized as bytes, also most significant bit first.
 type Bitstring struct {
-	buf  []byte
-	bits int
+	words []uint64
+	bits  int
 }
 
 func NewBitstring(bits int) *Bitstring {
-	n := bits / 8
-	if bits%8 != 0 {
-		n++
-	}
-	return &Bitstring{buf: make([]byte, n), bits: bits}
+	return &Bitstring{words: make([]uint64, (bits+63)/64), bits: bits}
 }
 
 func (bs *Bitstring) BitLen() int {
@@ -45,67 +50,177 @@ func (bs *Bitstring) BitLen() int {
 }
 
 func (bs *Bitstring) ByteLen() int {
-	return len(bs.buf)
+	return (bs.bits + 7) / 8
 }
 
 func (bs *Bitstring) bitIndex(bit int) (int, uint) {
-	return bit / 8, uint(bit % 8)
+	return bit / 64, uint(63 - bit%64)
 }
 
 func (bs *Bitstring) Get(bit int) int {
-	bytePos, bitPos := bs.bitIndex(bit)
-	if (bs.buf[bytePos] & (byte(1) << (8 - bitPos - 1))) != 0 {
-		return 1
-	}
-	return 0
+	wordPos, bitPos := bs.bitIndex(bit)
+	return int((bs.words[wordPos] >> bitPos) & 1)
 }
 
 func (bs *Bitstring) Set(bit int) {
-	bytePos, bitPos := bs.bitIndex(bit)
-	bs.buf[bytePos] |= (byte(1) << (8 - bitPos - 1))
+	wordPos, bitPos := bs.bitIndex(bit)
+	bs.words[wordPos] |= 1 << bitPos
 }
 
 func (bs *Bitstring) Unset(bit int) {
-	bytePos, bitPos := bs.bitIndex(bit)
-	bs.buf[bytePos] &^= (byte(1) << (8 - bitPos - 1))
+	wordPos, bitPos := bs.bitIndex(bit)
+	bs.words[wordPos] &^= 1 << bitPos
 }
 
 func (bs *Bitstring) Flip(bit int) {
-	bytePos, bitPos := bs.bitIndex(bit)
-	bs.buf[bytePos] ^= (byte(1) << (8 - bitPos - 1))
+	wordPos, bitPos := bs.bitIndex(bit)
+	bs.words[wordPos] ^= 1 << bitPos
 }
 
-func (bs *Bitstring) SetBytes(buf []byte) {
-	for i := 0; i < len(bs.buf); i++ {
-		if i < len(buf) {
-			bs.buf[i] = buf[i]
-		} else {
-			bs.buf[i] = byte(0)
+// trim clears the unused bits of the last word.
+func (bs *Bitstring) trim() {
+	if r := bs.bits % 64; r != 0 {
+		bs.words[len(bs.words)-1] &= ^uint64(0) << uint(64-r)
+	}
+}
+
+// Copy returns a copy of the bitstring.
+func (bs *Bitstring) Copy() *Bitstring {
+	c := NewBitstring(bs.bits)
+	copy(c.words, bs.words)
+	return c
+}
+
+// Prefix returns a copy of the first n bits of the bitstring.
+func (bs *Bitstring) Prefix(n int) *Bitstring {
+	if n < 0 || n > bs.bits {
+		panic(fmt.Sprintf("prefix of %d bits out of range for %d bit bitstring", n, bs.bits))
+	}
+	prefix := NewBitstring(n)
+	copy(prefix.words, bs.words)
+	prefix.trim()
+	return prefix
+}
+
+// HasPrefix tests if the bitstring begins with prefix.
+func (bs *Bitstring) HasPrefix(prefix *Bitstring) bool {
+	return prefix.bits <= bs.bits && bs.cmpBits(prefix, prefix.bits) == 0
+}
+
+// Append returns a new bitstring of this one followed by other.
+func (bs *Bitstring) Append(other *Bitstring) *Bitstring {
+	result := NewBitstring(bs.bits + other.bits)
+	copy(result.words, bs.words)
+	shift := uint(bs.bits % 64)
+	for i, w := range other.words {
+		pos := bs.bits/64 + i
+		result.words[pos] |= w >> shift
+		if shift != 0 && pos+1 < len(result.words) {
+			result.words[pos+1] |= w << (64 - shift)
+		}
+	}
+	return result
+}
+
+// AppendUint returns a new bitstring of this one followed by the low
+// n bits of v, least significant bit first. This is the order in which
+// the bits of a child's index extend its parent's key in a prefix tree.
+func (bs *Bitstring) AppendUint(v uint, n int) *Bitstring {
+	ext := NewBitstring(n)
+	if n > 0 {
+		ext.words[0] = bits.Reverse64(uint64(v))
+		ext.trim()
+	}
+	return bs.Append(ext)
+}
+
+// Uint returns the n bits beginning at bit start as an unsigned integer,
+// the first being the least significant. It is the inverse of AppendUint.
+func (bs *Bitstring) Uint(start, n int) uint {
+	if n == 0 {
+		return 0
+	}
+	wordPos, offset := start/64, uint(start%64)
+	w := bs.words[wordPos] << offset
+	if offset != 0 && int(64-offset) < n {
+		w |= bs.words[wordPos+1] >> (64 - offset)
+	}
+	// The bits are now at the top of w, first bit highest
+	return uint(bits.Reverse64(w) & (^uint64(0) >> uint(64-n)))
+}
+
+// Cmp compares bitstrings in lexicographic order of their bits,
+// returning -1, 0 or 1. A bitstring sorts before any longer one
+// which it is a prefix of.
+func (bs *Bitstring) Cmp(other *Bitstring) int {
+	n := bs.bits
+	if other.bits < n {
+		n = other.bits
+	}
+	if c := bs.cmpBits(other, n); c != 0 {
+		return c
+	}
+	switch {
+	case bs.bits < other.bits:
+		return -1
+	case bs.bits > other.bits:
+		return 1
+	}
+	return 0
+}
+
+// cmpBits compares the first n bits of two bitstrings.
+func (bs *Bitstring) cmpBits(other *Bitstring, n int) int {
+	for i := 0; i*64 < n; i++ {
+		a, b := bs.words[i], other.words[i]
+		if r := n - i*64; r < 64 {
+			mask := ^uint64(0) << uint(64-r)
+			a, b = a&mask, b&mask
+		}
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
 		}
 	}
-	bytePos, bitPos := bs.bitIndex(bs.bits)
-	if bitPos != 0 {
-		mask := ^((byte(1) << (8 - bitPos)) - 1)
-		bs.buf[bytePos] &= mask
+	return 0
+}
+
+func (bs *Bitstring) SetBytes(buf []byte) {
+	for i := range bs.words {
+		bs.words[i] = 0
+	}
+	for i := 0; i < bs.ByteLen() && i < len(buf); i++ {
+		bs.words[i/8] |= uint64(buf[i]) << uint(56-8*(i%8))
 	}
+	bs.trim()
 }
 
 func (bs *Bitstring) Lsh(n uint) {
-	i := big.NewInt(int64(0)).SetBytes(bs.buf)
+	i := big.NewInt(int64(0)).SetBytes(bs.Bytes())
 	i.Lsh(i, n)
 	bs.SetBytes(i.Bytes())
 }
 
 func (bs *Bitstring) Rsh(n uint) {
-	i := big.NewInt(int64(0)).SetBytes(bs.buf)
+	i := big.NewInt(int64(0)).SetBytes(bs.Bytes())
 	i.Rsh(i, n)
 	bs.SetBytes(i.Bytes())
 }
 
+// String formats the bitstring as its length in bits and its bytes in
+// hexadecimal, separated by a colon, such as "10:8040". ParseBitstring
+// reads it back.
 func (bs *Bitstring) String() string {
 	if bs == nil {
 		return "nil"
 	}
+	return fmt.Sprintf("%d:%s", bs.bits, hex.EncodeToString(bs.Bytes()))
+}
+
+// BinaryString formats the bitstring as a string of 0s and 1s.
+func (bs *Bitstring) BinaryString() string {
 	w := bytes.NewBuffer(nil)
 	for i := 0; i < bs.bits; i++ {
 		fmt.Fprintf(w, "%d", bs.Get(i))
@@ -113,10 +228,95 @@ func (bs *Bitstring) String() string {
 	return w.String()
 }
 
+// ParseBitstring reads a bitstring in the form formatted by String,
+// rejecting any bits set in the last byte past the length.
+func ParseBitstring(s string) (*Bitstring, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New(fmt.Sprintf("invalid bitstring %q: expect length:hex", s))
+	}
+	bits, err := strconv.Atoi(parts[0])
+	if err != nil || bits < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid bitstring length %q", parts[0]))
+	}
+	buf, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid bitstring bytes %q: %v", parts[1], err))
+	}
+	bs := NewBitstring(bits)
+	if len(buf) != bs.ByteLen() {
+		return nil, errors.New(fmt.Sprintf(
+			"expect %d bytes for a %d bit bitstring, was %d", bs.ByteLen(), bits, len(buf)))
+	}
+	// Bits past the length must be zero, so that each bitstring has one form
+	if pad := uint(8*len(buf) - bits); pad > 0 && buf[len(buf)-1]&(1<<pad-1) != 0 {
+		return nil, errors.New(fmt.Sprintf("invalid bitstring %q: bits set past length %d", s, bits))
+	}
+	bs.SetBytes(buf)
+	return bs, nil
+}
+
 func (bs *Bitstring) Bytes() []byte {
-	w := bytes.NewBuffer(nil)
-	w.Write(bs.buf)
-	return w.Bytes()
+	buf := make([]byte, bs.ByteLen())
+	for i := range buf {
+		buf[i] = byte(bs.words[i/8] >> uint(56-8*(i%8)))
+	}
+	return buf
+}
+
+// MarshalBinary encodes the bitstring as its length in bits,
+// a 4-byte big-endian integer, followed by its bytes.
+func (bs *Bitstring) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 4+bs.ByteLen())
+	binary.BigEndian.PutUint32(buf, uint32(bs.bits))
+	copy(buf[4:], bs.Bytes())
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a bitstring encoded by MarshalBinary.
+func (bs *Bitstring) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("bitstring encoding too short")
+	}
+	bits := int(binary.BigEndian.Uint32(data))
+	decoded := NewBitstring(bits)
+	if len(data)-4 != decoded.ByteLen() {
+		return errors.New(fmt.Sprintf(
+			"expect %d bytes for a %d bit bitstring, was %d", decoded.ByteLen(), bits, len(data)-4))
+	}
+	decoded.SetBytes(data[4:])
+	*bs = *decoded
+	return nil
+}
+
+// MarshalText encodes the bitstring as String formats it.
+func (bs *Bitstring) MarshalText() ([]byte, error) {
+	return []byte(bs.String()), nil
+}
+
+// UnmarshalText decodes a bitstring encoded by MarshalText, or
+// given as a string of 0s and 1s.
+func (bs *Bitstring) UnmarshalText(text []byte) error {
+	if bytes.IndexByte(text, ':') >= 0 {
+		decoded, err := ParseBitstring(string(text))
+		if err != nil {
+			return err
+		}
+		*bs = *decoded
+		return nil
+	}
+	decoded := NewBitstring(len(text))
+	for i, c := range text {
+		switch c {
+		case '0':
+		case '1':
+			decoded.Set(i)
+		default:
+			return errors.New(fmt.Sprintf("invalid bit %q in bitstring", c))
+		}
+	}
+	*bs = *decoded
+	return nil
 }
 
 func ReverseBytes(buf []byte) (result []byte) {
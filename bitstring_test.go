@@ -23,6 +23,7 @@ package conflux
 
 import (
 	"github.com/bmizerany/assert"
+	"strings"
 	"testing"
 )
 
@@ -30,28 +31,28 @@ func TestBitstringSet(t *testing.T) {
 	var bs *Bitstring
 	// bitstring len=1
 	bs = NewBitstring(1)
-	assert.Equal(t, bs.String(), "0")
+	assert.Equal(t, bs.BinaryString(), "0")
 	bs.Flip(0)
-	assert.Equal(t, bs.String(), "1")
+	assert.Equal(t, bs.BinaryString(), "1")
 	assert.Equal(t, bs.Bytes()[0], byte(0x80))
 	// bitstring len=2
 	bs = NewBitstring(2)
-	assert.Equal(t, bs.String(), "00")
+	assert.Equal(t, bs.BinaryString(), "00")
 	bs.Flip(0)
-	assert.Equal(t, bs.String(), "10")
+	assert.Equal(t, bs.BinaryString(), "10")
 	assert.Equal(t, bs.Bytes()[0], byte(0x80))
 	bs.Flip(1)
-	assert.Equal(t, bs.String(), "11")
+	assert.Equal(t, bs.BinaryString(), "11")
 	assert.Equal(t, bs.Bytes()[0], byte(0xc0))
 	bs.Flip(0)
-	assert.Equal(t, bs.String(), "01")
+	assert.Equal(t, bs.BinaryString(), "01")
 	assert.Equal(t, bs.Bytes()[0], byte(0x40))
 	// bitstring len=16
 	bs = NewBitstring(16)
-	assert.Equal(t, bs.String(), "0000000000000000")
+	assert.Equal(t, bs.BinaryString(), "0000000000000000")
 	bs.Set(0)
 	bs.Set(15)
-	assert.Equal(t, bs.String(), "1000000000000001")
+	assert.Equal(t, bs.BinaryString(), "1000000000000001")
 	assert.Equal(t, bs.Bytes()[0], byte(0x80))
 	assert.Equal(t, bs.Bytes()[1], byte(0x01))
 }
@@ -83,3 +84,136 @@ func TestReverseBytes(t *testing.T) {
 	assert.Equal(t, []byte{0x41, 0x82}, ReverseBytes([]byte{0x41, 0x82}))
 	assert.Equal(t, []byte{0xb7, 0xd0}, ReverseBytes([]byte{0x0b, 0xed}))
 }
+
+func TestBitstringMarshal(t *testing.T) {
+	bs := NewBitstring(10)
+	bs.Set(0)
+	bs.Set(9)
+	buf, err := bs.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0, 0, 0, 10, 0x80, 0x40}, buf)
+	var bs2 Bitstring
+	assert.Equal(t, nil, bs2.UnmarshalBinary(buf))
+	assert.Equal(t, bs.String(), bs2.String())
+	assert.NotEqual(t, nil, bs2.UnmarshalBinary(buf[:5]))
+	text, err := bs.MarshalText()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10:8040", string(text))
+	var bs3 Bitstring
+	assert.Equal(t, nil, bs3.UnmarshalText(text))
+	assert.Equal(t, bs.Bytes(), bs3.Bytes())
+	assert.NotEqual(t, nil, bs3.UnmarshalText([]byte("012")))
+}
+
+func bitstring(s string) *Bitstring {
+	var bs Bitstring
+	if err := bs.UnmarshalText([]byte(s)); err != nil {
+		panic(err)
+	}
+	return &bs
+}
+
+func TestBitstringPrefix(t *testing.T) {
+	bs := bitstring("1011001110")
+	assert.Equal(t, "1011", bs.Prefix(4).BinaryString())
+	assert.Equal(t, "", bs.Prefix(0).BinaryString())
+	assert.Equal(t, bs.BinaryString(), bs.Prefix(10).BinaryString())
+	assert.Equal(t, []byte{0xb0}, bs.Prefix(4).Bytes())
+	assert.T(t, bs.HasPrefix(bitstring("101100111")))
+	assert.T(t, bs.HasPrefix(NewBitstring(0)))
+	assert.T(t, !bs.HasPrefix(bitstring("100")))
+	assert.T(t, !bs.Prefix(3).HasPrefix(bs))
+	c := bs.Copy()
+	c.Flip(0)
+	assert.Equal(t, "0011001110", c.BinaryString())
+	assert.Equal(t, "1011001110", bs.BinaryString())
+}
+
+func TestBitstringAppend(t *testing.T) {
+	bs := bitstring("101")
+	assert.Equal(t, "1010110011", bs.Append(bitstring("0110011")).BinaryString())
+	assert.Equal(t, "101", bs.Append(NewBitstring(0)).BinaryString())
+	// Low bits first, as child keys are built
+	assert.Equal(t, "10101", bs.AppendUint(2, 2).BinaryString())
+	assert.Equal(t, "10111000", bs.AppendUint(3, 5).BinaryString())
+	ext := bs.AppendUint(13, 4).AppendUint(6, 3)
+	assert.Equal(t, uint(13), ext.Uint(3, 4))
+	assert.Equal(t, uint(6), ext.Uint(7, 3))
+	assert.Equal(t, uint(5), ext.Uint(0, 3))
+}
+
+func TestBitstringCmp(t *testing.T) {
+	assert.Equal(t, 0, bitstring("1011001110").Cmp(bitstring("1011001110")))
+	assert.Equal(t, -1, bitstring("1011001100").Cmp(bitstring("1011001110")))
+	assert.Equal(t, 1, bitstring("11").Cmp(bitstring("1011001110")))
+	assert.Equal(t, -1, bitstring("10110").Cmp(bitstring("1011001110")))
+	assert.Equal(t, 1, bitstring("101100111").Cmp(bitstring("10110011")))
+	assert.Equal(t, 0, NewBitstring(0).Cmp(NewBitstring(0)))
+	assert.Equal(t, -1, NewBitstring(0).Cmp(bitstring("0")))
+}
+
+func TestBitstringWords(t *testing.T) {
+	// Bitstrings spanning several words, split at every offset
+	var text []byte
+	for i := 0; i < 150; i++ {
+		text = append(text, "01"[(i*i/3)%2])
+	}
+	bs := bitstring(string(text))
+	assert.Equal(t, string(text), bs.BinaryString())
+	assert.Equal(t, 19, len(bs.Bytes()))
+	for n := 0; n <= bs.BitLen(); n++ {
+		prefix, suffix := bitstring(string(text[:n])), bitstring(string(text[n:]))
+		assert.Equal(t, string(text[:n]), bs.Prefix(n).BinaryString())
+		assert.T(t, bs.HasPrefix(prefix))
+		assert.Equal(t, string(text), prefix.Append(suffix).BinaryString())
+		if n < bs.BitLen() {
+			assert.Equal(t, -1, prefix.Cmp(bs))
+			assert.Equal(t, 1, bs.Cmp(prefix))
+		}
+		if n+7 <= bs.BitLen() {
+			v := bs.Uint(n, 7)
+			assert.Equal(t, string(text[n:n+7]), NewBitstring(0).AppendUint(v, 7).BinaryString())
+		}
+	}
+	var bs2 Bitstring
+	buf, err := bs.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, bs2.UnmarshalBinary(buf))
+	assert.Equal(t, 0, bs.Cmp(&bs2))
+}
+
+func BenchmarkBitstringUint(b *testing.B) {
+	bs := ZpBitstring(Zs(P_SKS, "229305846979453177871691812413112208676"))
+	for i := 0; i < b.N; i++ {
+		for depth := 0; depth < 64; depth++ {
+			bs.Uint(depth*2, 2)
+		}
+	}
+}
+
+func BenchmarkBitstringHasPrefix(b *testing.B) {
+	bs := ZpBitstring(Zs(P_SKS, "229305846979453177871691812413112208676"))
+	prefix := bs.Prefix(100)
+	for i := 0; i < b.N; i++ {
+		bs.HasPrefix(prefix)
+	}
+}
+
+func TestBitstringString(t *testing.T) {
+	bs := bitstring("1000000001")
+	assert.Equal(t, "10:8040", bs.String())
+	assert.Equal(t, "0:", NewBitstring(0).String())
+	assert.Equal(t, "3:a0", bitstring("101").String())
+	for _, s := range []string{"10:8040", "0:", "3:a0", "16:ffff", "150:" + strings.Repeat("5a", 18) + "58"} {
+		parsed, err := ParseBitstring(s)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, s, parsed.String())
+	}
+	parsed, err := ParseBitstring("10:8040")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, parsed.Cmp(bs))
+	for _, s := range []string{"", "10", "x:8040", "-1:", "10:80", "10:804", "10:80zz", "3:a0a0", "10:8041", "3:b0"} {
+		_, err = ParseBitstring(s)
+		assert.NotEqual(t, nil, err)
+	}
+}
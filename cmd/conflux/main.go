@@ -0,0 +1,596 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// conflux inspects and maintains a prefix tree snapshot,
+// and reconciles it with remote recon peers.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var settingsPath *string = flag.String("settings", "", "Recon settings file (TOML or YAML)")
+var treePath *string = flag.String("tree", "conflux.ptree", "Prefix tree snapshot file")
+var verbose *bool = flag.Bool("v", false, "Log recon protocol activity")
+var jsonReport *bool = flag.Bool("json", false, "Write diff as a JSON report")
+var dotDepth *int = flag.Int("depth", -1, "Levels of the tree to render with dot, or -1 for all")
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command = map[string]command{
+	"stats":      {"", stats},
+	"dump":       {"", dump},
+	"restore":    {"snapshot-file", restore},
+	"import-sks": {"hash-file", importSks},
+	"insert":     {"hash...", insert},
+	"remove":     {"hash...", remove},
+	"verify":     {"", verify},
+	"digest":     {"[snapshot-file]", digest},
+	"node":       {"[key]", node},
+	"dot":        {"[key]", dot},
+	"diff":       {"partner", diff},
+	"serve":      {"", serve},
+}
+
+var commandNames []string = []string{
+	"stats", "dump", "restore", "import-sks", "insert", "remove", "verify", "digest", "node", "dot", "diff", "serve"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] command [args]\n\nCommands:\n", os.Args[0])
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, has := commands[flag.Arg(0)]
+	if !has {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func loadSettings() (*recon.Settings, error) {
+	if *settingsPath == "" {
+		return recon.DefaultSettings(), nil
+	}
+	return recon.LoadSettings(*settingsPath)
+}
+
+// loadTree reads the snapshot into a new in-memory prefix tree.
+// A missing snapshot file loads as an empty tree.
+func loadTree(settings *recon.Settings) (*recon.MemPrefixTree, error) {
+	tree := recon.NewMemPrefixTree(settings)
+	f, err := os.Open(*treePath)
+	if os.IsNotExist(err) {
+		return tree, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return tree, readHashes(f, tree.Insert)
+}
+
+// saveTree writes the elements of the tree to the snapshot, replacing
+// the file only once the new snapshot is complete.
+func saveTree(tree recon.PrefixTree) error {
+	root, err := tree.Root()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(*treePath), filepath.Base(*treePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	elements, err := root.Elements()
+	if err == nil {
+		err = writeHashes(tmp, elements)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *treePath)
+}
+
+func parseHash(s string) (*Zp, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid hash %q: %v", s, err))
+	}
+	return Zb(P_SKS, buf), nil
+}
+
+// readHashes reads hex-encoded hashes, one per line,
+// skipping blank lines and # comments.
+func readHashes(r io.Reader, f func(z *Zp) error) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		z, err := parseHash(line)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: %v", n, err))
+		}
+		if err = f(z); err != nil {
+			return errors.New(fmt.Sprintf("line %d: %v", n, err))
+		}
+	}
+	return scanner.Err()
+}
+
+func writeHashes(w io.Writer, elements []*Zp) error {
+	bw := bufio.NewWriter(w)
+	for _, z := range elements {
+		if _, err := fmt.Fprintf(bw, "%x\n", z.Bytes()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// stats prints the shape of the prefix tree.
+func stats(args []string) error {
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	root, err := tree.Root()
+	if err != nil {
+		return err
+	}
+	var nodes, leaves, maxDepth, maxLeaf int
+	err = recon.WalkLevels(tree, func(depth int, level []recon.PrefixNode) error {
+		nodes += len(level)
+		maxDepth = depth
+		for _, node := range level {
+			if !node.IsLeaf() {
+				continue
+			}
+			leaves++
+			if node.Size() > maxLeaf {
+				maxLeaf = node.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("elements:       %d\n", root.Size())
+	fmt.Printf("nodes:          %d\n", nodes)
+	fmt.Printf("leaves:         %d\n", leaves)
+	fmt.Printf("max depth:      %d\n", maxDepth)
+	fmt.Printf("max leaf size:  %d\n", maxLeaf)
+	fmt.Printf("avg leaf size:  %.2f\n", float64(root.Size())/float64(leaves))
+	fmt.Printf("bit quantum:    %d\n", tree.BitQuantum())
+	fmt.Printf("split/join:     %d/%d\n", tree.SplitThreshold(), tree.JoinThreshold())
+	fmt.Printf("samples:        %d\n", tree.NumSamples())
+	return nil
+}
+
+// dump writes the snapshot elements to stdout.
+func dump(args []string) error {
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	root, err := tree.Root()
+	if err != nil {
+		return err
+	}
+	elements, err := root.Elements()
+	if err != nil {
+		return err
+	}
+	return writeHashes(os.Stdout, elements)
+}
+
+// restoreBulkSize is the number of elements restore inserts at once.
+const restoreBulkSize = 10000
+
+// restore adds the elements of a snapshot, or stdin if
+// the file is "-", to the prefix tree, in bulk.
+func restore(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Expected a snapshot file")
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n := 0
+	var bulk []*Zp
+	flush := func() error {
+		if err := recon.InsertAll(tree, bulk); err != nil {
+			return err
+		}
+		n += len(bulk)
+		bulk = bulk[:0]
+		return nil
+	}
+	err = readHashes(r, func(z *Zp) error {
+		bulk = append(bulk, z)
+		if len(bulk) < restoreBulkSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d elements\n", n)
+	return saveTree(tree)
+}
+
+// importSks adds the keys of an SKS key database to the prefix tree,
+// from a list of key hashes or a db_dump of the KDB key database, or
+// stdin if the file is "-". Keys already in the tree are skipped.
+func importSks(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Expected an SKS hash file")
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, skipped := 0, 0
+	err = recon.ReadSksHashes(r, settings.Prime(), func(z *Zp) error {
+		node, err := recon.Find(tree, z)
+		if err != nil {
+			return err
+		}
+		elements, err := node.Elements()
+		if err != nil {
+			return err
+		}
+		if NewZSet(elements...).Has(z) {
+			skipped++
+			return nil
+		}
+		if err := tree.Insert(z); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d elements, skipped %d already present\n", n, skipped)
+	return saveTree(tree)
+}
+
+func insert(args []string) error {
+	return update(args, func(tree recon.PrefixTree, z *Zp) error { return tree.Insert(z) })
+}
+
+func remove(args []string) error {
+	return update(args, func(tree recon.PrefixTree, z *Zp) error { return tree.Remove(z) })
+}
+
+func update(args []string, f func(tree recon.PrefixTree, z *Zp) error) error {
+	if len(args) == 0 {
+		return errors.New("Expected at least one hash")
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		z, err := parseHash(arg)
+		if err != nil {
+			return err
+		}
+		if err = f(tree, z); err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", arg, err))
+		}
+	}
+	return saveTree(tree)
+}
+
+// verify checks the consistency of the prefix tree.
+func verify(args []string) error {
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	if err = recon.VerifyTree(tree); err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// digest prints the multiset digest of the elements in the prefix
+// tree, or in a snapshot if one is given, so that a backup may be
+// checked against the tree it was taken from.
+func digest(args []string) error {
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := NewMultisetHash()
+		if err = readHashes(f, func(z *Zp) error {
+			h.Add(z)
+			return nil
+		}); err != nil {
+			return err
+		}
+		fmt.Println(h)
+		return nil
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	h, err := recon.TreeDigest(tree)
+	if err != nil {
+		return err
+	}
+	fmt.Println(h)
+	return nil
+}
+
+// node describes the prefix tree node with the given key,
+// in the form length:hex, or the root node if none is given.
+func node(args []string) error {
+	key := NewBitstring(0)
+	if len(args) > 0 {
+		var err error
+		if key, err = ParseBitstring(args[0]); err != nil {
+			return err
+		}
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	n, err := tree.Node(key)
+	if err != nil {
+		return err
+	}
+	nodeKey, err := n.Key()
+	if err != nil {
+		return err
+	}
+	children, err := n.Children()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("key:       %v\n", nodeKey)
+	fmt.Printf("elements:  %d\n", n.Size())
+	fmt.Printf("leaf:      %v\n", n.IsLeaf())
+	for _, child := range children {
+		childKey, err := child.Key()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("child:     %v (%d elements)\n", childKey, child.Size())
+	}
+	return nil
+}
+
+// dot renders the snapshot's prefix tree, or the subtree under a key,
+// as a Graphviz DOT digraph.
+func dot(args []string) error {
+	key := NewBitstring(0)
+	if len(args) > 0 {
+		var err error
+		if key, err = ParseBitstring(args[0]); err != nil {
+			return err
+		}
+	}
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return err
+	}
+	return recon.WriteDot(os.Stdout, tree, key, *dotDepth)
+}
+
+// startPeer starts a peer on the snapshot tree which
+// neither listens nor gossips unless asked to serve.
+func startPeer(serve bool) (*recon.Peer, *recon.MemPrefixTree, error) {
+	settings, err := loadSettings()
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := loadTree(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !serve {
+		settings.Set("conflux.recon.serveTcp", false)
+		settings.Set("conflux.recon.listen", []interface{}{})
+		settings.Set("conflux.recon.unixSocket", "")
+		settings.Set("conflux.recon.partners", []interface{}{})
+	}
+	peer := recon.NewPeer(settings, tree)
+	peer.Start()
+	return peer, tree, nil
+}
+
+// diff reconciles with a partner as a client, printing the elements
+// the partner has which the snapshot lacks without adding them, or
+// a JSON report of the differences in both directions.
+func diff(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Expected a partner address")
+	}
+	peer, _, err := startPeer(false)
+	if err != nil {
+		return err
+	}
+	defer peer.Stop()
+	go func() {
+		for _ = range peer.RecoverChan {
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", peer.PartnerAddr(args[0]), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	st, err := peer.ReconcileWith(conn, recon.RoleClient)
+	if err != nil {
+		return err
+	}
+	if *jsonReport {
+		return peer.DiffReport(&st).WriteJSON(os.Stdout)
+	}
+	return writeHashes(os.Stdout, st.Elements)
+}
+
+// serve runs a recon peer on the snapshot, adding recovered elements
+// and removing those caught up peers removed, and saving the snapshot
+// when interrupted.
+func serve(args []string) error {
+	peer, tree, err := startPeer(true)
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	recovered := peer.RecoverChan
+	for {
+		select {
+		case r, ok := <-recovered:
+			if !ok {
+				recovered = nil
+				continue
+			}
+			for _, z := range r.RemoteElements {
+				if err := peer.Insert(z); err != nil {
+					fmt.Fprintf(os.Stderr, "insert %x: %v\n", z.Bytes(), err)
+				}
+			}
+			for _, z := range r.RemoteRemoved {
+				if err := peer.Remove(z); err != nil {
+					fmt.Fprintf(os.Stderr, "remove %x: %v\n", z.Bytes(), err)
+				}
+			}
+			fmt.Printf("recovered %d elements from %v\n", len(r.RemoteElements), r.RemoteAddr)
+		case <-sigs:
+			peer.Stop()
+			return saveTree(tree)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// recon-replay decodes session captures recorded by a peer
+// with conflux.recon.captureDir set.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cmars/conflux/recon"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s capture-file...\n", os.Args[0])
+		os.Exit(1)
+	}
+	for _, path := range os.Args[1:] {
+		if err := replay(path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	received, sent, err := recon.ReadCapture(f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s:\n", path)
+	printTranscript("sent", sent)
+	printTranscript("received", received)
+	return nil
+}
+
+func printTranscript(label string, data []byte) {
+	t, err := recon.DecodeTranscript(bytes.NewBuffer(data))
+	fmt.Printf("  %s (%d bytes):\n", label, len(data))
+	if t.Config != nil {
+		fmt.Printf("    config: %v\n", t.Config)
+	}
+	if t.Status != "" {
+		fmt.Printf("    status: %s %s\n", t.Status, t.Reason)
+	}
+	for _, msg := range t.Msgs {
+		fmt.Printf("    %v\n", msg)
+	}
+	if err != nil {
+		fmt.Printf("    decode error: %v\n", err)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// recond runs a standalone recon peer, reconciling its prefix tree
+// with partners in place of the SKS recon server process.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/leveldb"
+	"github.com/cmars/conflux/recon/pqptree"
+	_ "github.com/lib/pq"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const RECOND = "recond:"
+
+var configPath *string = flag.String("config", "", "Recon settings file (TOML or YAML)")
+var sksDir *string = flag.String("sks", "", "SKS configuration directory containing sksconf and membership")
+var gc *bool = flag.Bool("gc", false, "Delete prefix tree nodes unreachable from the root, then exit")
+
+// daemonSettings adds the recond backend and hashquery
+// settings to the recon settings.
+type daemonSettings struct {
+	*recon.Settings
+}
+
+// Backend is the prefix tree storage: leveldb, postgres or memory.
+func (s *daemonSettings) Backend() string {
+	return s.GetString("conflux.recond.backend", "leveldb")
+}
+
+// HashqueryUrl is where recovered hashes are posted,
+// if set, in the SKS hashquery request format.
+func (s *daemonSettings) HashqueryUrl() string {
+	return s.GetString("conflux.recond.hashqueryUrl", "")
+}
+
+func loadSettings() (*recon.Settings, error) {
+	switch {
+	case *configPath != "" && *sksDir != "":
+		return nil, errors.New("Only one of -config and -sks may be given")
+	case *configPath != "":
+		return recon.LoadSettings(*configPath)
+	case *sksDir != "":
+		return recon.LoadSksSettings(*sksDir)
+	}
+	settings := recon.DefaultSettings()
+	settings.ApplyProcessEnv()
+	return settings, nil
+}
+
+func openPeer(settings *daemonSettings) (*recon.Peer, error) {
+	switch settings.Backend() {
+	case "leveldb":
+		return leveldb.NewPeer(&leveldb.DbSettings{Settings: settings.Settings})
+	case "postgres":
+		pqSettings := pqptree.NewSettings(settings.Settings)
+		db, err := pqptree.Connect(pqSettings)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := pqptree.New(pqSettings.Namespace(), db, pqSettings)
+		if err != nil {
+			return nil, err
+		}
+		peer := recon.NewPeer(settings.Settings, tree)
+		if pqSettings.SessionLog() {
+			peer.Journal, err = pqptree.NewSessionLog(pqSettings.Namespace(), db, pqSettings.SessionLogMax())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return peer, nil
+	case "memory":
+		return recon.NewPeer(settings.Settings, recon.NewMemPrefixTree(settings.Settings)), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown backend: %s", settings.Backend()))
+}
+
+func main() {
+	flag.Parse()
+	reconSettings, err := loadSettings()
+	if err != nil {
+		die(err)
+	}
+	if err = reconSettings.Validate(); err != nil {
+		die(err)
+	}
+	settings := &daemonSettings{reconSettings}
+	peer, err := openPeer(settings)
+	if err != nil {
+		die(err)
+	}
+	if *gc {
+		n, err := recon.CollectOrphans(peer.PrefixTree)
+		if err != nil {
+			die(err)
+		}
+		fmt.Printf("Collected %d orphaned nodes\n", n)
+		return
+	}
+	peer.SessionHooks = append(peer.SessionHooks, logSession)
+	stopReload := peer.ReloadOnSignal(syscall.SIGHUP)
+	peer.Start()
+	log.Println(RECOND, "Started with", settings.Backend(), "backend")
+	go serveHttp(peer)
+	if addr := peer.AdminAddr(); addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, peer.AdminHandler()); err != nil {
+				log.Println(RECOND, "admin:", err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case r := <-peer.RecoverChan:
+			handleRecover(peer, settings, r)
+		case sig := <-sigs:
+			log.Println(RECOND, "Received", sig)
+			stopReload()
+			peer.Stop()
+			return
+		}
+	}
+}
+
+func logSession(stats *recon.SessionStats, err error) {
+	log.Printf("%s %s session with %s: %v, %d msgs, %d bytes, %d subtrees, recovered %d, sent %d, err=%v",
+		RECOND, stats.Role.Name(), stats.Partner, stats.Duration,
+		stats.MsgsSent+stats.MsgsReceived, stats.BytesSent+stats.BytesReceived,
+		stats.Subtrees, stats.Recovered, stats.ElementsSent, err)
+}
+
+// serveHttp serves the stats page and recon over HTTP on the http port.
+func serveHttp(peer *recon.Peer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pks/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("op") != "stats" {
+			http.Error(w, "Only op=stats is supported", http.StatusNotImplemented)
+			return
+		}
+		peer.StatsHandler().ServeHTTP(w, r)
+	})
+	mux.Handle("/recon", peer.ReconHandler())
+	addr := net.JoinHostPort("", strconv.Itoa(peer.HttpPort()))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println(RECOND, "http:", err)
+	}
+}
+
+func die(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(1)
+}
+
+// handleRecover forwards recovered elements to the hashquery endpoint
+// if one is configured, and adds them to the prefix tree once it has
+// fetched them. Elements it failed to fetch are left out of the tree,
+// so that they are recovered again in a later session, reconciled in
+// full if they were caught up from the remote peer. Elements a
+// remote peer removed when caught up from its change log are removed
+// from the tree.
+func handleRecover(peer *recon.Peer, settings *daemonSettings, r *recon.Recover) {
+	log.Println(RECOND, "Recovered", len(r.RemoteElements), "elements from", r.RemoteAddr)
+	for _, z := range r.RemoteRemoved {
+		if err := peer.Remove(z); err != nil {
+			log.Println(RECOND, "remove:", err)
+		}
+	}
+	if len(r.RemoteElements) == 0 {
+		return
+	}
+	if url := settings.HashqueryUrl(); url != "" {
+		if err := postHashquery(url, r); err != nil {
+			log.Println(RECOND, "hashquery:", err)
+			peer.RecoverFailed(r)
+			return
+		}
+	}
+	for _, z := range r.RemoteElements {
+		if err := peer.Insert(z); err != nil {
+			log.Println(RECOND, "insert:", err)
+		}
+	}
+}
+
+var hashqueryClient *http.Client = &http.Client{Timeout: 30 * time.Second}
+
+// postHashquery sends the recovered hashes as an SKS hashquery
+// request: a count followed by each length-prefixed hash, in the
+// little-endian digest form which SKS reads.
+func postHashquery(url string, r *recon.Recover) error {
+	body := bytes.NewBuffer(nil)
+	if err := recon.WriteInt(body, len(r.RemoteElements)); err != nil {
+		return err
+	}
+	for _, z := range r.RemoteElements {
+		if err := recon.WriteString(body, string(ZpDigest(z, recon.SksHashSize))); err != nil {
+			return err
+		}
+	}
+	resp, err := hashqueryClient.Post(url, "application/octet-stream", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%s: %s", url, resp.Status))
+	}
+	return nil
+}
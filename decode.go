@@ -23,8 +23,10 @@
 package conflux
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 )
 
@@ -154,12 +156,35 @@ func PolyRand(p *big.Int, degree int) *Poly {
 	return NewPoly(terms...)
 }
 
+// polyRandFrom generates a random monic polynomial of degree n,
+// reading random bytes from r.
+func polyRandFrom(r io.Reader, p *big.Int, degree int) (*Poly, error) {
+	terms := make([]*Zp, degree+1)
+	for i := 0; i < degree; i++ {
+		z, err := randZp(r, p)
+		if err != nil {
+			return nil, err
+		}
+		terms[i] = z
+	}
+	terms[degree] = Zi(p, 1)
+	return NewPoly(terms...), nil
+}
+
 // Factor reduces a polynomial to irreducible linear components.
 // If the polynomial is not reducible to a product of linears,
 // the polynomial is useless for reconciliation, resulting in an error.
 // Returns a ZSet of all the constants in each linear factor.
 func (p *Poly) Factor() (roots *ZSet, err error) {
-	factors, err := p.factor()
+	return p.FactorRand(rand.Reader)
+}
+
+// FactorRand finds the roots of a square-free polynomial as Factor
+// does, reading the random bytes the factoring needs from r. Reading
+// from a seeded source, such as math/rand with a fixed seed, makes
+// the factoring deterministic, which is useful for tests.
+func (p *Poly) FactorRand(r io.Reader) (roots *ZSet, err error) {
+	factors, err := p.factor(r)
 	if err != nil {
 		return
 	}
@@ -181,7 +206,7 @@ func (p *Poly) Factor() (roots *ZSet, err error) {
 // on a complex polynomial into linear factors.
 // Adapted from sympy.polys.galoistools.gf_edf_zassenhaus, specialized for
 // the reconciliation cases of GF(p) and factor degree.
-func (p *Poly) factor() (factors []*Poly, err error) {
+func (p *Poly) factor(rnd io.Reader) (factors []*Poly, err error) {
 	factors = append(factors, p)
 	q := big.NewInt(int64(0)).Set(p.p)
 	if p.degree <= 1 {
@@ -189,13 +214,13 @@ func (p *Poly) factor() (factors []*Poly, err error) {
 	}
 	for len(factors) < p.degree {
 		//r := Zrand(p.p).Mod(Zi(p.p, (2*p.degree) - 1))
-		r := PolyRand(p.p, 2*p.degree-1)
-		qh := big.NewInt(int64(0))
-		qh.Sub(q, qh)
-		qh.Div(qh, big.NewInt(int64(2)))
+		r, err := polyRandFrom(rnd, p.p, 2*p.degree-1)
 		if err != nil {
 			return nil, err
 		}
+		qh := big.NewInt(int64(0))
+		qh.Sub(q, qh)
+		qh.Div(qh, big.NewInt(int64(2)))
 		h, err := polyPowMod(r, qh, p)
 		if err != nil {
 			return nil, err
@@ -209,11 +234,11 @@ func (p *Poly) factor() (factors []*Poly, err error) {
 			if err != nil {
 				return nil, err
 			}
-			factors, err = g.factor()
+			factors, err = g.factor(rnd)
 			if err != nil {
 				return nil, err
 			}
-			qfgFactors, err := qfg.factor()
+			qfgFactors, err := qfg.factor(rnd)
 			if err != nil {
 				return nil, err
 			}
@@ -223,12 +248,15 @@ func (p *Poly) factor() (factors []*Poly, err error) {
 	return
 }
 
+// factorCheck tests that a polynomial is a product of distinct linear
+// factors, and so can be factored into the elements of a set, by
+// checking that it divides z^p - z, the product of all such factors.
 func factorCheck(p *Poly) bool {
 	if p.degree <= 1 {
 		return true
 	}
 	z := NewPoly(Zi(p.p, 0), Zi(p.p, 1))
-	zq, err := polyPowMod(z, P_SKS, p)
+	zq, err := polyPowMod(z, p.p, p)
 	if err != nil {
 		return false
 	}
@@ -239,10 +267,13 @@ func factorCheck(p *Poly) bool {
 	if err != nil {
 		return false
 	}
-	return zqmz.degree == 0 || (zqmz.degree == 1 && zqmz.coeff[0].IsZero())
+	return zqmz.isZero()
 }
 
-// Generate points for rational function interpolation.
+// Zpoints generates n points for rational function interpolation:
+// 0, -1, 1, -2, 2, ... in the finite field p. These are the points
+// at which SKS samples its prefix tree, as ZZp.points does, so they
+// must not change for conflux to reconcile with SKS.
 func Zpoints(p *big.Int, n int) []*Zp {
 	points := make([]*Zp, n)
 	for i := 0; i < n; i++ {
@@ -257,6 +288,10 @@ func Zpoints(p *big.Int, n int) []*Zp {
 	return points
 }
 
+// Reconcile interpolates the rational function of the sample ratios
+// values at points, using all but the last to interpolate and the last
+// to check the result, and factors it into the elements of each set
+// missing from the other. LowMBar is returned if the check fails.
 func Reconcile(values []*Zp, points []*Zp, degDiff int) (*ZSet, *ZSet, error) {
 	rfn, err := Interpolate(
 		values[:len(values)-1], points[:len(points)-1], degDiff)
@@ -281,3 +316,80 @@ func Reconcile(values []*Zp, points []*Zp, degDiff int) (*ZSet, *ZSet, error) {
 	}
 	return numF, denomF, nil
 }
+
+// ErrInterpolationFailed reports that the difference between two sets
+// could not be recovered from their sample ratios, most likely because
+// it has more elements than the MBar samples available to interpolate.
+// Reconciliation should then continue with smaller subsets.
+type ErrInterpolationFailed struct {
+	// Number of samples used to interpolate
+	MBar int
+	// Difference in the sizes of the sets
+	DegDiff int
+	// Cause of the failure
+	Err error
+}
+
+func (e *ErrInterpolationFailed) Error() string {
+	return fmt.Sprintf("Interpolation failed with mbar=%d, degDiff=%d: %v",
+		e.MBar, e.DegDiff, e.Err)
+}
+
+// SampleRatios divides the samples of a remote set by the samples of
+// a local set, taken at the same points, giving the values of the
+// rational function which ReconcileRatios interpolates.
+func SampleRatios(remote, local []*Zp) ([]*Zp, error) {
+	if len(remote) != len(local) {
+		return nil, errors.New(fmt.Sprintf(
+			"Mismatched sample count: remote %d, local %d", len(remote), len(local)))
+	}
+	if len(local) == 0 {
+		return nil, nil
+	}
+	if err := local[0].CheckP(local...); err != nil {
+		return nil, err
+	}
+	if err := local[0].CheckP(remote...); err != nil {
+		return nil, err
+	}
+	ratios := make([]*Zp, len(local))
+	for i := range local {
+		if local[i].IsZero() {
+			return nil, errors.New(fmt.Sprintf("Local sample %d is zero", i))
+		}
+		ratios[i] = Z(local[i].P).Div(remote[i], local[i])
+	}
+	return ratios, nil
+}
+
+// ReconcileRatios recovers the difference between a remote and a local
+// set from the ratios of their samples at points, as given by
+// SampleRatios, and degDiff, the remote set size less the local one.
+// It returns the elements only in the remote set and the elements only
+// in the local set. If there are too few samples to recover the
+// difference, the error is an *ErrInterpolationFailed.
+func ReconcileRatios(ratios []*Zp, points []*Zp, degDiff int) (remoteOnly *ZSet, localOnly *ZSet, err error) {
+	if len(ratios) != len(points) {
+		return nil, nil, errors.New(fmt.Sprintf(
+			"Mismatched sample count: %d ratios, %d points", len(ratios), len(points)))
+	}
+	if len(points) < 2 {
+		return nil, nil, errors.New(fmt.Sprintf(
+			"At least 2 samples are required, got %d", len(points)))
+	}
+	if err = points[0].CheckP(points...); err != nil {
+		return nil, nil, err
+	}
+	if err = points[0].CheckP(ratios...); err != nil {
+		return nil, nil, err
+	}
+	mbar := len(points) - 1
+	if abs(degDiff) > mbar {
+		return nil, nil, &ErrInterpolationFailed{MBar: mbar, DegDiff: degDiff, Err: LowMBar}
+	}
+	remoteOnly, localOnly, err = Reconcile(ratios, points, degDiff)
+	if err != nil {
+		return nil, nil, &ErrInterpolationFailed{MBar: mbar, DegDiff: degDiff, Err: err}
+	}
+	return remoteOnly, localOnly, nil
+}
@@ -26,6 +26,7 @@ import (
 	"crypto/rand"
 	"github.com/bmizerany/assert"
 	"math/big"
+	mrand "math/rand"
 	"testing"
 )
 
@@ -69,6 +70,35 @@ func TestFactorization(t *testing.T) {
 	}
 }
 
+func TestFactorRand(t *testing.T) {
+	p := P_SKS
+	poly := NewPoly(Zi(p, 1))
+	roots := NewZSet()
+	for i := 1; i <= 8; i++ {
+		root := Zi(p, 65537*i)
+		roots.Add(root)
+		poly = NewPoly().Mul(poly, NewPoly(root.Copy().Neg(), Zi(p, 1)))
+	}
+	factored1, err := poly.FactorRand(mrand.New(mrand.NewSource(1)))
+	assert.Equal(t, nil, err)
+	assert.T(t, roots.Equal(factored1))
+	factored2, err := poly.FactorRand(mrand.New(mrand.NewSource(1)))
+	assert.Equal(t, nil, err)
+	assert.T(t, factored1.Equal(factored2))
+}
+
+func TestFactorCheckField(t *testing.T) {
+	// Roots larger than P_SKS
+	p := P_256
+	poly, roots := randLinearProd(p, 5)
+	assert.T(t, factorCheck(poly))
+	factored, err := poly.Factor()
+	assert.Equal(t, nil, err)
+	assert.T(t, roots.Equal(factored))
+	// Irreducible quadratic: -1 is not a square mod 3 (mod 4) primes
+	assert.T(t, !factorCheck(NewPoly(Zi(P_SKS, 1), Z(P_SKS), Zi(P_SKS, 1))))
+}
+
 func TestCannedInterpolation(t *testing.T) {
 	/*
 		interpolate
@@ -274,3 +304,105 @@ func TestPolyNomNomNom(t *testing.T) {
 	rational := Z(p).Div(numAt, denomAt)
 	assert.Equal(t, rational.String(), "372597725470208235965358485960825765733")
 }
+
+func TestReconcileRatios(t *testing.T) {
+	p := P_SKS
+	points := Zpoints(p, 6)
+	remote := NewZSet(Zi(p, 65537), Zi(p, 65539), Zi(p, 65541))
+	local := NewZSet(Zi(p, 65537), Zi(p, 65543))
+	remoteSamples := Zarray(p, len(points), Zi(p, 1))
+	localSamples := Zarray(p, len(points), Zi(p, 1))
+	for i, point := range points {
+		for _, z := range remote.Items() {
+			remoteSamples[i].Mul(remoteSamples[i], Z(p).Sub(point, z))
+		}
+		for _, z := range local.Items() {
+			localSamples[i].Mul(localSamples[i], Z(p).Sub(point, z))
+		}
+	}
+	ratios, err := SampleRatios(remoteSamples, localSamples)
+	assert.Equal(t, nil, err)
+	remoteOnly, localOnly, err := ReconcileRatios(ratios, points, 1)
+	assert.Equal(t, nil, err)
+	assert.T(t, remoteOnly.Equal(NewZSet(Zi(p, 65539), Zi(p, 65541))))
+	assert.T(t, localOnly.Equal(NewZSet(Zi(p, 65543))))
+	// Difference in set size exceeds mbar
+	_, _, err = ReconcileRatios(ratios, points, 6)
+	ierr, is := err.(*ErrInterpolationFailed)
+	assert.T(t, is)
+	assert.Equal(t, 5, ierr.MBar)
+	assert.Equal(t, LowMBar, ierr.Err)
+	// Mismatched inputs
+	_, _, err = ReconcileRatios(ratios[:3], points, 1)
+	assert.NotEqual(t, nil, err)
+	_, err = SampleRatios(remoteSamples, localSamples[:3])
+	assert.NotEqual(t, nil, err)
+	_, err = SampleRatios(remoteSamples, Zarray(P_128, len(points), Zi(P_128, 1)))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestReconcileRatiosLowMBar(t *testing.T) {
+	p := P_SKS
+	values := []*Zp{Zs(p, "260405721246918987273155339614020972656"), Zs(p, "243393001638573476362665007855413044937"), Zs(p, "505905314437392989818278468923779137359"), Zs(p, "105358332430258313066486664282953088018"), Zs(p, "2560440886574256298562818527295701964"), Zs(p, "118746265689993312951910051444187575775"), Zs(p, "529698088600031242289045200206930982765"), Zs(p, "441488592726201746187835041000728091281")}
+	points := Zpoints(p, len(values))
+	_, _, err := ReconcileRatios(values, points, 3)
+	ierr, is := err.(*ErrInterpolationFailed)
+	assert.T(t, is)
+	assert.Equal(t, LowMBar, ierr.Err)
+	assert.Equal(t, 3, ierr.DegDiff)
+}
+
+// sampleRatios computes the ratios at points of the characteristic
+// polynomials of two sets which differ by the elements of d.
+func (d quickDiff) sampleRatios(points []*Zp) []*Zp {
+	values := make([]*Zp, len(points))
+	for i, point := range points {
+		num, denom := Zi(point.P, 1), Zi(point.P, 1)
+		for _, a := range d.A.Items() {
+			num.Mul(num, Z(point.P).Sub(point, a))
+		}
+		for _, b := range d.B.Items() {
+			denom.Mul(denom, Z(point.P).Sub(point, b))
+		}
+		values[i] = Z(point.P).Div(num, denom)
+	}
+	return values
+}
+
+func TestReconcileProperties(t *testing.T) {
+	points := Zpoints(P_SKS, 2*quickMaxDiff+2)
+	checkQuick(t, func(d quickDiff) bool {
+		a, b, err := Reconcile(d.sampleRatios(points), points, d.A.Len()-d.B.Len())
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return a.Equal(d.A) && b.Equal(d.B)
+	})
+}
+
+// BenchmarkReconcile measures interpolating and factoring the
+// difference between sets which differ by 10 elements, as a recon
+// client does for each differing subtree.
+func BenchmarkReconcile(b *testing.B) {
+	p := P_SKS
+	const m1, m2 = 6, 4
+	points := Zpoints(p, m1+m2+1)
+	values := Zarray(p, len(points), Zi(p, 1))
+	for i := 0; i < m1+m2; i++ {
+		z := Zrand(p)
+		for j, point := range points {
+			if i < m1 {
+				values[j].Mul(values[j].Copy(), Z(p).Sub(point, z))
+			} else {
+				values[j].Div(values[j].Copy(), Z(p).Sub(point, z))
+			}
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := Reconcile(values, points, m1-m2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
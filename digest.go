@@ -0,0 +1,85 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"math/big"
+)
+
+// ZpFromBytes creates an integer in the finite field p from a digest.
+// As in SKS, the digest is read as a little-endian integer.
+func ZpFromBytes(p *big.Int, digest []byte) *Zp {
+	buf := make([]byte, len(digest))
+	for i, b := range digest {
+		buf[len(buf)-1-i] = b
+	}
+	return Zb(p, buf)
+}
+
+// ZpDigest returns the digest which ZpFromBytes reads as z: its bytes,
+// least significant first, padded with zeros to size bytes. This is
+// the form in which SKS exchanges key hashes.
+func ZpDigest(z *Zp, size int) []byte {
+	b := z.Int.Bytes()
+	if len(b) > size {
+		size = len(b)
+	}
+	digest := make([]byte, size)
+	for i, x := range b {
+		digest[len(b)-1-i] = x
+	}
+	return digest
+}
+
+// ZpFromMd5 creates an integer in the finite field p from the MD5
+// digest of data. SKS identifies keys by the MD5 digest of their
+// content in Z(P_SKS).
+func ZpFromMd5(p *big.Int, data []byte) *Zp {
+	digest := md5.Sum(data)
+	return ZpFromBytes(p, digest[:])
+}
+
+// ZpFromSha1 creates an integer in the finite field p
+// from the SHA-1 digest of data.
+func ZpFromSha1(p *big.Int, data []byte) *Zp {
+	digest := sha1.Sum(data)
+	return ZpFromBytes(p, digest[:])
+}
+
+// ZpFromSha256 creates an integer in the finite field p
+// from the SHA-256 digest of data.
+func ZpFromSha256(p *big.Int, data []byte) *Zp {
+	digest := sha256.Sum256(data)
+	return ZpFromBytes(p, digest[:])
+}
+
+// ZpBitstring returns the key locating an integer in a prefix tree,
+// the bits of the integer from least to most significant.
+func ZpBitstring(z *Zp) *Bitstring {
+	bs := NewBitstring(z.P.BitLen())
+	bs.SetBytes(ReverseBytes(z.Bytes()))
+	return bs
+}
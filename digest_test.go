@@ -0,0 +1,65 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/bmizerany/assert"
+	"math/big"
+	"testing"
+)
+
+func TestZpFromBytes(t *testing.T) {
+	z := ZpFromBytes(P_SKS, []byte{0x01, 0x02})
+	assert.Equal(t, int64(0x0201), z.Int64())
+	digest, _ := hex.DecodeString("d41d8cd98f00b204e9800998ecf8427e")
+	z = ZpFromMd5(P_SKS, nil)
+	assert.Equal(t, 0, z.Cmp(ZpFromBytes(P_SKS, digest)))
+	sum := md5.Sum(nil)
+	assert.Equal(t, digest, sum[:])
+	// 128-bit digests are within Z(P_SKS)
+	expect, _ := big.NewInt(0).SetString("7e42f8ec980980e904b2008fd98c1dd4", 16)
+	assert.Equal(t, 0, expect.Cmp(z.Int))
+	// larger digests are reduced
+	z = ZpFromSha256(P_SKS, []byte("conflux"))
+	assert.T(t, z.Int.Cmp(P_SKS) < 0)
+	z = ZpFromSha1(P_160, []byte("conflux"))
+	assert.T(t, z.Int.Cmp(P_160) < 0)
+}
+
+func TestZpDigest(t *testing.T) {
+	digest, _ := hex.DecodeString("d41d8cd98f00b204e9800998ecf8427e")
+	assert.Equal(t, digest, ZpDigest(ZpFromBytes(P_SKS, digest), 16))
+	// Digests with high zero bytes are padded
+	assert.Equal(t, []byte{0x01, 0x02, 0, 0}, ZpDigest(Zi(P_SKS, 0x0201), 4))
+}
+
+func TestZpBitstring(t *testing.T) {
+	bs := ZpBitstring(Zi(P_SKS, 6))
+	assert.Equal(t, P_SKS.BitLen(), bs.BitLen())
+	assert.Equal(t, 0, bs.Get(0))
+	assert.Equal(t, 1, bs.Get(1))
+	assert.Equal(t, 1, bs.Get(2))
+	assert.Equal(t, 0, bs.Get(3))
+}
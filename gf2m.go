@@ -0,0 +1,324 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// gf2m is the binary field GF(2^m), for m a multiple of 64, with
+// elements held as little-endian words of polynomial coefficients.
+type gf2m struct {
+	m int
+	n int
+	// Exponents of the terms of the field polynomial below x^m
+	poly []int
+}
+
+// gf2Fields are binary fields by degree, with irreducible field
+// polynomials of low weight.
+var gf2Fields []*gf2m = []*gf2m{
+	{m: 64, n: 1, poly: []int{4, 3, 1, 0}},
+	{m: 128, n: 2, poly: []int{7, 2, 1, 0}},
+	{m: 192, n: 3, poly: []int{7, 2, 1, 0}},
+	{m: 256, n: 4, poly: []int{10, 5, 2, 0}},
+	{m: 320, n: 5, poly: []int{4, 3, 1, 0}},
+	{m: 384, n: 6, poly: []int{12, 3, 2, 0}},
+	{m: 448, n: 7, poly: []int{11, 6, 4, 0}},
+	{m: 512, n: 8, poly: []int{8, 5, 2, 0}},
+}
+
+// gf2FieldBits returns the smallest binary field with
+// at least the given number of bits, or nil if none.
+func gf2FieldBits(nbits int) *gf2m {
+	for _, f := range gf2Fields {
+		if f.m >= nbits {
+			return f
+		}
+	}
+	return nil
+}
+
+func (f *gf2m) zero() []uint64 {
+	return make([]uint64, f.n)
+}
+
+func (f *gf2m) one() []uint64 {
+	a := f.zero()
+	a[0] = 1
+	return a
+}
+
+func (f *gf2m) isZero(a []uint64) bool {
+	for _, w := range a {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *gf2m) equal(a, b []uint64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *gf2m) add(a, b []uint64) []uint64 {
+	r := f.zero()
+	for i := range r {
+		r[i] = a[i] ^ b[i]
+	}
+	return r
+}
+
+// clmul returns the carry-less product of two words.
+func clmul(a, b uint64) (lo, hi uint64) {
+	for b != 0 {
+		i := uint(bits.TrailingZeros64(b))
+		lo ^= a << i
+		if i > 0 {
+			hi ^= a >> (64 - i)
+		}
+		b &= b - 1
+	}
+	return
+}
+
+func (f *gf2m) mul(a, b []uint64) []uint64 {
+	prod := make([]uint64, 2*f.n)
+	for i, ai := range a {
+		if ai == 0 {
+			continue
+		}
+		for j, bj := range b {
+			lo, hi := clmul(ai, bj)
+			prod[i+j] ^= lo
+			prod[i+j+1] ^= hi
+		}
+	}
+	// Reduce the words above x^m by the field polynomial
+	for w := 2*f.n - 1; w >= f.n; {
+		t := prod[w]
+		if t == 0 {
+			w--
+			continue
+		}
+		prod[w] = 0
+		for _, e := range f.poly {
+			prod[w-f.n] ^= t << uint(e)
+			if e > 0 {
+				prod[w-f.n+1] ^= t >> uint(64-e)
+			}
+		}
+	}
+	return prod[:f.n]
+}
+
+func (f *gf2m) sqr(a []uint64) []uint64 {
+	return f.mul(a, a)
+}
+
+// inv returns the multiplicative inverse of a nonzero
+// element, a^(2^m-2).
+func (f *gf2m) inv(a []uint64) []uint64 {
+	r, s := f.one(), a
+	for i := 1; i < f.m; i++ {
+		s = f.sqr(s)
+		r = f.mul(r, s)
+	}
+	return r
+}
+
+func (f *gf2m) fromInt(v *big.Int) []uint64 {
+	buf := make([]byte, f.n*8)
+	v.FillBytes(buf)
+	a := f.zero()
+	for i := range a {
+		for j := 0; j < 8; j++ {
+			a[i] |= uint64(buf[len(buf)-1-i*8-j]) << uint(8*j)
+		}
+	}
+	return a
+}
+
+func (f *gf2m) toInt(a []uint64) *big.Int {
+	buf := make([]byte, f.n*8)
+	for i, w := range a {
+		for j := 0; j < 8; j++ {
+			buf[len(buf)-1-i*8-j] = byte(w >> uint(8*j))
+		}
+	}
+	return big.NewInt(0).SetBytes(buf)
+}
+
+// Polynomials over the field hold coefficients from
+// the constant term up, with no leading zeros.
+
+func (f *gf2m) polyTrim(a [][]uint64) [][]uint64 {
+	for len(a) > 0 && f.isZero(a[len(a)-1]) {
+		a = a[:len(a)-1]
+	}
+	return a
+}
+
+// polyMod returns the remainder of a divided by the monic polynomial d.
+func (f *gf2m) polyMod(a, d [][]uint64) [][]uint64 {
+	r := make([][]uint64, len(a))
+	copy(r, a)
+	for len(r) >= len(d) {
+		lead := r[len(r)-1]
+		shift := len(r) - len(d)
+		for i := 0; i < len(d)-1; i++ {
+			if !f.isZero(d[i]) {
+				r[shift+i] = f.add(r[shift+i], f.mul(lead, d[i]))
+			}
+		}
+		r = f.polyTrim(r[:len(r)-1])
+	}
+	return r
+}
+
+// polyDivMonic returns the quotient of a divided by the monic polynomial d.
+func (f *gf2m) polyDivMonic(a, d [][]uint64) [][]uint64 {
+	r := make([][]uint64, len(a))
+	copy(r, a)
+	q := make([][]uint64, len(a)-len(d)+1)
+	for i := range q {
+		q[i] = f.zero()
+	}
+	for len(r) >= len(d) {
+		lead := r[len(r)-1]
+		shift := len(r) - len(d)
+		q[shift] = lead
+		for i := 0; i < len(d)-1; i++ {
+			if !f.isZero(d[i]) {
+				r[shift+i] = f.add(r[shift+i], f.mul(lead, d[i]))
+			}
+		}
+		r = f.polyTrim(r[:len(r)-1])
+	}
+	return q
+}
+
+func (f *gf2m) polyMonic(a [][]uint64) [][]uint64 {
+	lead := a[len(a)-1]
+	if f.equal(lead, f.one()) {
+		return a
+	}
+	inv := f.inv(lead)
+	r := make([][]uint64, len(a))
+	for i := range a {
+		r[i] = f.mul(a[i], inv)
+	}
+	return r
+}
+
+func (f *gf2m) polyGcd(a, b [][]uint64) [][]uint64 {
+	for len(b) > 0 {
+		b = f.polyMonic(b)
+		a, b = b, f.polyMod(a, b)
+	}
+	return a
+}
+
+// polySqrMod returns a^2 modulo d. Squaring is linear in
+// characteristic 2, so only the coefficients are squared.
+func (f *gf2m) polySqrMod(a, d [][]uint64) [][]uint64 {
+	if len(a) == 0 {
+		return a
+	}
+	r := make([][]uint64, 2*len(a)-1)
+	for i := range r {
+		if i%2 == 0 {
+			r[i] = f.sqr(a[i/2])
+		} else {
+			r[i] = f.zero()
+		}
+	}
+	return f.polyMod(r, d)
+}
+
+// polyRoots returns the roots of the monic polynomial d, which must
+// have as many distinct roots in the field as its degree, by the
+// Berlekamp trace algorithm. The trace of beta*x separates roots
+// for some beta among the basis elements of the field.
+func (f *gf2m) polyRoots(d [][]uint64, basis int) ([][]uint64, bool) {
+	switch {
+	case len(d) == 2:
+		return [][]uint64{d[0]}, true
+	case len(d) < 2:
+		return nil, true
+	}
+	for ; basis < f.m; basis++ {
+		beta := f.zero()
+		beta[basis/64] = 1 << uint(basis%64)
+		t := f.polyMod([][]uint64{f.zero(), beta}, d)
+		tr := t
+		for i := 1; i < f.m; i++ {
+			t = f.polySqrMod(t, d)
+			tr = f.polyAdd(tr, t)
+		}
+		g := f.polyGcd(d, tr)
+		if len(g) > 1 && len(g) < len(d) {
+			left, ok := f.polyRoots(g, basis+1)
+			if !ok {
+				return nil, false
+			}
+			right, ok := f.polyRoots(f.polyDivMonic(d, g), basis+1)
+			if !ok {
+				return nil, false
+			}
+			return append(left, right...), true
+		}
+	}
+	return nil, false
+}
+
+func (f *gf2m) polyAdd(a, b [][]uint64) [][]uint64 {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	r := make([][]uint64, len(a))
+	copy(r, a)
+	for i := range b {
+		r[i] = f.add(a[i], b[i])
+	}
+	return f.polyTrim(r)
+}
+
+// polySplits returns whether the monic polynomial d is a product of
+// distinct linear factors over the field, that is, whether it
+// divides x^(2^m) - x.
+func (f *gf2m) polySplits(d [][]uint64) bool {
+	x := f.polyMod([][]uint64{f.zero(), f.one()}, d)
+	t := x
+	for i := 0; i < f.m; i++ {
+		t = f.polySqrMod(t, d)
+	}
+	return len(f.polyAdd(t, x)) == 0
+}
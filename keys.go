@@ -0,0 +1,89 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+)
+
+// KeyStrategy derives the key locating an element in a prefix tree.
+// Keys should be uniformly distributed for the tree to be balanced,
+// and peers must derive keys the same way to reconcile.
+type KeyStrategy interface {
+	// Key returns the key of an element.
+	Key(z *Zp) *Bitstring
+	// Name identifies the strategy to remote peers.
+	Name() string
+}
+
+type keyStrategyFunc struct {
+	name string
+	key  func(z *Zp) *Bitstring
+}
+
+func (k *keyStrategyFunc) Key(z *Zp) *Bitstring { return k.key(z) }
+
+func (k *keyStrategyFunc) Name() string { return k.name }
+
+// SksKeys derives keys as SKS does, with ZpBitstring.
+var SksKeys KeyStrategy = &keyStrategyFunc{name: "sks", key: ZpBitstring}
+
+// BigEndianKeys derives keys from the bits of an element, most
+// significant first, for elements which are uniformly distributed
+// throughout the finite field.
+var BigEndianKeys KeyStrategy = &keyStrategyFunc{name: "bigendian", key: zpBigEndianBitstring}
+
+func zpBigEndianBitstring(z *Zp) *Bitstring {
+	bits := z.P.BitLen()
+	bs := NewBitstring(bits)
+	buf := make([]byte, bs.ByteLen())
+	big.NewInt(0).Lsh(z.Int, uint(len(buf)*8-bits)).FillBytes(buf)
+	bs.SetBytes(buf)
+	return bs
+}
+
+// SaltedKeys derives keys from the SHA-256 digest of a salt and the
+// element, which balances the tree for any distribution of elements.
+type SaltedKeys struct {
+	Salt []byte
+}
+
+func (k *SaltedKeys) Key(z *Zp) *Bitstring {
+	h := sha256.New()
+	h.Write(k.Salt)
+	buf := make([]byte, (z.P.BitLen()+7)/8)
+	z.Int.FillBytes(buf)
+	h.Write(buf)
+	bs := NewBitstring(sha256.Size * 8)
+	bs.SetBytes(h.Sum(nil))
+	return bs
+}
+
+// Name identifies salted keys by a digest of the salt,
+// so that the salt itself is not disclosed.
+func (k *SaltedKeys) Name() string {
+	digest := sha256.Sum256(k.Salt)
+	return "salted:" + hex.EncodeToString(digest[:8])
+}
@@ -0,0 +1,56 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestSksKeys(t *testing.T) {
+	z := Zi(P_SKS, 0x0102)
+	assert.Equal(t, "sks", SksKeys.Name())
+	assert.Equal(t, 0, SksKeys.Key(z).Cmp(ZpBitstring(z)))
+	assert.Equal(t, "0100000010000000", SksKeys.Key(z).Prefix(16).BinaryString())
+}
+
+func TestBigEndianKeys(t *testing.T) {
+	key := BigEndianKeys.Key(Zi(P_SKS, 0x0102))
+	assert.Equal(t, P_SKS.BitLen(), key.BitLen())
+	// The last bits of the key are the least significant
+	assert.Equal(t, "0000000100000010", key.BinaryString()[key.BitLen()-16:])
+	key = BigEndianKeys.Key(Zs(P_SKS, "340282366920938463463374607431768211456"))
+	assert.Equal(t, 1, key.Get(0))
+	assert.Equal(t, 0, key.Get(1))
+}
+
+func TestSaltedKeys(t *testing.T) {
+	z := Zi(P_SKS, 65537)
+	k1, k2 := &SaltedKeys{Salt: []byte("a")}, &SaltedKeys{Salt: []byte("b")}
+	assert.Equal(t, 256, k1.Key(z).BitLen())
+	assert.Equal(t, 0, k1.Key(z).Cmp((&SaltedKeys{Salt: []byte("a")}).Key(z)))
+	assert.NotEqual(t, 0, k1.Key(z).Cmp(k2.Key(z)))
+	assert.NotEqual(t, 0, k1.Key(z).Cmp(k1.Key(Zi(P_SKS, 65539))))
+	assert.NotEqual(t, k1.Name(), k2.Name())
+	assert.Equal(t, k1.Name(), (&SaltedKeys{Salt: []byte("a")}).Name())
+}
@@ -28,11 +28,15 @@ import (
 	"fmt"
 )
 
+// Matrix is a dense matrix of integers in a finite field Z(p), used to
+// solve the system of linear equations for rational function
+// interpolation. Cells are addressed by column i and row j.
 type Matrix struct {
 	columns, rows int
 	cells         []*Zp
 }
 
+// NewMatrix creates a matrix with all cells initialized to x.
 func NewMatrix(columns, rows int, x *Zp) *Matrix {
 	matrix := &Matrix{
 		rows:    rows,
@@ -44,6 +48,38 @@ func NewMatrix(columns, rows int, x *Zp) *Matrix {
 	return matrix
 }
 
+// NewMatrixRows creates a matrix from a slice of rows,
+// which must all be the same length.
+func NewMatrixRows(rows [][]*Zp) (*Matrix, error) {
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return nil, errors.New("Matrix must have at least one row and column")
+	}
+	m := &Matrix{columns: len(rows[0]), rows: len(rows)}
+	for j, row := range rows {
+		if len(row) != m.columns {
+			return nil, errors.New(fmt.Sprintf(
+				"Row %d has %d columns, expected %d", j, len(row), m.columns))
+		}
+		for _, x := range row {
+			m.cells = append(m.cells, x.Copy())
+		}
+	}
+	if err := m.cells[0].CheckP(m.cells...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Columns returns the number of columns in the matrix.
+func (m *Matrix) Columns() int {
+	return m.columns
+}
+
+// Rows returns the number of rows in the matrix.
+func (m *Matrix) Rows() int {
+	return m.rows
+}
+
 func (m *Matrix) Get(i, j int) *Zp {
 	return m.cells[i+(j*m.columns)]
 }
@@ -54,6 +90,39 @@ func (m *Matrix) Set(i, j int, x *Zp) {
 
 var MatrixTooNarrow = errors.New("Matrix is too narrow to reduce")
 
+var SingularMatrix = errors.New("Matrix is singular")
+
+// Solve solves the system of linear equations given by an augmented
+// matrix, of n rows and n+1 columns holding the coefficients of each
+// equation followed by its constant term. The matrix is reduced in
+// place. Returns SingularMatrix if there is no unique solution.
+func (m *Matrix) Solve() ([]*Zp, error) {
+	if m.columns != m.rows+1 {
+		return nil, errors.New(fmt.Sprintf(
+			"Augmented matrix must have %d columns, has %d", m.rows+1, m.columns))
+	}
+	if err := m.Reduce(); err != nil {
+		return nil, err
+	}
+	solution := make([]*Zp, m.rows)
+	for j := 0; j < m.rows; j++ {
+		if !isOne(m.Get(j, j)) {
+			return nil, SingularMatrix
+		}
+		solution[j] = m.Get(m.rows, j).Copy()
+	}
+	return solution, nil
+}
+
+// isOne tests if an integer is 1.
+func isOne(x *Zp) bool {
+	return x.IsInt64() && x.Int64() == 1
+}
+
+// Reduce transforms the matrix into reduced row echelon form by
+// Gauss-Jordan elimination. Where a pivot is zero, rows below are
+// searched for a non-zero pivot to swap in; every non-zero integer
+// in the field is a unit. Columns without a pivot are skipped.
 func (m *Matrix) Reduce() (err error) {
 	if m.columns < m.rows {
 		return MatrixTooNarrow
@@ -71,7 +140,7 @@ func (m *Matrix) Reduce() (err error) {
 }
 
 func (m *Matrix) backSubstitute(j int) {
-	if m.Get(j, j).Int64() == int64(1) {
+	if isOne(m.Get(j, j)) {
 		last := m.rows - 1
 		for j2 := j - 1; j2 >= 0; j2-- {
 			scmult := m.Get(j, j2).Copy()
@@ -99,7 +168,7 @@ func (m *Matrix) processRowForward(j int) error {
 		m.swapRows(j, jswap)
 		v = m.Get(j, j)
 	}
-	if v.Int64() != int64(1) {
+	if !isOne(v) {
 		m.scmultRow(j, j, v.Copy().Inv())
 	}
 	for j2 := j + 1; j2 < m.rows; j2++ {
@@ -129,7 +198,7 @@ func (m *Matrix) rowsub(scol, src, dst int, scmult *Zp) {
 		sval := m.Get(i, src)
 		if !sval.IsZero() {
 			v := m.Get(i, dst)
-			if scmult.Int64() != int64(1) {
+			if !isOne(scmult) {
 				v.Sub(v, Z(scmult.P).Mul(sval, scmult))
 			} else {
 				v.Sub(v, sval)
@@ -127,3 +127,59 @@ func TestProcessRowForward(t *testing.T) {
 	m0.processRowForward(0)
 	assertEqualMatrix(t, m0, m1)
 }
+
+func TestSolve(t *testing.T) {
+	p := big.NewInt(int64(97))
+	// 2x + y - z = 8, -3x - y + 2z = -11, -2x + y + 2z = -3
+	m, err := NewMatrixRows([][]*Zp{
+		{Zi(p, 2), Zi(p, 1), Zi(p, -1), Zi(p, 8)},
+		{Zi(p, -3), Zi(p, -1), Zi(p, 2), Zi(p, -11)},
+		{Zi(p, -2), Zi(p, 1), Zi(p, 2), Zi(p, -3)}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, m.Columns())
+	assert.Equal(t, 3, m.Rows())
+	solution, err := m.Solve()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(solution))
+	assert.Equal(t, 0, solution[0].Cmp(Zi(p, 2)))
+	assert.Equal(t, 0, solution[1].Cmp(Zi(p, 3)))
+	assert.Equal(t, 0, solution[2].Cmp(Zi(p, -1)))
+	// Pivot on a zero in the first row
+	m, err = NewMatrixRows([][]*Zp{
+		{Zi(p, 0), Zi(p, 1), Zi(p, 5)},
+		{Zi(p, 1), Zi(p, 0), Zi(p, 7)}})
+	assert.Equal(t, nil, err)
+	solution, err = m.Solve()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, solution[0].Cmp(Zi(p, 7)))
+	assert.Equal(t, 0, solution[1].Cmp(Zi(p, 5)))
+}
+
+func TestSolveSingular(t *testing.T) {
+	p := big.NewInt(int64(97))
+	m, err := NewMatrixRows([][]*Zp{
+		{Zi(p, 1), Zi(p, 2), Zi(p, 3)},
+		{Zi(p, 2), Zi(p, 4), Zi(p, 6)}})
+	assert.Equal(t, nil, err)
+	_, err = m.Solve()
+	assert.Equal(t, SingularMatrix, err)
+	_, err = NewMatrixRows([][]*Zp{{Zi(p, 1), Zi(p, 2)}, {Zi(p, 1)}})
+	assert.NotEqual(t, nil, err)
+	m = NewMatrix(3, 3, Zi(p, 1))
+	_, err = m.Solve()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSolveLargePivot(t *testing.T) {
+	// A pivot of 2^64+1 must not be taken for 1
+	p := P_SKS
+	pivot := Zb(p, []byte{1, 0, 0, 0, 0, 0, 0, 0, 1})
+	m, err := NewMatrixRows([][]*Zp{
+		{pivot, Zi(p, 0), Zzp(pivot)},
+		{Zi(p, 0), Zi(p, 1), Zi(p, 3)}})
+	assert.Equal(t, nil, err)
+	solution, err := m.Solve()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, solution[0].Cmp(Zi(p, 1)))
+	assert.Equal(t, 0, solution[1].Cmp(Zi(p, 3)))
+}
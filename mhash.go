@@ -0,0 +1,95 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"math/big"
+)
+
+// MultisetHash is an incremental digest of a multiset of integers,
+// which does not depend on the order in which integers are added.
+// It is the sum of the SHA-512 digests of the integers modulo 2^512,
+// as MSet-Add-Hash of Clarke et al., and is suited to detecting
+// differences between sets rather than deliberate collisions.
+type MultisetHash struct {
+	sum *big.Int
+}
+
+var multisetModulus *big.Int = big.NewInt(0).Lsh(big.NewInt(1), sha512.Size*8)
+
+// NewMultisetHash returns the digest of the empty multiset.
+func NewMultisetHash() *MultisetHash {
+	return &MultisetHash{sum: big.NewInt(0)}
+}
+
+// MultisetDigest returns the digest of the given integers.
+func MultisetDigest(values ...*Zp) *MultisetHash {
+	h := NewMultisetHash()
+	for _, z := range values {
+		h.Add(z)
+	}
+	return h
+}
+
+func multisetElement(z *Zp) *big.Int {
+	buf := make([]byte, (z.P.BitLen()+7)/8)
+	z.Int.FillBytes(buf)
+	digest := sha512.Sum512(buf)
+	return big.NewInt(0).SetBytes(digest[:])
+}
+
+// Add adds an integer to the multiset.
+func (h *MultisetHash) Add(z *Zp) {
+	h.sum.Add(h.sum, multisetElement(z))
+	h.sum.Mod(h.sum, multisetModulus)
+}
+
+// Remove removes an integer from the multiset.
+func (h *MultisetHash) Remove(z *Zp) {
+	h.sum.Sub(h.sum, multisetElement(z))
+	h.sum.Mod(h.sum, multisetModulus)
+}
+
+// Copy returns a copy of the digest.
+func (h *MultisetHash) Copy() *MultisetHash {
+	return &MultisetHash{sum: big.NewInt(0).Set(h.sum)}
+}
+
+// Equal returns whether two digests are of the same multiset.
+func (h *MultisetHash) Equal(other *MultisetHash) bool {
+	return h.sum.Cmp(other.sum) == 0
+}
+
+// Bytes returns the digest as sha512.Size bytes.
+func (h *MultisetHash) Bytes() []byte {
+	buf := make([]byte, sha512.Size)
+	h.sum.FillBytes(buf)
+	return buf
+}
+
+// String returns the digest in hexadecimal.
+func (h *MultisetHash) String() string {
+	return hex.EncodeToString(h.Bytes())
+}
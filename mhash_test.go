@@ -0,0 +1,60 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestMultisetHashOrder(t *testing.T) {
+	a := MultisetDigest(Zi(P_SKS, 1), Zi(P_SKS, 2), Zi(P_SKS, 3))
+	b := MultisetDigest(Zi(P_SKS, 3), Zi(P_SKS, 1), Zi(P_SKS, 2))
+	assert.T(t, a.Equal(b))
+	assert.Equal(t, a.String(), b.String())
+	assert.Equal(t, 128, len(a.String()))
+	assert.T(t, !a.Equal(MultisetDigest(Zi(P_SKS, 1), Zi(P_SKS, 2))))
+	assert.T(t, !a.Equal(MultisetDigest(Zi(P_SKS, 1), Zi(P_SKS, 2), Zi(P_SKS, 4))))
+}
+
+func TestMultisetHashRemove(t *testing.T) {
+	h := NewMultisetHash()
+	empty := h.String()
+	h.Add(Zi(P_SKS, 65537))
+	h.Add(Zi(P_SKS, 65539))
+	saved := h.Copy()
+	h.Remove(Zi(P_SKS, 65537))
+	assert.T(t, h.Equal(MultisetDigest(Zi(P_SKS, 65539))))
+	assert.T(t, !h.Equal(saved))
+	h.Remove(Zi(P_SKS, 65539))
+	assert.Equal(t, empty, h.String())
+	assert.T(t, saved.Equal(MultisetDigest(Zi(P_SKS, 65539), Zi(P_SKS, 65537))))
+}
+
+func TestMultisetHashMultiplicity(t *testing.T) {
+	once := MultisetDigest(Zi(P_SKS, 7))
+	twice := MultisetDigest(Zi(P_SKS, 7), Zi(P_SKS, 7))
+	assert.T(t, !once.Equal(twice))
+	twice.Remove(Zi(P_SKS, 7))
+	assert.T(t, once.Equal(twice))
+}
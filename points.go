@@ -0,0 +1,74 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// PointGenerator generates the n points in the finite field p at which
+// sets are sampled for reconciliation. Peers must sample at the same
+// points to reconcile, and the points must be distinct.
+type PointGenerator interface {
+	Points(p *big.Int, n int) []*Zp
+}
+
+// PointGeneratorFunc adapts a function to a PointGenerator.
+type PointGeneratorFunc func(p *big.Int, n int) []*Zp
+
+func (f PointGeneratorFunc) Points(p *big.Int, n int) []*Zp {
+	return f(p, n)
+}
+
+// SksPoints generates the points used by SKS, with Zpoints.
+var SksPoints PointGenerator = PointGeneratorFunc(Zpoints)
+
+// HashPoints generates points from the SHA-256 digests of a seed and
+// the point's index. Unlike the small integers generated by Zpoints,
+// these are unlikely to coincide with an element, where the sample
+// value would be zero and could not be divided by. Points are
+// rejected and drawn again if they repeat.
+type HashPoints struct {
+	Seed []byte
+}
+
+func (h *HashPoints) Points(p *big.Int, n int) []*Zp {
+	points := make([]*Zp, 0, n)
+	seen := NewZSet()
+	var index [8]byte
+	for i := uint64(0); len(points) < n; i++ {
+		binary.BigEndian.PutUint64(index[:], i)
+		digest := sha256.New()
+		digest.Write(h.Seed)
+		digest.Write(index[:])
+		z := Zb(p, digest.Sum(nil))
+		if seen.Has(z) {
+			continue
+		}
+		seen.Add(z)
+		points = append(points, z)
+	}
+	return points
+}
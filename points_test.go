@@ -0,0 +1,67 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"math/big"
+	"testing"
+)
+
+// Points sampled by SKS with the default mbar of 5.
+var sksPoints = []string{
+	"0",
+	"530512889551602322505127520352579437338",
+	"1",
+	"530512889551602322505127520352579437337",
+	"2",
+	"530512889551602322505127520352579437336",
+}
+
+func TestZpointsSks(t *testing.T) {
+	points := Zpoints(P_SKS, len(sksPoints))
+	for i, s := range sksPoints {
+		assert.Equalf(t, s, points[i].String(), "point %d", i)
+	}
+	points = SksPoints.Points(P_SKS, 11)
+	assert.Equal(t, 11, len(points))
+	assert.Equal(t, "5", points[10].String())
+	assert.Equal(t, "530512889551602322505127520352579437334", points[9].String())
+}
+
+func TestHashPoints(t *testing.T) {
+	gen := &HashPoints{Seed: []byte("conflux")}
+	points := gen.Points(P_SKS, 20)
+	assert.Equal(t, 20, len(points))
+	assert.Equal(t, 20, NewZSet(points...).Len())
+	// Points are determined by the seed
+	again := (&HashPoints{Seed: []byte("conflux")}).Points(P_SKS, 20)
+	for i := range points {
+		assert.Equal(t, 0, points[i].Cmp(again[i]))
+	}
+	other := (&HashPoints{Seed: []byte("other")}).Points(P_SKS, 20)
+	assert.NotEqual(t, 0, points[0].Cmp(other[0]))
+	// Small fields repeat digests, which are drawn again
+	points = gen.Points(big.NewInt(int64(97)), 20)
+	assert.Equal(t, 20, NewZSet(points...).Len())
+}
@@ -189,20 +189,25 @@ func (p *Poly) Sub(x, y *Poly) *Poly {
 	return p.Add(x, y.Copy().Neg())
 }
 
+// Mul sets the polynomial to the product of x and y. Products of
+// high degree are computed by Karatsuba's method. Coefficients are
+// reduced once each, rather than after every term.
 func (p *Poly) Mul(x, y *Poly) *Poly {
 	x.assertP(y.p)
+	xc := make([]*big.Int, x.degree+1)
+	for i := range xc {
+		xc[i] = x.coeff[i].Int
+	}
+	yc := make([]*big.Int, y.degree+1)
+	for i := range yc {
+		yc[i] = y.coeff[i].Int
+	}
+	prod := mulCoeffs(xc, yc)
 	p.p = x.p
-	p.coeff = make([]*Zp, x.degree+y.degree+1)
-	p.degree = x.degree + y.degree
-	for i := 0; i <= x.degree; i++ {
-		for j := 0; j <= y.degree; j++ {
-			zp := p.coeff[i+j]
-			if zp == nil {
-				zp = Z(p.p)
-				p.coeff[i+j] = zp
-			}
-			zp.Add(zp, Z(p.p).Mul(x.coeff[i], y.coeff[j]))
-		}
+	p.coeff = make([]*Zp, len(prod))
+	p.degree = len(prod) - 1
+	for i, c := range prod {
+		p.coeff[i] = &Zp{Int: c.Mod(c, p.p), P: p.p}
 	}
 	p.trim()
 	return p
@@ -215,7 +220,7 @@ func (p *Poly) IsConstant(c *Zp) bool {
 func (p *Poly) Eval(z *Zp) *Zp {
 	sum := Zi(p.p, 0)
 	for d := 0; d <= p.degree; d++ {
-		sum.Add(sum.Copy(), Z(p.p).Mul(p.coeff[d], Z(p.p).Exp(z, Zi(p.p, d))))
+		sum.Add(sum.Copy(), Z(p.p).Mul(p.coeff[d], Z(p.p).ExpInt(z, big.NewInt(int64(d)))))
 	}
 	return sum
 }
@@ -273,28 +278,182 @@ func PolyMod(x, y *Poly) (r *Poly, err error) {
 	return
 }
 
+// polyGcd finds the greatest common divisor of x and y by
+// Euclid's algorithm.
 func polyGcd(x, y *Poly) (*Poly, error) {
-	//fmt.Printf("polyGcd x=(%v) y=(%v)\n", x, y)
-	if y.IsConstant(Zi(x.p, 0)) {
-		//fmt.Printf("y is zero\n")
-		return x, nil
+	for !y.isZero() {
+		_, r, err := PolyDivmod(x, y)
+		if err != nil {
+			return nil, err
+		}
+		x, y = y, r
 	}
-	_, r, err := PolyDivmod(x, y)
+	return x, nil
+}
+
+// PolyGcd returns the monic greatest common divisor of x and y,
+// found by Euclid's algorithm.
+func PolyGcd(x, y *Poly) (result *Poly, err error) {
+	x.assertP(y.p)
+	result, err = polyGcd(x, y)
 	if err != nil {
 		return nil, err
 	}
-	return polyGcd(y, r)
+	return result.monic(), nil
 }
 
-func PolyGcd(x, y *Poly) (result *Poly, err error) {
-	result, err = polyGcd(x, y)
-	//fmt.Printf("result = (%v)\n", result)
+// monic scales the polynomial so that its leading coefficient is 1.
+// The zero polynomial is returned as it is.
+func (p *Poly) monic() *Poly {
+	if p.isZero() {
+		return p
+	}
+	return NewPoly().Mul(p, NewPoly(p.coeff[p.degree].Copy().Inv()))
+}
+
+// isZero tests if this is the zero polynomial.
+func (p *Poly) isZero() bool {
+	return p.degree == 0 && (len(p.coeff) == 0 || p.coeff[0].IsZero())
+}
+
+// deg returns the degree of the polynomial, taking
+// the degree of the zero polynomial to be -1.
+func (p *Poly) deg() int {
+	if p.isZero() {
+		return -1
+	}
+	return p.degree
+}
+
+// shift divides the polynomial by z^k, discarding the remainder.
+func (p *Poly) shift(k int) *Poly {
+	if k > p.degree {
+		return NewPoly(Z(p.p))
+	}
+	coeff := make([]*Zp, p.degree-k+1)
+	copy(coeff, p.coeff[k:p.degree+1])
+	return NewPoly(coeff...)
+}
+
+// PolyMatrix is a 2x2 matrix of polynomials [A B; C D],
+// used to carry the quotients of Euclid's algorithm.
+type PolyMatrix struct {
+	A, B, C, D *Poly
+}
+
+// NewPolyMatrix creates the identity matrix in the finite field p.
+func NewPolyMatrix(p *big.Int) *PolyMatrix {
+	return &PolyMatrix{
+		A: NewPoly(Zi(p, 1)), B: NewPoly(Z(p)),
+		C: NewPoly(Z(p)), D: NewPoly(Zi(p, 1))}
+}
+
+// Mul sets the matrix to the product x * y.
+func (m *PolyMatrix) Mul(x, y *PolyMatrix) *PolyMatrix {
+	a := NewPoly().Add(NewPoly().Mul(x.A, y.A), NewPoly().Mul(x.B, y.C))
+	b := NewPoly().Add(NewPoly().Mul(x.A, y.B), NewPoly().Mul(x.B, y.D))
+	c := NewPoly().Add(NewPoly().Mul(x.C, y.A), NewPoly().Mul(x.D, y.C))
+	d := NewPoly().Add(NewPoly().Mul(x.C, y.B), NewPoly().Mul(x.D, y.D))
+	m.A, m.B, m.C, m.D = a, b, c, d
+	return m
+}
+
+// Apply multiplies the column vector (x, y) by the matrix.
+func (m *PolyMatrix) Apply(x, y *Poly) (*Poly, *Poly) {
+	return NewPoly().Add(NewPoly().Mul(m.A, x), NewPoly().Mul(m.B, y)),
+		NewPoly().Add(NewPoly().Mul(m.C, x), NewPoly().Mul(m.D, y))
+}
+
+// polyStep returns the matrix taking (x, y) to (y, x mod y), and x mod y.
+func polyStep(x, y *Poly) (*PolyMatrix, *Poly, error) {
+	q, r, err := PolyDivmod(x, y)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &PolyMatrix{
+		A: NewPoly(Z(x.p)), B: NewPoly(Zi(x.p, 1)),
+		C: NewPoly(Zi(x.p, 1)), D: q.Copy().Neg()}, r, nil
+}
+
+// PolyHalfGcd takes Euclid's algorithm on x and y, where the degree
+// of x is greater than that of y, halfway: it returns the matrix M of
+// the quotients such that M(x, y) = (u, v), consecutive remainders
+// with deg u >= ceil(deg x / 2) > deg v. The quotients are found by
+// recursing on the high halves of the coefficients, which needs far
+// fewer coefficient operations than Euclid when paired with fast
+// polynomial multiplication.
+func PolyHalfGcd(x, y *Poly) (*PolyMatrix, error) {
+	x.assertP(y.p)
+	if x.deg() <= y.deg() {
+		return nil, errors.New(fmt.Sprintf(
+			"Half-GCD requires deg x %d > deg y %d", x.deg(), y.deg()))
+	}
+	return polyHalfGcd(x, y)
+}
+
+func polyHalfGcd(x, y *Poly) (*PolyMatrix, error) {
+	m := (x.deg() + 1) / 2
+	if y.deg() < m {
+		return NewPolyMatrix(x.p), nil
+	}
+	// Quotients of the high halves are those of x and y,
+	// down to remainders of degree m.
+	r, err := polyHalfGcd(x.shift(m), y.shift(m))
+	if err != nil {
+		return nil, err
+	}
+	u, v := r.Apply(x, y)
+	if v.deg() < m {
+		return r, nil
+	}
+	step, w, err := polyStep(u, v)
 	if err != nil {
 		return nil, err
 	}
-	result = NewPoly().Mul(result,
-		NewPoly(result.coeff[result.degree].Copy().Inv()))
-	return result, nil
+	r.Mul(step, r)
+	u, v = v, w
+	if v.deg() < m {
+		return r, nil
+	}
+	k := 2*m - u.deg()
+	s, err := polyHalfGcd(u.shift(k), v.shift(k))
+	if err != nil {
+		return nil, err
+	}
+	return s.Mul(s, r), nil
+}
+
+// PolyFastGcd returns the monic greatest common divisor of x and y,
+// as PolyGcd does, reducing them with PolyHalfGcd.
+func PolyFastGcd(x, y *Poly) (*Poly, error) {
+	x.assertP(y.p)
+	if x.deg() < y.deg() {
+		x, y = y, x
+	}
+	for !y.isZero() {
+		if x.deg() == y.deg() {
+			_, r, err := polyStep(x, y)
+			if err != nil {
+				return nil, err
+			}
+			x, y = y, r
+			continue
+		}
+		m, err := polyHalfGcd(x, y)
+		if err != nil {
+			return nil, err
+		}
+		x, y = m.Apply(x, y)
+		if y.isZero() {
+			break
+		}
+		_, r, err := polyStep(x, y)
+		if err != nil {
+			return nil, err
+		}
+		x, y = y, r
+	}
+	return x.monic(), nil
 }
 
 type RationalFn struct {
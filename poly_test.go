@@ -23,6 +23,7 @@
 package conflux
 
 import (
+	"fmt"
 	"github.com/bmizerany/assert"
 	"math/big"
 	"testing"
@@ -76,6 +77,36 @@ func TestPolyMul(t *testing.T) {
 	}
 }
 
+// schoolbookMul multiplies polynomials without Karatsuba's method.
+func schoolbookMul(x, y *Poly) *Poly {
+	defer func(threshold int) { karatsubaThreshold = threshold }(karatsubaThreshold)
+	karatsubaThreshold = 1 << 30
+	return NewPoly().Mul(x, y)
+}
+
+func TestPolyMulKaratsuba(t *testing.T) {
+	defer func(threshold int) { karatsubaThreshold = threshold }(karatsubaThreshold)
+	for _, threshold := range []int{2, 3, 32} {
+		karatsubaThreshold = threshold
+		for _, degrees := range [][2]int{
+			{0, 0}, {1, 1}, {2, 3}, {7, 8}, {31, 31}, {32, 32}, {33, 90},
+			{64, 64}, {100, 3}, {127, 129}, {200, 150}} {
+			x, y := PolyRand(P_SKS, degrees[0]), PolyRand(P_SKS, degrees[1])
+			expect := schoolbookMul(x, y)
+			prod := NewPoly().Mul(x, y)
+			assert.Equalf(t, degrees[0]+degrees[1], prod.Degree(), "degree of %v", degrees)
+			assert.Tf(t, expect.Equal(prod), "threshold %d, degrees %v", threshold, degrees)
+		}
+	}
+	// In place
+	x, y := PolyRand(P_SKS, 80), PolyRand(P_SKS, 70)
+	expect := schoolbookMul(x, y)
+	assert.T(t, expect.Equal(x.Mul(x, y)))
+	// With a zero factor
+	zero := NewPoly(Z(P_SKS))
+	assert.T(t, zero.Equal(NewPoly().Mul(PolyRand(P_SKS, 100), zero)))
+}
+
 func TestPolyAdd(t *testing.T) {
 	p := big.NewInt(int64(97))
 	// (x+1) + (x+2) = (2x+3)
@@ -130,3 +161,126 @@ func TestGcd(t *testing.T) {
 	assert.Equal(t, int64(1), r.coeff[1].Int64())
 	assert.Equal(t, 2, len(r.coeff))
 }
+
+func TestGcdZero(t *testing.T) {
+	p := big.NewInt(int64(97))
+	x := NewPoly(Zi(p, 2), Zi(p, 2))
+	r, err := PolyGcd(x, NewPoly(Z(p)))
+	assert.Equal(t, nil, err)
+	assert.T(t, r.Equal(NewPoly(Zi(p, 1), Zi(p, 1))))
+	r, err = PolyFastGcd(NewPoly(Z(p)), x)
+	assert.Equal(t, nil, err)
+	assert.T(t, r.Equal(NewPoly(Zi(p, 1), Zi(p, 1))))
+}
+
+func TestHalfGcd(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		common := PolyRand(P_SKS, 1+i%4)
+		x := NewPoly().Mul(common, PolyRand(P_SKS, 12+i))
+		y := NewPoly().Mul(common, PolyRand(P_SKS, 5+i))
+		m, err := PolyHalfGcd(x, y)
+		assert.Equal(t, nil, err)
+		u, v := m.Apply(x, y)
+		half := (x.Degree() + 1) / 2
+		assert.Tf(t, u.deg() >= half, "deg u=%d half=%d", u.deg(), half)
+		assert.Tf(t, v.deg() < half, "deg v=%d half=%d", v.deg(), half)
+		// The remainders have the same GCD
+		expect, err := PolyGcd(x, y)
+		assert.Equal(t, nil, err)
+		g, err := PolyGcd(u, v)
+		assert.Equal(t, nil, err)
+		assert.T(t, expect.Equal(g))
+		g, err = PolyFastGcd(x, y)
+		assert.Equal(t, nil, err)
+		assert.T(t, expect.Equal(g))
+		assert.T(t, expect.Degree() >= common.Degree())
+	}
+	p := big.NewInt(int64(97))
+	_, err := PolyHalfGcd(NewPoly(Zi(p, 1), Zi(p, 1)), NewPoly(Zi(p, 1), Zi(p, 1)))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPolyRingProperties(t *testing.T) {
+	checkQuick(t, func(x, y, z quickPoly) bool {
+		return NewPoly().Add(x.Poly, y.Poly).Equal(NewPoly().Add(y.Poly, x.Poly)) &&
+			NewPoly().Sub(NewPoly().Add(x.Poly, y.Poly), y.Poly).Equal(x.Poly) &&
+			NewPoly().Mul(x.Poly, y.Poly).Equal(NewPoly().Mul(y.Poly, x.Poly)) &&
+			NewPoly().Mul(NewPoly().Mul(x.Poly, y.Poly), z.Poly).Equal(
+				NewPoly().Mul(x.Poly, NewPoly().Mul(y.Poly, z.Poly))) &&
+			NewPoly().Mul(x.Poly, NewPoly().Add(y.Poly, z.Poly)).Equal(
+				NewPoly().Add(NewPoly().Mul(x.Poly, y.Poly), NewPoly().Mul(x.Poly, z.Poly)))
+	})
+}
+
+func TestPolyEvalProperties(t *testing.T) {
+	checkQuick(t, func(x, y quickPoly, z quickZp) bool {
+		p := z.P
+		return NewPoly().Add(x.Poly, y.Poly).Eval(z.Zp).Cmp(
+			Z(p).Add(x.Eval(z.Zp), y.Eval(z.Zp))) == 0 &&
+			NewPoly().Mul(x.Poly, y.Poly).Eval(z.Zp).Cmp(
+				Z(p).Mul(x.Eval(z.Zp), y.Eval(z.Zp))) == 0
+	})
+}
+
+func TestPolyDivmodProperties(t *testing.T) {
+	checkQuick(t, func(x quickPoly, y quickNonZeroPoly) bool {
+		q, r, err := PolyDivmod(x.Poly, y.Poly)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return NewPoly().Add(NewPoly().Mul(q, y.Poly), r).Equal(x.Poly) &&
+			r.deg() < y.deg()
+	})
+}
+
+func TestPolyMulDivRoundTrip(t *testing.T) {
+	checkQuick(t, func(x quickPoly, y quickNonZeroPoly) bool {
+		q, r, err := PolyDivmod(NewPoly().Mul(x.Poly, y.Poly), y.Poly)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return q.Equal(x.Poly) && r.isZero()
+	})
+}
+
+func TestPolyGcdProperties(t *testing.T) {
+	checkQuick(t, func(x, y quickPoly, c quickNonZeroPoly) bool {
+		// c divides both products, so it divides their gcd.
+		xc, yc := NewPoly().Mul(x.Poly, c.Poly), NewPoly().Mul(y.Poly, c.Poly)
+		g, err := PolyGcd(xc, yc)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		fg, err := PolyFastGcd(xc, yc)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		for _, dividend := range []*Poly{xc, yc} {
+			if r, err := PolyMod(dividend, g); err != nil || !r.isZero() {
+				return false
+			}
+		}
+		r, err := PolyMod(g, c.Poly)
+		return err == nil && r.isZero() && fg.Equal(g)
+	})
+}
+
+func BenchmarkPolyMul(b *testing.B) {
+	for _, degree := range []int{16, 32, 64, 128, 256, 512} {
+		x, y := PolyRand(P_SKS, degree), PolyRand(P_SKS, degree)
+		b.Run(fmt.Sprintf("schoolbook/%d", degree), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				schoolbookMul(x, y)
+			}
+		})
+		b.Run(fmt.Sprintf("auto/%d", degree), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				NewPoly().Mul(x, y)
+			}
+		})
+	}
+}
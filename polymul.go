@@ -0,0 +1,120 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+)
+
+// karatsubaThreshold is the number of coefficients in each factor from
+// which polynomials are multiplied by Karatsuba's method, in about
+// n**1.58 coefficient products rather than n**2. Below it, the
+// savings do not repay the additions. Interpolating differences of
+// the default mBar stays below it; deployments which raise mBar
+// factor larger polynomials.
+var karatsubaThreshold = 32
+
+// mulCoeffs returns the product of polynomials with the coefficients
+// x and y, in ascending degree order, without reducing them.
+func mulCoeffs(x, y []*big.Int) []*big.Int {
+	if len(x) == 0 || len(y) == 0 {
+		return nil
+	}
+	if len(x) < karatsubaThreshold || len(y) < karatsubaThreshold {
+		return mulSchoolbook(x, y)
+	}
+	// x = x1*z^m + x0, y = y1*z^m + y0
+	m := len(x)
+	if len(y) > m {
+		m = len(y)
+	}
+	m = (m + 1) / 2
+	x0, x1 := splitCoeffs(x, m)
+	y0, y1 := splitCoeffs(y, m)
+	z0 := mulCoeffs(x0, y0)
+	z2 := mulCoeffs(x1, y1)
+	// z1 = (x0 + x1)(y0 + y1) - z0 - z2 = x0*y1 + x1*y0
+	z1 := mulCoeffs(addCoeffs(x0, x1), addCoeffs(y0, y1))
+	n := len(x) + len(y) - 1
+	if len(z1)+m > n {
+		n = len(z1) + m
+	}
+	result := make([]*big.Int, n)
+	for i := range result {
+		result[i] = new(big.Int)
+	}
+	for i, c := range z0 {
+		result[i].Add(result[i], c)
+		result[i+m].Sub(result[i+m], c)
+	}
+	for i, c := range z2 {
+		result[i+2*m].Add(result[i+2*m], c)
+		result[i+m].Sub(result[i+m], c)
+	}
+	for i, c := range z1 {
+		result[i+m].Add(result[i+m], c)
+	}
+	// Terms above the degree of the product cancel
+	return result[:len(x)+len(y)-1]
+}
+
+// mulSchoolbook returns the product of polynomials with the coefficients
+// x and y, multiplying each pair of coefficients.
+func mulSchoolbook(x, y []*big.Int) []*big.Int {
+	result := make([]*big.Int, len(x)+len(y)-1)
+	for i := range result {
+		result[i] = new(big.Int)
+	}
+	var prod big.Int
+	for i := range x {
+		for j := range y {
+			result[i+j].Add(result[i+j], prod.Mul(x[i], y[j]))
+		}
+	}
+	return result
+}
+
+// splitCoeffs divides coefficients into those below degree m and those
+// above, which are shifted down by m.
+func splitCoeffs(x []*big.Int, m int) (lo, hi []*big.Int) {
+	if len(x) <= m {
+		return x, nil
+	}
+	return x[:m], x[m:]
+}
+
+// addCoeffs returns the sum of polynomials with the coefficients x
+// and y.
+func addCoeffs(x, y []*big.Int) []*big.Int {
+	if len(x) < len(y) {
+		x, y = y, x
+	}
+	result := make([]*big.Int, len(x))
+	for i := range x {
+		result[i] = new(big.Int).Set(x[i])
+		if i < len(y) {
+			result[i].Add(result[i], y[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Bounds on the size of a caller-provided prime, in bits. The smallest
+// leaves the polynomial interpolation a negligible chance of mistaking
+// a false solution for a true one; the largest bounds the cost of the
+// field arithmetic and of sending samples over the wire.
+const (
+	MinPrimeBits = 64
+	MaxPrimeBits = 4096
+)
+
+// PrimeRounds is the number of Miller-Rabin tests applied to a
+// caller-provided prime.
+const PrimeRounds = 20
+
+var ErrNotPrime error = errors.New("Finite field P is not prime")
+
+// PrimeSizeError reports a prime too small or too large to use
+// as a finite field for reconciliation.
+type PrimeSizeError struct {
+	Bits        int
+	ElementBits int
+}
+
+func (e *PrimeSizeError) Error() string {
+	if e.ElementBits > 0 && e.Bits <= e.ElementBits {
+		return fmt.Sprintf("%d-bit prime cannot hold %d-bit elements", e.Bits, e.ElementBits)
+	}
+	return fmt.Sprintf("%d-bit prime is not within %d to %d bits", e.Bits, MinPrimeBits, MaxPrimeBits)
+}
+
+// CheckPrime verifies that p is suitable for a finite field Z(p) which
+// includes all elementBits-bit integers: that it is probably prime,
+// greater than any such integer, and within the bounds on its size.
+// An elementBits of 0 skips the check on element size.
+func CheckPrime(p *big.Int, elementBits int) error {
+	if p == nil || p.Sign() <= 0 {
+		return ErrNotPrime
+	}
+	bits := p.BitLen()
+	if bits < MinPrimeBits || bits > MaxPrimeBits || (elementBits > 0 && bits <= elementBits) {
+		return &PrimeSizeError{Bits: bits, ElementBits: elementBits}
+	}
+	if !p.ProbablyPrime(PrimeRounds) {
+		return ErrNotPrime
+	}
+	return nil
+}
+
+// ParsePrime reads a prime from a decimal string, or a hexadecimal
+// string prefixed with 0x, and checks it with CheckPrime.
+func ParsePrime(s string, elementBits int) (*big.Int, error) {
+	p, ok := big.NewInt(0).SetString(s, 0)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid prime: %q", s))
+	}
+	if err := CheckPrime(p, elementBits); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
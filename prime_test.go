@@ -0,0 +1,61 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"math/big"
+	"testing"
+)
+
+func TestCheckPrime(t *testing.T) {
+	assert.Equal(t, nil, CheckPrime(P_SKS, 128))
+	assert.Equal(t, nil, CheckPrime(P_128, 128))
+	assert.Equal(t, nil, CheckPrime(P_256, 256))
+	assert.Equal(t, nil, CheckPrime(P_512, 0))
+	// Too small for the elements
+	_, is := CheckPrime(P_128, 160).(*PrimeSizeError)
+	assert.T(t, is)
+	// Too small for any elements
+	_, is = CheckPrime(big.NewInt(65537), 0).(*PrimeSizeError)
+	assert.T(t, is)
+	// Composite
+	composite := big.NewInt(0).Mul(P_SKS, big.NewInt(3))
+	assert.Equal(t, ErrNotPrime, CheckPrime(composite, 0))
+	assert.Equal(t, ErrNotPrime, CheckPrime(big.NewInt(0).Sub(P_SKS, big.NewInt(2)), 0))
+	assert.Equal(t, ErrNotPrime, CheckPrime(big.NewInt(-7), 0))
+	assert.Equal(t, ErrNotPrime, CheckPrime(nil, 0))
+}
+
+func TestParsePrime(t *testing.T) {
+	prime, err := ParsePrime(P_SKS.String(), 128)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, prime.Cmp(P_SKS))
+	prime, err = ParsePrime("0x"+P_160.Text(16), 160)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, prime.Cmp(P_160))
+	_, err = ParsePrime("sks", 0)
+	assert.NotEqual(t, nil, err)
+	_, err = ParsePrime("1000000000000000000000000000000", 0)
+	assert.Equal(t, ErrNotPrime, err)
+}
@@ -0,0 +1,126 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// Generators of random field elements, polynomials and set differences
+// for property tests with testing/quick. Properties are checked with a
+// fixed seed, so that a failure can be reproduced.
+
+const quickSeed = 1
+
+func checkQuick(t *testing.T, f interface{}) {
+	config := &quick.Config{Rand: rand.New(rand.NewSource(quickSeed))}
+	if err := quick.Check(f, config); err != nil {
+		t.Error(err)
+	}
+}
+
+// genZp generates an element of Z(p), favouring the edge cases 0, 1
+// and -1.
+func genZp(r *rand.Rand, p *big.Int) *Zp {
+	switch r.Intn(8) {
+	case 0:
+		return Zi(p, 0)
+	case 1:
+		return Zi(p, 1)
+	case 2:
+		return Zi(p, -1)
+	}
+	return &Zp{Int: big.NewInt(0).Rand(r, p), P: p}
+}
+
+// quickZp is an element of Z(P_SKS).
+type quickZp struct{ *Zp }
+
+func (quickZp) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(quickZp{genZp(r, P_SKS)})
+}
+
+// quickNonZeroZp is a non-zero element of Z(P_SKS).
+type quickNonZeroZp struct{ *Zp }
+
+func (quickNonZeroZp) Generate(r *rand.Rand, size int) reflect.Value {
+	z := genZp(r, P_SKS)
+	for z.IsZero() {
+		z = genZp(r, P_SKS)
+	}
+	return reflect.ValueOf(quickNonZeroZp{z})
+}
+
+const quickMaxDegree = 6
+
+func genPoly(r *rand.Rand, p *big.Int) *Poly {
+	coeff := make([]*Zp, r.Intn(quickMaxDegree+1)+1)
+	for i := range coeff {
+		coeff[i] = genZp(r, p)
+	}
+	return NewPoly(coeff...)
+}
+
+// quickPoly is a polynomial over Z(P_SKS), possibly zero.
+type quickPoly struct{ *Poly }
+
+func (quickPoly) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(quickPoly{genPoly(r, P_SKS)})
+}
+
+// quickNonZeroPoly is a non-zero polynomial over Z(P_SKS).
+type quickNonZeroPoly struct{ *Poly }
+
+func (quickNonZeroPoly) Generate(r *rand.Rand, size int) reflect.Value {
+	poly := genPoly(r, P_SKS)
+	for poly.isZero() {
+		poly = genPoly(r, P_SKS)
+	}
+	return reflect.ValueOf(quickNonZeroPoly{poly})
+}
+
+// quickDiff is a pair of disjoint sets, the elements each of two sets
+// has that the other does not.
+type quickDiff struct {
+	A, B *ZSet
+}
+
+const quickMaxDiff = 5
+
+func (quickDiff) Generate(r *rand.Rand, size int) reflect.Value {
+	d := quickDiff{A: NewZSet(), B: NewZSet()}
+	for _, zs := range []*ZSet{d.A, d.B} {
+		for n := r.Intn(quickMaxDiff + 1); zs.Len() < n; {
+			// Random elements are almost surely not sample points.
+			z := &Zp{Int: big.NewInt(0).Rand(r, P_SKS), P: P_SKS}
+			if !d.A.Has(z) && !d.B.Has(z) {
+				zs.Add(z)
+			}
+		}
+	}
+	return reflect.ValueOf(d)
+}
@@ -0,0 +1,315 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"encoding/json"
+	. "github.com/cmars/conflux"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+)
+
+// RecoverBuffer is the number of recoveries RecoverChan holds for a
+// consumer which has not yet read them. Zero, the default, leaves
+// RecoverChan unbuffered.
+func (s *Settings) RecoverBuffer() int {
+	return s.GetInt("conflux.recon.recoverBuffer", 0)
+}
+
+// RecoverPolicy names what is done with recovered elements when
+// RecoverChan is full: "block" the recon session until the consumer
+// reads them, the default; "drop" them, counted in the recoverDropped
+// metric, to be recovered again in a later session, which reconciles
+// in full with peers caught up from their change logs; or "spill" them
+// to the file RecoverSpillPath, from which they are sent to
+// RecoverChan once the consumer catches up, and which later recoveries
+// follow until all are sent.
+func (s *Settings) RecoverPolicy() string {
+	return s.GetString("conflux.recon.recoverPolicy", "block")
+}
+
+// RecoverSpillPath is the file holding recoveries spilled
+// from RecoverChan.
+func (s *Settings) RecoverSpillPath() string {
+	return s.GetString("conflux.recon.recoverSpill", "")
+}
+
+// sendRecover sends a recovery to RecoverChan according to the
+// recover policy of the peer, or of the peer hosting its namespace,
+// with which it shares RecoverChan, returning false if it is dropped.
+func (p *Peer) sendRecover(r *Recover) bool {
+	host := p
+	if p.host != nil {
+		host = p.host
+	}
+	delivered := host.deliverRecover(r)
+	if !delivered {
+		p.releaseRecovered(r)
+	}
+	r.done(delivered)
+	return delivered
+}
+
+// deliverRecover sends a recovery to RecoverChan, or spills it to be
+// sent later, returning false if it is dropped.
+func (p *Peer) deliverRecover(r *Recover) bool {
+	switch p.RecoverPolicy() {
+	case "drop":
+		select {
+		case p.RecoverChan <- r:
+		default:
+			log.Println(SERVE, "RecoverChan full, dropping", len(r.RemoteElements), "elements")
+			sessionMetrics.Add("recoverDropped", int64(len(r.RemoteElements)))
+			return false
+		}
+	case "spill":
+		// Recoveries follow those spilled before them, so that
+		// elements are not removed after being inserted again.
+		path := p.RecoverSpillPath()
+		if !p.spill.pending(path) {
+			select {
+			case p.RecoverChan <- r:
+				return true
+			default:
+			}
+		}
+		if err := p.spill.add(path, r); err != nil {
+			log.Println(SERVE, "spill:", err)
+			p.RecoverChan <- r
+		}
+	default:
+		p.RecoverChan <- r
+	}
+	return true
+}
+
+// replaySpill sends spilled recoveries to RecoverChan as the consumer
+// reads them, until stop is closed, closing done when it returns.
+func (p *Peer) replaySpill(stop, done chan struct{}) {
+	defer close(done)
+	for {
+		path := p.RecoverSpillPath()
+		r, n, err := p.spill.next(path, p.prime())
+		if err != nil {
+			log.Println(SERVE, "spill:", err)
+		}
+		if r == nil && n == 0 {
+			select {
+			case <-p.spill.added():
+				continue
+			case <-stop:
+				return
+			}
+		}
+		if r != nil {
+			select {
+			case p.RecoverChan <- r:
+			case <-stop:
+				return
+			}
+		}
+		if err = p.spill.advance(path, n); err != nil {
+			log.Println(SERVE, "spill:", err)
+		}
+	}
+}
+
+// spilledAddr is the remote address of a spilled recovery.
+type spilledAddr struct {
+	network, addr string
+}
+
+func (a *spilledAddr) Network() string { return a.network }
+func (a *spilledAddr) String() string  { return a.addr }
+
+// spillEntry is a recovery as written to the spill file.
+type spillEntry struct {
+	Network      string   `json:"network"`
+	Addr         string   `json:"addr"`
+	RemoteConfig *Config  `json:"remoteConfig"`
+	Elements     []string `json:"elements"`
+	Namespace    string   `json:"namespace,omitempty"`
+	Payloads     []string `json:"payloads,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+}
+
+func zpStrings(zs []*Zp) (result []string) {
+	for _, z := range zs {
+		result = append(result, z.String())
+	}
+	return
+}
+
+func stringZps(p *big.Int, ss []string) (result []*Zp) {
+	for _, s := range ss {
+		if z := Zs(p, s); z != nil {
+			result = append(result, z)
+		}
+	}
+	return
+}
+
+// spillCompactSize is the size of the recoveries replayed from the
+// head of the spill file beyond which the file is rewritten without
+// them, if they make up most of it.
+const spillCompactSize = 1 << 20
+
+// recoverSpill holds recoveries in a file, one JSON entry per line,
+// until RecoverChan has room. Entries are replayed from an offset into
+// the file, which is removed once all are replayed. The offset is not
+// kept across restarts, so that recoveries may be replayed twice, but
+// none is lost. The zero value is ready to use.
+type recoverSpill struct {
+	mu     sync.Mutex
+	offset int64
+	signal chan struct{}
+}
+
+// added returns a channel which receives when a recovery is spilled.
+func (s *recoverSpill) added() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signal == nil {
+		s.signal = make(chan struct{}, 1)
+	}
+	return s.signal
+}
+
+func (s *recoverSpill) add(path string, r *Recover) error {
+	entry := &spillEntry{
+		RemoteConfig: r.RemoteConfig,
+		Elements:     zpStrings(r.RemoteElements),
+		Namespace:    r.Namespace,
+		Payloads:     zpStrings(r.Payloads),
+		Removed:      zpStrings(r.RemoteRemoved)}
+	if r.RemoteAddr != nil {
+		entry.Network, entry.Addr = r.RemoteAddr.Network(), r.RemoteAddr.String()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if s.signal == nil {
+		s.signal = make(chan struct{}, 1)
+	}
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	return file.Close()
+}
+
+// pending returns whether any spilled recovery is not yet replayed.
+func (s *recoverSpill) pending(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(path)
+	return err == nil && fi.Size() > s.offset
+}
+
+// next reads the first spilled recovery not yet replayed, and the
+// length of its entry in the file, which is zero if none is left.
+// An entry which cannot be read is returned without a recovery, to
+// be skipped.
+func (s *recoverSpill) next(path string, p *big.Int) (*Recover, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(s.offset, 0); err != nil {
+		return nil, 0, err
+	}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err == io.EOF {
+		// Nothing, or an entry still being written
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var entry spillEntry
+	if err = json.Unmarshal(line, &entry); err != nil {
+		return nil, int64(len(line)), err
+	}
+	r := &Recover{
+		RemoteConfig:   entry.RemoteConfig,
+		RemoteElements: stringZps(p, entry.Elements),
+		Namespace:      entry.Namespace,
+		Payloads:       stringZps(p, entry.Payloads),
+		RemoteRemoved:  stringZps(p, entry.Removed)}
+	if entry.Addr != "" {
+		r.RemoteAddr = &spilledAddr{network: entry.Network, addr: entry.Addr}
+	}
+	return r, int64(len(line)), nil
+}
+
+// advance moves past an entry of n bytes once it is replayed,
+// removing the file when all are, or rewriting it without those
+// replayed when they make up most of it.
+func (s *recoverSpill) advance(path string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += n
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if s.offset >= fi.Size() {
+		s.offset = 0
+		return os.Remove(path)
+	}
+	if s.offset < spillCompactSize || s.offset*2 < fi.Size() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data[s.offset:], 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.offset = 0
+	return nil
+}
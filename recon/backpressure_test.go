@@ -0,0 +1,141 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRecover(n int) *Recover {
+	return &Recover{
+		RemoteAddr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370},
+		RemoteConfig:   NewMemPeer().Config(),
+		RemoteElements: []*Zp{Zi(P_SKS, 65537*n)}}
+}
+
+func TestRecoverDrop(t *testing.T) {
+	p := newTestPeer("conflux.recon.recoverBuffer", 1, "conflux.recon.recoverPolicy", "drop")
+	assert.Equal(t, 1, cap(p.RecoverChan))
+	p.sendRecover(newRecover(1))
+	p.sendRecover(newRecover(2))
+	assert.Equal(t, 1, len(p.RecoverChan))
+	r := <-p.RecoverChan
+	assert.Equal(t, 0, r.RemoteElements[0].Cmp(Zi(P_SKS, 65537)))
+}
+
+func TestRecoverSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill")
+	p := newTestPeer("conflux.recon.recoverBuffer", 1, "conflux.recon.recoverPolicy", "spill")
+	assert.NotEqual(t, nil, p.Settings.Validate())
+	p.Settings.Set("conflux.recon.recoverSpill", path)
+	assert.Equal(t, nil, p.Settings.Validate())
+	for i := 1; i <= 3; i++ {
+		r := newRecover(i)
+		r.RemoteRemoved = []*Zp{Zi(P_SKS, 65539*i)}
+		p.sendRecover(r)
+	}
+	_, err = os.Stat(path)
+	assert.Equal(t, nil, err)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go p.replaySpill(stop, done)
+	for i := 1; i <= 3; i++ {
+		r := <-p.RecoverChan
+		assert.Equal(t, 0, r.RemoteElements[0].Cmp(Zi(P_SKS, 65537*i)))
+		assert.Equal(t, 0, r.RemoteRemoved[0].Cmp(Zi(P_SKS, 65539*i)))
+		assert.Equal(t, "192.0.2.1:11370", r.RemoteAddr.String())
+		assert.Equal(t, "tcp", r.RemoteAddr.Network())
+		assert.Equal(t, p.Config().Version, r.RemoteConfig.Version)
+	}
+	// Recoveries spilled while replaying are sent too
+	p.sendRecover(newRecover(4))
+	p.sendRecover(newRecover(5))
+	for i := 4; i <= 5; i++ {
+		r := <-p.RecoverChan
+		assert.Equal(t, 0, r.RemoteElements[0].Cmp(Zi(P_SKS, 65537*i)))
+	}
+	close(stop)
+	<-done
+	assert.Equal(t, 0, len(p.RecoverChan))
+	_, err = os.Stat(path)
+	assert.T(t, os.IsNotExist(err))
+}
+
+func TestRecoverSpillOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	p := newTestPeer("conflux.recon.recoverBuffer", 1, "conflux.recon.recoverPolicy", "spill")
+	p.Settings.Set("conflux.recon.recoverSpill", filepath.Join(dir, "spill"))
+	p.sendRecover(newRecover(1))
+	p.sendRecover(newRecover(2))
+	<-p.RecoverChan
+	// Spilled while an older recovery is yet to be replayed,
+	// though RecoverChan has room
+	p.sendRecover(newRecover(3))
+	assert.Equal(t, 0, len(p.RecoverChan))
+	stop, done := make(chan struct{}), make(chan struct{})
+	go p.replaySpill(stop, done)
+	for i := 2; i <= 3; i++ {
+		r := <-p.RecoverChan
+		assert.Equal(t, 0, r.RemoteElements[0].Cmp(Zi(P_SKS, 65537*i)))
+	}
+	close(stop)
+	<-done
+}
+
+func TestRecoverSpillCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill")
+	garbage := append(bytes.Repeat([]byte{'x'}, spillCompactSize), '\n')
+	assert.Equal(t, nil, ioutil.WriteFile(path, garbage, 0644))
+	var s recoverSpill
+	assert.Equal(t, nil, s.add(path, newRecover(1)))
+	// An entry which cannot be read is skipped
+	r, n, err := s.next(path, P_SKS)
+	assert.NotEqual(t, nil, err)
+	assert.T(t, r == nil)
+	assert.Equal(t, int64(len(garbage)), n)
+	// and, making up most of the file, rewritten without
+	assert.Equal(t, nil, s.advance(path, n))
+	assert.Equal(t, int64(0), s.offset)
+	data, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	assert.T(t, len(data) < len(garbage))
+	r, n, err = s.next(path, P_SKS)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, r.RemoteElements[0].Cmp(Zi(P_SKS, 65537)))
+	assert.Equal(t, nil, s.advance(path, n))
+	_, err = os.Stat(path)
+	assert.T(t, os.IsNotExist(err))
+}
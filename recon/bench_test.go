@@ -0,0 +1,253 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+// benchElement is the i'th of a sequence of distinct elements, spread
+// across the prefix tree.
+func benchElement(i int) *Zp {
+	return Zi(P_SKS, 65537*(i+1))
+}
+
+func benchTree(b *testing.B, n int) *MemPrefixTree {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(benchElement(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return tree
+}
+
+// BenchmarkInsert measures inserting an element into a tree of 100000
+// elements.
+func BenchmarkInsert(b *testing.B) {
+	b.ReportAllocs()
+	const size = 100000
+	tree := benchTree(b, size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tree.Insert(benchElement(size + i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSplit measures the insert which splits a full leaf.
+func BenchmarkSplit(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := new(MemPrefixTree)
+		tree.Init()
+		for j := 0; j <= tree.SplitThreshold(); j++ {
+			tree.Insert(benchElement(j))
+		}
+		if !tree.root.IsLeaf() {
+			b.Fatal("root split early")
+		}
+		b.StartTimer()
+		tree.Insert(benchElement(tree.SplitThreshold() + 1))
+		if tree.root.IsLeaf() {
+			b.Fatal("root not split")
+		}
+	}
+}
+
+// BenchmarkBulkBuild measures building a tree of a million elements,
+// as when loading a keyserver's key hashes.
+func BenchmarkBulkBuild(b *testing.B) {
+	b.ReportAllocs()
+	if testing.Short() {
+		b.Skip("building a million element tree")
+	}
+	for i := 0; i < b.N; i++ {
+		benchTree(b, 1000000)
+	}
+}
+
+// BenchmarkBulkInsertAll measures building the same tree as
+// BenchmarkBulkBuild, inserting 10000 elements at a time.
+func BenchmarkBulkInsertAll(b *testing.B) {
+	b.ReportAllocs()
+	if testing.Short() {
+		b.Skip("building a million element tree")
+	}
+	const size, bulk = 1000000, 10000
+	for i := 0; i < b.N; i++ {
+		tree := new(MemPrefixTree)
+		tree.Init()
+		elements := make([]*Zp, bulk)
+		for j := 0; j < size; j += bulk {
+			for k := range elements {
+				elements[k] = benchElement(j + k)
+			}
+			if err := tree.InsertAll(elements); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func traverse(node PrefixNode) (n int) {
+	node.SValues()
+	children, _ := node.Children()
+	for _, child := range children {
+		n += traverse(child)
+	}
+	return n + 1
+}
+
+// BenchmarkTraverse measures visiting every node of a tree of 100000
+// elements, reading its sample values.
+func BenchmarkTraverse(b *testing.B) {
+	tree := benchTree(b, 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		traverse(tree.root)
+	}
+}
+
+// BenchmarkSValueUpdate measures updating a node's sample values with
+// an element, as insert does at each node on the element's path.
+func BenchmarkSValueUpdate(b *testing.B) {
+	b.ReportAllocs()
+	tree := new(MemPrefixTree)
+	tree.Init()
+	z := benchElement(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		marray := tree.elementVector(z, false)
+		tree.root.updateSvalues(z, marray)
+		tree.vectorPool.Put(marray)
+	}
+}
+
+// BenchmarkWriteMsg measures encoding a ReconRqstPoly, the message
+// the server sends for each node it compares.
+func BenchmarkWriteMsg(b *testing.B) {
+	b.ReportAllocs()
+	tree := benchTree(b, 1000)
+	msg := &ReconRqstPoly{
+		Prefix:  NewBitstring(0),
+		Size:    tree.root.Size(),
+		Samples: mustSValues(b, tree.root)}
+	for i := 0; i < b.N; i++ {
+		if err := WriteMsgDirect(ioutil.Discard, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchConnPair(b *testing.B) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("accept failed")
+	}
+	return conn, dialed
+}
+
+func benchPeer(elements []*Zp) *Peer {
+	p := NewMemPeer()
+	// Recoveries are not applied, so that every session finds the
+	// same difference.
+	p.Settings.Set("conflux.recon.recoverPolicy", "drop")
+	for _, z := range elements {
+		p.PrefixTree.Insert(z)
+	}
+	p.StartCmds()
+	return p
+}
+
+// BenchmarkRecon measures an in-memory recon session between peers
+// holding 10000 common elements, and differing by diff elements, split
+// between them. Sessions are dominated by the server's one second
+// polls for replies, so larger differences take minutes.
+func BenchmarkRecon(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	const common = 10000
+	for _, diff := range []int{0, 1, 10, 100} {
+		b.Run(fmt.Sprintf("diff=%d", diff), func(b *testing.B) {
+			if diff >= 100 && testing.Short() {
+				b.Skip("large difference")
+			}
+			var serverElements, clientElements []*Zp
+			for i := 0; i < common+diff; i++ {
+				z := benchElement(i)
+				if i < common || i%2 == 0 {
+					serverElements = append(serverElements, z)
+				}
+				if i < common || i%2 == 1 {
+					clientElements = append(clientElements, z)
+				}
+			}
+			server, client := benchPeer(serverElements), benchPeer(clientElements)
+			defer server.StopCmds()
+			defer client.StopCmds()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				serverConn, clientConn := benchConnPair(b)
+				b.StartTimer()
+				done := make(chan error)
+				go func() {
+					_, err := server.ReconcileWith(serverConn, RoleServer)
+					done <- err
+				}()
+				_, err := client.ReconcileWith(clientConn, RoleClient)
+				if serr := <-done; serr != nil {
+					err = serr
+				}
+				serverConn.Close()
+				clientConn.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"errors"
+	. "github.com/cmars/conflux"
+	"log"
+	"sync"
+)
+
+// Blacklist lists the digests, in hex, of data which the peer never
+// inserts into its prefix tree, recovers, or offers to remote peers,
+// such as keys known to be abusive. Entries may also be added and
+// removed while the peer runs. Elements are withheld from those sent
+// in full, but remote peers may still interpolate them from the
+// samples of a subtree, so should blacklist them as well.
+func (s *Settings) Blacklist() []string {
+	return s.GetStrings("conflux.recon.blacklist")
+}
+
+var ErrBlacklisted error = errors.New("Element is blacklisted")
+
+// blacklist holds the blacklisted elements, loaded from the settings
+// when first used. The zero value is ready to use.
+type blacklist struct {
+	mu       sync.Mutex
+	loaded   bool
+	elements map[string]bool
+}
+
+func (p *Peer) loadBlacklist() {
+	if p.blacklist.loaded {
+		return
+	}
+	p.blacklist.elements = make(map[string]bool)
+	for _, entry := range p.Settings.Blacklist() {
+		digest, err := hex.DecodeString(entry)
+		if err != nil {
+			log.Println(SERVE, "blacklist:", entry, ":", err)
+			continue
+		}
+		p.blacklist.elements[p.digestZp(digest).String()] = true
+	}
+	p.blacklist.loaded = true
+}
+
+// BlacklistDigest adds the element for a digest to the blacklist.
+// An element already in the prefix tree stays there until removed,
+// but is no longer offered to remote peers.
+func (p *Peer) BlacklistDigest(digest []byte) {
+	z := p.digestZp(digest)
+	p.blacklist.mu.Lock()
+	defer p.blacklist.mu.Unlock()
+	p.loadBlacklist()
+	p.blacklist.elements[z.String()] = true
+}
+
+// UnblacklistDigest removes the element for a digest from the blacklist.
+func (p *Peer) UnblacklistDigest(digest []byte) {
+	z := p.digestZp(digest)
+	p.blacklist.mu.Lock()
+	defer p.blacklist.mu.Unlock()
+	p.loadBlacklist()
+	delete(p.blacklist.elements, z.String())
+}
+
+// Blacklisted returns whether an element is blacklisted.
+func (p *Peer) Blacklisted(z *Zp) bool {
+	p.blacklist.mu.Lock()
+	defer p.blacklist.mu.Unlock()
+	p.loadBlacklist()
+	return p.blacklist.elements[z.String()]
+}
+
+// withoutBlacklisted returns the elements which are not blacklisted.
+func (p *Peer) withoutBlacklisted(elements []*Zp) []*Zp {
+	p.blacklist.mu.Lock()
+	defer p.blacklist.mu.Unlock()
+	p.loadBlacklist()
+	if len(p.blacklist.elements) == 0 {
+		return elements
+	}
+	var result []*Zp
+	for _, z := range elements {
+		if !p.blacklist.elements[z.String()] {
+			result = append(result, z)
+		}
+	}
+	if n := len(elements) - len(result); n > 0 {
+		sessionMetrics.Add("elementsBlacklisted", int64(n))
+	}
+	return result
+}
+
+// stripBlacklisted returns the set without blacklisted elements.
+func (p *Peer) stripBlacklisted(set *ZSet) *ZSet {
+	if set.Len() == 0 {
+		return set
+	}
+	return NewZSet(p.withoutBlacklisted(set.Items())...)
+}
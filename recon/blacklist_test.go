@@ -0,0 +1,65 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+// digestOf returns the digest for which digestZp gives z.
+func digestOf(z *Zp) []byte {
+	buf := z.Bytes()
+	digest := make([]byte, len(buf))
+	for i, b := range buf {
+		digest[len(buf)-1-i] = b
+	}
+	return digest
+}
+
+func TestBlacklist(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	poisoned, other := Zi(P_SKS, 65537*3), Zi(P_SKS, 65537*6)
+	server.Settings.Set("conflux.recon.blacklist", []interface{}{hex.EncodeToString(digestOf(poisoned))})
+	client.BlacklistDigest(digestOf(other))
+	assert.T(t, server.Blacklisted(poisoned))
+	assert.T(t, !server.Blacklisted(other))
+	assert.T(t, client.Blacklisted(other))
+	for i := 1; i < 10; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 == 0 {
+			server.PrefixTree.Insert(z)
+			client.PrefixTree.Insert(Zi(P_SKS, 65537*(i+10)))
+		}
+	}
+	// The server does not offer the poisoned element, and the client
+	// does not recover the other element it has blacklisted
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, s.clientSet.Len())
+	assert.T(t, s.clientSet.Has(Zi(P_SKS, 65537*9)))
+
+	assert.Equal(t, ErrBlacklisted, client.Insert(other))
+	client.UnblacklistDigest(digestOf(other))
+	assert.Equal(t, nil, client.Insert(other))
+}
@@ -0,0 +1,171 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptureDir is a directory in which the raw bytes of each recon
+// session are recorded, for replay when debugging interoperability.
+// Capture is disabled if empty.
+func (s *Settings) CaptureDir() string {
+	return s.GetString("conflux.recon.captureDir", "")
+}
+
+// Direction of captured data.
+const (
+	CaptureReceived = byte(0)
+	CaptureSent     = byte(1)
+)
+
+// captureConn records the data read from and written to a connection.
+// Each record is a direction byte and a big-endian 32-bit length,
+// followed by the data.
+type captureConn struct {
+	net.Conn
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func (c *captureConn) capture(dir byte, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr := make([]byte, 5)
+	hdr[0] = dir
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	c.w.Write(hdr)
+	c.w.Write(b)
+}
+
+func (c *captureConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.capture(CaptureReceived, b[:n])
+	}
+	return
+}
+
+func (c *captureConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.capture(CaptureSent, b[:n])
+	}
+	return
+}
+
+// finish closes the capture, leaving the connection open.
+func (c *captureConn) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Close()
+}
+
+// withCapture records the session on conn to a new file in the capture
+// directory, named for the time and remote address.
+func (p *Peer) withCapture(conn net.Conn, role Role) (*captureConn, error) {
+	name := fmt.Sprintf("%s-%s-%s.cap", time.Now().UTC().Format("20060102T150405.000000000"),
+		role.Name(), strings.Replace(conn.RemoteAddr().String(), ":", "_", -1))
+	f, err := os.Create(filepath.Join(p.CaptureDir(), name))
+	if err != nil {
+		return nil, err
+	}
+	return &captureConn{Conn: conn, w: f}, nil
+}
+
+// ReadCapture reads a session capture, returning the data
+// received and sent by the peer that recorded it.
+func ReadCapture(r io.Reader) (received, sent []byte, err error) {
+	var recvBuf, sentBuf bytes.Buffer
+	hdr := make([]byte, 5)
+	for {
+		if _, err = io.ReadFull(r, hdr); err == io.EOF {
+			return recvBuf.Bytes(), sentBuf.Bytes(), nil
+		} else if err != nil {
+			return
+		}
+		var buf *bytes.Buffer
+		switch hdr[0] {
+		case CaptureReceived:
+			buf = &recvBuf
+		case CaptureSent:
+			buf = &sentBuf
+		default:
+			return nil, nil, errors.New(fmt.Sprintf("Invalid capture direction: %d", hdr[0]))
+		}
+		if _, err = io.CopyN(buf, r, int64(binary.BigEndian.Uint32(hdr[1:]))); err != nil {
+			return
+		}
+	}
+}
+
+// Transcript is one side of a recon session, decoded from a capture.
+type Transcript struct {
+	// Configuration announced
+	Config *Config
+	// RemoteConfigPassed or RemoteConfigFailed
+	Status string
+	// Reason given when the configuration failed
+	Reason string
+	// Messages following the configuration exchange
+	Msgs []ReconMsg
+}
+
+// DecodeTranscript decodes one direction of a captured session.
+// Messages decoded before an error are returned along with it.
+func DecodeTranscript(r io.Reader) (t *Transcript, err error) {
+	t = &Transcript{}
+	msg, err := ReadMsg(r)
+	if err != nil {
+		return
+	}
+	var is bool
+	if t.Config, is = msg.(*Config); !is {
+		return t, errors.New(fmt.Sprintf("Expected config message, got %v", msg))
+	}
+	if t.Status, err = ReadString(r); err != nil {
+		return
+	}
+	if t.Status != RemoteConfigPassed {
+		t.Reason, err = ReadString(r)
+		return
+	}
+	for {
+		msg, err = ReadMsg(r)
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return
+		}
+		t.Msgs = append(t.Msgs, msg)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.captureDir", dir)
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	reconcile(t, server, client)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*-server-*.cap"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(paths))
+	f, err := os.Open(paths[0])
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	received, sent, err := ReadCapture(f)
+	assert.Equal(t, nil, err)
+
+	st, err := DecodeTranscript(bytes.NewBuffer(sent))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, server.Version(), st.Config.Version)
+	assert.Equal(t, server.MBar(), st.Config.MBar)
+	assert.Equal(t, RemoteConfigPassed, st.Status)
+	assert.T(t, len(st.Msgs) > 0)
+	_, is := st.Msgs[len(st.Msgs)-1].(*Done)
+	assert.T(t, is)
+
+	rt, err := DecodeTranscript(bytes.NewBuffer(received))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, client.Settings.BitQuantum(), rt.Config.BitQuantum)
+	assert.Equal(t, RemoteConfigPassed, rt.Status)
+	assert.T(t, len(rt.Msgs) > 0)
+}
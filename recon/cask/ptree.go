@@ -51,7 +51,7 @@ func NewPeer(basepath string, settings *Settings) (p *Peer, err error) {
 		return nil, err
 	}
 	return &Peer{
-		RecoverChan: make(RecoverChan),
+		RecoverChan: make(RecoverChan, settings.RecoverBuffer()),
 		Settings:    settings,
 		PrefixTree:  tree}, nil
 }
@@ -90,7 +90,7 @@ type prefixTree struct {
 
 func newPrefixTree(c *client, s *Settings) (tree *prefixTree, err error) {
 	tree = &prefixTree{client: c, Settings: s}
-	tree.points = Zpoints(P_SKS, tree.NumSamples())
+	tree.points = Zpoints(s.Prime(), tree.NumSamples())
 	tree.ptree, err = gocask.NewGocask(tree.ptreePath)
 	if err != nil {
 		return
@@ -120,6 +120,10 @@ func (t *prefixTree) NumSamples() int     { return t.Settings.NumSamples }
 
 func (t *prefixTree) Points() []*Zp { return t.points }
 
+// Keys returns SKS keys, by which the tree locates elements
+// regardless of the keys setting.
+func (t *prefixTree) Keys() KeyStrategy { return SksKeys }
+
 func (t *prefixTree) Root() (PrefixNode, error) {
 	return t.Node(NewBitstring(0))
 }
@@ -144,8 +148,11 @@ func (t *prefixTree) Node(bs *Bitstring) (node PrefixNode, err error) {
 }
 
 func (t *prefixTree) Insert(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
+	bs := ZpBitstring(z)
+	// Nodes are written on the way down, so the leaf is checked first
+	if err := t.checkLeafInsert(z, bs); err != nil {
+		return err
+	}
 	root, err := t.Root()
 	if err != nil {
 		return err
@@ -153,9 +160,30 @@ func (t *prefixTree) Insert(z *Zp) error {
 	return root.(*prefixNode).insert(z, AddElementArray(t, z), bs, 0)
 }
 
+// checkLeafInsert returns a *CollisionError if the leaf
+// which would hold z cannot.
+func (t *prefixTree) checkLeafInsert(z *Zp, bs *Bitstring) error {
+	leaf, err := Find(t, z)
+	if err != nil {
+		return err
+	}
+	key, err := leaf.Key()
+	if err != nil {
+		return err
+	}
+	elements, err := leaf.Elements()
+	if err != nil {
+		return err
+	}
+	return CheckLeafInsert(t, elements, z, bs, key.BitLen()/t.BitQuantum())
+}
+
 func (t *prefixTree) Remove(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
+	// Nodes are written on the way down, so the leaf is checked first
+	if err := CheckRemove(t, z); err != nil {
+		return err
+	}
+	bs := ZpBitstring(z)
 	root, err := t.Root()
 	if err != nil {
 		return err
@@ -166,22 +194,13 @@ func (t *prefixTree) Remove(z *Zp) error {
 func (t *prefixTree) newChildNode(parent *prefixNode, childIndex int) (*prefixNode, error) {
 	n := &prefixNode{prefixTree: t}
 	if parent != nil {
-		parentKey := parent.Key()
-		n.key = NewBitstring(parentKey.BitLen() + t.BitQuantum())
-		n.key.SetBytes(parentKey.Bytes())
-		for j := 0; j < parent.BitQuantum(); j++ {
-			if (childIndex>>uint(j))&0x1 == 1 {
-				n.key.Set(parentKey.BitLen() + j)
-			} else {
-				n.key.Unset(parentKey.BitLen() + j)
-			}
-		}
+		n.key = parent.key.AppendUint(uint(childIndex), parent.BitQuantum())
 	} else {
 		n.key = NewBitstring(0)
 	}
 	n.svalues = make([]*Zp, t.NumSamples())
 	for i := 0; i < len(n.svalues); i++ {
-		n.svalues[i] = Zi(P_SKS, 1)
+		n.svalues[i] = Zi(TreePrime(t), 1)
 	}
 	err := t.saveNode(n)
 	return n, err
@@ -194,11 +213,11 @@ func (t *prefixTree) loadNode(nd *nodeData) (n *prefixNode, err error) {
 		return
 	}
 	n.numElements = nd.NumElements
-	n.svalues, err = ReadZZarray(bytes.NewBuffer(nd.SvaluesBuf))
+	n.svalues, err = ReadZZarray(NewFieldReader(bytes.NewBuffer(nd.SvaluesBuf), TreePrime(t)))
 	if err != nil {
 		return
 	}
-	n.elements, err = ReadZZarray(bytes.NewBuffer(nd.ElementsBuf))
+	n.elements, err = ReadZZarray(NewFieldReader(bytes.NewBuffer(nd.ElementsBuf), TreePrime(t)))
 	if err != nil {
 		return
 	}
@@ -226,6 +245,9 @@ func (t *prefixTree) saveNode(n *prefixNode) (err error) {
 	// Write elements
 	out = bytes.NewBuffer(nil)
 	err = WriteZZarray(out, n.elements)
+	if err != nil {
+		return
+	}
 	nd.ElementsBuf = out.Bytes()
 	nd.NumElements = n.numElements
 	nd.ChildKeys = n.childKeys
@@ -239,6 +261,9 @@ func (t *prefixTree) saveNode(n *prefixNode) (err error) {
 	return
 }
 
+// nodeData is the gob-encoded form in which a node is stored. Gob
+// matches fields by name, so renaming a field loses its value in
+// nodes already stored.
 type nodeData struct {
 	KeyBuf      []byte
 	NumElements int
@@ -260,52 +285,56 @@ func (n *prefixNode) IsLeaf() bool {
 	return len(n.childKeys) == 0
 }
 
-func (n *prefixNode) Children() (result []PrefixNode) {
-	key := n.Key()
+func (n *prefixNode) Children() ([]PrefixNode, error) {
+	var result []PrefixNode
 	for _, i := range n.childKeys {
-		childKey := NewBitstring(key.BitLen() + n.BitQuantum())
-		childKey.SetBytes(key.Bytes())
-		for j := 0; j < n.BitQuantum(); j++ {
-			if (i>>uint(j))&0x1 == 1 {
-				childKey.Set(key.BitLen() + j)
-			} else {
-				childKey.Unset(key.BitLen() + j)
-			}
-		}
+		childKey := n.key.AppendUint(uint(i), n.BitQuantum())
 		child, err := n.Node(childKey)
 		if err != nil {
-			panic(fmt.Sprintf("Children failed on child#%v: %v", i, err))
+			return nil, errors.New(fmt.Sprintf("Children failed on child#%v: %v", i, err))
 		}
 		result = append(result, child)
 	}
-	return
+	return result, nil
 }
 
-func (n *prefixNode) Elements() []*Zp {
-	return n.elements
+// nextChild returns the child whose key is a prefix of bs.
+func (n *prefixNode) nextChild(bs *Bitstring, depth int) (*prefixNode, error) {
+	i, err := NextChild(n, bs, depth)
+	if err != nil {
+		return nil, err
+	}
+	child, err := n.Node(n.key.AppendUint(uint(i), n.BitQuantum()))
+	if err != nil {
+		return nil, err
+	}
+	return child.(*prefixNode), nil
+}
+
+func (n *prefixNode) Elements() ([]*Zp, error) {
+	return n.elements, nil
 }
 
 func (n *prefixNode) Size() int { return n.numElements }
 
-func (n *prefixNode) SValues() []*Zp {
-	return n.svalues
+func (n *prefixNode) SValues() ([]*Zp, error) {
+	return n.svalues, nil
 }
 
-func (n *prefixNode) Key() *Bitstring {
-	return n.key
+func (n *prefixNode) Key() (*Bitstring, error) {
+	return n.key, nil
 }
 
-func (n *prefixNode) Parent() (PrefixNode, bool) {
+func (n *prefixNode) Parent() (PrefixNode, bool, error) {
 	if n.key.BitLen() == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	parentKey := NewBitstring(n.key.BitLen() - n.BitQuantum())
-	parentKey.SetBytes(n.key.Bytes())
+	parentKey := n.key.Prefix(n.key.BitLen() - n.BitQuantum())
 	parent, err := n.Node(parentKey)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to get parent: %v", err))
+		return nil, false, errors.New(fmt.Sprintf("Failed to get parent: %v", err))
 	}
-	return parent, true
+	return parent, true, nil
 }
 
 func (n *prefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) (err error) {
@@ -324,7 +353,10 @@ func (n *prefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) (err
 		}
 	}
 	n.saveNode(n)
-	child := NextChild(n, bs, depth).(*prefixNode)
+	child, err := n.nextChild(bs, depth)
+	if err != nil {
+		return err
+	}
 	return child.insert(z, marray, bs, depth+1)
 }
 
@@ -341,9 +373,11 @@ func (n *prefixNode) split(depth int) (err error) {
 	}
 	// Move elements into child nodes
 	for _, element := range n.elements {
-		bs := NewBitstring(P_SKS.BitLen())
-		bs.SetBytes(ReverseBytes(element.Bytes()))
-		child := NextChild(n, bs, depth).(*prefixNode)
+		bs := ZpBitstring(element)
+		child, err := n.nextChild(bs, depth)
+		if err != nil {
+			return err
+		}
 		child.insert(element, AddElementArray(n.prefixTree, element), bs, depth+1)
 	}
 	n.elements = nil
@@ -364,10 +398,15 @@ func (n *prefixNode) remove(z *Zp, marray []*Zp, bs *Bitstring, depth int) error
 	n.numElements--
 	if !n.IsLeaf() {
 		if n.numElements <= n.JoinThreshold() {
-			n.join()
+			if err := n.join(); err != nil {
+				return err
+			}
 		} else {
 			n.saveNode(n)
-			child := NextChild(n, bs, depth).(*prefixNode)
+			child, err := n.nextChild(bs, depth)
+			if err != nil {
+				return err
+			}
 			return child.remove(z, marray, bs, depth+1)
 		}
 	}
@@ -376,24 +415,29 @@ func (n *prefixNode) remove(z *Zp, marray []*Zp, bs *Bitstring, depth int) error
 	return nil
 }
 
-func (n *prefixNode) join() {
-	for _, child := range n.Children() {
-		n.elements = append(n.elements, child.Elements()...)
+func (n *prefixNode) join() error {
+	children, err := n.Children()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		elements, err := child.Elements()
+		if err != nil {
+			return err
+		}
+		n.elements = append(n.elements, elements...)
 	}
 	n.childKeys = nil
+	return nil
 }
 
+// withRemoved returns elements without z, which has been checked
+// to be among them.
 func withRemoved(elements []*Zp, z *Zp) (result []*Zp) {
-	var has bool
 	for _, element := range elements {
 		if element.Cmp(z) != 0 {
 			result = append(result, element)
-		} else {
-			has = true
 		}
 	}
-	if !has {
-		panic("Remove non-existent element from node")
-	}
 	return
 }
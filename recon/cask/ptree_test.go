@@ -5,6 +5,7 @@ import (
 	"github.com/bmizerany/assert"
 	. "github.com/cmars/conflux"
 	. "github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/storetest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -35,14 +36,14 @@ func TestInsertNodesNoSplit(t *testing.T) {
 	peer.PrefixTree.Insert(Zi(P_SKS, 500))
 	root, err := peer.PrefixTree.Root()
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, len(root.Elements()))
+	assert.Equal(t, 3, len(storetest.MustElements(t, root)))
 	assert.T(t, root.IsLeaf())
 	peer.PrefixTree.Remove(Zi(P_SKS, 100))
 	peer.PrefixTree.Remove(Zi(P_SKS, 300))
 	peer.PrefixTree.Remove(Zi(P_SKS, 500))
 	root, err = peer.PrefixTree.Root()
-	assert.Equal(t, 0, len(root.Elements()))
-	for _, sv := range root.SValues() {
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
 }
@@ -65,7 +66,7 @@ func TestJustOneKey(t *testing.T) {
 	}
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.T(t, expect.Has(sv))
 		expect.Remove(sv)
 	}
@@ -92,11 +93,11 @@ func TestInsertNodeSplit(t *testing.T) {
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
 	// Insert/Remove reversible after splitting & joining?
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
-	assert.Equal(t, 0, len(root.Children()))
-	assert.Equal(t, 0, len(root.Elements()))
+	assert.Equal(t, 0, len(storetest.MustChildren(t, root)))
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
 }
 
 /*
@@ -128,10 +129,10 @@ func TestKeyMatch(t *testing.T) {
 		assert.Equal(t, err, nil)
 		node2, err := Find(tree2, zi)
 		assert.Equal(t, err, nil)
-		t.Logf("node1=%v, node2=%v (%b) full=%v", node1.Key(), node2.Key(), zi.Int64(), bs)
+		t.Logf("node1=%v, node2=%v (%b) full=%v", storetest.MustKey(t, node1), storetest.MustKey(t, node2), zi.Int64(), bs)
 		// If keys are different, one must prefix the other.
-		assert.T(t, strings.HasPrefix(node1.Key().String(), node2.Key().String()) ||
-			strings.HasPrefix(node2.Key().String(), node1.Key().String()))
+		assert.T(t, storetest.MustKey(t, node1).HasPrefix(storetest.MustKey(t, node2)) ||
+			storetest.MustKey(t, node2).HasPrefix(storetest.MustKey(t, node1)))
 	}
 }
 */
@@ -0,0 +1,350 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"log"
+	"net"
+	"sync"
+)
+
+// CatchUp enables catching up with trusted peers from the change log,
+// exchanging only the changes each has made since the last session,
+// rather than reconciling the prefix trees. Peers reconcile in full
+// when they have not caught up before, or the change log has a gap.
+// Catching up requires a ChangeLog, to which all changes to the
+// prefix tree are made through the peer, and a NodeId.
+func (s *Settings) CatchUp() bool {
+	return s.GetBool("conflux.recon.catchUp", false)
+}
+
+// CatchUpTrusted lists the hosts of the peers whose change logs are
+// trusted for catching up.
+func (s *Settings) CatchUpTrusted() []string {
+	return s.GetStrings("conflux.recon.catchUpTrusted")
+}
+
+// NodeId identifies the peer to those catching up from its change
+// log, which remember the last change seen from each peer by its id.
+// Peers which do not announce one are not caught up with.
+func (s *Settings) NodeId() string {
+	return s.GetString("conflux.recon.nodeId", "")
+}
+
+// remoteNodeId returns the id announced by a remote peer,
+// which is empty if none was given.
+func remoteNodeId(config *Config) string {
+	return config.Custom["node"]
+}
+
+// CatchUpMax is the most changes sent in a catch-up. Peers with more
+// changes to catch up on reconcile in full.
+func (s *Settings) CatchUpMax() int {
+	return s.GetInt("conflux.recon.catchUpMax", 10000)
+}
+
+// CatchUpStrategy exchanges the changes made since the last session
+// between trusted peers, falling back to PtreeStrategy otherwise.
+var CatchUpStrategy ReconStrategy = &reconStrategyFuncs{
+	name: "catchup",
+	serve: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		recovered, ok, err := p.catchUp(conn, remoteConfig, RoleServer)
+		if err != nil || ok {
+			return recovered, err
+		}
+		recovered, err = PtreeStrategy.Serve(p, conn, remoteConfig)
+		if err == nil {
+			p.caughtUp.reconciled(remoteNodeId(remoteConfig))
+		}
+		return recovered, err
+	},
+	initiate: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		recovered, ok, err := p.catchUp(conn, remoteConfig, RoleClient)
+		if err != nil || ok {
+			return recovered, err
+		}
+		recovered, err = PtreeStrategy.Initiate(p, conn, remoteConfig)
+		if err == nil {
+			p.caughtUp.reconciled(remoteNodeId(remoteConfig))
+		}
+		return recovered, err
+	}}
+
+// catchUpState remembers the last change seen from each trusted peer,
+// by the id it announces. The zero value is ready to use.
+type catchUpState struct {
+	mu   sync.Mutex
+	seen map[string]uint64
+	// Heads announced in sessions falling back to reconciliation
+	heads map[string]uint64
+}
+
+func (c *catchUpState) get(id string) (seq uint64, known bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq, known = c.seen[id]
+	return
+}
+
+func (c *catchUpState) set(id string, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]uint64)
+	}
+	c.seen[id] = seq
+}
+
+// forget drops the last change seen from a peer, so that
+// the next session with it reconciles in full.
+func (c *catchUpState) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, id)
+}
+
+// fallback remembers the head of the remote peer's change log when
+// falling back to reconciliation, which once complete has seen it.
+func (c *catchUpState) fallback(id string, head uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.heads == nil {
+		c.heads = make(map[string]uint64)
+	}
+	c.heads[id] = head
+}
+
+func (c *catchUpState) reconciled(id string) {
+	c.mu.Lock()
+	head, has := c.heads[id]
+	delete(c.heads, id)
+	c.mu.Unlock()
+	if has {
+		c.set(id, head)
+	}
+}
+
+// trusted returns whether the peer trusts the change log of a remote peer.
+func (p *Peer) trusted(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	host := trafficHost(addr.String())
+	for _, trusted := range p.CatchUpTrusted() {
+		if trusted == host {
+			return true
+		}
+	}
+	return false
+}
+
+// catchUpRqst requests the changes after the last seen from the
+// remote peer, if it is trusted and has announced its id.
+func (p *Peer) catchUpRqst(addr net.Addr, id string) *CatchUpRqst {
+	if !p.trusted(addr) || id == "" {
+		return &CatchUpRqst{}
+	}
+	seq, known := p.caughtUp.get(id)
+	return &CatchUpRqst{Known: known, Seq: seq}
+}
+
+// catchUpRepl answers a request for changes. Changes cannot be sent
+// to untrusted peers, nor to those which have not caught up before,
+// nor when the change log has a gap, cannot be read, or has too many
+// changes to send.
+func (p *Peer) catchUpRepl(addr net.Addr, rqst *CatchUpRqst) (*CatchUpRepl, error) {
+	repl := &CatchUpRepl{Head: p.ChangeLog.Seq()}
+	if !rqst.Known || !p.trusted(addr) || rqst.Seq > repl.Head {
+		return repl, nil
+	}
+	changes, err := p.ChangeLog.Since(p.prime(), rqst.Seq)
+	if err != nil {
+		log.Println("catch up: change log:", err)
+		return repl, nil
+	}
+	if len(changes) > p.CatchUpMax() {
+		return repl, nil
+	}
+	for i, change := range changes {
+		if change.Seq != rqst.Seq+uint64(i)+1 {
+			log.Println("catch up: gap in change log at", rqst.Seq+uint64(i)+1)
+			return repl, nil
+		}
+	}
+	repl.Ok = true
+	for _, change := range changes {
+		if change.Op != ChangeInsert || !p.Blacklisted(change.Element) {
+			repl.Changes = append(repl.Changes, change)
+		}
+	}
+	return repl, nil
+}
+
+// catchUp exchanges changes with the remote peer. The server requests
+// the changes it lacks first, then the client. If either cannot send
+// them, ok is false, and the peers reconcile in full. The changes
+// recovered are seen once delivered to RecoverChan, and otherwise the
+// next session reconciles in full.
+func (p *Peer) catchUp(conn net.Conn, remoteConfig *Config, role Role) (recovered []*Zp, ok bool, err error) {
+	id := remoteNodeId(remoteConfig)
+	var local, remote *CatchUpRepl
+	switch role {
+	case RoleServer:
+		if remote, err = p.requestChanges(conn, id); err != nil {
+			return
+		}
+		if local, err = p.serveChanges(conn); err != nil {
+			return
+		}
+	case RoleClient:
+		if local, err = p.serveChanges(conn); err != nil {
+			return
+		}
+		if remote, err = p.requestChanges(conn, id); err != nil {
+			return
+		}
+	}
+	if !local.Ok || !remote.Ok {
+		if id != "" && p.trusted(conn.RemoteAddr()) {
+			p.caughtUp.fallback(id, remote.Head)
+		}
+		return nil, false, nil
+	}
+	if err = p.checkRemoteP(changeElements(remote.Changes)...); err != nil {
+		return
+	}
+	var removed []*Zp
+	recovered, removed, err = p.applicableChanges(remote.Changes)
+	if err != nil {
+		return
+	}
+	if !p.recovers(remoteConfig) {
+		p.caughtUp.set(id, remote.Head)
+		return recovered, true, nil
+	}
+	if recovered = p.dedupRecovered(recovered); len(recovered) == 0 && len(removed) == 0 {
+		p.caughtUp.set(id, remote.Head)
+		return recovered, true, nil
+	}
+	head := remote.Head
+	p.recover(conn, &Recover{
+		RemoteAddr:     conn.RemoteAddr(),
+		RemoteConfig:   remoteConfig,
+		RemoteElements: recovered,
+		RemoteRemoved:  removed,
+		Namespace:      p.namespace,
+		sent: func(delivered bool) {
+			if delivered {
+				p.caughtUp.set(id, head)
+			} else {
+				p.caughtUp.forget(id)
+			}
+		}})
+	return recovered, true, nil
+}
+
+// RecoverFailed reports a recovery which the consumer of RecoverChan
+// could not apply. Peers which caught up on the changes recovered
+// reconcile in full in their next session, so that none is lost.
+func (p *Peer) RecoverFailed(r *Recover) {
+	if ns, has := p.namespaces[r.Namespace]; has {
+		p = ns
+	}
+	if r.RemoteConfig != nil {
+		p.caughtUp.forget(remoteNodeId(r.RemoteConfig))
+	}
+}
+
+func (p *Peer) requestChanges(conn net.Conn, id string) (*CatchUpRepl, error) {
+	if err := WriteMsg(conn, p.catchUpRqst(conn.RemoteAddr(), id)); err != nil {
+		return nil, err
+	}
+	msg, err := ReadMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	repl, is := msg.(*CatchUpRepl)
+	if !is {
+		return nil, errors.New(fmt.Sprintf("Expected catch up reply, got %v", msg))
+	}
+	return repl, nil
+}
+
+func (p *Peer) serveChanges(conn net.Conn) (*CatchUpRepl, error) {
+	msg, err := ReadMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	rqst, is := msg.(*CatchUpRqst)
+	if !is {
+		return nil, errors.New(fmt.Sprintf("Expected catch up request, got %v", msg))
+	}
+	repl, err := p.catchUpRepl(conn.RemoteAddr(), rqst)
+	if err != nil {
+		return nil, err
+	}
+	return repl, WriteMsg(conn, repl)
+}
+
+func changeElements(changes []*Change) (elements []*Zp) {
+	for _, change := range changes {
+		elements = append(elements, change.Element)
+	}
+	return
+}
+
+// applicableChanges returns the elements last inserted by the remote
+// peer which are not in the prefix tree, and those last removed which
+// are.
+func (p *Peer) applicableChanges(changes []*Change) (inserted, removed []*Zp, err error) {
+	last := make(map[string]*Change)
+	var order []string
+	for _, change := range changes {
+		k := change.Element.String()
+		if _, has := last[k]; !has {
+			order = append(order, k)
+		}
+		last[k] = change
+	}
+	for _, k := range order {
+		change := last[k]
+		node, err := Find(p.PrefixTree, change.Element)
+		if err != nil {
+			return nil, nil, err
+		}
+		elements, err := node.Elements()
+		if err != nil {
+			return nil, nil, err
+		}
+		has := NewZSet(elements...).Has(change.Element)
+		switch {
+		case change.Op == ChangeInsert && !has:
+			inserted = append(inserted, change.Element)
+		case change.Op == ChangeRemove && has:
+			removed = append(removed, change.Element)
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newCatchUpPeer creates a peer catching up from the trusted hosts,
+// with its change log kept in dir.
+func newCatchUpPeer(t *testing.T, dir, name string, trusted ...string) *Peer {
+	p := newTestPeer(
+		"conflux.recon.catchUp", true,
+		"conflux.recon.nodeId", name,
+		"conflux.recon.catchUpTrusted", trusted)
+	changeLog, err := OpenFileChangeLog(filepath.Join(dir, name))
+	assert.Equal(t, nil, err)
+	p.ChangeLog = changeLog
+	startCmds(p)
+	return p
+}
+
+func TestCatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	server := newCatchUpPeer(t, dir, "server", "127.0.0.1")
+	client := newCatchUpPeer(t, dir, "client", "127.0.0.1")
+	for i := 1; i < 50; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 != 0 {
+			assert.Equal(t, nil, server.Insert(z))
+		}
+		if i%4 != 0 {
+			assert.Equal(t, nil, client.Insert(z))
+		}
+	}
+	// The first session reconciles in full
+	s := reconcile(t, server, client)
+	assert.Equal(t, CatchUpStrategy.Name(), s.cs.Strategy)
+	assert.Equal(t, 49/4-49/12, s.cs.Recovered)
+	for _, z := range s.clientSet.Items() {
+		assert.Equal(t, nil, client.Insert(z))
+	}
+	// Later sessions exchange only the changes made since
+	added, removed := Zi(P_SKS, 65537*100), Zi(P_SKS, 65537)
+	assert.Equal(t, nil, server.Insert(added))
+	assert.Equal(t, nil, server.Remove(removed))
+	s = reconcile(t, server, client)
+	assert.Equal(t, 1, s.cs.Recovered)
+	cr := s.clientRecovered[0]
+	assert.Equal(t, 1, len(cr.RemoteElements))
+	assert.Equal(t, 0, added.Cmp(cr.RemoteElements[0]))
+	assert.Equal(t, 1, len(cr.RemoteRemoved))
+	assert.Equal(t, 0, removed.Cmp(cr.RemoteRemoved[0]))
+	assert.T(t, s.cs.MsgsReceived < 5)
+}
+
+func TestCatchUpUntrusted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	server := newCatchUpPeer(t, dir, "server", "127.0.0.1")
+	client := newCatchUpPeer(t, dir, "client")
+	assert.Equal(t, nil, server.Insert(Zi(P_SKS, 65537)))
+	for i := 0; i < 2; i++ {
+		s := reconcile(t, server, client)
+		assert.Equal(t, 1, s.cs.Recovered)
+		assert.Equal(t, 0, len(s.clientRecovered[0].RemoteRemoved))
+	}
+}
+
+func TestCatchUpGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	p := newCatchUpPeer(t, dir, "peer", "127.0.0.1")
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65537)))
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11370}
+	repl, err := p.catchUpRepl(addr, &CatchUpRqst{Known: true, Seq: 0})
+	assert.Equal(t, nil, err)
+	assert.T(t, repl.Ok)
+	assert.Equal(t, 1, len(repl.Changes))
+	// The remote peer has seen changes the log does not have
+	repl, err = p.catchUpRepl(addr, &CatchUpRqst{Known: true, Seq: 5})
+	assert.Equal(t, nil, err)
+	assert.T(t, !repl.Ok)
+	assert.Equal(t, uint64(1), repl.Head)
+	p.Settings.Set("conflux.recon.catchUpMax", 0)
+	repl, err = p.catchUpRepl(addr, &CatchUpRqst{Known: true, Seq: 0})
+	assert.Equal(t, nil, err)
+	assert.T(t, !repl.Ok)
+}
+
+func TestCatchUpNodeIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	client := newCatchUpPeer(t, dir, "client", "127.0.0.1")
+	a := newCatchUpPeer(t, dir, "a", "127.0.0.1")
+	b := newCatchUpPeer(t, dir, "b", "127.0.0.1")
+	for i := 1; i < 10; i++ {
+		assert.Equal(t, nil, b.Insert(Zi(P_SKS, 65537*i)))
+	}
+	for _, server := range []*Peer{a, b} {
+		s := reconcile(t, server, client)
+		for _, z := range s.clientSet.Items() {
+			assert.Equal(t, nil, client.Insert(z))
+		}
+	}
+	// Peers behind one address are caught up with apart
+	seq, known := client.caughtUp.get("a")
+	assert.T(t, known)
+	assert.Equal(t, uint64(0), seq)
+	seq, known = client.caughtUp.get("b")
+	assert.T(t, known)
+	assert.Equal(t, uint64(9), seq)
+	z := Zi(P_SKS, 65537*100)
+	assert.Equal(t, nil, b.Insert(z))
+	s := reconcile(t, b, client)
+	assert.Equal(t, 1, s.cs.Recovered)
+	assert.Equal(t, 0, z.Cmp(s.clientRecovered[0].RemoteElements[0]))
+	// Peers announcing no id are not caught up with
+	b.Settings.Set("conflux.recon.nodeId", "")
+	assert.Equal(t, nil, b.Remove(z))
+	for i := 0; i < 2; i++ {
+		s = reconcile(t, b, client)
+		for _, cr := range s.clientRecovered {
+			assert.Equal(t, 0, len(cr.RemoteRemoved))
+		}
+	}
+}
+
+func TestCatchUpUndelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	server := newCatchUpPeer(t, dir, "server", "127.0.0.1")
+	client := newCatchUpPeer(t, dir, "client", "127.0.0.1")
+	reconcile(t, server, client)
+	_, known := client.caughtUp.get("server")
+	assert.T(t, known)
+	z := Zi(P_SKS, 65537)
+	assert.Equal(t, nil, server.Insert(z))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, s.cs.Recovered)
+	seq, _ := client.caughtUp.get("server")
+	assert.Equal(t, uint64(1), seq)
+	// A recovery the consumer failed to apply is reconciled in full
+	client.RecoverFailed(s.clientRecovered[0])
+	_, known = client.caughtUp.get("server")
+	assert.T(t, !known)
+	s = reconcile(t, server, client)
+	assert.Equal(t, 1, s.cs.Recovered)
+	seq, known = client.caughtUp.get("server")
+	assert.T(t, known)
+	assert.Equal(t, uint64(1), seq)
+	// Recoveries dropped are reported undelivered
+	client.Settings.Set("conflux.recon.recoverPolicy", "drop")
+	var delivered []bool
+	ok := client.sendRecover(&Recover{
+		RemoteElements: []*Zp{z},
+		sent:           func(ok bool) { delivered = append(delivered, ok) }})
+	assert.T(t, !ok)
+	assert.Equal(t, []bool{false}, delivered)
+}
@@ -0,0 +1,329 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeLogPath is the file to which elements inserted and removed
+// through the peer are logged. The change log is disabled if empty.
+func (s *Settings) ChangeLogPath() string {
+	return s.GetString("conflux.recon.changeLog", "")
+}
+
+// ChangeOp is a mutation of the prefix tree.
+type ChangeOp byte
+
+const (
+	ChangeInsert = ChangeOp('+')
+	ChangeRemove = ChangeOp('-')
+)
+
+// Change records an element inserted into or removed from the
+// prefix tree. Changes are numbered in the order they were made.
+type Change struct {
+	Seq     uint64
+	Time    time.Time
+	Op      ChangeOp
+	Element *Zp
+}
+
+// String formats the change as it is logged: the sequence number, the
+// time in Unix nanoseconds, the operation and the element in hex.
+func (c *Change) String() string {
+	return fmt.Sprintf("%d %d %c %x", c.Seq, c.Time.UnixNano(), c.Op, c.Element.Bytes())
+}
+
+// parseChange parses a logged change, with elements in the field p.
+func parseChange(line string, p *big.Int) (*Change, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || len(fields[2]) != 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid change: %q", line))
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	nanos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	op := ChangeOp(fields[2][0])
+	if op != ChangeInsert && op != ChangeRemove {
+		return nil, errors.New(fmt.Sprintf("Invalid change operation: %q", line))
+	}
+	buf, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	return &Change{Seq: seq, Time: time.Unix(0, nanos), Op: op, Element: Zb(p, buf)}, nil
+}
+
+// ReadChanges reads the changes logged after seq, with elements in
+// the field p. Lines numbered up to seq are skipped without parsing.
+func ReadChanges(r io.Reader, p *big.Int, seq uint64) (changes []*Change, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if lineSeq, err := strconv.ParseUint(fields[0], 10, 64); err == nil && lineSeq <= seq {
+			continue
+		}
+		change, err := parseChange(scanner.Text(), p)
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
+
+// ChangeLog is an append-only record of changes to the prefix tree.
+type ChangeLog interface {
+	// Append records a change, numbering it after the last.
+	Append(op ChangeOp, z *Zp) (*Change, error)
+	// Seq returns the sequence number of the last change.
+	Seq() uint64
+	// Since returns the changes after seq, with elements in the field p.
+	Since(p *big.Int, seq uint64) ([]*Change, error)
+}
+
+// changeIndexInterval is the number of changes between those whose
+// offsets in the file are indexed.
+const changeIndexInterval = 1024
+
+// changeOffset is the offset in the file of a logged change.
+type changeOffset struct {
+	seq    uint64
+	offset int64
+}
+
+// FileChangeLog appends changes to a file, one per line. Sequence
+// numbers continue from the last change in the file.
+//
+// A change which fails to be written still takes its sequence number,
+// leaving a gap in the log from which catching up falls back to
+// reconciliation.
+type FileChangeLog struct {
+	// Keep is the number of changes kept in the file once it holds
+	// twice as many, when older changes are compacted away. Zero
+	// keeps all changes.
+	Keep int
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64
+	size    int64
+	count   int
+	partial bool
+	index   []changeOffset
+}
+
+func OpenFileChangeLog(path string) (*FileChangeLog, error) {
+	l := &FileChangeLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file and indexes the changes in it.
+func (l *FileChangeLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.size, l.count, l.partial, l.index = 0, 0, false, nil
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			// Left by a failed write
+			l.partial = true
+		}
+		if fields := strings.Fields(line); len(fields) == 4 {
+			if seq, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+				l.indexChange(seq, l.size)
+			}
+		}
+		l.size += int64(len(line))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	l.file = file
+	return nil
+}
+
+// indexChange counts a change logged at offset, indexing the first
+// of every changeIndexInterval.
+func (l *FileChangeLog) indexChange(seq uint64, offset int64) {
+	if l.count%changeIndexInterval == 0 {
+		l.index = append(l.index, changeOffset{seq: seq, offset: offset})
+	}
+	l.count++
+	l.seq = seq
+}
+
+func (l *FileChangeLog) Append(op ChangeOp, z *Zp) (*Change, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	change := &Change{Seq: l.seq + 1, Time: time.Now(), Op: op, Element: z}
+	line := change.String() + "\n"
+	offset := l.size
+	if l.partial {
+		// Terminate what a failed write left behind
+		line = "\n" + line
+		offset++
+	}
+	n, err := l.file.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		l.seq = change.Seq
+		l.partial = n > 0 || l.partial
+		return nil, err
+	}
+	l.partial = false
+	l.indexChange(change.Seq, offset)
+	if l.Keep > 0 && l.count >= 2*l.Keep {
+		if err = l.compact(); err != nil {
+			log.Println(SERVE, "change log compaction:", err)
+		}
+	}
+	return change, nil
+}
+
+// compact rewrites the file with only the last Keep changes.
+func (l *FileChangeLog) compact() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := os.Create(l.path + ".compact")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		seq, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil || seq+uint64(l.Keep) <= l.seq {
+			continue
+		}
+		if _, err = w.WriteString(scanner.Text() + "\n"); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+	seq := l.seq
+	l.file.Close()
+	err = l.open()
+	// Gaps at the end of the log are kept in its numbering
+	l.seq = seq
+	return err
+}
+
+// Seq returns the sequence number of the last change logged.
+func (l *FileChangeLog) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Since reads the changes logged after seq, with elements in the
+// field p, such as to catch up a follower from the last change it saw.
+// Reading starts from the last indexed change before them.
+func (l *FileChangeLog) Since(p *big.Int, seq uint64) ([]*Change, error) {
+	l.mu.Lock()
+	var offset int64
+	for _, indexed := range l.index {
+		if indexed.seq > seq+1 {
+			break
+		}
+		offset = indexed.offset
+	}
+	f, err := os.Open(l.path)
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ReadChanges(f, p, seq)
+}
+
+func (l *FileChangeLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// logChange records a change made through the peer to its ChangeLog.
+func (p *Peer) logChange(op ChangeOp, z *Zp) {
+	if p.ChangeLog == nil {
+		return
+	}
+	if _, err := p.ChangeLog.Append(op, z); err != nil {
+		log.Println(SERVE, "change log:", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes")
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.changeLog", path)
+	changeLog, err := OpenFileChangeLog(p.ChangeLogPath())
+	assert.Equal(t, nil, err)
+	p.ChangeLog = changeLog
+	startCmds(p)
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65537)))
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, p.Remove(Zi(P_SKS, 65537)))
+	// Failed changes are not logged
+	assert.NotEqual(t, nil, p.Remove(Zi(P_SKS, 65541)))
+	assert.Equal(t, uint64(3), changeLog.Seq())
+	changeLog.Close()
+
+	// Sequence numbers continue when the log is reopened
+	changeLog, err = OpenFileChangeLog(path)
+	assert.Equal(t, nil, err)
+	defer changeLog.Close()
+	assert.Equal(t, uint64(3), changeLog.Seq())
+	change, err := changeLog.Append(ChangeInsert, Zi(P_SKS, 65543))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(4), change.Seq)
+
+	changes, err := changeLog.Since(P_SKS, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, uint64(2), changes[0].Seq)
+	assert.Equal(t, ChangeInsert, changes[0].Op)
+	assert.Equal(t, 0, changes[0].Element.Cmp(Zi(P_SKS, 65539)))
+	assert.Equal(t, ChangeRemove, changes[1].Op)
+	assert.Equal(t, 0, changes[1].Element.Cmp(Zi(P_SKS, 65537)))
+	assert.T(t, !changes[2].Time.Before(changes[1].Time))
+}
+
+func TestChangeLogGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes")
+	changeLog, err := OpenFileChangeLog(path)
+	assert.Equal(t, nil, err)
+	defer changeLog.Close()
+	_, err = changeLog.Append(ChangeInsert, Zi(P_SKS, 65537))
+	assert.Equal(t, nil, err)
+
+	// A change which fails to be written takes its sequence number
+	file := changeLog.file
+	changeLog.file, err = os.Open(path)
+	assert.Equal(t, nil, err)
+	_, err = changeLog.Append(ChangeInsert, Zi(P_SKS, 65539))
+	assert.NotEqual(t, nil, err)
+	changeLog.file.Close()
+	changeLog.file = file
+	assert.Equal(t, uint64(2), changeLog.Seq())
+	change, err := changeLog.Append(ChangeInsert, Zi(P_SKS, 65541))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(3), change.Seq)
+
+	// Catching up across the gap falls back to reconciliation
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.catchUpTrusted", []interface{}{"127.0.0.1"})
+	p.ChangeLog = changeLog
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11370}
+	repl, err := p.catchUpRepl(addr, &CatchUpRqst{Known: true, Seq: 1})
+	assert.Equal(t, nil, err)
+	assert.T(t, !repl.Ok)
+	repl, err = p.catchUpRepl(addr, &CatchUpRqst{Known: true, Seq: 2})
+	assert.Equal(t, nil, err)
+	assert.T(t, repl.Ok)
+	assert.Equal(t, 1, len(repl.Changes))
+}
+
+func TestChangeLogCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes")
+	changeLog, err := OpenFileChangeLog(path)
+	assert.Equal(t, nil, err)
+	changeLog.Keep = 1500
+	n := 3*changeIndexInterval + 5
+	for i := 0; i < n; i++ {
+		_, err = changeLog.Append(ChangeInsert, Zi(P_SKS, 65537+i))
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, uint64(n), changeLog.Seq())
+	// Compacted at 3000 changes to the last 1500
+	assert.Equal(t, n-1500, changeLog.count)
+	changes, err := changeLog.Since(P_SKS, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n-1500, len(changes))
+	assert.Equal(t, uint64(1501), changes[0].Seq)
+
+	changes, err = changeLog.Since(P_SKS, uint64(n-3))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, uint64(n-2), changes[0].Seq)
+	assert.Equal(t, 0, changes[2].Element.Cmp(Zi(P_SKS, 65537+n-1)))
+	changeLog.Close()
+
+	// Reopened logs are indexed again
+	changeLog, err = OpenFileChangeLog(path)
+	assert.Equal(t, nil, err)
+	defer changeLog.Close()
+	assert.Equal(t, uint64(n), changeLog.Seq())
+	assert.Equal(t, 2, len(changeLog.index))
+	changes, err = changeLog.Since(P_SKS, 2600)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n-2600, len(changes))
+	assert.Equal(t, uint64(2601), changes[0].Seq)
+}
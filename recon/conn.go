@@ -0,0 +1,154 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// bufferedConn reads through a buffer which may already hold
+// data received on the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// timeoutConn refreshes I/O deadlines on every read and write, so that
+// a session with a hung or vanished peer fails once it has been idle
+// longer than the configured timeout. Deadlines set explicitly by the
+// caller are honored when they are sooner than the idle deadline.
+type timeoutConn struct {
+	net.Conn
+	idleTimeout   time.Duration
+	writeTimeout  time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.idleTimeout > 0 {
+		c.Conn.SetReadDeadline(earliest(c.readDeadline, time.Now().Add(c.idleTimeout)))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(earliest(c.writeDeadline, time.Now().Add(c.writeTimeout)))
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the sooner of an explicit deadline, which may be
+// unset, and an idle deadline.
+func earliest(deadline, idle time.Time) time.Time {
+	if !deadline.IsZero() && deadline.Before(idle) {
+		return deadline
+	}
+	return idle
+}
+
+// remoteKeepAlive tests if a remote peer announced that it reads
+// keepalive messages.
+func remoteKeepAlive(config *Config) bool {
+	_, has := config.Custom["keepalive"]
+	return has
+}
+
+// withTimeouts applies the configured keepalive, idle and write timeouts
+// to a recon connection.
+func (p *Peer) withTimeouts(conn net.Conn) net.Conn {
+	return p.withLimits(conn, p.IdleTimeout(), p.WriteTimeout(), 0)
+}
+
+// withLimits applies the configured keepalive, the given idle and write
+// timeouts in seconds and a bandwidth cap in bytes per second to a recon
+// connection. Zero disables a timeout or the bandwidth cap.
+func (p *Peer) withLimits(conn net.Conn, idleTimeout, writeTimeout, bandwidth int) net.Conn {
+	if tcpConn, is := conn.(*net.TCPConn); is && p.KeepAlive() > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Second * time.Duration(p.KeepAlive()))
+	}
+	if bandwidth > 0 {
+		conn = &rateConn{Conn: conn, rate: bandwidth}
+	}
+	if idleTimeout <= 0 && writeTimeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{
+		Conn:         conn,
+		idleTimeout:  time.Second * time.Duration(idleTimeout),
+		writeTimeout: time.Second * time.Duration(writeTimeout)}
+}
+
+// rateConn caps the rate of data read from and written
+// to a connection, in bytes per second.
+type rateConn struct {
+	net.Conn
+	rate      int
+	readNext  time.Time
+	writeNext time.Time
+}
+
+// throttle delays after transferring n bytes until the
+// transfer would have taken its share of time at the rate.
+func (c *rateConn) throttle(next *time.Time, n int) {
+	now := time.Now()
+	if next.Before(now) {
+		*next = now
+	}
+	*next = next.Add(time.Duration(n) * time.Second / time.Duration(c.rate))
+	time.Sleep(next.Sub(now))
+}
+
+func (c *rateConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.throttle(&c.readNext, n)
+	return
+}
+
+func (c *rateConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.throttle(&c.writeNext, n)
+	return
+}
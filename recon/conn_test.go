@@ -0,0 +1,90 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &timeoutConn{Conn: c1, idleTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	assert.T(t, err != nil)
+	assert.T(t, time.Since(start) < time.Second)
+}
+
+func TestIdleTimeoutRefresh(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &timeoutConn{Conn: c1, idleTimeout: 200 * time.Millisecond}
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			c2.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		_, err := conn.Read(buf)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, byte(i), buf[0])
+	}
+}
+
+func TestExplicitDeadlineHonored(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &timeoutConn{Conn: c1, idleTimeout: time.Minute}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	assert.T(t, err != nil)
+	assert.T(t, time.Since(start) < time.Second)
+}
+
+func TestKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sc := &sessionConn{Conn: c1, stats: &SessionStats{}}
+	stop := make(chan struct{})
+	defer close(stop)
+	go sc.keepAlive(20*time.Millisecond, stop)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		WriteMsg(sc, &Done{})
+	}()
+	// Keepalives refresh the idle deadline, and are skipped
+	conn := &timeoutConn{Conn: c2, idleTimeout: 100 * time.Millisecond}
+	msg, err := ReadMsg(conn)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgTypeDone, msg.MsgType())
+}
@@ -0,0 +1,250 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Dashboard enables the web dashboard on the admin server,
+// under /dashboard/.
+func (s *Settings) Dashboard() bool {
+	return s.GetBool("conflux.recon.dashboard", false)
+}
+
+// DashboardState is the state of a peer shown by the web dashboard.
+type DashboardState struct {
+	Stats    *ReconStats      `json:"stats"`
+	Debug    *DebugState      `json:"debug"`
+	Sessions []*SessionResult `json:"sessions"`
+	// Elements recovered per hour over the recent sessions
+	RecoveryRate float64 `json:"recoveryRate"`
+}
+
+// DashboardState reports the peer's stats, its debug state, its
+// recent sessions and the rate at which they recovered elements.
+// The peer must be started.
+func (p *Peer) DashboardState() (*DashboardState, error) {
+	stats, err := p.ReconStats()
+	if err != nil {
+		return nil, err
+	}
+	state := &DashboardState{
+		Stats:    stats,
+		Debug:    p.DebugState(),
+		Sessions: p.RecentSessions()}
+	state.RecoveryRate = recoveryRate(state.Sessions, time.Now())
+	return state, nil
+}
+
+// recoveryRate returns the elements recovered per hour in the given
+// sessions, from the start of the earliest until now.
+func recoveryRate(sessions []*SessionResult, now time.Time) float64 {
+	if len(sessions) == 0 {
+		return 0
+	}
+	recovered, start := 0, now
+	for _, s := range sessions {
+		recovered += s.Recovered
+		if s.Start.Before(start) {
+			start = s.Start
+		}
+	}
+	elapsed := now.Sub(start)
+	if elapsed < time.Minute {
+		elapsed = time.Minute
+	}
+	return float64(recovered) / elapsed.Hours()
+}
+
+// DashboardHandler returns an HTTP handler serving the web dashboard,
+// a page which polls the peer's DashboardState as JSON from the path
+// state.json beside it. The page and its assets are built in.
+func (p *Peer) DashboardHandler() http.Handler {
+	return http.HandlerFunc(p.serveDashboard)
+}
+
+func (p *Peer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/state.json") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := io.WriteString(w, dashboardPage); err != nil {
+			log.Println(SERVE, "dashboard:", err)
+		}
+		return
+	}
+	state, err := p.DashboardState()
+	if err != nil {
+		log.Println(SERVE, "dashboard:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(state); err != nil {
+		log.Println(SERVE, "dashboard:", err)
+	}
+}
+
+// dashboardPage renders the dashboard in the browser, with its styles
+// and script inline so that it is served by a single handler.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Recon Dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; }
+.summary td:first-child { color: #666; }
+.ok { color: #080; }
+.failing { color: #c00; }
+.never { color: #888; }
+.bar { fill: #48c; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Recon Dashboard</h1>
+<p id="error"></p>
+<table class="summary">
+<tr><td>Version</td><td id="version"></td></tr>
+<tr><td>Elements</td><td id="total"></td></tr>
+<tr><td>Recovered per hour</td><td id="rate"></td></tr>
+<tr><td>Sessions in progress</td><td id="active"></td></tr>
+<tr><td>Connections</td><td id="conns"></td></tr>
+<tr><td>Pending commands</td><td id="pending"></td></tr>
+<tr><td>Goroutines</td><td id="goroutines"></td></tr>
+</table>
+<h2>Partners</h2>
+<table>
+<thead><tr><th>Partner</th><th>Health</th><th>Last recon</th><th>Recovered</th><th>Error</th></tr></thead>
+<tbody id="partners"></tbody>
+</table>
+<h2>Daily Recoveries</h2>
+<svg id="daily" width="560" height="120"></svg>
+<h2>Recent Sessions</h2>
+<table>
+<thead><tr><th>Start</th><th>Role</th><th>Partner</th><th>Strategy</th><th>Duration</th><th>Recovered</th><th>Sent</th><th>Error</th></tr></thead>
+<tbody id="sessions"></tbody>
+</table>
+<script>
+(function() {
+	function $(id) { return document.getElementById(id); }
+	function cell(row, text, cls) {
+		var td = document.createElement("td");
+		td.textContent = text;
+		if (cls) { td.className = cls; }
+		row.appendChild(td);
+	}
+	function clear(el) {
+		while (el.firstChild) { el.removeChild(el.firstChild); }
+	}
+	function when(t) {
+		return (!t || t.indexOf("0001-") === 0) ? "" : new Date(t).toLocaleString();
+	}
+	function render(s) {
+		$("version").textContent = s.stats.version;
+		$("total").textContent = s.stats.total;
+		$("rate").textContent = s.recoveryRate.toFixed(1);
+		$("active").textContent = (s.debug.sessions || []).length;
+		$("conns").textContent = s.debug.conns;
+		$("pending").textContent = s.debug.pendingCmds;
+		$("goroutines").textContent = s.debug.goroutines;
+		var partners = $("partners");
+		clear(partners);
+		(s.stats.partners || []).forEach(function(p) {
+			var row = document.createElement("tr");
+			var health = p.error ? "failing" : (when(p.lastRecon) ? "ok" : "never");
+			cell(row, p.addr);
+			cell(row, health, health);
+			cell(row, when(p.lastRecon));
+			cell(row, p.recovered, "num");
+			cell(row, p.error || "");
+			partners.appendChild(row);
+		});
+		var daily = (s.stats.daily || []).slice(0, 14).reverse();
+		var svg = $("daily"), max = 1;
+		clear(svg);
+		daily.forEach(function(d) { max = Math.max(max, d.recovered); });
+		daily.forEach(function(d, i) {
+			var h = Math.round(100 * d.recovered / max);
+			var bar = document.createElementNS("http://www.w3.org/2000/svg", "rect");
+			bar.setAttribute("class", "bar");
+			bar.setAttribute("x", i * 40);
+			bar.setAttribute("y", 100 - h);
+			bar.setAttribute("width", 32);
+			bar.setAttribute("height", h);
+			var title = document.createElementNS("http://www.w3.org/2000/svg", "title");
+			title.textContent = d.date + ": " + d.recovered + " recovered in " + d.sessions + " sessions";
+			bar.appendChild(title);
+			svg.appendChild(bar);
+			var label = document.createElementNS("http://www.w3.org/2000/svg", "text");
+			label.setAttribute("x", i * 40);
+			label.setAttribute("y", 115);
+			label.setAttribute("font-size", 10);
+			label.textContent = d.date.substring(5);
+			svg.appendChild(label);
+		});
+		var sessions = $("sessions");
+		clear(sessions);
+		(s.sessions || []).forEach(function(r) {
+			var row = document.createElement("tr");
+			cell(row, when(r.start));
+			cell(row, r.role);
+			cell(row, r.partner);
+			cell(row, r.strategy);
+			cell(row, (r.duration / 1e9).toFixed(2) + "s", "num");
+			cell(row, r.recovered, "num");
+			cell(row, r.elementsSent, "num");
+			cell(row, r.error || "", r.error ? "failing" : "");
+			sessions.appendChild(row);
+		});
+	}
+	function poll() {
+		var req = new XMLHttpRequest();
+		req.onload = function() {
+			if (req.status === 200) {
+				$("error").textContent = "";
+				render(JSON.parse(req.responseText));
+			} else {
+				$("error").textContent = req.responseText;
+			}
+		};
+		req.onerror = function() { $("error").textContent = "Peer unreachable"; };
+		req.open("GET", "state.json");
+		req.send();
+	}
+	poll();
+	setInterval(poll, 10000);
+})();
+</script>
+</body>
+</html>
+`
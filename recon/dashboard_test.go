@@ -0,0 +1,79 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoveryRate(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 0.0, recoveryRate(nil, now))
+	sessions := []*SessionResult{
+		{SessionStats: &SessionStats{Stats: Stats{Recovered: 30}, Start: now.Add(-time.Hour)}},
+		{SessionStats: &SessionStats{Stats: Stats{Recovered: 10}, Start: now.Add(-2 * time.Hour)}}}
+	assert.Equal(t, 20.0, recoveryRate(sessions, now))
+}
+
+func TestDashboardHandler(t *testing.T) {
+	p := NewMemPeer()
+	p.PrefixTree.Insert(Zi(P_SKS, 65537))
+	startCmds(p)
+	ts := httptest.NewServer(p.AdminHandler())
+	resp, err := http.Get(ts.URL + "/dashboard/")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	ts.Close()
+
+	p.Settings.Set("conflux.recon.dashboard", true)
+	p.recent.add(&SessionStats{Stats: Stats{Recovered: 3}, Role: RoleClient,
+		Partner: "192.0.2.1:11370", Start: time.Now()}, nil)
+	ts = httptest.NewServer(p.AdminHandler())
+	defer ts.Close()
+	resp, err = http.Get(ts.URL + "/dashboard/")
+	assert.Equal(t, nil, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, nil, err)
+	assert.T(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+	assert.T(t, strings.Contains(string(body), "Recon Dashboard"))
+
+	resp, err = http.Get(ts.URL + "/dashboard/state.json")
+	assert.Equal(t, nil, err)
+	var state DashboardState
+	assert.Equal(t, nil, json.NewDecoder(resp.Body).Decode(&state))
+	resp.Body.Close()
+	assert.Equal(t, 1, state.Stats.Total)
+	assert.Equal(t, 1, len(state.Sessions))
+	assert.Equal(t, 3, state.Sessions[0].Recovered)
+	assert.T(t, state.RecoveryRate > 0)
+	assert.T(t, state.Debug.Goroutines > 0)
+}
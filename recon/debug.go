@@ -0,0 +1,195 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdminAddr is the address of the admin server, which serves debug
+// endpoints. It should not be reachable by the public. The admin
+// server is disabled if empty.
+func (s *Settings) AdminAddr() string {
+	return s.GetString("conflux.recon.adminAddr", "")
+}
+
+// Pprof enables the net/http/pprof profiling endpoints
+// on the admin server.
+func (s *Settings) Pprof() bool {
+	return s.GetBool("conflux.recon.pprof", false)
+}
+
+// SessionState describes a recon session in progress.
+type SessionState struct {
+	Role   string    `json:"role"`
+	Remote string    `json:"remote"`
+	Start  time.Time `json:"start"`
+}
+
+// DebugState is a snapshot of a peer's internal state,
+// for diagnosing stalled or stuck recon.
+type DebugState struct {
+	Goroutines   int             `json:"goroutines"`
+	Sessions     []*SessionState `json:"sessions"`
+	Conns        int             `json:"conns"`
+	ConnsPerHost map[string]int  `json:"connsPerHost"`
+	PendingCmds  int             `json:"pendingCmds"`
+	Tracing      bool            `json:"tracing"`
+}
+
+// sessionTable tracks the recon sessions in progress.
+// The zero value is ready to use.
+type sessionTable struct {
+	mu     sync.Mutex
+	next   int
+	active map[int]*SessionState
+}
+
+func (t *sessionTable) begin(role Role, remote net.Addr) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = make(map[int]*SessionState)
+	}
+	t.next++
+	state := &SessionState{Role: role.Name(), Start: time.Now()}
+	if remote != nil {
+		state.Remote = remote.String()
+	}
+	t.active[t.next] = state
+	return t.next
+}
+
+func (t *sessionTable) end(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, id)
+}
+
+func (t *sessionTable) states() (states []*SessionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range t.active {
+		copied := *state
+		states = append(states, &copied)
+	}
+	sort.Sort(byStart(states))
+	return
+}
+
+type byStart []*SessionState
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// DebugState reports the peer's sessions in progress, open
+// connections and the commands waiting on the prefix tree.
+func (p *Peer) DebugState() *DebugState {
+	state := &DebugState{
+		Goroutines:   runtime.NumGoroutine(),
+		Sessions:     p.sessions.states(),
+		ConnsPerHost: make(map[string]int),
+		PendingCmds:  int(atomic.LoadInt32(&p.pendingCmds)),
+		Tracing:      Tracing()}
+	if p.limiter != nil {
+		p.limiter.mu.Lock()
+		state.Conns = p.limiter.total
+		for host, n := range p.limiter.perHost {
+			state.ConnsPerHost[host] = n
+		}
+		p.limiter.mu.Unlock()
+	}
+	return state
+}
+
+// AdminHandler returns an HTTP handler for the admin server. It serves
+// the peer's debug state as JSON on /debug/state, recently completed
+// sessions on /debug/sessions and session metrics on /debug/vars. It
+// runs a recon session with a partner on a POST to /reconcile?partner=addr,
+// deletes orphaned prefix tree nodes on a POST to /gc and, if enabled in the settings, serves the net/http/pprof endpoints
+// under /debug/pprof/ and the web dashboard under /dashboard/.
+func (p *Peer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/state", p.serveDebugState)
+	mux.HandleFunc("/debug/sessions", p.serveSessions)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/reconcile", p.serveReconcile)
+	mux.HandleFunc("/gc", p.serveCollectOrphans)
+	if p.Pprof() {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if p.Dashboard() {
+		mux.Handle("/dashboard/", p.DashboardHandler())
+	}
+	return mux
+}
+
+func (p *Peer) serveDebugState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.DebugState()); err != nil {
+		log.Println(SERVE, "debug:", err)
+	}
+}
+
+func (p *Peer) serveSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.RecentSessions()); err != nil {
+		log.Println(SERVE, "debug:", err)
+	}
+}
+
+func (p *Peer) serveReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "reconcile requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	partner := r.FormValue("partner")
+	if partner == "" {
+		http.Error(w, "partner is required", http.StatusBadRequest)
+		return
+	}
+	stats, err := p.ReconcileNow(partner)
+	result := &SessionResult{SessionStats: &stats}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(SERVE, "reconcile:", err)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugState(t *testing.T) {
+	p := NewMemPeer()
+	p.limiter = newConnLimiter(0, 0)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370}
+	p.limiter.acquire(addr)
+	id := p.sessions.begin(RoleServer, addr)
+	p.sessions.begin(RoleClient, nil)
+	state := p.DebugState()
+	assert.Equal(t, 2, len(state.Sessions))
+	assert.Equal(t, "server", state.Sessions[0].Role)
+	assert.Equal(t, "192.0.2.1:11370", state.Sessions[0].Remote)
+	assert.Equal(t, 1, state.Conns)
+	assert.Equal(t, 1, state.ConnsPerHost["192.0.2.1"])
+	assert.T(t, state.Goroutines > 0)
+	p.sessions.end(id)
+	assert.Equal(t, 1, len(p.DebugState().Sessions))
+}
+
+func TestAdminHandler(t *testing.T) {
+	p := NewMemPeer()
+	ts := httptest.NewServer(p.AdminHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/debug/state")
+	assert.Equal(t, nil, err)
+	var state DebugState
+	assert.Equal(t, nil, json.NewDecoder(resp.Body).Decode(&state))
+	resp.Body.Close()
+	resp, err = http.Get(ts.URL + "/debug/pprof/")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	p.Settings.Set("conflux.recon.pprof", true)
+	ts2 := httptest.NewServer(p.AdminHandler())
+	defer ts2.Close()
+	resp, err = http.Get(ts2.URL + "/debug/pprof/")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,105 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	. "github.com/cmars/conflux"
+	"sync"
+	"time"
+)
+
+// RecoverDedupSecs is the time for which elements sent to RecoverChan
+// are not sent again when recovered in other sessions, such as with
+// several partners at once, so that consumers do not fetch them more
+// than once. Zero, the default, sends every element recovered.
+func (s *Settings) RecoverDedupSecs() int {
+	return s.GetInt("conflux.recon.recoverDedupSecs", 0)
+}
+
+// recoverDedup remembers the elements recently sent to RecoverChan,
+// or reserved by sessions to be sent.
+// The zero value is ready to use.
+type recoverDedup struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// reserve returns the elements not seen within ttl of now, marking
+// them as seen at now, so that sessions recovering them at the same
+// time do not also send them.
+func (d *recoverDedup) reserve(elements []*Zp, ttl time.Duration, now time.Time) (result []*Zp) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]time.Time)
+	}
+	if now.Sub(d.lastSweep) > ttl {
+		for k, t := range d.seen {
+			if now.Sub(t) > ttl {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	for _, z := range elements {
+		if t, has := d.seen[z.String()]; has && now.Sub(t) <= ttl {
+			continue
+		}
+		d.seen[z.String()] = now
+		result = append(result, z)
+	}
+	return
+}
+
+// release forgets elements reserved but not sent.
+func (d *recoverDedup) release(elements []*Zp) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, z := range elements {
+		delete(d.seen, z.String())
+	}
+}
+
+// dedupRecovered removes the elements recently sent to RecoverChan, or
+// being recovered by another session, reserving the rest until the
+// recovery holding them is sent.
+func (p *Peer) dedupRecovered(elements []*Zp) []*Zp {
+	secs := p.RecoverDedupSecs()
+	if secs <= 0 {
+		return elements
+	}
+	result := p.recovered.reserve(elements, time.Duration(secs)*time.Second, time.Now())
+	if n := len(elements) - len(result); n > 0 {
+		sessionMetrics.Add("elementsDeduplicated", int64(n))
+	}
+	return result
+}
+
+// releaseRecovered releases the elements of a recovery dropped rather
+// than sent to RecoverChan, or spilled to be sent, so that they are
+// recovered again in a later session.
+func (p *Peer) releaseRecovered(r *Recover) {
+	if p.RecoverDedupSecs() > 0 {
+		p.recovered.release(r.RemoteElements)
+	}
+}
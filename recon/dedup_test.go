@@ -0,0 +1,106 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+	"time"
+)
+
+func TestRecoverDedup(t *testing.T) {
+	var d recoverDedup
+	now := time.Now()
+	a, b, c := Zi(P_SKS, 65537), Zi(P_SKS, 65539), Zi(P_SKS, 65541)
+	assert.Equal(t, []*Zp{a, b}, d.reserve([]*Zp{a, b}, time.Minute, now))
+	assert.Equal(t, []*Zp{c}, d.reserve([]*Zp{a, b, c}, time.Minute, now.Add(time.Second)))
+	// Expired elements are sent again
+	assert.Equal(t, []*Zp{a, b}, d.reserve([]*Zp{a, b, c}, time.Minute, now.Add(time.Minute+time.Millisecond)))
+	assert.Equal(t, 3, len(d.seen))
+	// Released elements are sent again
+	d.release([]*Zp{c})
+	assert.Equal(t, []*Zp{c}, d.reserve([]*Zp{a, b, c}, time.Minute, now.Add(time.Minute+time.Second)))
+	assert.Equal(t, 3, len(d.reserve([]*Zp{a, b, c}, time.Minute, now.Add(3*time.Minute))))
+}
+
+func TestDedupRecovered(t *testing.T) {
+	p := newTestPeer("conflux.recon.recoverBuffer", 1, "conflux.recon.recoverPolicy", "drop")
+	a, b := Zi(P_SKS, 65537), Zi(P_SKS, 65539)
+	assert.Equal(t, 2, len(p.dedupRecovered([]*Zp{a, b})))
+	p.sendRecover(&Recover{RemoteElements: []*Zp{a, b}})
+	<-p.RecoverChan
+	assert.Equal(t, 2, len(p.dedupRecovered([]*Zp{a, b})))
+	p.Settings.Set("conflux.recon.recoverDedupSecs", 60)
+	assert.Equal(t, 2, len(p.dedupRecovered([]*Zp{a, b})))
+	// Elements being recovered are not recovered by other sessions
+	assert.Equal(t, 0, len(p.dedupRecovered([]*Zp{a, b})))
+	p.sendRecover(&Recover{RemoteElements: []*Zp{a, b}})
+	assert.Equal(t, 0, len(p.dedupRecovered([]*Zp{a, b})))
+	// Elements dropped, RecoverChan being full, are not remembered as sent
+	c := Zi(P_SKS, 65541)
+	assert.Equal(t, 1, len(p.dedupRecovered([]*Zp{c})))
+	p.sendRecover(&Recover{RemoteElements: []*Zp{c}})
+	assert.Equal(t, 1, len(p.dedupRecovered([]*Zp{c})))
+}
+
+func TestDedupOverlapping(t *testing.T) {
+	server := newTestPeer(append(payloadSettings,
+		"conflux.recon.recoverDedupSecs", 60)...)
+	server.Payloads = newMemPayloads()
+	startCmds(server)
+	z := Zi(P_SKS, 65537)
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		payloads := newMemPayloads()
+		client := newTestPeer(payloadSettings...)
+		client.Payloads = payloads
+		client.PrefixTree.Insert(z)
+		payloads.StorePayload(z, payloadFor(1))
+		startCmds(client)
+		serverConn, clientConn := connPair(t)
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go client.ReconcileWith(clientConn, RoleClient)
+		go func() {
+			_, err := server.ReconcileWith(serverConn, RoleServer)
+			done <- err
+		}()
+	}
+	// Sessions holding recoveries until payloads are transferred send
+	// them after leaving the command handler. While one waits on the
+	// consumer, the other finds the element reserved.
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("both sessions wait to recover the element")
+	}
+	r := <-server.RecoverChan
+	assert.Equal(t, []*Zp{z}, r.RemoteElements)
+	assert.Equal(t, nil, <-done)
+	select {
+	case r = <-server.RecoverChan:
+		t.Fatal("element recovered twice")
+	default:
+	}
+}
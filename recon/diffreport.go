@@ -0,0 +1,93 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io"
+	"time"
+)
+
+// DiffBucket counts the differences under a top-level prefix of
+// the element keys.
+type DiffBucket struct {
+	Prefix        string `json:"prefix"`
+	LocalMissing  int    `json:"localMissing"`
+	RemoteMissing int    `json:"remoteMissing"`
+}
+
+// DiffReport describes how the prefix tree differs from a remote
+// peer's, as found by a recon session. Hashes are the elements in hex.
+type DiffReport struct {
+	Partner            string        `json:"partner"`
+	Time               time.Time     `json:"time"`
+	LocalMissingCount  int           `json:"localMissingCount"`
+	RemoteMissingCount int           `json:"remoteMissingCount"`
+	LocalMissing       []string      `json:"localMissing"`
+	RemoteMissing      []string      `json:"remoteMissing"`
+	Buckets            []*DiffBucket `json:"buckets"`
+}
+
+// DiffReport reports the elements the peer lacks and those the remote
+// peer lacks from the stats of a session, counting them under each
+// prefix of the first level of the prefix tree. The elements the
+// remote peer lacks are those in Stats.Offered, which a Merkle client
+// cannot tell.
+func (p *Peer) DiffReport(stats *SessionStats) *DiffReport {
+	r := &DiffReport{
+		Partner:            stats.Partner,
+		Time:               stats.Start,
+		LocalMissingCount:  len(stats.Elements),
+		RemoteMissingCount: len(stats.Offered),
+		LocalMissing:       []string{},
+		RemoteMissing:      []string{}}
+	nbq := p.Settings.BitQuantum()
+	for i := 0; i < 1<<uint(nbq); i++ {
+		r.Buckets = append(r.Buckets, &DiffBucket{
+			Prefix: NewBitstring(0).AppendUint(uint(i), nbq).String()})
+	}
+	keys := TreeKeys(p.PrefixTree)
+	bucket := func(z *Zp) *DiffBucket {
+		return r.Buckets[keys.Key(z).Uint(0, nbq)]
+	}
+	for _, z := range stats.Elements {
+		r.LocalMissing = append(r.LocalMissing, fmt.Sprintf("%x", z.Bytes()))
+		bucket(z).LocalMissing++
+	}
+	for _, z := range stats.Offered {
+		r.RemoteMissing = append(r.RemoteMissing, fmt.Sprintf("%x", z.Bytes()))
+		bucket(z).RemoteMissing++
+	}
+	return r
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *DiffReport) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,69 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func testDiffReport(t *testing.T, server, client *Peer) {
+	for i := 1; i < 200; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	for i := 1; i <= 5; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i+2))
+	}
+	for i := 1; i <= 3; i++ {
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i+4))
+	}
+	s := reconcile(t, server, client)
+	report := client.DiffReport(&s.cs)
+	assert.Equal(t, 5, report.LocalMissingCount)
+	assert.Equal(t, 3, report.RemoteMissingCount)
+	assert.Equal(t, fmt.Sprintf("%x", Zi(P_SKS, 65537*1+4).Bytes()), report.RemoteMissing[0])
+	assert.Equal(t, 1<<uint(client.Settings.BitQuantum()), len(report.Buckets))
+	local, remote := 0, 0
+	for _, b := range report.Buckets {
+		local += b.LocalMissing
+		remote += b.RemoteMissing
+	}
+	assert.Equal(t, 5, local)
+	assert.Equal(t, 3, remote)
+
+	var buf bytes.Buffer
+	assert.Equal(t, nil, report.WriteJSON(&buf))
+	var decoded DiffReport
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, report.LocalMissing, decoded.LocalMissing)
+	assert.Equal(t, report.RemoteMissing, decoded.RemoteMissing)
+	assert.Equal(t, s.cs.Partner, decoded.Partner)
+}
+
+func TestDiffReport(t *testing.T) {
+	testDiffReport(t, NewMemPeer(), NewMemPeer())
+}
@@ -0,0 +1,79 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io"
+)
+
+// WriteDot renders the subtree of a prefix tree under key as a Graphviz
+// DOT digraph. Each node is labeled with its key, element count and
+// depth, leaves drawn as boxes. Nodes deeper than maxDepth below key
+// are omitted, unless maxDepth is negative.
+func WriteDot(w io.Writer, t PrefixTree, key *Bitstring, maxDepth int) error {
+	node, err := t.Node(key)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph ptree {")
+	fmt.Fprintln(bw, "\tnode [shape=ellipse];")
+	if err = writeDotNode(bw, node, maxDepth); err != nil {
+		return err
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func writeDotNode(w io.Writer, node PrefixNode, maxDepth int) error {
+	key, err := node.Key()
+	if err != nil {
+		return err
+	}
+	shape := ""
+	if node.IsLeaf() {
+		shape = ", shape=box"
+	}
+	fmt.Fprintf(w, "\t%q [label=%q%s];\n", key.String(), fmt.Sprintf(
+		"%v\n%d elements\ndepth %d", key, node.Size(), key.BitLen()/node.BitQuantum()), shape)
+	if node.IsLeaf() || maxDepth == 0 {
+		return nil
+	}
+	children, err := node.Children()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childKey, err := child.Key()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\t%q -> %q;\n", key.String(), childKey.String())
+		if err = writeDotNode(w, child, maxDepth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
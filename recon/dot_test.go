@@ -0,0 +1,57 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"strings"
+	"testing"
+)
+
+func TestWriteDot(t *testing.T) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 1; i < 100; i++ {
+		tree.Insert(Zi(P_SKS, 65537*i))
+	}
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, !root.IsLeaf())
+
+	var buf bytes.Buffer
+	assert.Equal(t, nil, WriteDot(&buf, tree, NewBitstring(0), -1))
+	out := buf.String()
+	assert.T(t, strings.HasPrefix(out, "digraph ptree {\n"))
+	assert.T(t, strings.HasSuffix(out, "}\n"))
+	assert.T(t, strings.Contains(out, `"0:" [label="0:\n99 elements\ndepth 0"];`))
+	for _, child := range mustChildren(t, root) {
+		assert.T(t, strings.Contains(out, `"0:" -> "`+mustKey(t, child).String()+`";`))
+	}
+	assert.T(t, strings.Contains(out, "shape=box"))
+
+	// Only the root and its children are rendered at depth 1
+	buf.Reset()
+	assert.Equal(t, nil, WriteDot(&buf, tree, NewBitstring(0), 1))
+	assert.Equal(t, 1+len(mustChildren(t, root)), strings.Count(buf.String(), "[label="))
+}
@@ -0,0 +1,117 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"os"
+	"strings"
+)
+
+// EnvPrefix starts the names of environment variables which override settings.
+const EnvPrefix = "CONFLUX_"
+
+// envAliases are short names for commonly overridden settings.
+var envAliases = map[string]string{
+	"CONFLUX_RECON_PORT": "conflux.recon.reconPort",
+	"CONFLUX_HTTP_PORT":  "conflux.recon.httpPort",
+	"CONFLUX_PARTNERS":   "conflux.recon.partners",
+	"CONFLUX_FILTERS":    "conflux.recon.filters",
+}
+
+// envListKeys are settings which hold a list, given in the
+// environment separated by commas.
+var envListKeys = map[string]bool{
+	"conflux.recon.partners":          true,
+	"conflux.recon.filters":           true,
+	"conflux.recon.listen":            true,
+	"conflux.recon.partnerProxies":    true,
+	"conflux.recon.noise.trustedKeys": true,
+}
+
+// EnvKey returns the settings key overridden by an environment
+// variable. Words separated by an underscore are joined in camel case,
+// and a double underscore separates nested keys, so that
+// CONFLUX_RECON_GOSSIP_INTERVAL_SECS sets conflux.recon.gossipIntervalSecs
+// and CONFLUX_RECON_LEVELDB__PATH sets conflux.recon.leveldb.path.
+func EnvKey(name string) string {
+	if key, has := envAliases[name]; has {
+		return key
+	}
+	if !strings.HasPrefix(name, EnvPrefix) {
+		return ""
+	}
+	parts := strings.SplitN(name[len(EnvPrefix):], "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	key := []string{"conflux", strings.ToLower(parts[0])}
+	for _, nested := range strings.Split(parts[1], "__") {
+		var camel string
+		for i, word := range strings.Split(strings.ToLower(nested), "_") {
+			if i > 0 && word != "" {
+				word = strings.ToUpper(word[:1]) + word[1:]
+			}
+			camel += word
+		}
+		if camel == "" {
+			return ""
+		}
+		key = append(key, camel)
+	}
+	return strings.Join(key, ".")
+}
+
+// envValue converts an environment variable value to a list for
+// settings which hold one. Other values are kept as strings, which the
+// Settings getters convert to the type of the setting.
+func envValue(key, value string) interface{} {
+	if envListKeys[key] {
+		var list []interface{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return value
+}
+
+// ApplyEnv overrides settings with CONFLUX_ environment variables
+// from environ, given as "NAME=value" strings like os.Environ.
+func (s *Settings) ApplyEnv(environ []string) {
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		if key := EnvKey(kv[:i]); key != "" {
+			s.Set(key, envValue(key, kv[i+1:]))
+		}
+	}
+	s.UpdateDerived()
+}
+
+// ApplyProcessEnv overrides settings with the process environment.
+func (s *Settings) ApplyProcessEnv() {
+	s.ApplyEnv(os.Environ())
+}
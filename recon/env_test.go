@@ -0,0 +1,79 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestEnvKey(t *testing.T) {
+	for name, key := range map[string]string{
+		"CONFLUX_RECON_PORT":                 "conflux.recon.reconPort",
+		"CONFLUX_PARTNERS":                   "conflux.recon.partners",
+		"CONFLUX_RECON_GOSSIP_INTERVAL_SECS": "conflux.recon.gossipIntervalSecs",
+		"CONFLUX_RECON_M_BAR":                "conflux.recon.mBar",
+		"CONFLUX_RECON_LEVELDB__PATH":        "conflux.recon.leveldb.path",
+		"CONFLUX_RECON_NOISE__PRIVATE_KEY":   "conflux.recon.noise.privateKey",
+		"CONFLUX_RECON":                      "",
+		"HOME":                               ""} {
+		assert.Equal(t, key, EnvKey(name))
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	s := DefaultSettings()
+	s.ApplyEnv([]string{
+		"CONFLUX_RECON_PORT=21370",
+		"CONFLUX_PARTNERS=a.example.com:11370, b.example.com:11370",
+		"CONFLUX_RECON_M_BAR=7",
+		"CONFLUX_RECON_SERVE_TCP=false",
+		"CONFLUX_RECON_LEVELDB__PATH=/tmp/ptree",
+		"HOME=/root"})
+	assert.Equal(t, 21370, s.ReconPort())
+	assert.Equal(t, []string{"a.example.com:11370", "b.example.com:11370"}, s.Partners())
+	assert.Equal(t, 7, s.MBar())
+	assert.Equal(t, 8, s.NumSamples())
+	assert.T(t, !s.ServeTcp())
+	assert.Equal(t, "/tmp/ptree", s.GetString("conflux.recon.leveldb.path", ""))
+}
+
+func TestApplyEnvTypes(t *testing.T) {
+	s := DefaultSettings()
+	s.ApplyEnv([]string{
+		"CONFLUX_RECON_NODE_ID=42",
+		"CONFLUX_RECON_FOLLOWER=1",
+		"CONFLUX_RECON_SERVE_TCP=0",
+		"CONFLUX_RECON_SYNC_CHECK=true"})
+	// Values are read as the type of the setting, however they look
+	assert.Equal(t, "42", s.NodeId())
+	assert.T(t, s.Follower())
+	assert.T(t, !s.ServeTcp())
+	assert.T(t, s.SyncCheck())
+	s.ApplyEnv([]string{"CONFLUX_RECON_FOLLOWER=0"})
+	assert.T(t, !s.Follower())
+	// Settings files may give numbers and booleans too
+	s.Set("conflux.recon.nodeId", int64(7))
+	assert.Equal(t, "7", s.NodeId())
+	s.Set("conflux.recon.follower", int64(1))
+	assert.T(t, s.Follower())
+}
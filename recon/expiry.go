@@ -0,0 +1,154 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	. "github.com/cmars/conflux"
+	"log"
+	"sync"
+	"time"
+)
+
+// ExpirySweepSecs is the interval in seconds at which elements past
+// their expiry are removed from the prefix tree.
+func (s *Settings) ExpirySweepSecs() int {
+	return s.GetInt("conflux.recon.expirySweepSecs", 60)
+}
+
+// ExpiryStore holds the times at which elements of the prefix tree
+// expire. Elements without an expiry are kept until removed.
+type ExpiryStore interface {
+	// SetExpiry sets the time at which an element expires.
+	SetExpiry(z *Zp, expires time.Time) error
+	// ClearExpiry forgets the expiry of an element.
+	ClearExpiry(z *Zp) error
+	// Expired returns the elements which expire before now.
+	Expired(now time.Time) ([]*Zp, error)
+}
+
+type memExpiry struct {
+	z       *Zp
+	expires time.Time
+}
+
+// MemExpiryStore holds element expiries in memory.
+type MemExpiryStore struct {
+	mu       sync.Mutex
+	expiries map[string]memExpiry
+}
+
+func NewMemExpiryStore() *MemExpiryStore {
+	return &MemExpiryStore{expiries: make(map[string]memExpiry)}
+}
+
+func (s *MemExpiryStore) SetExpiry(z *Zp, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiries[z.String()] = memExpiry{z: z, expires: expires}
+	return nil
+}
+
+func (s *MemExpiryStore) ClearExpiry(z *Zp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expiries, z.String())
+	return nil
+}
+
+func (s *MemExpiryStore) Expired(now time.Time) (expired []*Zp, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.expiries {
+		if e.expires.Before(now) {
+			expired = append(expired, e.z)
+		}
+	}
+	return
+}
+
+var ErrNoExpiryStore error = errors.New("Peer has no expiry store")
+
+// InsertExpiring inserts an element which is removed from the prefix
+// tree once expires has passed.
+func (p *Peer) InsertExpiring(z *Zp, expires time.Time) error {
+	if p.Expiry == nil {
+		return ErrNoExpiryStore
+	}
+	if err := p.Insert(z); err != nil {
+		return err
+	}
+	return p.Expiry.SetExpiry(z, expires)
+}
+
+// sweepExpired removes the elements which have expired by now,
+// stopping early if stop is closed.
+func (p *Peer) sweepExpired(now time.Time, stop chan struct{}) (n int, err error) {
+	expired, err := p.Expiry.Expired(now)
+	if err != nil {
+		return 0, err
+	}
+	for _, z := range expired {
+		select {
+		case <-stop:
+			return n, nil
+		default:
+		}
+		if err := p.Remove(z); err != nil {
+			log.Println(SERVE, "expire", z, ":", err)
+			if _, is := err.(*NotFoundError); is {
+				// Forget the expiry of elements already removed
+				p.Expiry.ClearExpiry(z)
+			}
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		sessionMetrics.Add("elementsExpired", int64(n))
+	}
+	return n, nil
+}
+
+// sweep removes expired elements every ExpirySweepSecs until stop
+// is closed, closing done when it returns.
+func (p *Peer) sweep(stop, done chan struct{}) {
+	defer close(done)
+	secs := p.ExpirySweepSecs()
+	if secs <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(secs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n, err := p.sweepExpired(now, stop); err != nil {
+				log.Println(SERVE, "expiry sweep:", err)
+			} else if n > 0 {
+				log.Println(SERVE, "expired", n, "elements")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+	p := NewMemPeer()
+	startCmds(p)
+	assert.Equal(t, ErrNoExpiryStore, p.InsertExpiring(Zi(P_SKS, 65537), time.Now()))
+	p.Expiry = NewMemExpiryStore()
+	now := time.Now()
+	assert.Equal(t, nil, p.InsertExpiring(Zi(P_SKS, 65537), now.Add(time.Minute)))
+	assert.Equal(t, nil, p.InsertExpiring(Zi(P_SKS, 65539), now.Add(time.Hour)))
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65541)))
+	n, err := p.sweepExpired(now, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+	n, err = p.sweepExpired(now.Add(2*time.Minute), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, n)
+	root, _ := p.Root()
+	assert.Equal(t, 2, root.Size())
+	assert.T(t, !NewZSet(mustElements(t, root)...).Has(Zi(P_SKS, 65537)))
+	// Removing an element forgets its expiry
+	assert.Equal(t, nil, p.Remove(Zi(P_SKS, 65539)))
+	expired, err := p.Expiry.Expired(now.Add(2 * time.Hour))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(expired))
+	root, _ = p.Root()
+	assert.Equal(t, 1, root.Size())
+	// The expiry of an element removed behind the peer's back is
+	// forgotten, leaving the tree as it was
+	assert.Equal(t, nil, p.InsertExpiring(Zi(P_SKS, 65543), now))
+	assert.Equal(t, nil, p.PrefixTree.Remove(Zi(P_SKS, 65543)))
+	n, err = p.sweepExpired(now.Add(time.Minute), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+	expired, _ = p.Expiry.Expired(now.Add(time.Minute))
+	assert.Equal(t, 0, len(expired))
+	root, _ = p.Root()
+	assert.Equal(t, 1, root.Size())
+	// No more elements are removed once stopped
+	assert.Equal(t, nil, p.InsertExpiring(Zi(P_SKS, 65545), now))
+	stop := make(chan struct{})
+	close(stop)
+	n, err = p.sweepExpired(now.Add(time.Minute), stop)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+	root, _ = p.Root()
+	assert.Equal(t, 2, root.Size())
+}
@@ -0,0 +1,66 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	. "github.com/cmars/conflux"
+	"log"
+)
+
+// Follower tests if the peer only pulls elements from its partners,
+// as a mirror does, never serving its own differences. Followers
+// announce themselves, so that partners do not recover elements from
+// the sets they must exchange to find their differences.
+func (s *Settings) Follower() bool {
+	return s.GetBool("conflux.recon.follower", false)
+}
+
+// FollowerAccept tests if a follower accepts recon connections from
+// other peers, rather than only initiating its own.
+func (s *Settings) FollowerAccept() bool {
+	return s.GetBool("conflux.recon.followerAccept", true)
+}
+
+// refuseConns tests if the peer does not accept recon connections.
+func (p *Peer) refuseConns() bool {
+	return p.Follower() && !p.FollowerAccept()
+}
+
+var ErrFollowerRefused error = errors.New("Follower does not accept recon connections")
+
+// remoteFollower tests if a remote peer announced that it only pulls
+// elements, so that none should be recovered from it.
+func remoteFollower(config *Config) bool {
+	return config.Custom["follower"] == "true"
+}
+
+// serveElements returns the elements the peer offers of those a
+// remote peer lacks, which are none if the peer is a follower, and
+// never those blacklisted.
+func (p *Peer) serveElements(diff *ZSet) *ZSet {
+	if p.Follower() && diff.Len() > 0 {
+		log.Println(SERVE, "follower withholding", diff.Len(), "elements")
+		return NewZSet()
+	}
+	return p.stripBlacklisted(diff)
+}
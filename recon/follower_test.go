@@ -0,0 +1,76 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+// followerStats reconciles a follower with a peer holding
+// elements the other lacks, as client or server.
+func followerStats(t *testing.T, serverFollows bool) (follower, peer SessionStats) {
+	server, client := NewMemPeer(), NewMemPeer()
+	client.Settings.Set("conflux.recon.follower", true)
+	if serverFollows {
+		server, client = client, server
+	}
+	for i := 1; i < 100; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 != 0 {
+			server.PrefixTree.Insert(z)
+		}
+		if i%4 != 0 {
+			client.PrefixTree.Insert(z)
+		}
+	}
+	s := reconcile(t, server, client)
+	if serverFollows {
+		return s.ss, s.cs
+	}
+	return s.cs, s.ss
+}
+
+func TestFollowerClient(t *testing.T) {
+	follower, peer := followerStats(t, false)
+	assert.Equal(t, 99/4-99/12, follower.Recovered)
+	assert.Equal(t, 0, peer.Recovered)
+	assert.T(t, remoteFollower(peer.RemoteConfig))
+}
+
+func TestFollowerServer(t *testing.T) {
+	follower, peer := followerStats(t, true)
+	assert.Equal(t, 99/3-99/12, follower.Recovered)
+	assert.Equal(t, 0, peer.Recovered)
+}
+
+func TestFollowerRefuse(t *testing.T) {
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.follower", true)
+	assert.T(t, !p.refuseConns())
+	p.Settings.Set("conflux.recon.followerAccept", false)
+	assert.T(t, p.refuseConns())
+	serverConn, clientConn := connPair(t)
+	defer clientConn.Close()
+	assert.Equal(t, ErrFollowerRefused, p.Accept(serverConn))
+}
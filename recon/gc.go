@@ -0,0 +1,134 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/cmars/conflux"
+	"log"
+	"net/http"
+)
+
+// NodeStore is implemented by prefix trees which store their nodes
+// persistently. A crash between the writes of a split, or a bug in
+// removing elements, can leave stored nodes unreachable from the root.
+type NodeStore interface {
+	// NodeKeys returns the keys of all the nodes stored.
+	NodeKeys() ([]*Bitstring, error)
+	// DeleteNode deletes the node stored with a key.
+	DeleteNode(key *Bitstring) error
+}
+
+var ErrNotNodeStore error = errors.New("Prefix tree does not store its nodes")
+
+// CollectOrphans deletes the nodes of a prefix tree which are
+// unreachable from its root, returning the number deleted. The nodes
+// reachable are marked by walking the tree's levels from the root.
+// The shards of a sharded tree are each collected.
+func CollectOrphans(t PrefixTree) (int, error) {
+	if sharded, is := t.(*ShardedPrefixTree); is {
+		total := 0
+		for _, shard := range sharded.Shards() {
+			n, err := CollectOrphans(shard)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	}
+	store, is := t.(NodeStore)
+	if !is {
+		return 0, ErrNotNodeStore
+	}
+	reachable := make(map[string]bool)
+	err := WalkLevels(t, func(depth int, nodes []PrefixNode) error {
+		for _, node := range nodes {
+			key, err := node.Key()
+			if err != nil {
+				return err
+			}
+			reachable[key.String()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	keys, err := store.NodeKeys()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		if reachable[key.String()] {
+			continue
+		}
+		if err = store.DeleteNode(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// CollectOrphans deletes the nodes of the peer's prefix tree which
+// are unreachable from its root, while no other command changes it.
+func (p *Peer) CollectOrphans() (n int, err error) {
+	err = p.ExecCmd(func() error {
+		n, err = CollectOrphans(p.PrefixTree)
+		return err
+	})
+	if n > 0 {
+		log.Println("Collected", n, "orphaned prefix tree nodes")
+		sessionMetrics.Add("nodesCollected", int64(n))
+	}
+	return
+}
+
+// CollectResult is the outcome of collecting orphaned nodes
+// on the admin server.
+type CollectResult struct {
+	Collected int    `json:"collected"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (p *Peer) serveCollectOrphans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "gc requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := p.CollectOrphans()
+	result := &CollectResult{Collected: n}
+	w.Header().Set("Content-Type", "application/json")
+	if err == ErrNotNodeStore {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusNotImplemented)
+	} else if err != nil {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(SERVE, "gc:", err)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// orphanStore is a memory prefix tree which also stores
+// nodes unreachable from its root.
+type orphanStore struct {
+	*MemPrefixTree
+	orphans map[string]*Bitstring
+}
+
+func (t *orphanStore) NodeKeys() (keys []*Bitstring, err error) {
+	err = WalkLevels(t, func(depth int, nodes []PrefixNode) error {
+		for _, node := range nodes {
+			key, err := node.Key()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range t.orphans {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (t *orphanStore) DeleteNode(key *Bitstring) error {
+	delete(t.orphans, key.String())
+	return nil
+}
+
+func newOrphanStore() *orphanStore {
+	t := &orphanStore{MemPrefixTree: new(MemPrefixTree), orphans: make(map[string]*Bitstring)}
+	t.Init()
+	for i := 1; i < 100; i++ {
+		t.Insert(Zi(P_SKS, 65537*i))
+	}
+	for _, s := range []string{"4:00", "6:f0"} {
+		key, _ := ParseBitstring(s)
+		t.orphans[s] = key
+	}
+	return t
+}
+
+func TestCollectOrphans(t *testing.T) {
+	tree := newOrphanStore()
+	n, err := CollectOrphans(tree)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, len(tree.orphans))
+	n, err = CollectOrphans(tree)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+
+	_, err = CollectOrphans(NewMemPrefixTree(DefaultSettings()))
+	assert.Equal(t, ErrNotNodeStore, err)
+}
+
+func TestCollectOrphansSharded(t *testing.T) {
+	a, b := newOrphanStore(), newOrphanStore()
+	tree, err := NewShardedPrefixTree(a, b, newOrphanStore(), newOrphanStore())
+	assert.Equal(t, nil, err)
+	n, err := CollectOrphans(tree)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 0, len(a.orphans)+len(b.orphans))
+}
+
+func TestAdminCollectOrphans(t *testing.T) {
+	tree := newOrphanStore()
+	p := NewPeer(DefaultSettings(), tree)
+	startCmds(p)
+	ts := httptest.NewServer(p.AdminHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/gc")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Post(ts.URL+"/gc", "", nil)
+	assert.Equal(t, nil, err)
+	var result CollectResult
+	assert.Equal(t, nil, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, result.Collected)
+	assert.Equal(t, 0, len(tree.orphans))
+}
@@ -0,0 +1,266 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The golden files in testdata/golden hold the bytes conflux puts on
+// the wire, in hex. They pin the codec to the SKS protocol: a change
+// to them is a change in what other implementations will read.
+// Regenerate them with go test -run Golden -update, only when the
+// wire format is meant to change.
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+func goldenBits(s string) *Bitstring {
+	bs, err := ParseBitstring(s)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// goldenElements are SKS key hash elements: zero, small, one
+// spanning every byte, and the largest in the field.
+var goldenElements = []*Zp{
+	Zi(P_SKS, 0),
+	Zi(P_SKS, 65537),
+	Zb(P_SKS, []byte{
+		0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88,
+		0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}),
+	Z(P_SKS).Sub(Zi(P_SKS, 0), Zi(P_SKS, 1)),
+}
+
+var goldenConfig = &Config{
+	Version:    "1.1.6",
+	HttpPort:   11371,
+	BitQuantum: 2,
+	MBar:       5,
+	Filters:    "yminsky.dedup,yminsky.merge",
+}
+
+type goldenVector struct {
+	name  string
+	write func(w io.Writer) error
+}
+
+func msgVector(name string, msg ReconMsg) goldenVector {
+	return goldenVector{name, func(w io.Writer) error { return WriteMsgDirect(w, msg) }}
+}
+
+// sessionVector writes one side of an SKS recon session: the config
+// exchange, followed by the messages sent.
+func sessionVector(name string, msgs ...ReconMsg) goldenVector {
+	return goldenVector{name, func(w io.Writer) error {
+		if err := WriteMsgDirect(w, goldenConfig); err != nil {
+			return err
+		}
+		if err := WriteString(w, RemoteConfigPassed); err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := WriteMsgDirect(w, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+var goldenVectors = []goldenVector{
+	{"bitstring-0", func(w io.Writer) error { return WriteBitstring(w, NewBitstring(0)) }},
+	{"bitstring-1", func(w io.Writer) error { return WriteBitstring(w, goldenBits("1:80")) }},
+	{"bitstring-2", func(w io.Writer) error { return WriteBitstring(w, goldenBits("2:40")) }},
+	{"bitstring-9", func(w io.Writer) error { return WriteBitstring(w, goldenBits("9:8080")) }},
+	{"bitstring-16", func(w io.Writer) error { return WriteBitstring(w, goldenBits("16:a5c3")) }},
+	{"zzarray-empty", func(w io.Writer) error { return WriteZZarray(w, nil) }},
+	{"zzarray", func(w io.Writer) error { return WriteZZarray(w, goldenElements) }},
+	msgVector("msg-reconrqstpoly", &ReconRqstPoly{
+		Prefix:  goldenBits("2:40"),
+		Size:    3,
+		Samples: goldenElements[1:]}),
+	msgVector("msg-reconrqstfull", &ReconRqstFull{
+		Prefix:   goldenBits("4:a0"),
+		Elements: NewZSet(goldenElements...)}),
+	msgVector("msg-elements", &Elements{NewZSet(goldenElements[1:3]...)}),
+	msgVector("msg-fullelements", &FullElements{NewZSet(goldenElements[2])}),
+	msgVector("msg-syncfail", &SyncFail{}),
+	msgVector("msg-done", &Done{}),
+	msgVector("msg-flush", &Flush{}),
+	msgVector("msg-error", &Error{&textMsg{Text: "sync failed"}}),
+	msgVector("msg-dbrqst", &DbRqst{&textMsg{Text: "/pks/lookup?op=get"}}),
+	msgVector("msg-dbrepl", &DbRepl{&textMsg{Text: "ok"}}),
+	msgVector("msg-config", goldenConfig),
+	msgVector("msg-config-custom", &Config{
+		Version:    "1.1.6",
+		HttpPort:   11371,
+		BitQuantum: 2,
+		MBar:       5,
+		Filters:    "yminsky.dedup,yminsky.merge",
+		Custom:     map[string]string{"prefix": "2:40", "namespace": "keys", "payloads": "1"}}),
+	// The server, which accepted the connection, drives the session.
+	// The client lacks 65537, and the server lacks the other element
+	// under prefix 01.
+	sessionVector("session-server",
+		&ReconRqstPoly{Prefix: NewBitstring(0), Size: 3, Samples: goldenElements[1:]},
+		&Flush{},
+		&ReconRqstFull{Prefix: goldenBits("2:40"), Elements: NewZSet(goldenElements[1])},
+		&Flush{},
+		&Elements{NewZSet(goldenElements[1])},
+		&Done{}),
+	sessionVector("session-client",
+		&SyncFail{},
+		&FullElements{NewZSet(goldenElements[2])}),
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "golden", name+".hex")
+}
+
+// formatGolden dumps data in hex, 32 bytes to a line.
+func formatGolden(data []byte) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > 32 {
+			n = 32
+		}
+		buf.WriteString(hex.EncodeToString(data[:n]))
+		buf.WriteByte('\n')
+		data = data[n:]
+	}
+	return buf.Bytes()
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	text, err := ioutil.ReadFile(goldenPath(name))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	data, err := hex.DecodeString(strings.Join(strings.Fields(string(text)), ""))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return data
+}
+
+func TestGoldenEncode(t *testing.T) {
+	for _, v := range goldenVectors {
+		var buf bytes.Buffer
+		assert.Equal(t, nil, v.write(&buf))
+		if *updateGolden {
+			assert.Equal(t, nil, ioutil.WriteFile(goldenPath(v.name), formatGolden(buf.Bytes()), 0644))
+			continue
+		}
+		if expect := readGolden(t, v.name); !bytes.Equal(expect, buf.Bytes()) {
+			t.Errorf("%s: encoded\n%sexpected\n%s", v.name, formatGolden(buf.Bytes()), formatGolden(expect))
+		}
+	}
+}
+
+func TestGoldenDecode(t *testing.T) {
+	if *updateGolden {
+		t.Skip("updating golden files")
+	}
+	for _, v := range goldenVectors {
+		if !strings.HasPrefix(v.name, "msg-") {
+			continue
+		}
+		data := readGolden(t, v.name)
+		r := bytes.NewBuffer(data)
+		msg, err := ReadMsg(r)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 0, r.Len())
+		var buf bytes.Buffer
+		assert.Equal(t, nil, WriteMsgDirect(&buf, msg))
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Errorf("%s: %v does not encode as decoded", v.name, msg)
+		}
+	}
+}
+
+func TestGoldenBitstring(t *testing.T) {
+	if *updateGolden {
+		t.Skip("updating golden files")
+	}
+	for _, s := range []string{"1:80", "2:40", "9:8080", "16:a5c3"} {
+		bs := goldenBits(s)
+		name := "bitstring-" + strings.SplitN(s, ":", 2)[0]
+		read, err := ReadBitstring(bytes.NewBuffer(readGolden(t, name)))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 0, bs.Cmp(read))
+		assert.Equal(t, bs.BitLen(), read.BitLen())
+	}
+	read, err := ReadBitstring(bytes.NewBuffer(readGolden(t, "bitstring-0")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, read.BitLen())
+}
+
+func TestGoldenZZarray(t *testing.T) {
+	if *updateGolden {
+		t.Skip("updating golden files")
+	}
+	data := readGolden(t, "zzarray")
+	// A count, then each element in 17 bytes, least significant first.
+	assert.Equal(t, 4+len(goldenElements)*17, len(data))
+	arr, err := ReadZZarray(bytes.NewBuffer(data))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(goldenElements), len(arr))
+	for i := range arr {
+		assert.Equal(t, 0, goldenElements[i].Cmp(arr[i]))
+	}
+	arr, err = ReadZZarray(bytes.NewBuffer(readGolden(t, "zzarray-empty")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(arr))
+}
+
+func TestGoldenSession(t *testing.T) {
+	if *updateGolden {
+		t.Skip("updating golden files")
+	}
+	server, err := DecodeTranscript(bytes.NewBuffer(readGolden(t, "session-server")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, goldenConfig.Version, server.Config.Version)
+	assert.Equal(t, goldenConfig.MBar, server.Config.MBar)
+	assert.Equal(t, RemoteConfigPassed, server.Status)
+	assert.Equal(t, 6, len(server.Msgs))
+	_, is := server.Msgs[5].(*Done)
+	assert.T(t, is)
+
+	client, err := DecodeTranscript(bytes.NewBuffer(readGolden(t, "session-client")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, goldenConfig.BitQuantum, client.Config.BitQuantum)
+	assert.Equal(t, 2, len(client.Msgs))
+	full, is := client.Msgs[1].(*FullElements)
+	assert.T(t, is)
+	assert.T(t, full.Has(goldenElements[2]))
+}
@@ -26,7 +26,6 @@ import (
 	"fmt"
 	. "github.com/cmars/conflux"
 	"log"
-	"math/rand"
 	"net"
 	"time"
 )
@@ -54,11 +53,12 @@ func (p *Peer) Gossip() {
 			goto DELAY
 		}
 		log.Println(GOSSIP, "Initiating recon with peer", peer)
-		err = p.initiateRecon(peer)
+		_, err = p.initiateRecon(peer)
 		if err != nil {
 			log.Println(GOSSIP, "Recon error:", err)
 		}
 	DELAY:
+		p.gossipNamespaces()
 		delay := time.Duration(p.GossipIntervalSecs()) * time.Second
 		// jitter the delay
 		time.Sleep(delay)
@@ -66,34 +66,61 @@ func (p *Peer) Gossip() {
 }
 
 var NoPartnersError error = errors.New("That feel when no recon partner")
+var NoScheduledPartnersError error = errors.New("No recon partner scheduled at this time")
 var IncompatiblePeerError error = errors.New("Remote peer configuration is not compatible")
 
-func (p *Peer) choosePartner() (net.Addr, error) {
-	partners, err := p.PartnerAddrs()
-	if err != nil {
-		return nil, err
+func (p *Peer) choosePartner() (string, error) {
+	var partners []string
+	for _, partner := range p.Partners() {
+		if partner != "" {
+			partners = append(partners, partner)
+		}
 	}
 	if len(partners) == 0 {
-		return nil, NoPartnersError
+		return "", NoPartnersError
+	}
+	if partners = p.scheduledPartners(partners, time.Now()); len(partners) == 0 {
+		return "", NoScheduledPartnersError
 	}
-	return partners[rand.Intn(len(partners))], nil
+	sel, has := lookupPartnerSelector(p.PartnerSelection())
+	if !has {
+		sel = selectRandom
+	}
+	return sel(p, partners), nil
 }
 
-func (p *Peer) initiateRecon(peer net.Addr) error {
+var ErrPeerNotStarted error = errors.New("Peer is not started")
+
+// ReconcileNow runs a recon session with partner immediately, as a
+// client, outside of the gossip schedule. The partner need not be
+// configured. Recovered elements are sent to RecoverChan as they are
+// for gossip, so the peer must be started and its RecoverChan read.
+func (p *Peer) ReconcileNow(partner string) (stats SessionStats, err error) {
+	if p.reconCmdReq == nil {
+		return stats, ErrPeerNotStarted
+	}
+	stats, err = p.initiateRecon(partner)
+	stats.Partner = partner
+	return
+}
+
+func (p *Peer) initiateRecon(peer string) (stats SessionStats, err error) {
+	pc := p.PartnerConfig(peer)
+	if pc == nil {
+		pc = &PartnerConfig{Addr: peer}
+	}
+	defer func() { p.history.recordPartner(peer, stats.Recovered, err) }()
 	// Connect to peer
-	conn, err := net.DialTimeout(peer.Network(), peer.String(), time.Second)
+	conn, err := p.dialPartner(pc.dialAddr())
 	if err != nil {
-		return err
+		return
 	}
 	defer conn.Close()
-	if p.ReadTimeout() > 0 {
-		conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(p.ReadTimeout())))
-	}
-	remoteConfig, err := p.handleConfig(conn, GOSSIP)
-	// Interact with peer
-	return p.ExecCmd(func() error {
-		return p.clientRecon(conn, remoteConfig)
-	})
+	readTimeout := p.ReadTimeout()
+	if pc.ReadTimeout != 0 {
+		readTimeout = pc.ReadTimeout
+	}
+	return p.reconcileWith(p.withPartnerLimits(conn, pc), RoleClient, readTimeout)
 }
 
 type msgProgress struct {
@@ -107,10 +134,12 @@ type msgProgressChan chan *msgProgress
 
 var ReconDone = errors.New("Reconciliation Done")
 
-func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
+// clientRecon reconciles the elements with keys in scope,
+// or the whole tree if scope is nil.
+func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config, scope *Bitstring) ([]*Zp, error) {
 	respSet := NewZSet()
 	var pendingMessages []ReconMsg
-	for step := range p.interactWithServer(conn) {
+	for step := range p.interactWithServer(conn, scope) {
 		if step.err != nil {
 			if step.err == ReconDone {
 				log.Println(GOSSIP, "Reconcilation done.")
@@ -133,34 +162,64 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 		respSet.AddAll(step.elements)
 		log.Println(GOSSIP, "Recover set now:", respSet)
 	}
-	items := respSet.Items()
+	items := p.scopeElements(scope, respSet.Items())
 	if len(items) > 0 {
 		log.Println(GOSSIP, "Sending recover:", items)
-		p.RecoverChan <- &Recover{
-			RemoteAddr:     conn.RemoteAddr(),
-			RemoteConfig:   remoteConfig,
-			RemoteElements: items}
+		p.recoverElements(conn, remoteConfig, items)
 	}
-	return nil
+	return items, nil
 }
 
-func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
+// interactWithServer reads the server's requests, sending the progress
+// made by each on the returned channel, in order. The differences for
+// ReconRqstPoly requests are solved on a pool of workers, while
+// further requests are read.
+func (p *Peer) interactWithServer(conn net.Conn, scope *Bitstring) msgProgressChan {
 	out := make(msgProgressChan)
+	pending := make(chan chan *msgProgress, p.MaxOutstandingReconRequests())
+	reads := newTreeReads()
+	go forwardInOrder(pending, out, reads)
 	go func() {
+		defer close(pending)
+		var panicErr error
+		defer func() {
+			if panicErr != nil {
+				pending <- ready(&msgProgress{err: panicErr})
+			}
+		}()
+		defer recoverPanic(&panicErr)
+		pool := newInterpolationPool(p.InterpolationWorkers())
 		var resp *msgProgress
 		for resp == nil || resp.err == nil {
 			msg, err := ReadMsg(conn)
 			if err != nil {
 				log.Println(GOSSIP, "interact: msg err:", err)
-				out <- &msgProgress{err: err}
+				pending <- ready(&msgProgress{err: err})
 				return
 			}
+			select {
+			case <-reads.done:
+				return
+			default:
+			}
 			log.Println(GOSSIP, "interact: got msg:", msg)
+			var solve func() *msgProgress
 			switch m := msg.(type) {
 			case *ReconRqstPoly:
-				resp = p.handleReconRqstPoly(m)
+				if !inScope(m.Prefix, scope) {
+					resp = outOfScope(m.Prefix)
+				} else {
+					resp, solve = p.prepareReconRqstPoly(m, reads)
+				}
 			case *ReconRqstFull:
-				resp = p.handleReconRqstFull(m)
+				if !inScope(m.Prefix, scope) {
+					resp = outOfScope(m.Prefix)
+				} else if reads.lock() {
+					resp = p.handleReconRqstFull(m)
+					reads.unlock()
+				} else {
+					return
+				}
 			case *Elements:
 				log.Println(GOSSIP, "Elements:", m.ZSet)
 				resp = &msgProgress{elements: m.ZSet}
@@ -171,59 +230,130 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 			default:
 				resp = &msgProgress{err: errors.New(fmt.Sprintf("Unexpected message: %v", m))}
 			}
-			out <- resp
+			if solve != nil {
+				pending <- pool.run(solve)
+			} else {
+				pending <- ready(resp)
+			}
 		}
 	}()
 	return out
 }
 
+// outOfScope answers a request for a subtree outside the prefix
+// reconciled by the client as though it held no differences, so that
+// the server does not traverse it further.
+func outOfScope(prefix *Bitstring) *msgProgress {
+	log.Println(GOSSIP, "Request out of scope:", prefix)
+	return &msgProgress{elements: NewZSet(), messages: []ReconMsg{&Elements{ZSet: NewZSet()}}}
+}
+
 var ReconRqstPolyNotFound = errors.New("Peer should not receive a request for a non-existant node in ReconRqstPoly")
 
 func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly) *msgProgress {
+	resp, solve := p.prepareReconRqstPoly(rp, newTreeReads())
+	if solve != nil {
+		return solve()
+	}
+	return resp
+}
+
+// prepareReconRqstPoly checks a ReconRqstPoly and looks up its node,
+// returning either the failure, or a func which solves for the
+// differences. The prefix tree is read holding reads, so that solves
+// may run concurrently.
+func (p *Peer) prepareReconRqstPoly(rp *ReconRqstPoly, reads *treeReads) (*msgProgress, func() *msgProgress) {
 	remoteSize := rp.Size
 	points := p.Points()
 	remoteSamples := rp.Samples
+	if len(remoteSamples) != len(points) {
+		return &msgProgress{err: errors.New(fmt.Sprintf(
+			"Expected %d samples in ReconRqstPoly, received %d", len(points), len(remoteSamples)))}, nil
+	}
+	if err := p.checkRemoteP(remoteSamples...); err != nil {
+		return &msgProgress{err: err}, nil
+	}
+	if !reads.lock() {
+		return &msgProgress{err: errSessionEnded}, nil
+	}
+	defer reads.unlock()
 	node, err := p.Node(rp.Prefix)
 	if err == PNodeNotFound {
-		return &msgProgress{err: ReconRqstPolyNotFound}
+		return &msgProgress{err: ReconRqstPolyNotFound}, nil
+	} else if err != nil {
+		return &msgProgress{err: err}, nil
+	}
+	localSamples, err := node.SValues()
+	if err != nil {
+		return &msgProgress{err: err}, nil
 	}
-	localSamples := node.SValues()
 	localSize := node.Size()
-	remoteSet, localSet, err := p.solve(
-		remoteSamples, localSamples, remoteSize, localSize, points)
-	if err == LowMBar {
-		log.Println(GOSSIP, "Low MBar")
-		if node.IsLeaf() || node.Size() < (p.ThreshMult()*p.MBar()) {
-			log.Println(GOSSIP, "Sending full elements for node:", node.Key())
-			return &msgProgress{elements: NewZSet(), messages: []ReconMsg{&FullElements{ZSet: NewZSet(node.Elements()...)}}}
+	sendFull := node.IsLeaf() || localSize < (p.ThreshMult()*p.MBar())
+	return nil, func() *msgProgress {
+		remoteSet, localSet, err := p.solve(
+			remoteSamples, localSamples, remoteSize, localSize, points)
+		if _, is := err.(*ErrInterpolationFailed); is {
+			log.Println(GOSSIP, "Low MBar")
+			if sendFull {
+				if !reads.lock() {
+					return &msgProgress{err: errSessionEnded}
+				}
+				defer reads.unlock()
+				log.Println(GOSSIP, "Sending full elements for node:", rp.Prefix)
+				elements, err := node.Elements()
+				if err != nil {
+					return &msgProgress{err: err}
+				}
+				return &msgProgress{elements: NewZSet(), messages: []ReconMsg{&FullElements{ZSet: NewZSet(elements...)}}}
+			}
 		}
+		if err != nil {
+			log.Println(GOSSIP, "sending SyncFail because", err)
+			return &msgProgress{elements: NewZSet(), messages: []ReconMsg{&SyncFail{}}}
+		}
+		log.Println(GOSSIP, "solved: localSet=", localSet, "remoteSet=", remoteSet)
+		return &msgProgress{elements: remoteSet, messages: []ReconMsg{&Elements{ZSet: p.serveElements(localSet)}}}
 	}
-	if err != nil {
-		log.Println(GOSSIP, "sending SyncFail because", err)
-		return &msgProgress{elements: NewZSet(), messages: []ReconMsg{&SyncFail{}}}
-	}
-	log.Println(GOSSIP, "solved: localSet=", localSet, "remoteSet=", remoteSet)
-	return &msgProgress{elements: remoteSet, messages: []ReconMsg{&Elements{ZSet: localSet}}}
 }
 
 func (p *Peer) solve(remoteSamples, localSamples []*Zp, remoteSize, localSize int, points []*Zp) (*ZSet, *ZSet, error) {
-	var values []*Zp
-	for i, x := range remoteSamples {
-		values = append(values, Z(x.P).Div(x, localSamples[i]))
+	values, err := SampleRatios(remoteSamples, localSamples)
+	if err != nil {
+		return nil, nil, err
 	}
 	log.Println(GOSSIP, "Reconcile", values, points, remoteSize-localSize)
-	return Reconcile(values, points, remoteSize-localSize)
+	return ReconcileRatios(values, points, remoteSize-localSize)
 }
 
 func (p *Peer) handleReconRqstFull(rf *ReconRqstFull) *msgProgress {
+	if err := p.checkRemoteP(rf.Elements.Items()...); err != nil {
+		return &msgProgress{err: err}
+	}
 	node, err := p.Node(rf.Prefix)
 	if err == PNodeNotFound {
 		return &msgProgress{err: ReconRqstPolyNotFound}
+	} else if err != nil {
+		return &msgProgress{err: err}
 	}
-	localset := NewZSet(node.Elements()...)
+	elements, err := node.Elements()
+	if err != nil {
+		return &msgProgress{err: err}
+	}
+	localset := NewZSet(elements...)
 	log.Println(GOSSIP, "localset=", localset)
-	localdiff := ZSetDiff(localset, rf.Elements)
-	remotediff := ZSetDiff(rf.Elements, localset)
+	localdiff := localset.Difference(rf.Elements)
+	remotediff := rf.Elements.Difference(localset)
 	log.Println(GOSSIP, "localdiff=", localdiff, "remotediff=", remotediff)
-	return &msgProgress{elements: remotediff, messages: []ReconMsg{&Elements{ZSet: localdiff}}}
+	return &msgProgress{elements: remotediff, messages: []ReconMsg{&Elements{ZSet: p.serveElements(localdiff)}}}
+}
+
+// checkRemoteP verifies that values received from the remote peer are
+// in the finite field of the prefix tree, so that arithmetic on them
+// cannot panic.
+func (p *Peer) checkRemoteP(values ...*Zp) error {
+	points := p.Points()
+	if len(points) == 0 {
+		return nil
+	}
+	return points[0].CheckP(values...)
 }
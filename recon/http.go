@@ -0,0 +1,143 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HttpUpgradeProtocol is the protocol named in the Upgrade header
+// when tunneling recon over an HTTP connection.
+const HttpUpgradeProtocol = "conflux-recon"
+
+func init() {
+	RegisterTransport("http", dialHttp)
+	RegisterTransport("https", dialHttp)
+}
+
+// ReconHandler returns an HTTP handler that accepts recon sessions
+// tunneled through an HTTP connection upgrade, for peers which can
+// only be reached through a web server port or reverse proxy.
+// Partners address it with a URL such as https://example.com/recon.
+func (p *Peer) ReconHandler() http.Handler {
+	return http.HandlerFunc(p.serveUpgrade)
+}
+
+func (p *Peer) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), HttpUpgradeProtocol) {
+		w.Header().Set("Upgrade", HttpUpgradeProtocol)
+		http.Error(w, "recon requires a connection upgrade", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Println(SERVE, err)
+		return
+	}
+	limited, err := p.AcquireConn(conn)
+	if err != nil {
+		log.Println(SERVE, err, "dropping:", conn.RemoteAddr())
+		fmt.Fprintf(rw, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		rw.Flush()
+		conn.Close()
+		return
+	}
+	conn = limited
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n",
+		HttpUpgradeProtocol)
+	if err = rw.Flush(); err != nil {
+		log.Println(SERVE, err)
+		conn.Close()
+		return
+	}
+	err = p.Accept(p.withTimeouts(&bufferedConn{Conn: conn, r: rw.Reader}))
+	if err != nil {
+		log.Println(SERVE, err)
+	}
+}
+
+func dialHttp(addr string, timeout time.Duration) (conn net.Conn, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostport := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			hostport = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostport, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", hostport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Host:   u.Host,
+		Header: make(http.Header)}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", HttpUpgradeProtocol)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("Upgrade to recon refused by %s: %s", addr, resp.Status))
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
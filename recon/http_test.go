@@ -0,0 +1,83 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpUpgradeRecon(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	startCmds(server)
+	startCmds(client)
+	mux := http.NewServeMux()
+	mux.Handle("/recon", server.ReconHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	conn, err := client.dialPartner(ts.URL + "/recon")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	clientErr := make(chan error)
+	go func() {
+		_, err := client.ReconcileWith(conn, RoleClient)
+		clientErr <- err
+	}()
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, <-clientErr)
+}
+
+func TestHttpUpgradeRequired(t *testing.T) {
+	ts := httptest.NewServer(NewMemPeer().ReconHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+}
+
+func TestHttpUpgradeLimit(t *testing.T) {
+	p := NewMemPeer()
+	p.limiter = newConnLimiter(0, 1)
+	ts := httptest.NewServer(p.ReconHandler())
+	defer ts.Close()
+	conn, err := p.dialPartner(ts.URL)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	// The session holds the only slot for the host until closed
+	_, err = p.dialPartner(ts.URL)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPartnerScheme(t *testing.T) {
+	assert.Equal(t, "tcp", PartnerScheme("keys.example.com:11370"))
+	assert.Equal(t, "https", PartnerScheme("https://keys.example.com/recon"))
+}
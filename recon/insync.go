@@ -0,0 +1,93 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// SyncCheck enables announcing a summary of the prefix tree in the
+// handshake, so that a session between two peers which both announce
+// the same summary ends without reconciling. The summary is a digest
+// of the elements if the tree maintains one, and is otherwise the size
+// and sample values of the root.
+func (s *Settings) SyncCheck() bool {
+	return s.GetBool("conflux.recon.syncCheck", false)
+}
+
+// syncSummary summarizes the prefix tree for the sync check, returning
+// the custom configuration key under which it is announced. The root
+// summary is the size of the root and a digest of its sample values,
+// which differ for any two sets with overwhelming probability.
+func (p *Peer) syncSummary() (key, summary string, err error) {
+	err = p.ExecCmd(func() error {
+		if dt, is := p.PrefixTree.(DigestTree); is {
+			key, summary = "digest", dt.Digest().String()
+			return nil
+		}
+		root, err := p.Root()
+		if err != nil {
+			return err
+		}
+		svalues, err := root.SValues()
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		for _, sv := range svalues {
+			h.Write([]byte(sv.String() + ","))
+		}
+		key = "root"
+		summary = fmt.Sprintf("%d:%s", root.Size(), hex.EncodeToString(h.Sum(nil)[:16]))
+		return nil
+	})
+	return
+}
+
+// withSyncSummary adds the tree summary to the configuration sent
+// in the handshake, if the sync check is enabled.
+func (p *Peer) withSyncSummary(config *Config) *Config {
+	if !p.SyncCheck() {
+		return config
+	}
+	key, summary, err := p.syncSummary()
+	if err != nil {
+		return config
+	}
+	if config.Custom == nil {
+		config.Custom = make(map[string]string)
+	}
+	config.Custom[key] = summary
+	return config
+}
+
+// inSync returns whether both peers announced the same tree summary.
+func inSync(local, remote *Config) bool {
+	for _, key := range []string{"digest", "root"} {
+		if summary, has := local.Custom[key]; has {
+			return remote.Custom[key] == summary
+		}
+	}
+	return false
+}
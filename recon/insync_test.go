@@ -0,0 +1,99 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestSyncCheckInSync(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.syncCheck", true)
+	client.Settings.Set("conflux.recon.syncCheck", true)
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	s := reconcile(t, server, client)
+	assert.T(t, s.ss.InSync)
+	assert.T(t, s.cs.InSync)
+	assert.Equal(t, 0, s.ss.Subtrees)
+	_, has := s.cs.RemoteConfig.Custom["digest"]
+	assert.T(t, has)
+	// Only the configuration is exchanged
+	assert.Equal(t, 1, s.cs.MsgsSent)
+	assert.Equal(t, 1, s.cs.MsgsReceived)
+}
+
+// plainTree hides the digest maintained by a prefix tree.
+type plainTree struct {
+	PrefixTree
+}
+
+func TestSyncCheckRootSummary(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.syncCheck", true)
+	client.Settings.Set("conflux.recon.syncCheck", true)
+	server.PrefixTree = &plainTree{server.PrefixTree}
+	client.PrefixTree = &plainTree{client.PrefixTree}
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	s := reconcile(t, server, client)
+	assert.T(t, s.ss.InSync)
+	assert.T(t, s.cs.InSync)
+	key, _, err := server.syncSummary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "root", key)
+}
+
+func TestSyncCheckOutOfSync(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.syncCheck", true)
+	client.Settings.Set("conflux.recon.syncCheck", true)
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	s := reconcile(t, server, client)
+	assert.T(t, !s.ss.InSync)
+	assert.T(t, !s.cs.InSync)
+	assert.Equal(t, 1, s.cs.Recovered)
+}
+
+func TestSyncCheckOneSided(t *testing.T) {
+	// A peer without the sync check reconciles as usual
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.syncCheck", true)
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	s := reconcile(t, server, client)
+	assert.T(t, !s.ss.InSync)
+	assert.T(t, !s.cs.InSync)
+	assert.T(t, s.ss.Subtrees > 0)
+}
@@ -0,0 +1,136 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// InterpolationWorkers is the number of ReconRqstPoly requests for
+// which a client solves the differences at once, within a session.
+// The server sends several requests before flushing, for differing
+// subtrees which may be solved independently. Defaults to the number
+// of CPUs.
+func (s *Settings) InterpolationWorkers() int {
+	return s.GetInt("conflux.recon.interpolationWorkers", runtime.NumCPU())
+}
+
+// interpolationPool runs the solves of a session on a bounded number
+// of goroutines.
+type interpolationPool struct {
+	sem chan struct{}
+}
+
+func newInterpolationPool(workers int) *interpolationPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &interpolationPool{sem: make(chan struct{}, workers)}
+}
+
+// run starts solve once a worker is free, returning a channel which
+// receives its result. A panic in solve is returned as an error.
+func (ip *interpolationPool) run(solve func() *msgProgress) chan *msgProgress {
+	result := make(chan *msgProgress, 1)
+	ip.sem <- struct{}{}
+	go func() {
+		defer func() { <-ip.sem }()
+		var resp *msgProgress
+		var panicErr error
+		defer func() {
+			if panicErr != nil {
+				resp = &msgProgress{err: panicErr}
+			}
+			result <- resp
+		}()
+		defer recoverPanic(&panicErr)
+		resp = solve()
+	}()
+	return result
+}
+
+// ready returns a channel holding a result already known.
+func ready(resp *msgProgress) chan *msgProgress {
+	result := make(chan *msgProgress, 1)
+	result <- resp
+	return result
+}
+
+// treeReads serializes the reads of the prefix tree made by a client
+// session's reader and its workers, and ends them once the session has
+// given up, after which the tree may be changed by other commands.
+type treeReads struct {
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func newTreeReads() *treeReads {
+	return &treeReads{done: make(chan struct{})}
+}
+
+// lock holds the tree for reading, returning false without
+// holding it if the session has given up.
+func (t *treeReads) lock() bool {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *treeReads) unlock() {
+	t.mu.Unlock()
+}
+
+// stop ends the reads of the tree, once any in progress is done.
+func (t *treeReads) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	close(t.done)
+}
+
+// errSessionEnded is the result of a request
+// read after the session has given up.
+var errSessionEnded = errors.New("Session ended")
+
+// forwardInOrder sends the results on out in the order their channels
+// were queued on pending. Once an error is sent, the client has given
+// up on the session, so the remaining results are discarded, and reads
+// of the tree are stopped before the error is sent.
+func forwardInOrder(pending chan chan *msgProgress, out msgProgressChan, reads *treeReads) {
+	failed := false
+	for result := range pending {
+		resp := <-result
+		if !failed {
+			if resp.err != nil {
+				reads.stop()
+			}
+			out <- resp
+		}
+		failed = failed || resp.err != nil
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInterpolationPool(t *testing.T) {
+	pool := newInterpolationPool(2)
+	pending := make(chan chan *msgProgress, 10)
+	out := make(msgProgressChan)
+	reads := newTreeReads()
+	go forwardInOrder(pending, out, reads)
+	var running, most int32
+	for i := 0; i < 6; i++ {
+		i := i
+		pending <- pool.run(func() *msgProgress {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			// Later requests finish first
+			time.Sleep(time.Duration(6-i) * 5 * time.Millisecond)
+			return &msgProgress{elements: NewZSet(Zi(P_SKS, i))}
+		})
+	}
+	pending <- pool.run(func() *msgProgress { panic("solve failed") })
+	pending <- ready(&msgProgress{err: errors.New("not forwarded")})
+	close(pending)
+	for i := 0; i < 6; i++ {
+		resp := <-out
+		assert.T(t, resp.elements.Has(Zi(P_SKS, i)))
+	}
+	resp := <-out
+	_, is := resp.err.(*PanicError)
+	assert.T(t, is)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&most))
+	// The tree is no longer read once the session has failed
+	assert.T(t, !reads.lock())
+}
+
+// Test that solving differing subtrees concurrently recovers the same
+// elements as solving them one at a time.
+func TestReconcileWithWorkers(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		server, client := NewMemPeer(), NewMemPeer()
+		client.Settings.Set("conflux.recon.interpolationWorkers", workers)
+		serverOnly, clientOnly := NewZSet(), NewZSet()
+		for i := 1; i <= 1000; i++ {
+			z := Zi(P_SKS, 65537*i)
+			switch {
+			case i%97 == 0:
+				server.PrefixTree.Insert(z)
+				serverOnly.Add(z)
+			case i%89 == 0:
+				client.PrefixTree.Insert(z)
+				clientOnly.Add(z)
+			default:
+				server.PrefixTree.Insert(z)
+				client.PrefixTree.Insert(z)
+			}
+		}
+		s := reconcile(t, server, client)
+		assert.T(t, clientOnly.Equal(s.serverSet))
+		assert.T(t, serverOnly.Equal(s.clientSet))
+	}
+}
@@ -0,0 +1,106 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalPath is the file to which recon sessions are journaled.
+// The journal is disabled if empty.
+func (s *Settings) JournalPath() string {
+	return s.GetString("conflux.recon.journal", "")
+}
+
+// JournalEntry records a single recon session.
+type JournalEntry struct {
+	Role         string    `json:"role"`
+	Partner      string    `json:"partner"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	LocalConfig  *Config   `json:"localConfig"`
+	RemoteConfig *Config   `json:"remoteConfig,omitempty"`
+	MsgsSent     int       `json:"msgsSent"`
+	MsgsReceived int       `json:"msgsReceived"`
+	Recovered    []string  `json:"recovered,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Journal is an append-only record of recon sessions.
+type Journal interface {
+	Record(entry *JournalEntry) error
+}
+
+// FileJournal appends journal entries to a file as lines of JSON.
+type FileJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{file: file}, nil
+}
+
+func (j *FileJournal) Record(entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.file.Write(append(data, '\n'))
+	return err
+}
+
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+func (p *Peer) record(stats *SessionStats, err error) {
+	entry := &JournalEntry{
+		Role:         stats.Role.Name(),
+		Partner:      stats.Partner,
+		Start:        stats.Start,
+		End:          stats.Start.Add(stats.Duration),
+		LocalConfig:  p.Config(),
+		RemoteConfig: stats.RemoteConfig,
+		MsgsSent:     stats.MsgsSent,
+		MsgsReceived: stats.MsgsReceived}
+	for _, z := range stats.Elements {
+		entry.Recovered = append(entry.Recovered, fmt.Sprintf("%x", z.Bytes()))
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := p.Journal.Record(entry); err != nil {
+		log.Println(stats.Role, "journal:", err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	journal, err := OpenFileJournal(path)
+	assert.Equal(t, nil, err)
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Journal = journal
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	s := reconcile(t, server, client)
+	journal.Close()
+
+	f, err := os.Open(path)
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	assert.T(t, scanner.Scan())
+	var entry JournalEntry
+	assert.Equal(t, nil, json.Unmarshal(scanner.Bytes(), &entry))
+	assert.Equal(t, "server", entry.Role)
+	assert.Equal(t, s.ss.Partner, entry.Partner)
+	assert.Equal(t, server.MBar(), entry.RemoteConfig.MBar)
+	assert.T(t, entry.MsgsSent > 1)
+	assert.T(t, entry.MsgsReceived > 1)
+	assert.Equal(t, []string{fmt.Sprintf("%x", Zi(P_SKS, 65541).Bytes())}, entry.Recovered)
+	assert.Equal(t, "", entry.Error)
+	assert.T(t, !entry.End.Before(entry.Start))
+	assert.T(t, !scanner.Scan())
+}
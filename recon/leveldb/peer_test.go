@@ -22,8 +22,11 @@
 package leveldb
 
 import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
 	"github.com/cmars/conflux/recon"
 	. "github.com/cmars/conflux/testing"
+	"net"
 	"testing"
 )
 
@@ -53,3 +56,54 @@ func TestPolySyncMBar(t *testing.T) {
 func TestPolySyncLowMBar(t *testing.T) {
 	RunPolySyncLowMBar(t, &ldbPeerManager{t})
 }
+
+// Test reconciling a prefix of keys deeper than the tree, where no
+// node is stored under the prefix.
+func TestReconcileDeepPrefix(t *testing.T) {
+	server, serverPath := createTestPeer(t)
+	defer destroyTestPeer(server, serverPath)
+	client, clientPath := createTestPeer(t)
+	defer destroyTestPeer(client, clientPath)
+	server.Settings.Set("conflux.recon.prefix", "01")
+	client.Settings.Set("conflux.recon.readTimeout", 10)
+	keys := recon.TreeKeys(server.PrefixTree)
+	var inside int
+	for i := 1; i < 50; i++ {
+		z := Zi(P_SKS, 65537*i)
+		assert.Equal(t, nil, server.PrefixTree.Insert(z))
+		if bs := keys.Key(z); bs.Get(0) == 0 && bs.Get(1) == 1 {
+			inside++
+		}
+	}
+	root, err := server.PrefixTree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, root.IsLeaf())
+	assert.T(t, inside > 0)
+	server.StartCmds()
+	defer server.StopCmds()
+	client.StartCmds()
+	defer client.StopCmds()
+	go func() {
+		for _ = range client.RecoverChan {
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	done := make(chan error)
+	go func() {
+		serverConn, err := ln.Accept()
+		if err == nil {
+			defer serverConn.Close()
+			_, err = server.ReconcileWith(serverConn, recon.RoleServer)
+		}
+		done <- err
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Equal(t, nil, err)
+	defer clientConn.Close()
+	stats, err := client.ReconcileWith(clientConn, recon.RoleClient)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, <-done)
+	assert.Equal(t, inside, stats.Recovered)
+}
@@ -29,7 +29,9 @@ import (
 	. "github.com/cmars/conflux"
 	"github.com/cmars/conflux/recon"
 	"github.com/jmhodges/levigo"
+	"io"
 	"os"
+	"path/filepath"
 )
 
 func NewPeer(settings *DbSettings) (p *recon.Peer, err error) {
@@ -37,12 +39,17 @@ func NewPeer(settings *DbSettings) (p *recon.Peer, err error) {
 	if err != nil {
 		return nil, err
 	}
-	tree, err := newPrefixTree(settings)
+	var tree recon.PrefixTree
+	if settings.Sharded() {
+		tree, err = newShardedTree(settings)
+	} else {
+		tree, err = newPrefixTree(settings, settings.DbPath())
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &recon.Peer{
-		RecoverChan: make(recon.RecoverChan),
+		RecoverChan: make(recon.RecoverChan, settings.RecoverBuffer()),
 		Settings:    settings.Settings,
 		PrefixTree:  tree}, nil
 }
@@ -69,11 +76,107 @@ type prefixTree struct {
 	rdOptions *levigo.ReadOptions
 	wrOptions *levigo.WriteOptions
 	points    []*Zp
+	// Node writes pending in a batch, if any
+	batch *nodeBatch
+	// Element arrays of a bulk insert in progress, if any
+	arrays *recon.ElementArrays
+}
+
+// nodeBatch collects the node writes of an insert or remove, to
+// commit them together. Values written to the batch are read from it
+// until it is committed.
+type nodeBatch struct {
+	wb *levigo.WriteBatch
+	// Values written, by key, nil if deleted
+	values map[string][]byte
+}
+
+func (t *prefixTree) beginBatch() {
+	t.batch = &nodeBatch{wb: levigo.NewWriteBatch(), values: make(map[string][]byte)}
+}
+
+// endBatch commits the pending node writes, or discards them if the
+// operation which made them failed, setting *err if the commit fails.
+// It is deferred by the operation, so that the batch is discarded,
+// rather than left pending, if the operation panics.
+func (t *prefixTree) endBatch(err *error) {
+	batch := t.batch
+	t.batch = nil
+	defer batch.wb.Close()
+	if r := recover(); r != nil {
+		panic(r)
+	}
+	if *err == nil {
+		*err = t.ptree.Write(t.wrOptions, batch.wb)
+	}
+}
+
+// get reads the value stored with a key, from the pending batch if it
+// was written there. A missing key has a nil value.
+func (t *prefixTree) get(key []byte) ([]byte, error) {
+	if t.batch != nil {
+		if value, pending := t.batch.values[string(key)]; pending {
+			return value, nil
+		}
+	}
+	return t.ptree.Get(t.rdOptions, key)
+}
+
+// put stores a value with a key, in the pending batch if there is one.
+func (t *prefixTree) put(key, value []byte) error {
+	if t.batch != nil {
+		t.batch.wb.Put(key, value)
+		t.batch.values[string(key)] = value
+		return nil
+	}
+	return t.ptree.Put(t.wrOptions, key, value)
+}
+
+// delete removes the value stored with a key, in the pending batch if
+// there is one.
+func (t *prefixTree) delete(key []byte) error {
+	if t.batch != nil {
+		t.batch.wb.Delete(key)
+		t.batch.values[string(key)] = nil
+		return nil
+	}
+	return t.ptree.Delete(t.wrOptions, key)
 }
 
-func newPrefixTree(s *DbSettings) (tree *prefixTree, err error) {
+// elementsPrefix begins the keys under which the elements of leaf
+// nodes are stored, apart from the nodes themselves, so that reading
+// a node for its sample values does not read its elements too. A node
+// key begins with its 32-bit bit length, so its first byte is always
+// zero, and never this prefix.
+var elementsPrefix = []byte("elements:")
+
+// elementsKey returns the key of the elements of the node stored with
+// the given key.
+func elementsKey(nodeKey []byte) []byte {
+	return append(append([]byte(nil), elementsPrefix...), nodeKey...)
+}
+
+// newShardedTree opens a database for each top-level prefix of
+// the tree, in subdirectories of the database path.
+func newShardedTree(s *DbSettings) (recon.PrefixTree, error) {
+	var shards []recon.PrefixTree
+	for i := 0; i < 1<<uint(s.BitQuantum()); i++ {
+		path := filepath.Join(s.DbPath(), fmt.Sprintf("shard-%d", i))
+		if err := initDb(path); err != nil {
+			return nil, err
+		}
+		shard, err := newPrefixTree(s, path)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return recon.NewShardedPrefixTree(shards...)
+}
+
+func newPrefixTree(s *DbSettings, path string) (tree *prefixTree, err error) {
 	tree = &prefixTree{DbSettings: s}
-	tree.points = Zpoints(P_SKS, tree.NumSamples())
+	tree.points = Zpoints(s.Prime(), tree.NumSamples())
 	tree.options = levigo.NewOptions()
 	tree.options.SetErrorIfExists(false)
 	tree.options.SetCreateIfMissing(true)
@@ -89,8 +192,8 @@ func newPrefixTree(s *DbSettings) (tree *prefixTree, err error) {
 	tree.rdOptions.SetVerifyChecksums(false)
 	tree.rdOptions.SetFillCache(false)
 	tree.wrOptions = levigo.NewWriteOptions()
-	tree.wrOptions.SetSync(false)
-	tree.ptree, err = levigo.Open(s.DbPath(), tree.options)
+	tree.wrOptions.SetSync(s.Sync())
+	tree.ptree, err = levigo.Open(path, tree.options)
 	if err != nil {
 		return
 	}
@@ -116,17 +219,22 @@ func (t *prefixTree) ensureRoot() error {
 
 func (t *prefixTree) Points() []*Zp { return t.points }
 
+// Keys returns SKS keys, by which the tree locates elements
+// regardless of the keys setting.
+func (t *prefixTree) Keys() KeyStrategy { return SksKeys }
+
 func (t *prefixTree) Root() (recon.PrefixNode, error) {
 	return t.Node(NewBitstring(0))
 }
 
 func (t *prefixTree) Node(bs *Bitstring) (node recon.PrefixNode, err error) {
-	key := bytes.NewBuffer([]byte{})
+	key := recon.GetBuffer()
+	defer recon.PutBuffer(key)
 	err = recon.WriteBitstring(key, bs)
 	if err != nil {
 		return
 	}
-	ndRaw, err := t.ptree.Get(t.rdOptions, key.Bytes())
+	ndRaw, err := t.get(key.Bytes())
 	if err != nil {
 		return
 	}
@@ -134,59 +242,187 @@ func (t *prefixTree) Node(bs *Bitstring) (node recon.PrefixNode, err error) {
 		err = ErrKeyNotFound
 		return
 	}
+	return t.decodeNode(ndRaw)
+}
+
+func (t *prefixTree) decodeNode(ndRaw []byte) (recon.PrefixNode, error) {
 	dec := gob.NewDecoder(bytes.NewBuffer(ndRaw))
 	nd := new(nodeData)
-	err = dec.Decode(nd)
+	if err := dec.Decode(nd); err != nil {
+		return nil, err
+	}
+	return t.loadNode(nd)
+}
+
+// NodesAtDepth returns the nodes at a depth of the tree, in key order.
+// A node key begins with its bit length, so each level is read with
+// a range scan of the keys sharing it. Nodes left behind by a join
+// are stored at the same depths as those in the tree, so each level
+// down to depth is scanned, keeping only the children of the split
+// nodes above.
+func (t *prefixTree) NodesAtDepth(depth int) ([]recon.PrefixNode, error) {
+	if depth < 0 {
+		return nil, nil
+	}
+	root, err := t.Root()
 	if err != nil {
+		return nil, err
+	}
+	level := []recon.PrefixNode{root}
+	for d := 1; d <= depth && len(level) > 0; d++ {
+		parents := make(map[string]bool)
+		for _, node := range level {
+			if !node.IsLeaf() {
+				parents[node.(*prefixNode).key.String()] = true
+			}
+		}
+		if len(parents) == 0 {
+			return nil, nil
+		}
+		nodes, err := t.scanLevel(d)
+		if err != nil {
+			return nil, err
+		}
+		level = level[:0]
+		for _, node := range nodes {
+			key := node.(*prefixNode).key
+			if parents[key.Prefix(key.BitLen()-t.BitQuantum()).String()] {
+				level = append(level, node)
+			}
+		}
+	}
+	return level, nil
+}
+
+// scanLevel reads the nodes stored at a depth, in key order, whether
+// or not they are reachable from the root.
+func (t *prefixTree) scanLevel(depth int) (nodes []recon.PrefixNode, err error) {
+	prefix := recon.GetBuffer()
+	defer recon.PutBuffer(prefix)
+	if err = recon.WriteInt(prefix, depth*t.BitQuantum()); err != nil {
 		return
 	}
-	return t.loadNode(nd)
+	it := t.ptree.NewIterator(t.rdOptions)
+	defer it.Close()
+	for it.Seek(prefix.Bytes()); it.Valid() && bytes.HasPrefix(it.Key(), prefix.Bytes()); it.Next() {
+		node, err := t.decodeNode(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, it.GetError()
 }
 
-func (t *prefixTree) Insert(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
+// Insert adds an element to the tree, writing the nodes it changes,
+// including those created by a split, in a single batch.
+func (t *prefixTree) Insert(z *Zp) (err error) {
+	bs := ZpBitstring(z)
 	root, err := t.Root()
 	if err != nil {
 		return err
 	}
-	return root.(*prefixNode).insert(z, recon.AddElementArray(t, z), bs, 0)
+	t.beginBatch()
+	defer t.endBatch(&err)
+	return root.(*prefixNode).insert(z, t.arrays.Get(t, z), bs, 0)
 }
 
-func (t *prefixTree) Remove(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
+// InsertAll adds elements to the tree, computing the element array of
+// each once, for its whole path and any splits along it. The nodes
+// changed are written in a single batch.
+func (t *prefixTree) InsertAll(elements []*Zp) (err error) {
+	t.arrays = recon.NewElementArrays(t, elements)
+	defer func() { t.arrays = nil }()
 	root, err := t.Root()
 	if err != nil {
 		return err
 	}
+	t.beginBatch()
+	defer t.endBatch(&err)
+	for _, z := range elements {
+		err = root.(*prefixNode).insert(z, t.arrays.Get(t, z), ZpBitstring(z), 0)
+		if err != nil {
+			return err
+		}
+		// The root was rewritten in the batch
+		if root, err = t.Root(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes an element from the tree, writing the nodes it
+// changes in a single batch. It returns a *recon.NotFoundError,
+// changing nothing, if the element is not in the tree.
+func (t *prefixTree) Remove(z *Zp) (err error) {
+	if err = recon.CheckRemove(t, z); err != nil {
+		return err
+	}
+	bs := ZpBitstring(z)
+	root, err := t.Root()
+	if err != nil {
+		return err
+	}
+	t.beginBatch()
+	defer t.endBatch(&err)
 	return root.(*prefixNode).remove(z, recon.DelElementArray(t, z), bs, 0)
 }
 
+// NodeKeys returns the keys of all the nodes stored in the database.
+func (t *prefixTree) NodeKeys() (keys []*Bitstring, err error) {
+	it := t.ptree.NewIterator(t.rdOptions)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if bytes.HasPrefix(it.Key(), elementsPrefix) {
+			continue
+		}
+		key, err := recon.ReadBitstring(bytes.NewBuffer(it.Key()))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, it.GetError()
+}
+
+// DeleteNode deletes the node stored with a key, and its elements.
+func (t *prefixTree) DeleteNode(bs *Bitstring) (err error) {
+	key := recon.GetBuffer()
+	defer recon.PutBuffer(key)
+	if err = recon.WriteBitstring(key, bs); err != nil {
+		return err
+	}
+	t.beginBatch()
+	defer t.endBatch(&err)
+	if err = t.delete(key.Bytes()); err != nil {
+		return err
+	}
+	return t.delete(elementsKey(key.Bytes()))
+}
+
 func (t *prefixTree) newChildNode(parent *prefixNode, childIndex int) (*prefixNode, error) {
-	n := &prefixNode{prefixTree: t}
+	// A new node has no elements, replacing any left by a node once
+	// stored with its key.
+	n := &prefixNode{prefixTree: t, elementsLoaded: true}
 	if parent != nil {
-		parentKey := parent.Key()
-		n.key = NewBitstring(parentKey.BitLen() + t.BitQuantum())
-		n.key.SetBytes(parentKey.Bytes())
-		for j := 0; j < parent.BitQuantum(); j++ {
-			if (childIndex>>uint(j))&0x1 == 1 {
-				n.key.Set(parentKey.BitLen() + j)
-			} else {
-				n.key.Unset(parentKey.BitLen() + j)
-			}
-		}
+		n.key = parent.key.AppendUint(uint(childIndex), parent.BitQuantum())
 	} else {
 		n.key = NewBitstring(0)
 	}
 	n.svalues = make([]*Zp, t.NumSamples())
 	for i := 0; i < len(n.svalues); i++ {
-		n.svalues[i] = Zi(P_SKS, 1)
+		n.svalues[i] = Zi(recon.TreePrime(t), 1)
 	}
 	err := t.saveNode(n)
 	return n, err
 }
 
+// fieldReader reads integers stored in the finite field of the tree.
+func (t *prefixTree) fieldReader(buf []byte) io.Reader {
+	return recon.NewFieldReader(bytes.NewBuffer(buf), recon.TreePrime(t))
+}
+
 func (t *prefixTree) loadNode(nd *nodeData) (n *prefixNode, err error) {
 	n = &prefixNode{prefixTree: t}
 	n.key, err = recon.ReadBitstring(bytes.NewBuffer(nd.KeyBuf))
@@ -194,39 +430,48 @@ func (t *prefixTree) loadNode(nd *nodeData) (n *prefixNode, err error) {
 		return
 	}
 	n.numElements = nd.NumElements
-	n.svalues, err = recon.ReadZZarray(bytes.NewBuffer(nd.SvaluesBuf))
+	n.svalues, err = recon.ReadZZarray(t.fieldReader(nd.SvaluesBuf))
 	if err != nil {
 		return
 	}
-	n.elements, err = recon.ReadZZarray(bytes.NewBuffer(nd.ElementsBuf))
-	if err != nil {
-		return
+	if nd.ElementsBuf != nil {
+		// Stored before elements were kept apart from the node
+		n.elements, err = recon.ReadZZarray(t.fieldReader(nd.ElementsBuf))
+		if err != nil {
+			return
+		}
+		n.elementsLoaded = true
 	}
 	n.childKeys = nd.ChildKeys
 	return
 }
 
+// saveNode writes a node, and its elements if they were read. Its
+// fields are encoded in pooled buffers, which the gob encoding copies,
+// but the encoded node itself is kept by a pending batch, so it has a
+// buffer of its own.
 func (t *prefixTree) saveNode(n *prefixNode) (err error) {
+	if t.batch == nil {
+		t.beginBatch()
+		defer t.endBatch(&err)
+	}
 	nd := &nodeData{}
-	var out *bytes.Buffer
 	// Write key
-	out = bytes.NewBuffer(nil)
-	err = recon.WriteBitstring(out, n.key)
+	key := recon.GetBuffer()
+	defer recon.PutBuffer(key)
+	err = recon.WriteBitstring(key, n.key)
 	if err != nil {
 		return
 	}
-	nd.KeyBuf = out.Bytes()
+	nd.KeyBuf = key.Bytes()
 	// Write sample values
-	out = bytes.NewBuffer(nil)
-	err = recon.WriteZZarray(out, n.svalues)
+	svalues := recon.GetBuffer()
+	defer recon.PutBuffer(svalues)
+	err = recon.WriteZZarray(svalues, n.svalues)
 	if err != nil {
 		return
 	}
-	nd.SvaluesBuf = out.Bytes()
-	// Write elements
-	out = bytes.NewBuffer(nil)
-	err = recon.WriteZZarray(out, n.elements)
-	nd.ElementsBuf = out.Bytes()
+	nd.SvaluesBuf = svalues.Bytes()
 	nd.NumElements = n.numElements
 	nd.ChildKeys = n.childKeys
 	ndBuf := bytes.NewBuffer(nil)
@@ -235,14 +480,61 @@ func (t *prefixTree) saveNode(n *prefixNode) (err error) {
 	if err != nil {
 		return
 	}
-	err = t.ptree.Put(t.wrOptions, nd.KeyBuf, ndBuf.Bytes())
-	return
+	if err = t.put(nd.KeyBuf, ndBuf.Bytes()); err != nil {
+		return
+	}
+	return n.saveElements(nd.KeyBuf)
+}
+
+// saveElements writes the elements of a leaf, if they were read, with
+// the key of the node, or deletes them if the node has split.
+func (n *prefixNode) saveElements(nodeKey []byte) error {
+	if !n.elementsLoaded {
+		return nil
+	}
+	if !n.IsLeaf() {
+		return n.delete(elementsKey(nodeKey))
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := recon.WriteZZarray(buf, n.elements); err != nil {
+		return err
+	}
+	return n.put(elementsKey(nodeKey), buf.Bytes())
 }
 
+// loadElements reads the elements of a leaf, which are not read with
+// the node itself, since comparing nodes needs only their sample
+// values.
+func (n *prefixNode) loadElements() error {
+	if n.elementsLoaded || !n.IsLeaf() {
+		return nil
+	}
+	key := recon.GetBuffer()
+	defer recon.PutBuffer(key)
+	if err := recon.WriteBitstring(key, n.key); err != nil {
+		return err
+	}
+	raw, err := n.get(elementsKey(key.Bytes()))
+	if err != nil {
+		return err
+	}
+	if raw != nil {
+		if n.elements, err = recon.ReadZZarray(n.fieldReader(raw)); err != nil {
+			return err
+		}
+	}
+	n.elementsLoaded = true
+	return nil
+}
+
+// nodeData is the gob-encoded form in which a node is stored. Gob
+// matches fields by name, so renaming a field loses its value in
+// nodes already stored.
 type nodeData struct {
 	KeyBuf      []byte
 	NumElements int
 	SvaluesBuf  []byte
+	// Elements of a node stored before they were kept apart from it
 	ElementsBuf []byte
 	ChildKeys   []int
 }
@@ -252,66 +544,100 @@ type prefixNode struct {
 	key         *Bitstring
 	numElements int
 	svalues     []*Zp
-	elements    []*Zp
-	childKeys   []int
+	// Elements of a leaf, once read
+	elements       []*Zp
+	elementsLoaded bool
+	childKeys      []int
 }
 
 func (n *prefixNode) IsLeaf() bool {
 	return len(n.childKeys) == 0
 }
 
-func (n *prefixNode) Children() (result []recon.PrefixNode) {
-	key := n.Key()
+func (n *prefixNode) Children() ([]recon.PrefixNode, error) {
+	var result []recon.PrefixNode
 	for _, i := range n.childKeys {
-		childKey := NewBitstring(key.BitLen() + n.BitQuantum())
-		childKey.SetBytes(key.Bytes())
-		for j := 0; j < n.BitQuantum(); j++ {
-			if (i>>uint(j))&0x1 == 1 {
-				childKey.Set(key.BitLen() + j)
-			} else {
-				childKey.Unset(key.BitLen() + j)
-			}
-		}
-		child, err := n.Node(childKey)
+		child, err := n.child(i)
 		if err != nil {
-			panic(fmt.Sprintf("Children failed on child#%v: %v", i, err))
+			return nil, errors.New(fmt.Sprintf("Children failed on child#%v: %v", i, err))
 		}
 		result = append(result, child)
 	}
-	return
+	return result, nil
+}
+
+// child returns the child node with the given index.
+func (n *prefixNode) child(i int) (*prefixNode, error) {
+	node, err := n.Node(n.key.AppendUint(uint(i), n.BitQuantum()))
+	if err != nil {
+		return nil, err
+	}
+	return node.(*prefixNode), nil
 }
 
-func (n *prefixNode) Elements() []*Zp {
-	return n.elements
+// nextChild returns the child whose key is a prefix of bs.
+func (n *prefixNode) nextChild(bs *Bitstring, depth int) (*prefixNode, error) {
+	i, err := recon.NextChild(n, bs, depth)
+	if err != nil {
+		return nil, err
+	}
+	return n.child(i)
+}
+
+func (n *prefixNode) Elements() ([]*Zp, error) {
+	if n.IsLeaf() {
+		if err := n.loadElements(); err != nil {
+			return nil, errors.New(fmt.Sprintf("Elements failed on %v: %v", n.key, err))
+		}
+		return n.elements, nil
+	}
+	children, err := n.Children()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Zp
+	for _, child := range children {
+		elements, err := child.Elements()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, elements...)
+	}
+	return result, nil
 }
 
 func (n *prefixNode) Size() int { return n.numElements }
 
-func (n *prefixNode) SValues() []*Zp {
-	return n.svalues
+func (n *prefixNode) SValues() ([]*Zp, error) {
+	return n.svalues, nil
 }
 
-func (n *prefixNode) Key() *Bitstring {
-	return n.key
+func (n *prefixNode) Key() (*Bitstring, error) {
+	return n.key, nil
 }
 
-func (n *prefixNode) Parent() (recon.PrefixNode, bool) {
+func (n *prefixNode) Parent() (recon.PrefixNode, bool, error) {
 	if n.key.BitLen() == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	parentKey := NewBitstring(n.key.BitLen() - n.BitQuantum())
-	parentKey.SetBytes(n.key.Bytes())
+	parentKey := n.key.Prefix(n.key.BitLen() - n.BitQuantum())
 	parent, err := n.Node(parentKey)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to get parent: %v", err))
+		return nil, false, errors.New(fmt.Sprintf("Failed to get parent: %v", err))
 	}
-	return parent, true
+	return parent, true, nil
 }
 
 func (n *prefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) (err error) {
 	n.updateSvalues(z, marray)
 	n.numElements++
 	if n.IsLeaf() {
+		if err = n.loadElements(); err != nil {
+			return
+		}
+		if err = recon.CheckLeafInsert(n.prefixTree, n.elements, z, bs, depth); err != nil {
+			return
+		}
 		if len(n.elements) > n.SplitThreshold() {
 			err = n.split(depth)
 			if err != nil {
@@ -319,12 +645,16 @@ func (n *prefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) (err
 			}
 		} else {
 			n.elements = append(n.elements, z)
-			n.saveNode(n)
-			return
+			return n.saveNode(n)
 		}
 	}
-	n.saveNode(n)
-	child := recon.NextChild(n, bs, depth).(*prefixNode)
+	if err = n.saveNode(n); err != nil {
+		return
+	}
+	child, err := n.nextChild(bs, depth)
+	if err != nil {
+		return err
+	}
 	return child.insert(z, marray, bs, depth+1)
 }
 
@@ -341,10 +671,15 @@ func (n *prefixNode) split(depth int) (err error) {
 	}
 	// Move elements into child nodes
 	for _, element := range n.elements {
-		bs := NewBitstring(P_SKS.BitLen())
-		bs.SetBytes(ReverseBytes(element.Bytes()))
-		child := recon.NextChild(n, bs, depth).(*prefixNode)
-		child.insert(element, recon.AddElementArray(n.prefixTree, element), bs, depth+1)
+		bs := ZpBitstring(element)
+		child, err := n.nextChild(bs, depth)
+		if err != nil {
+			return err
+		}
+		err = child.insert(element, n.arrays.Get(n.prefixTree, element), bs, depth+1)
+		if err != nil {
+			return err
+		}
 	}
 	n.elements = nil
 	return
@@ -364,36 +699,43 @@ func (n *prefixNode) remove(z *Zp, marray []*Zp, bs *Bitstring, depth int) error
 	n.numElements--
 	if !n.IsLeaf() {
 		if n.numElements <= n.JoinThreshold() {
-			n.join()
+			if err := n.join(); err != nil {
+				return err
+			}
 		} else {
-			n.saveNode(n)
-			child := recon.NextChild(n, bs, depth).(*prefixNode)
+			if err := n.saveNode(n); err != nil {
+				return err
+			}
+			child, err := n.nextChild(bs, depth)
+			if err != nil {
+				return err
+			}
 			return child.remove(z, marray, bs, depth+1)
 		}
 	}
+	if err := n.loadElements(); err != nil {
+		return err
+	}
 	n.elements = withRemoved(n.elements, z)
-	n.saveNode(n)
-	return nil
+	return n.saveNode(n)
 }
 
-func (n *prefixNode) join() {
-	for _, child := range n.Children() {
-		n.elements = append(n.elements, child.Elements()...)
+func (n *prefixNode) join() (err error) {
+	if n.elements, err = n.Elements(); err != nil {
+		return
 	}
+	n.elementsLoaded = true
 	n.childKeys = nil
+	return
 }
 
+// withRemoved returns elements without z, which has been checked
+// to be among them.
 func withRemoved(elements []*Zp, z *Zp) (result []*Zp) {
-	var has bool
 	for _, element := range elements {
 		if element.Cmp(z) != 0 {
 			result = append(result, element)
-		} else {
-			has = true
 		}
 	}
-	if !has {
-		panic("Remove non-existent element from node")
-	}
 	return
 }
@@ -22,12 +22,16 @@
 package leveldb
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/gob"
 	"fmt"
 	"github.com/bmizerany/assert"
 	. "github.com/cmars/conflux"
 	"github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/storetest"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -64,14 +68,14 @@ func TestInsertNodesNoSplit(t *testing.T) {
 	peer.PrefixTree.Insert(Zi(P_SKS, 500))
 	root, err := peer.PrefixTree.Root()
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, len(root.Elements()))
+	assert.Equal(t, 3, len(storetest.MustElements(t, root)))
 	assert.T(t, root.IsLeaf())
 	peer.PrefixTree.Remove(Zi(P_SKS, 100))
 	peer.PrefixTree.Remove(Zi(P_SKS, 300))
 	peer.PrefixTree.Remove(Zi(P_SKS, 500))
 	root, err = peer.PrefixTree.Root()
-	assert.Equal(t, 0, len(root.Elements()))
-	for _, sv := range root.SValues() {
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
 }
@@ -94,7 +98,7 @@ func TestJustOneKey(t *testing.T) {
 	}
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.T(t, expect.Has(sv))
 		expect.Remove(sv)
 	}
@@ -121,11 +125,160 @@ func TestInsertNodeSplit(t *testing.T) {
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
 	// Insert/Remove reversible after splitting & joining?
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
-	assert.Equal(t, 0, len(root.Children()))
-	assert.Equal(t, 0, len(root.Elements()))
+	assert.Equal(t, 0, len(storetest.MustChildren(t, root)))
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
+}
+
+// Test that a node reads back as it was stored
+func TestNodeRoundTrip(t *testing.T) {
+	peer, path := createTestPeer(t)
+	defer destroyTestPeer(peer, path)
+	tree := peer.PrefixTree.(*prefixTree)
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	n, err := tree.newChildNode(root.(*prefixNode), 2)
+	assert.Equal(t, nil, err)
+	n.numElements = 2
+	n.elements = []*Zp{Zi(P_SKS, 65537), Zi(P_SKS, 65539)}
+	n.svalues[0] = Zi(P_SKS, 7)
+	assert.Equal(t, nil, tree.saveNode(n))
+	node, err := tree.Node(n.key)
+	assert.Equal(t, nil, err)
+	loaded := node.(*prefixNode)
+	assert.Equal(t, 0, loaded.key.Cmp(n.key))
+	assert.Equal(t, 2, loaded.numElements)
+	elements := storetest.MustElements(t, loaded)
+	assert.Equal(t, 2, len(elements))
+	for i := range n.elements {
+		assert.Equal(t, 0, elements[i].Cmp(n.elements[i]))
+	}
+	assert.Equal(t, len(n.svalues), len(loaded.svalues))
+	for i := range n.svalues {
+		assert.Equal(t, 0, loaded.svalues[i].Cmp(n.svalues[i]))
+	}
+	n, err = tree.newChildNode(root.(*prefixNode), 3)
+	assert.Equal(t, nil, err)
+	n.childKeys = []int{0, 1, 2, 3}
+	assert.Equal(t, nil, tree.saveNode(n))
+	node, err = tree.Node(n.key)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n.childKeys, node.(*prefixNode).childKeys)
+}
+
+// Test that a leaf's elements are stored apart from it, and only read
+// when asked for
+func TestLazyElements(t *testing.T) {
+	peer, path := createTestPeer(t)
+	defer destroyTestPeer(peer, path)
+	tree := peer.PrefixTree.(*prefixTree)
+	for i := 1; i < 10; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	n := root.(*prefixNode)
+	assert.T(t, !n.elementsLoaded)
+	assert.Equal(t, 0, len(n.elements))
+	assert.Equal(t, 9, len(storetest.MustElements(t, n)))
+	assert.T(t, n.elementsLoaded)
+	// Splitting deletes the stored elements of the parent
+	for i := 10; i <= tree.SplitThreshold()+2; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	key := bytes.NewBuffer(nil)
+	assert.Equal(t, nil, recon.WriteBitstring(key, NewBitstring(0)))
+	raw, err := tree.ptree.Get(tree.rdOptions, elementsKey(key.Bytes()))
+	assert.Equal(t, nil, err)
+	assert.T(t, raw == nil)
+	keys, err := tree.NodeKeys()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1+(1<<uint(tree.BitQuantum())), len(keys))
+}
+
+// Test that a node stored with its elements, before they were kept
+// apart, is read, and stored apart when next written
+func TestInlineElements(t *testing.T) {
+	peer, path := createTestPeer(t)
+	defer destroyTestPeer(peer, path)
+	tree := peer.PrefixTree.(*prefixTree)
+	z := Zi(P_SKS, 65537)
+	marray := recon.AddElementArray(tree, z)
+	nd := &nodeData{NumElements: 1}
+	var buf bytes.Buffer
+	assert.Equal(t, nil, recon.WriteBitstring(&buf, NewBitstring(0)))
+	nd.KeyBuf = buf.Bytes()
+	buf = bytes.Buffer{}
+	assert.Equal(t, nil, recon.WriteZZarray(&buf, marray))
+	nd.SvaluesBuf = buf.Bytes()
+	buf = bytes.Buffer{}
+	assert.Equal(t, nil, recon.WriteZZarray(&buf, []*Zp{z}))
+	nd.ElementsBuf = buf.Bytes()
+	buf = bytes.Buffer{}
+	assert.Equal(t, nil, gob.NewEncoder(&buf).Encode(nd))
+	assert.Equal(t, nil, tree.ptree.Put(tree.wrOptions, nd.KeyBuf, buf.Bytes()))
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, root.(*prefixNode).elementsLoaded)
+	assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65539)))
+	root, err = tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, !root.(*prefixNode).elementsLoaded)
+	expect := NewZSet(z, Zi(P_SKS, 65539))
+	assert.T(t, expect.Equal(NewZSet(storetest.MustElements(t, root)...)))
+}
+
+// Test that a split commits the parent and its children together
+func TestSplitBatch(t *testing.T) {
+	peer, path := createTestPeer(t)
+	defer destroyTestPeer(peer, path)
+	tree := peer.PrefixTree.(*prefixTree)
+	for i := 1; i <= tree.SplitThreshold()+2; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+		assert.T(t, tree.batch == nil)
+	}
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, !root.IsLeaf())
+	sum := 0
+	for _, child := range storetest.MustChildren(t, root) {
+		key := bytes.NewBuffer(nil)
+		assert.Equal(t, nil, recon.WriteBitstring(key, storetest.MustKey(t, child)))
+		raw, err := tree.ptree.Get(tree.rdOptions, key.Bytes())
+		assert.Equal(t, nil, err)
+		assert.T(t, raw != nil)
+		sum += child.Size()
+	}
+	assert.Equal(t, root.Size(), sum)
+}
+
+// Test that nodes unreachable from the root are collected
+func TestCollectOrphans(t *testing.T) {
+	peer, path := createTestPeer(t)
+	defer destroyTestPeer(peer, path)
+	tree := peer.PrefixTree.(*prefixTree)
+	for i := 1; i < 10; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, root.IsLeaf())
+	// A child stored without its parent being split is an orphan
+	_, err = tree.newChildNode(root.(*prefixNode), 2)
+	assert.Equal(t, nil, err)
+	key := storetest.MustKey(t, root).AppendUint(2, root.BitQuantum())
+	_, err = tree.Node(key)
+	assert.Equal(t, nil, err)
+	n, err := recon.CollectOrphans(tree)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, n)
+	_, err = tree.Node(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	root, err = tree.Root()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 9, root.Size())
 }
 
 /*
@@ -159,8 +312,34 @@ func TestKeyMatch(t *testing.T) {
 		assert.Equal(t, err, nil)
 		t.Logf("node1=%v, node2=%v (%b) full=%v", node1.Key(), node2.Key(), zi.Int64(), bs)
 		// If keys are different, one must prefix the other.
-		assert.T(t, strings.HasPrefix(node1.Key().String(), node2.Key().String()) ||
-			strings.HasPrefix(node2.Key().String(), node1.Key().String()))
+		assert.T(t, node1.Key().HasPrefix(node2.Key()) ||
+			node2.Key().HasPrefix(node1.Key()))
 	}
 }
 */
+
+// Test that sample values and elements are read back in the finite
+// field of the tree
+func TestPrimeRoundTrip(t *testing.T) {
+	testDbDir, err := ioutil.TempDir("", "conflux-prime-test")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(testDbDir)
+	settings := DefaultSettings()
+	settings.Set("conflux.recon.leveldb.path", testDbDir)
+	settings.Set("conflux.recon.prime", "128")
+	peer, err := NewPeer(settings)
+	assert.Equal(t, nil, err)
+	defer peer.PrefixTree.(*prefixTree).ptree.Close()
+	tree := peer.PrefixTree
+	assert.Equal(t, 0, recon.TreePrime(tree).Cmp(P_128))
+	assert.Equal(t, nil, tree.Insert(Zi(P_128, 65537)))
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	elements := storetest.MustElements(t, root)
+	assert.Equal(t, 0, elements[0].P.Cmp(P_128))
+	svalues, err := root.SValues()
+	assert.Equal(t, nil, err)
+	for _, sv := range svalues {
+		assert.Equal(t, 0, sv.P.Cmp(P_128))
+	}
+}
@@ -33,6 +33,19 @@ func (s *DbSettings) DbPath() string {
 	return s.GetString("conflux.recon.leveldb.path", "/var/lib/hockeypuck/ptree-leveldb")
 }
 
+// Sharded tests if the prefix tree is partitioned by top-level prefix
+// across a database for each, in subdirectories of DbPath.
+func (s *DbSettings) Sharded() bool {
+	return s.GetBool("conflux.recon.leveldb.sharded", false)
+}
+
+// Sync tests if each write is flushed to disk before it completes.
+// Synced writes survive a crash of the machine, not only of the
+// process, but make bulk inserts much slower.
+func (s *DbSettings) Sync() bool {
+	return s.GetBool("conflux.recon.leveldb.sync", false)
+}
+
 func NewSettings(tree *toml.TomlTree) *DbSettings {
 	reconSettings := recon.NewSettings(tree)
 	return &DbSettings{reconSettings}
@@ -0,0 +1,78 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/storetest"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type dbTreeManager struct {
+	paths map[recon.PrefixTree]string
+}
+
+func newDbTreeManager() *dbTreeManager {
+	return &dbTreeManager{paths: make(map[recon.PrefixTree]string)}
+}
+
+func (m *dbTreeManager) CreateTree(settings *recon.Settings) (recon.PrefixTree, error) {
+	path, err := ioutil.TempDir("", "conflux-leveldb-storetest")
+	if err != nil {
+		return nil, err
+	}
+	tree, err := newPrefixTree(&DbSettings{settings}, path)
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+	m.paths[tree] = path
+	return tree, nil
+}
+
+func (m *dbTreeManager) DestroyTree(tree recon.PrefixTree) {
+	tree.(*prefixTree).ptree.Close()
+	os.RemoveAll(m.paths[tree])
+	delete(m.paths, tree)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, newDbTreeManager())
+}
+
+func BenchmarkInsert(b *testing.B) {
+	storetest.BenchmarkInsert(b, newDbTreeManager())
+}
+
+func BenchmarkInsertAll(b *testing.B) {
+	storetest.BenchmarkInsertAll(b, newDbTreeManager())
+}
+
+func BenchmarkRemove(b *testing.B) {
+	storetest.BenchmarkRemove(b, newDbTreeManager())
+}
+
+func BenchmarkFind(b *testing.B) {
+	storetest.BenchmarkFind(b, newDbTreeManager())
+}
@@ -0,0 +1,140 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// MaxConns is the number of incoming recon connections that may be
+// open at once, including those waiting for the server.
+func (s *Settings) MaxConns() int {
+	return s.GetInt("conflux.recon.maxConns", 64)
+}
+
+// MaxConnsPerHost is the number of incoming recon connections that
+// may be open at once from a single IP address.
+func (s *Settings) MaxConnsPerHost() int {
+	return s.GetInt("conflux.recon.maxConnsPerHost", 4)
+}
+
+// HandshakeTimeout is the number of seconds allowed for the exchange
+// of configuration at the start of a recon session.
+func (s *Settings) HandshakeTimeout() int {
+	return s.GetInt("conflux.recon.handshakeTimeout", 30)
+}
+
+// connLimiter counts open incoming connections, in total and per
+// remote host. A limit of zero or less is unlimited.
+type connLimiter struct {
+	mu         sync.Mutex
+	maxTotal   int
+	maxPerHost int
+	total      int
+	perHost    map[string]int
+}
+
+func newConnLimiter(maxTotal, maxPerHost int) *connLimiter {
+	return &connLimiter{
+		maxTotal:   maxTotal,
+		maxPerHost: maxPerHost,
+		perHost:    make(map[string]int)}
+}
+
+// connHost returns the remote IP address of a connection, or the
+// empty string for connections without one, such as unix sockets.
+func connHost(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
+
+// setLimits changes the limits, without affecting open connections.
+func (l *connLimiter) setLimits(maxTotal, maxPerHost int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxTotal, l.maxPerHost = maxTotal, maxPerHost
+}
+
+// acquire reserves a slot for a connection from addr, returning false
+// if a limit has been reached.
+func (l *connLimiter) acquire(addr net.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	host := connHost(addr)
+	if host != "" && l.maxPerHost > 0 && l.perHost[host] >= l.maxPerHost {
+		return false
+	}
+	l.total++
+	if host != "" {
+		l.perHost[host]++
+	}
+	return true
+}
+
+func (l *connLimiter) release(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if host := connHost(addr); host != "" {
+		if l.perHost[host]--; l.perHost[host] <= 0 {
+			delete(l.perHost, host)
+		}
+	}
+}
+
+// limitedConn releases its slot in the limiter when closed.
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.Conn.RemoteAddr()) })
+	return c.Conn.Close()
+}
+
+var ErrConnLimit error = errors.New("Connection limit reached")
+
+// AcquireConn counts a connection accepted by a transport other than
+// the peer's listeners, such as an HTTP upgrade, against the limits on
+// incoming connections. It returns the connection, which releases its
+// slot when closed, or ErrConnLimit if a limit has been reached.
+func (p *Peer) AcquireConn(conn net.Conn) (net.Conn, error) {
+	if p.limiter == nil {
+		return conn, nil
+	}
+	if !p.limiter.acquire(conn.RemoteAddr()) {
+		return nil, ErrConnLimit
+	}
+	return &limitedConn{Conn: conn, limiter: p.limiter}, nil
+}
@@ -0,0 +1,100 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(3, 2)
+	a1 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	a2 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}
+	c := &net.TCPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1}
+	assert.T(t, l.acquire(a1))
+	assert.T(t, l.acquire(a2))
+	// Per-host limit
+	assert.T(t, !l.acquire(a1))
+	assert.T(t, l.acquire(b))
+	// Total limit
+	assert.T(t, !l.acquire(c))
+	l.release(a1)
+	assert.T(t, l.acquire(c))
+	assert.T(t, !l.acquire(a1))
+	l.release(b)
+	assert.T(t, l.acquire(a1))
+	assert.Equal(t, 2, len(l.perHost))
+}
+
+func TestAcquireConn(t *testing.T) {
+	p := NewMemPeer()
+	p.limiter = newConnLimiter(1, 0)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn, err := p.AcquireConn(c1)
+	assert.Equal(t, nil, err)
+	_, err = p.AcquireConn(c2)
+	assert.Equal(t, ErrConnLimit, err)
+	conn.Close()
+	conn, err = p.AcquireConn(c2)
+	assert.Equal(t, nil, err)
+	// QUIC connections are counted by host too
+	l := newConnLimiter(0, 1)
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	assert.T(t, l.acquire(udp))
+	assert.T(t, !l.acquire(udp))
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.listen", []interface{}{ln.Addr().String()})
+	p.Settings.Set("conflux.recon.reconPort", port)
+	p.Settings.Set("conflux.recon.handshakeTimeout", 1)
+	p.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	p.Start()
+	defer p.Stop()
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", ln.Addr().String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	// Read the server's config, then stall without answering.
+	_, err = ReadMsg(conn)
+	assert.Equal(t, nil, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = ReadMsg(conn)
+	assert.NotEqual(t, nil, err)
+	assert.T(t, time.Since(start) < 3*time.Second)
+}
@@ -0,0 +1,136 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// ServeTcp reports whether the recon server listens on TCP.
+func (s *Settings) ServeTcp() bool {
+	return s.GetBool("conflux.recon.serveTcp", true)
+}
+
+// Listen lists the TCP addresses on which the recon server listens,
+// such as "192.0.2.1:11370" or "[2001:db8::1]:11370". If empty, the
+// server listens on reconPort on all interfaces.
+func (s *Settings) Listen() []string {
+	return s.GetStrings("conflux.recon.listen")
+}
+
+// ListenAddrs returns the TCP addresses the recon server binds.
+func (s *Settings) ListenAddrs() []string {
+	if addrs := s.Listen(); len(addrs) > 0 {
+		return addrs
+	}
+	return []string{fmt.Sprintf(":%d", s.ReconPort())}
+}
+
+// UnixSocket is the path of a unix domain socket on which the recon
+// server also listens, for use by a co-located proxy or sidecar.
+func (s *Settings) UnixSocket() string {
+	return s.GetString("conflux.recon.unixSocket", "")
+}
+
+// listen opens the configured recon server listeners.
+func (p *Peer) listen() (listeners []net.Listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			listeners = nil
+		}
+	}()
+	if p.ServeTcp() {
+		for _, addr := range p.ListenAddrs() {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return listeners, err
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+	if path := p.UnixSocket(); path != "" {
+		ln, err := listenUnix(path)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return
+}
+
+// listenUnix listens on a unix socket, replacing a stale socket
+// left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// acceptConns hands off connections accepted on ln until the listener
+// is closed or done is closed. Connections over the limits are dropped
+// immediately, and accepting backs off while the process is out of
+// file descriptors.
+func acceptConns(ln net.Listener, limiter *connLimiter, conns chan net.Conn, done chan interface{}) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			log.Println(SERVE, err)
+			if ne, is := err.(net.Error); is && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return
+		}
+		delay = 0
+		if !limiter.acquire(conn.RemoteAddr()) {
+			log.Println(SERVE, "connection limit reached, dropping:", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			select {
+			case conns <- conn:
+			case <-done:
+				conn.Close()
+			}
+		}(&limitedConn{Conn: conn, limiter: limiter})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recon.sock")
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.serveTcp", false)
+	server.Settings.Set("conflux.recon.unixSocket", path)
+	server.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	server.Start()
+	defer server.Stop()
+	startCmds(client)
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = client.dialPartner("unix://" + path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	go client.ReconcileWith(conn, RoleClient)
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+}
+
+func TestListenAddrs(t *testing.T) {
+	p := NewMemPeer()
+	assert.Equal(t, []string{":11370"}, p.ListenAddrs())
+	p.Settings.Set("conflux.recon.listen", []interface{}{"127.0.0.1:0", "[::1]:0"})
+	listeners, err := p.listen()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(listeners))
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	assert.T(t, listeners[0].Addr().(*net.TCPAddr).IP.To4() != nil)
+	assert.T(t, listeners[1].Addr().(*net.TCPAddr).IP.To4() == nil)
+}
+
+func TestPartnerAddr(t *testing.T) {
+	s := DefaultSettings()
+	for partner, addr := range map[string]string{
+		"keys.example.com:11371":    "keys.example.com:11371",
+		"keys.example.com":          "keys.example.com:11370",
+		"tcp://192.0.2.1:11371":     "192.0.2.1:11371",
+		"[2001:db8::1]:11371":       "[2001:db8::1]:11371",
+		"[2001:db8::1]":             "[2001:db8::1]:11370",
+		"2001:db8::1":               "[2001:db8::1]:11370",
+		"tcp://[2001:db8::1]:11371": "[2001:db8::1]:11371"} {
+		assert.Equal(t, addr, s.PartnerAddr(partner))
+	}
+}
+
+func TestDialIpv6Partner(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	p := NewMemPeer()
+	conn, err := p.dialPartner(ln.Addr().String())
+	assert.Equal(t, nil, err)
+	conn.Close()
+}
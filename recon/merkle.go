@@ -0,0 +1,246 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"log"
+	"net"
+)
+
+// Merkle prefers comparing prefix trees by the digests of their
+// subtrees, level by level, exchanging the elements of differing
+// subtrees once they are small. It is simpler than reconciling by
+// interpolation, at the cost of more rounds and more elements sent.
+// Peers compare trees this way only if both support it.
+func (s *Settings) Merkle() bool {
+	return s.GetBool("conflux.recon.merkle", false)
+}
+
+// keyBits returns the length of the keys locating elements in the tree.
+func (p *Peer) keyBits() int {
+	return TreeKeys(p.PrefixTree).Key(Zi(p.prime(), 0)).BitLen()
+}
+
+// prefixElements returns the elements whose keys have the prefix,
+// which may lie below a leaf of the prefix tree.
+func (p *Peer) prefixElements(prefix *Bitstring) ([]*Zp, error) {
+	node, err := p.Node(prefix)
+	if err != nil {
+		return nil, err
+	}
+	elements, err := node.Elements()
+	if err != nil {
+		return nil, err
+	}
+	key, err := node.Key()
+	if err != nil {
+		return nil, err
+	}
+	if key.BitLen() >= prefix.BitLen() {
+		return elements, nil
+	}
+	keys := TreeKeys(p.PrefixTree)
+	var result []*Zp
+	for _, z := range elements {
+		if keys.Key(z).HasPrefix(prefix) {
+			result = append(result, z)
+		}
+	}
+	return result, nil
+}
+
+// merkleNode summarizes the elements under a prefix by their number
+// and multiset digest, which does not depend on the shape of the tree.
+// The summaries of interior nodes of the tree are kept, and updated
+// as elements are inserted and removed.
+func (p *Peer) merkleNode(prefix *Bitstring) (*MerkleNode, error) {
+	s := &p.summaries
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, err := p.Node(prefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := node.Key()
+	if err != nil {
+		return nil, err
+	}
+	cache := key.BitLen() == prefix.BitLen() && node.Size() > p.Settings.SplitThreshold()
+	if summary, has := s.merkle[prefix.BinaryString()]; cache && has && summary.size == node.Size() {
+		return &MerkleNode{Prefix: prefix, Size: summary.size, Digest: summary.digest.Bytes()}, nil
+	}
+	elements, err := p.prefixElements(prefix)
+	if err != nil {
+		return nil, err
+	}
+	digest := MultisetDigest(elements...)
+	if cache {
+		if s.merkle == nil {
+			s.merkle = make(map[string]*merkleSummary)
+		}
+		s.merkle[prefix.BinaryString()] = &merkleSummary{size: len(elements), digest: digest.Copy()}
+	}
+	return &MerkleNode{Prefix: prefix, Size: len(elements), Digest: digest.Bytes()}, nil
+}
+
+func checkIndexes(indexes []int, n int) error {
+	for _, i := range indexes {
+		if i < 0 || i >= n {
+			return errors.New(fmt.Sprintf("Node index %d out of range", i))
+		}
+	}
+	return nil
+}
+
+// merkleWithClient offers the client the digests of each level of
+// the prefix tree, from the root, descending into the prefixes the
+// client finds different.
+func (p *Peer) merkleWithClient(conn net.Conn, remoteConfig *Config) (recovered []*Zp, err error) {
+	log.Println(SERVE, "comparing digests with client")
+	level := []*Bitstring{NewBitstring(0)}
+	rcvrSet, sendSet := NewZSet(), NewZSet()
+	nbq := p.Settings.BitQuantum()
+	for {
+		msg := &MerkleLevel{Elements: sendSet}
+		for _, prefix := range level {
+			node, err := p.merkleNode(prefix)
+			if err != nil {
+				return nil, err
+			}
+			msg.Nodes = append(msg.Nodes, node)
+		}
+		if err = WriteMsg(conn, msg); err != nil {
+			return
+		}
+		if len(level) == 0 {
+			break
+		}
+		var reply ReconMsg
+		if reply, err = ReadMsg(conn); err != nil {
+			return
+		}
+		repl, is := reply.(*MerkleRepl)
+		if !is {
+			return nil, errors.New(fmt.Sprintf("Expected Merkle reply, got %v", reply))
+		}
+		if err = checkIndexes(repl.Descend, len(level)); err != nil {
+			return
+		}
+		if err = checkIndexes(repl.Full, len(level)); err != nil {
+			return
+		}
+		if err = p.checkRemoteP(repl.Elements.Items()...); err != nil {
+			return
+		}
+		localSet := NewZSet()
+		for _, i := range repl.Full {
+			elements, err := p.prefixElements(level[i])
+			if err != nil {
+				return nil, err
+			}
+			localSet.AddSlice(elements)
+		}
+		rcvrSet.AddAll(repl.Elements.Difference(localSet))
+		sendSet = p.serveElements(localSet.Difference(repl.Elements))
+		var next []*Bitstring
+		for _, i := range repl.Descend {
+			if level[i].BitLen()+nbq > p.keyBits() {
+				return nil, errors.New(fmt.Sprintf("Cannot descend below key %v", level[i]))
+			}
+			for child := 0; child < 1<<uint(nbq); child++ {
+				next = append(next, level[i].AppendUint(uint(child), nbq))
+			}
+		}
+		level = next
+	}
+	recovered = rcvrSet.Items()
+	p.recoverElements(conn, remoteConfig, recovered)
+	return recovered, nil
+}
+
+// merkleWithServer compares the digests offered by the server with
+// those of the prefix tree, sending the elements of differing prefixes
+// holding few elements, and asking to descend into the others.
+func (p *Peer) merkleWithServer(conn net.Conn, remoteConfig *Config) (recovered []*Zp, err error) {
+	rcvrSet := NewZSet()
+	nbq := p.Settings.BitQuantum()
+	for {
+		var msg ReconMsg
+		if msg, err = ReadMsg(conn); err != nil {
+			return
+		}
+		level, is := msg.(*MerkleLevel)
+		if !is {
+			return nil, errors.New(fmt.Sprintf("Expected Merkle level, got %v", msg))
+		}
+		if err = p.checkRemoteP(level.Elements.Items()...); err != nil {
+			return
+		}
+		rcvrSet.AddAll(level.Elements)
+		if len(level.Nodes) == 0 {
+			break
+		}
+		repl := &MerkleRepl{Elements: NewZSet()}
+		for i, remote := range level.Nodes {
+			if remote.Prefix.BitLen() > p.keyBits() {
+				return nil, errors.New(fmt.Sprintf("Prefix %v longer than keys", remote.Prefix))
+			}
+			local, err := p.merkleNode(remote.Prefix)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case local.Size == remote.Size && bytes.Equal(local.Digest, remote.Digest):
+			case local.Size <= p.Settings.SplitThreshold() || remote.Size <= p.Settings.SplitThreshold() ||
+				remote.Prefix.BitLen()+nbq > p.keyBits():
+				elements, err := p.prefixElements(remote.Prefix)
+				if err != nil {
+					return nil, err
+				}
+				repl.Full = append(repl.Full, i)
+				repl.Elements.AddSlice(p.withoutBlacklisted(elements))
+			default:
+				repl.Descend = append(repl.Descend, i)
+			}
+		}
+		if err = WriteMsg(conn, repl); err != nil {
+			return
+		}
+	}
+	// Only recover elements missing from the tree
+	for _, z := range rcvrSet.Items() {
+		node, err := Find(p.PrefixTree, z)
+		if err != nil {
+			continue
+		}
+		if elements, err := node.Elements(); err == nil && NewZSet(elements...).Has(z) {
+			rcvrSet.Remove(z)
+		}
+	}
+	recovered = rcvrSet.Items()
+	p.recoverElements(conn, remoteConfig, recovered)
+	return recovered, nil
+}
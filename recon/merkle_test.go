@@ -0,0 +1,184 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestMerkleSession(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.merkle", true)
+	client.Settings.Set("conflux.recon.merkle", true)
+	for i := 1; i < 1000; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	for i := 1; i <= 3; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i+2))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i+4))
+	}
+	server.PrefixTree.Remove(Zi(P_SKS, 65537*500))
+	s := reconcile(t, server, client)
+	assert.Equal(t, "merkle", s.ss.Strategy)
+	assert.Equal(t, "{65541, 131078, 196615, 32768500}", s.serverSet.String())
+	assert.Equal(t, "{65539, 131076, 196613}", s.clientSet.String())
+	assert.Equal(t, 4, s.ss.Recovered)
+	assert.Equal(t, 3, s.cs.Recovered)
+	assert.T(t, s.ss.Subtrees > 1)
+	assert.Equal(t, s.ss.Subtrees, s.cs.Subtrees)
+	assert.Equal(t, 0, s.ss.PolyFailed+s.ss.PolySucceeded)
+}
+
+// Test that a following server withholds its elements from the client.
+func TestMerkleFollower(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.merkle", true)
+	client.Settings.Set("conflux.recon.merkle", true)
+	server.Settings.Set("conflux.recon.follower", true)
+	for i := 1; i < 1000; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	for i := 1; i <= 3; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i+2))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i+4))
+	}
+	s := reconcile(t, server, client)
+	assert.Equal(t, "merkle", s.ss.Strategy)
+	assert.Equal(t, 0, len(s.ss.Offered))
+	assert.Equal(t, 0, s.cs.Recovered)
+	assert.Equal(t, "{65541, 131078, 196615}", s.serverSet.String())
+}
+
+func TestMerkleInSync(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.merkle", true)
+	client.Settings.Set("conflux.recon.merkle", true)
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	s := reconcile(t, server, client)
+	// Only the root is compared
+	assert.Equal(t, 1, s.ss.Subtrees)
+	assert.Equal(t, 0, s.ss.Recovered+s.cs.Recovered)
+}
+
+func TestMerkleOneSided(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.merkle", true)
+	strategy, err := server.negotiateStrategy(RoleServer, client.Config())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, PtreeStrategy, strategy)
+	other := NewMemPeer()
+	other.Settings.Set("conflux.recon.merkle", true)
+	strategy, err = server.negotiateStrategy(RoleServer, other.Config())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MerkleStrategy, strategy)
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65539))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, s.ss.Recovered)
+	assert.Equal(t, 1, s.cs.Recovered)
+}
+
+func TestPrefixElements(t *testing.T) {
+	p := NewMemPeer()
+	for i := 1; i < 20; i++ {
+		p.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	root, _ := p.Root()
+	assert.T(t, root.IsLeaf())
+	total := 0
+	for child := 0; child < 4; child++ {
+		prefix := NewBitstring(0).AppendUint(uint(child), 2)
+		elements, err := p.prefixElements(prefix)
+		assert.Equal(t, nil, err)
+		for _, z := range elements {
+			assert.T(t, ZpBitstring(z).HasPrefix(prefix))
+		}
+		total += len(elements)
+	}
+	assert.Equal(t, 19, total)
+}
+
+func TestMerkleNodeUpdated(t *testing.T) {
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.merkle", true)
+	startCmds(p)
+	for i := 1; i < 1000; i++ {
+		p.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	prefixes := []*Bitstring{NewBitstring(0)}
+	for child := 0; child < 4; child++ {
+		prefixes = append(prefixes, NewBitstring(0).AppendUint(uint(child), 2))
+	}
+	for _, prefix := range prefixes {
+		_, err := p.merkleNode(prefix)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, len(prefixes), len(p.summaries.merkle))
+	kept := p.summaries.merkle[""]
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, p.Remove(Zi(P_SKS, 65537*500)))
+	for _, prefix := range prefixes {
+		node, err := p.merkleNode(prefix)
+		assert.Equal(t, nil, err)
+		elements, err := p.prefixElements(prefix)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(elements), node.Size)
+		assert.Equal(t, MultisetDigest(elements...).Bytes(), node.Digest)
+	}
+	// Updated in place, rather than digested again
+	assert.T(t, kept == p.summaries.merkle[""])
+	// Changes made other than through the peer are digested again
+	p.PrefixTree.Insert(Zi(P_SKS, 65541))
+	node, err := p.merkleNode(NewBitstring(0))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1000, node.Size)
+	assert.T(t, kept != p.summaries.merkle[""])
+}
+
+func TestMerkleMsgs(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	level := &MerkleLevel{
+		Nodes: []*MerkleNode{
+			{Prefix: NewBitstring(0), Size: 2, Digest: []byte{1, 2}},
+			{Prefix: NewBitstring(0).AppendUint(3, 2), Size: 1, Digest: []byte{3}}},
+		Elements: NewZSet(Zi(P_SKS, 65537))}
+	repl := &MerkleRepl{Descend: []int{0}, Full: []int{1, 2}, Elements: NewZSet()}
+	assert.Equal(t, nil, WriteMsg(buf, level, repl))
+	msg, err := ReadMsg(buf)
+	assert.Equal(t, nil, err)
+	readLevel := msg.(*MerkleLevel)
+	assert.Equal(t, 2, len(readLevel.Nodes))
+	assert.Equal(t, "2:c0", readLevel.Nodes[1].Prefix.String())
+	assert.Equal(t, []byte{3}, readLevel.Nodes[1].Digest)
+	assert.Equal(t, "{65537}", readLevel.Elements.String())
+	msg, err = ReadMsg(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, repl.String(), msg.(*MerkleRepl).String())
+}
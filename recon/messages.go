@@ -30,15 +30,15 @@ import (
 	. "github.com/cmars/conflux"
 	"io"
 	"math/big"
+	"sort"
+	"sync"
+	"time"
 )
 
-var sksZpNbytes int
-
-func init() {
-	sksZpNbytes = P_SKS.BitLen() / 8
-	if P_SKS.BitLen()%8 != 0 {
-		sksZpNbytes++
-	}
+// zpNbytes is the length of an integer in the finite field p
+// when encoded in a message.
+func zpNbytes(p *big.Int) int {
+	return (p.BitLen() + 7) / 8
 }
 
 type MsgType uint8
@@ -55,6 +55,16 @@ const (
 	MsgTypeDbRqst        = MsgType(8)
 	MsgTypeDbRepl        = MsgType(9)
 	MsgTypeConfig        = MsgType(10)
+	// Extensions to the SKS protocol, sent only to peers which
+	// announce support for them in their config
+	MsgTypeReconSketch = MsgType(11)
+	MsgTypeMerkleLevel = MsgType(12)
+	MsgTypeMerkleRepl  = MsgType(13)
+	MsgTypePayloadRqst = MsgType(14)
+	MsgTypePayload     = MsgType(15)
+	MsgTypeCatchUpRqst = MsgType(16)
+	MsgTypeCatchUpRepl = MsgType(17)
+	MsgTypeKeepAlive   = MsgType(18)
 )
 
 func (mt MsgType) String() string {
@@ -81,6 +91,22 @@ func (mt MsgType) String() string {
 		return "DbRepl"
 	case MsgTypeConfig:
 		return "Config"
+	case MsgTypeReconSketch:
+		return "ReconSketch"
+	case MsgTypeMerkleLevel:
+		return "MerkleLevel"
+	case MsgTypeMerkleRepl:
+		return "MerkleRepl"
+	case MsgTypePayloadRqst:
+		return "PayloadRqst"
+	case MsgTypePayload:
+		return "Payload"
+	case MsgTypeCatchUpRqst:
+		return "CatchUpRqst"
+	case MsgTypeCatchUpRepl:
+		return "CatchUpRepl"
+	case MsgTypeKeepAlive:
+		return "KeepAlive"
 	}
 	return "Unknown"
 }
@@ -132,14 +158,24 @@ func WriteInt(w io.Writer, n int) (err error) {
 	return
 }
 
+// readN reads n bytes, allocating space as they arrive rather than up
+// front, so that a corrupt length cannot exhaust memory.
+func readN(r io.Reader, n int) ([]byte, error) {
+	var buf bytes.Buffer
+	nread, err := io.CopyN(&buf, r, int64(n))
+	if err == io.EOF && nread > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
 func ReadString(r io.Reader) (string, error) {
 	var n int
 	n, err := ReadInt(r)
 	if err != nil || n == 0 {
 		return "", err
 	}
-	buf := make([]byte, n)
-	_, err = io.ReadFull(r, buf)
+	buf, err := readN(r, n)
 	return string(buf), err
 }
 
@@ -165,8 +201,7 @@ func ReadBitstring(r io.Reader) (*Bitstring, error) {
 	if nbits == 0 {
 		return bs, nil
 	}
-	buf := make([]byte, nbytes)
-	_, err = io.ReadFull(r, buf)
+	buf, err := readN(r, nbytes)
 	bs.SetBytes(buf)
 	return bs, err
 }
@@ -189,12 +224,13 @@ func ReadZZarray(r io.Reader) ([]*Zp, error) {
 	if err != nil {
 		return nil, err
 	}
-	arr := make([]*Zp, n)
+	arr := make([]*Zp, 0)
 	for i := 0; i < n; i++ {
-		arr[i], err = ReadZp(r)
+		z, err := ReadZp(r)
 		if err != nil {
 			return nil, err
 		}
+		arr = append(arr, z)
 	}
 	return arr, nil
 }
@@ -227,14 +263,20 @@ func WriteZSet(w io.Writer, zset *ZSet) error {
 	return WriteZZarray(w, zset.Items())
 }
 
+// ReadZp reads an integer in the finite field P_SKS, or
+// the field of r if it is a FieldConn.
 func ReadZp(r io.Reader) (*Zp, error) {
-	buf := make([]byte, sksZpNbytes)
+	p := P_SKS
+	if fc, is := r.(FieldConn); is {
+		p = fc.Prime()
+	}
+	buf := make([]byte, zpNbytes(p))
 	_, err := io.ReadFull(r, buf)
 	if err != nil {
 		return nil, err
 	}
 	v := big.NewInt(0).SetBytes(ReverseBytes(buf))
-	z := &Zp{Int: v, P: P_SKS}
+	z := &Zp{Int: v, P: p}
 	z.Norm()
 	return z, nil
 }
@@ -245,8 +287,8 @@ func WriteZp(w io.Writer, z *Zp) (err error) {
 	if err != nil {
 		return
 	}
-	if len(num) < sksZpNbytes {
-		pad := make([]byte, sksZpNbytes-len(num))
+	if n := zpNbytes(z.P); len(num) < n {
+		pad := make([]byte, n-len(num))
 		_, err = w.Write(pad)
 	}
 	return
@@ -347,6 +389,366 @@ func (msg *Elements) unmarshal(r io.Reader) (err error) {
 	return
 }
 
+// ReconSketch offers a sketch of the elements in the prefix tree,
+// from which the remote peer may decode the differences between the
+// trees in one round trip.
+type ReconSketch struct {
+	Size     int
+	Capacity int
+	Sketch   []byte
+}
+
+func (msg *ReconSketch) String() string {
+	return fmt.Sprintf("%v: size=%v capacity=%v", msg.MsgType(), msg.Size, msg.Capacity)
+}
+
+func (msg *ReconSketch) MsgType() MsgType {
+	return MsgTypeReconSketch
+}
+
+func (msg *ReconSketch) marshal(w io.Writer) (err error) {
+	if err = WriteInt(w, msg.Size); err != nil {
+		return
+	}
+	if err = WriteInt(w, msg.Capacity); err != nil {
+		return
+	}
+	return WriteString(w, string(msg.Sketch))
+}
+
+func (msg *ReconSketch) unmarshal(r io.Reader) (err error) {
+	if msg.Size, err = ReadInt(r); err != nil {
+		return
+	}
+	if msg.Capacity, err = ReadInt(r); err != nil {
+		return
+	}
+	var sketch string
+	sketch, err = ReadString(r)
+	msg.Sketch = []byte(sketch)
+	return
+}
+
+// MerkleNode summarizes the elements whose keys have a prefix.
+type MerkleNode struct {
+	Prefix *Bitstring
+	Size   int
+	Digest []byte
+}
+
+// MerkleLevel offers summaries of a level of prefixes to compare, with
+// the elements the remote peer lacks under the prefixes it asked for in
+// full at the previous level. A level without prefixes ends the session.
+type MerkleLevel struct {
+	Nodes    []*MerkleNode
+	Elements *ZSet
+}
+
+func (msg *MerkleLevel) String() string {
+	return fmt.Sprintf("%v: nodes=%d elements=%v", msg.MsgType(), len(msg.Nodes), msg.Elements)
+}
+
+func (msg *MerkleLevel) MsgType() MsgType {
+	return MsgTypeMerkleLevel
+}
+
+func (msg *MerkleLevel) marshal(w io.Writer) (err error) {
+	if err = WriteInt(w, len(msg.Nodes)); err != nil {
+		return
+	}
+	for _, node := range msg.Nodes {
+		if err = WriteBitstring(w, node.Prefix); err != nil {
+			return
+		}
+		if err = WriteInt(w, node.Size); err != nil {
+			return
+		}
+		if err = WriteString(w, string(node.Digest)); err != nil {
+			return
+		}
+	}
+	return WriteZSet(w, msg.Elements)
+}
+
+func (msg *MerkleLevel) unmarshal(r io.Reader) (err error) {
+	var n int
+	if n, err = ReadInt(r); err != nil {
+		return
+	}
+	msg.Nodes = nil
+	for i := 0; i < n; i++ {
+		node := new(MerkleNode)
+		if node.Prefix, err = ReadBitstring(r); err != nil {
+			return
+		}
+		if node.Size, err = ReadInt(r); err != nil {
+			return
+		}
+		var digest string
+		if digest, err = ReadString(r); err != nil {
+			return
+		}
+		node.Digest = []byte(digest)
+		msg.Nodes = append(msg.Nodes, node)
+	}
+	msg.Elements, err = ReadZSet(r)
+	return
+}
+
+// MerkleRepl answers a MerkleLevel with the indexes of the differing
+// prefixes to descend into, and of those to exchange in full, with the
+// elements under the latter.
+type MerkleRepl struct {
+	Descend  []int
+	Full     []int
+	Elements *ZSet
+}
+
+func (msg *MerkleRepl) String() string {
+	return fmt.Sprintf("%v: descend=%v full=%v elements=%v",
+		msg.MsgType(), msg.Descend, msg.Full, msg.Elements)
+}
+
+func (msg *MerkleRepl) MsgType() MsgType {
+	return MsgTypeMerkleRepl
+}
+
+func writeInts(w io.Writer, ints []int) (err error) {
+	if err = WriteInt(w, len(ints)); err != nil {
+		return
+	}
+	for _, i := range ints {
+		if err = WriteInt(w, i); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func readInts(r io.Reader) (ints []int, err error) {
+	var n, v int
+	if n, err = ReadInt(r); err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		if v, err = ReadInt(r); err != nil {
+			return
+		}
+		ints = append(ints, v)
+	}
+	return
+}
+
+func (msg *MerkleRepl) marshal(w io.Writer) (err error) {
+	if err = writeInts(w, msg.Descend); err != nil {
+		return
+	}
+	if err = writeInts(w, msg.Full); err != nil {
+		return
+	}
+	return WriteZSet(w, msg.Elements)
+}
+
+func (msg *MerkleRepl) unmarshal(r io.Reader) (err error) {
+	if msg.Descend, err = readInts(r); err != nil {
+		return
+	}
+	if msg.Full, err = readInts(r); err != nil {
+		return
+	}
+	msg.Elements, err = ReadZSet(r)
+	return
+}
+
+// PayloadRqst asks the remote peer for the payloads of elements
+// recovered from it. It is answered with a Payload message for each
+// chunk of the payloads the remote peer holds, then Done.
+type PayloadRqst struct {
+	Elements *ZSet
+}
+
+func (msg *PayloadRqst) String() string {
+	return fmt.Sprintf("%v: elements=%v", msg.MsgType(), msg.Elements)
+}
+
+func (msg *PayloadRqst) MsgType() MsgType {
+	return MsgTypePayloadRqst
+}
+
+func (msg *PayloadRqst) marshal(w io.Writer) error {
+	return WriteZSet(w, msg.Elements)
+}
+
+func (msg *PayloadRqst) unmarshal(r io.Reader) (err error) {
+	msg.Elements, err = ReadZSet(r)
+	return
+}
+
+// Payload is a chunk of the data digested by an element. More is set
+// on all but the last chunk.
+type Payload struct {
+	Element *Zp
+	Data    []byte
+	More    bool
+}
+
+func (msg *Payload) String() string {
+	return fmt.Sprintf("%v: element=%v size=%d more=%v", msg.MsgType(), msg.Element, len(msg.Data), msg.More)
+}
+
+func (msg *Payload) MsgType() MsgType {
+	return MsgTypePayload
+}
+
+func (msg *Payload) marshal(w io.Writer) (err error) {
+	if err = WriteZp(w, msg.Element); err != nil {
+		return
+	}
+	if err = WriteString(w, string(msg.Data)); err != nil {
+		return
+	}
+	var more int
+	if msg.More {
+		more = 1
+	}
+	return WriteInt(w, more)
+}
+
+func (msg *Payload) unmarshal(r io.Reader) (err error) {
+	if msg.Element, err = ReadZp(r); err != nil {
+		return
+	}
+	var data string
+	if data, err = ReadString(r); err != nil {
+		return
+	}
+	msg.Data = []byte(data)
+	var more int
+	more, err = ReadInt(r)
+	msg.More = more != 0
+	return
+}
+
+// CatchUpRqst asks a trusted remote peer for the changes it has made
+// to its prefix tree after Seq. Known is false if the peer has not
+// caught up with the remote peer before, or does not trust it.
+type CatchUpRqst struct {
+	Known bool
+	Seq   uint64
+}
+
+func (msg *CatchUpRqst) String() string {
+	return fmt.Sprintf("%v: known=%v seq=%d", msg.MsgType(), msg.Known, msg.Seq)
+}
+
+func (msg *CatchUpRqst) MsgType() MsgType {
+	return MsgTypeCatchUpRqst
+}
+
+func (msg *CatchUpRqst) marshal(w io.Writer) (err error) {
+	var known int
+	if msg.Known {
+		known = 1
+	}
+	if err = WriteInt(w, known); err != nil {
+		return
+	}
+	return binary.Write(w, binary.BigEndian, msg.Seq)
+}
+
+func (msg *CatchUpRqst) unmarshal(r io.Reader) (err error) {
+	var known int
+	if known, err = ReadInt(r); err != nil {
+		return
+	}
+	msg.Known = known != 0
+	return binary.Read(r, binary.BigEndian, &msg.Seq)
+}
+
+// CatchUpRepl answers a CatchUpRqst with the changes requested, if Ok.
+// Otherwise the peers reconcile their prefix trees in full. Head is
+// the sequence number of the last change the remote peer has made.
+type CatchUpRepl struct {
+	Ok      bool
+	Head    uint64
+	Changes []*Change
+}
+
+func (msg *CatchUpRepl) String() string {
+	return fmt.Sprintf("%v: ok=%v head=%d changes=%d", msg.MsgType(), msg.Ok, msg.Head, len(msg.Changes))
+}
+
+func (msg *CatchUpRepl) MsgType() MsgType {
+	return MsgTypeCatchUpRepl
+}
+
+func (msg *CatchUpRepl) marshal(w io.Writer) (err error) {
+	var ok int
+	if msg.Ok {
+		ok = 1
+	}
+	if err = WriteInt(w, ok); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, msg.Head); err != nil {
+		return
+	}
+	if err = WriteInt(w, len(msg.Changes)); err != nil {
+		return
+	}
+	for _, change := range msg.Changes {
+		if _, err = w.Write([]byte{byte(change.Op)}); err != nil {
+			return
+		}
+		if err = binary.Write(w, binary.BigEndian, change.Seq); err != nil {
+			return
+		}
+		if err = binary.Write(w, binary.BigEndian, change.Time.UnixNano()); err != nil {
+			return
+		}
+		if err = WriteZp(w, change.Element); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (msg *CatchUpRepl) unmarshal(r io.Reader) (err error) {
+	var ok, n int
+	if ok, err = ReadInt(r); err != nil {
+		return
+	}
+	msg.Ok = ok != 0
+	if err = binary.Read(r, binary.BigEndian, &msg.Head); err != nil {
+		return
+	}
+	if n, err = ReadInt(r); err != nil {
+		return
+	}
+	msg.Changes = nil
+	for i := 0; i < n; i++ {
+		change := new(Change)
+		op := make([]byte, 1)
+		if _, err = io.ReadFull(r, op); err != nil {
+			return
+		}
+		change.Op = ChangeOp(op[0])
+		if err = binary.Read(r, binary.BigEndian, &change.Seq); err != nil {
+			return
+		}
+		var nanos int64
+		if err = binary.Read(r, binary.BigEndian, &nanos); err != nil {
+			return
+		}
+		change.Time = time.Unix(0, nanos)
+		if change.Element, err = ReadZp(r); err != nil {
+			return
+		}
+		msg.Changes = append(msg.Changes, change)
+	}
+	return
+}
+
 type FullElements struct {
 	*ZSet
 }
@@ -441,6 +843,21 @@ func (msg *DbRepl) MsgType() MsgType {
 	return MsgTypeDbRepl
 }
 
+// KeepAlive is sent while a session has nothing else to send, so that
+// a peer waiting on it does not take it for stalled. It is skipped by
+// ReadMsg.
+type KeepAlive struct {
+	*emptyMsg
+}
+
+func (msg *KeepAlive) String() string {
+	return fmt.Sprintf("%v", msg.MsgType())
+}
+
+func (msg *KeepAlive) MsgType() MsgType {
+	return MsgTypeKeepAlive
+}
+
 var RemoteConfigPassed string = "passed"
 var RemoteConfigFailed string = "failed"
 
@@ -505,14 +922,19 @@ func (msg *Config) marshal(w io.Writer) (err error) {
 	if err = WriteString(w, msg.Filters); err != nil {
 		return
 	}
-	if msg.Custom != nil {
-		for k, v := range msg.Custom {
-			if err = WriteString(w, k); err != nil {
-				return
-			}
-			if err = WriteString(w, v); err != nil {
-				return
-			}
+	// Custom values are written in key order, so that a config
+	// always encodes the same way.
+	keys := make([]string, 0, len(msg.Custom))
+	for k := range msg.Custom {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = WriteString(w, k); err != nil {
+			return
+		}
+		if err = WriteString(w, msg.Custom[k]); err != nil {
+			return
 		}
 	}
 	return
@@ -571,18 +993,39 @@ func (msg *Config) unmarshal(r io.Reader) (err error) {
 	return nil
 }
 
+// ReadMsg reads the next message, skipping keepalives.
 func ReadMsg(r io.Reader) (msg ReconMsg, err error) {
+	for {
+		if msg, err = readMsg(r); err != nil {
+			return
+		}
+		if _, is := msg.(*KeepAlive); !is {
+			break
+		}
+	}
+	if o, is := r.(MsgObserver); is {
+		o.MsgReceived(msg)
+	}
+	return
+}
+
+func readMsg(r io.Reader) (msg ReconMsg, err error) {
 	var msgSize int
 	msgSize, err = ReadInt(r)
 	if err != nil {
 		return nil, err
 	}
-	msgBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(r, msgBuf)
+	msgBuf, err := readN(r, msgSize)
 	if err != nil {
 		return nil, err
 	}
-	br := bytes.NewBuffer(msgBuf)
+	if Tracing() {
+		traceMsg("recv", msgBuf)
+	}
+	var br io.Reader = bytes.NewBuffer(msgBuf)
+	if fc, is := r.(FieldConn); is {
+		br = &fieldReader{Reader: br, p: fc.Prime()}
+	}
 	buf := make([]byte, 1)
 	_, err = io.ReadFull(br, buf[:1])
 	if err != nil {
@@ -612,6 +1055,22 @@ func ReadMsg(r io.Reader) (msg ReconMsg, err error) {
 		msg = &DbRepl{&textMsg{}}
 	case MsgTypeConfig:
 		msg = &Config{}
+	case MsgTypeReconSketch:
+		msg = &ReconSketch{}
+	case MsgTypeMerkleLevel:
+		msg = &MerkleLevel{}
+	case MsgTypeMerkleRepl:
+		msg = &MerkleRepl{}
+	case MsgTypePayloadRqst:
+		msg = &PayloadRqst{}
+	case MsgTypePayload:
+		msg = &Payload{}
+	case MsgTypeCatchUpRqst:
+		msg = &CatchUpRqst{}
+	case MsgTypeCatchUpRepl:
+		msg = &CatchUpRepl{}
+	case MsgTypeKeepAlive:
+		msg = &KeepAlive{}
 	default:
 		return nil, errors.New(fmt.Sprintf("Unexpected message code: %d", msgType))
 	}
@@ -620,10 +1079,9 @@ func ReadMsg(r io.Reader) (msg ReconMsg, err error) {
 }
 
 func WriteMsgDirect(w io.Writer, msg ReconMsg) (err error) {
-	data := bytes.NewBuffer(nil)
-	buf := make([]byte, 1)
-	buf[0] = byte(msg.MsgType())
-	_, err = data.Write(buf)
+	data := GetBuffer()
+	defer PutBuffer(data)
+	err = data.WriteByte(byte(msg.MsgType()))
 	if err != nil {
 		return
 	}
@@ -631,6 +1089,9 @@ func WriteMsgDirect(w io.Writer, msg ReconMsg) (err error) {
 	if err != nil {
 		return
 	}
+	if Tracing() {
+		traceMsg("send", data.Bytes())
+	}
 	err = WriteInt(w, data.Len())
 	if err != nil {
 		return
@@ -639,7 +1100,13 @@ func WriteMsgDirect(w io.Writer, msg ReconMsg) (err error) {
 	return err
 }
 
+// WriteMsg writes messages, holding the lock of connections which
+// are also written by other goroutines, such as to send keepalives.
 func WriteMsg(w io.Writer, msgs ...ReconMsg) (err error) {
+	if l, is := w.(sync.Locker); is {
+		l.Lock()
+		defer l.Unlock()
+	}
 	bufw := bufio.NewWriter(w)
 	for _, msg := range msgs {
 		err = WriteMsgDirect(bufw, msg)
@@ -648,5 +1115,17 @@ func WriteMsg(w io.Writer, msgs ...ReconMsg) (err error) {
 		}
 	}
 	err = bufw.Flush()
+	if o, is := w.(MsgObserver); is && err == nil {
+		for _, msg := range msgs {
+			o.MsgSent(msg)
+		}
+	}
 	return
 }
+
+// MsgObserver is implemented by connections which watch the
+// recon messages read from and written to them.
+type MsgObserver interface {
+	MsgSent(msg ReconMsg)
+	MsgReceived(msg ReconMsg)
+}
@@ -24,6 +24,8 @@ package recon
 import (
 	"bytes"
 	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io"
 	"testing"
 )
 
@@ -63,3 +65,18 @@ func TestConfigMsgRoundTrip(t *testing.T) {
 	assert.Equal(t, c.BitQuantum, c2.BitQuantum)
 	assert.Equal(t, c.MBar, c2.MBar)
 }
+
+// Test that a corrupt length fails to decode without allocating for it.
+func TestReadCorruptLength(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	assert.Equal(t, nil, WriteMsg(buf, &Elements{NewZSet(Zi(P_SKS, 65537))}))
+	data := buf.Bytes()
+	// Claim 2^31 elements
+	data[5] = 0x80
+	_, err := ReadMsg(bytes.NewBuffer(data))
+	assert.NotEqual(t, nil, err)
+	// Claim a 2^31 byte message
+	data[0] = 0x80
+	_, err = ReadMsg(bytes.NewBuffer(data))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,79 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	. "github.com/cmars/conflux"
+	"sync"
+)
+
+// treeChanges signals changes made to the prefix tree through the peer.
+// The zero value is ready to use.
+type treeChanges struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// wait returns a channel closed at the next change.
+func (c *treeChanges) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+func (c *treeChanges) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// TreeChanged returns a channel which is closed the next time an
+// element is inserted or removed through the peer.
+func (p *Peer) TreeChanged() <-chan struct{} {
+	return p.changes.wait()
+}
+
+// digestZp returns the element of the peer's finite field for a
+// digest, which is read as a little-endian integer as SKS does.
+func (p *Peer) digestZp(digest []byte) *Zp {
+	return ZpFromBytes(p.prime(), digest)
+}
+
+// InsertDigest inserts the element for a digest of the data which
+// the embedding application has added, keeping the prefix tree and
+// its digest consistent with the data, logging the change, and
+// notifying those waiting on TreeChanged.
+func (p *Peer) InsertDigest(digest []byte) error {
+	return p.Insert(p.digestZp(digest))
+}
+
+// RemoveDigest removes the element for a digest of the data which
+// the embedding application has removed.
+func (p *Peer) RemoveDigest(digest []byte) error {
+	return p.Remove(p.digestZp(digest))
+}
@@ -0,0 +1,60 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"crypto/md5"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestInsertRemoveDigest(t *testing.T) {
+	p := NewMemPeer()
+	startCmds(p)
+	digest := md5.Sum([]byte("hello"))
+	changed := p.TreeChanged()
+	assert.Equal(t, nil, p.InsertDigest(digest[:]))
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected tree change")
+	}
+	root, err := p.Root()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, root.Size())
+	z := ZpFromMd5(P_SKS, []byte("hello"))
+	assert.Equal(t, 0, z.Cmp(mustElements(t, root)[0]))
+	assert.Equal(t, MultisetDigest(z).String(), p.PrefixTree.(DigestTree).Digest().String())
+	changed = p.TreeChanged()
+	assert.Equal(t, nil, p.RemoveDigest(digest[:]))
+	<-changed
+	root, _ = p.Root()
+	assert.Equal(t, 0, root.Size())
+	assert.Equal(t, MultisetDigest().String(), p.PrefixTree.(DigestTree).Digest().String())
+	// Removing it again fails, rather than corrupting the tree
+	_, is := p.RemoveDigest(digest[:]).(*NotFoundError)
+	assert.T(t, is)
+	root, _ = p.Root()
+	assert.Equal(t, 0, root.Size())
+	assert.Equal(t, MultisetDigest().String(), p.PrefixTree.(DigestTree).Digest().String())
+}
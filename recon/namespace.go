@@ -0,0 +1,130 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// AddNamespace hosts another prefix tree behind the peer's listener,
+// reconciled with remote peers which name the namespace in their
+// config. The namespace has its own settings, or the peer's if nil,
+// and so may gossip with its own partners. It shares the peer's
+// command loop, session hooks, journal and RecoverChan, where elements
+// recovered into the namespace are identified by Recover.Namespace,
+// and are sent by the peer's recover policy.
+// Namespaces must be added before the peer is started.
+func (p *Peer) AddNamespace(name string, settings *Settings, tree PrefixTree) *Peer {
+	if settings == nil {
+		settings = p.Settings
+	}
+	ns := NewPeer(settings, tree)
+	ns.namespace = name
+	ns.host = p
+	ns.RecoverChan = p.RecoverChan
+	if p.namespaces == nil {
+		p.namespaces = make(map[string]*Peer)
+	}
+	p.namespaces[name] = ns
+	return ns
+}
+
+// Namespace returns the name of the peer's namespace,
+// which is empty for the peer hosting the namespaces.
+func (p *Peer) Namespace() string {
+	return p.namespace
+}
+
+// Namespaces returns the names of the namespaces hosted by the peer.
+func (p *Peer) Namespaces() (names []string) {
+	for name := range p.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// startNamespaces shares the running peer with its namespaces.
+func (p *Peer) startNamespaces() {
+	for _, ns := range p.namespaces {
+		ns.reconCmdReq = p.reconCmdReq
+		ns.reconCmdResp = p.reconCmdResp
+		ns.SessionHooks = p.SessionHooks
+		ns.Journal = p.Journal
+	}
+}
+
+// remoteNamespace returns the namespace named by a remote peer,
+// which is empty if none was given.
+func remoteNamespace(config *Config) string {
+	return config.Custom["namespace"]
+}
+
+// routeNamespace reads the config sent by a client to find the
+// namespace it reconciles, returning the peer of the namespace and
+// the connection from which the config may be read again. Clients
+// naming an unknown namespace are left to fail the handshake with
+// this peer.
+func (p *Peer) routeNamespace(conn net.Conn) (*Peer, net.Conn, error) {
+	if len(p.namespaces) == 0 {
+		return p, conn, nil
+	}
+	if p.HandshakeTimeout() > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(p.HandshakeTimeout())))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	raw := bytes.NewBuffer(nil)
+	msg, err := ReadMsg(io.TeeReader(conn, raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(raw, conn))}
+	if config, is := msg.(*Config); is {
+		if ns, has := p.namespaces[remoteNamespace(config)]; has {
+			log.Println(SERVE, "namespace:", ns.namespace)
+			return ns, conn, nil
+		}
+	}
+	return p, conn, nil
+}
+
+// gossipNamespaces runs a recon session for each namespace
+// with one of its partners.
+func (p *Peer) gossipNamespaces() {
+	for _, name := range p.Namespaces() {
+		ns := p.namespaces[name]
+		partner, err := ns.choosePartner()
+		if err != nil {
+			continue
+		}
+		log.Println(GOSSIP, "Initiating recon of namespace", name, "with peer", partner)
+		if _, err = ns.initiateRecon(partner); err != nil {
+			log.Println(GOSSIP, "Recon error:", err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net"
+	"testing"
+)
+
+func newMemTree() *MemPrefixTree {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	return tree
+}
+
+func TestNamespaceRouting(t *testing.T) {
+	server := NewMemPeer()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	ns := server.AddNamespace("b", nil, newMemTree())
+	ns.PrefixTree.Insert(Zi(P_SKS, 65539))
+	assert.Equal(t, []string{"b"}, server.Namespaces())
+	assert.Equal(t, "b", ns.Namespace())
+	client := NewMemPeer()
+	client.namespace = "b"
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	startCmds(server)
+	server.startNamespaces()
+	s := runSession(t, server, client, func(conn net.Conn) (SessionStats, error) {
+		return SessionStats{}, server.Accept(conn)
+	})
+	assert.Equal(t, nil, s.clientErr)
+	assert.Equal(t, 1, len(s.serverRecovered))
+	recovered := s.serverRecovered[0]
+	assert.Equal(t, "b", recovered.Namespace)
+	assert.Equal(t, "b", recovered.RemoteConfig.Custom["namespace"])
+	assert.Equal(t, 1, len(recovered.RemoteElements))
+	assert.T(t, recovered.RemoteElements[0].Cmp(Zi(P_SKS, 65541)) == 0)
+}
+
+func TestMismatchedNamespace(t *testing.T) {
+	server := NewMemPeer()
+	server.AddNamespace("b", nil, newMemTree())
+	client := NewMemPeer()
+	client.namespace = "c"
+	startCmds(server)
+	server.startNamespaces()
+	s := runSession(t, server, client, func(conn net.Conn) (SessionStats, error) {
+		return SessionStats{}, server.Accept(conn)
+	})
+	assert.Equal(t, IncompatiblePeerError, s.clientErr)
+}
@@ -0,0 +1,192 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package noise
+
+import (
+	"bytes"
+	"encoding/binary"
+	flynn "github.com/flynn/noise"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxMsgLen is the largest Noise transport message.
+const maxMsgLen = 65535
+
+// maxPlaintextLen leaves room for the AEAD tag in each message.
+const maxPlaintextLen = maxMsgLen - 16
+
+// Conn encrypts a recon session with the cipher states established
+// by the handshake. Each message is framed with a two-byte length.
+type Conn struct {
+	net.Conn
+	send, recv *flynn.CipherState
+	buf        []byte
+	readMu     sync.Mutex
+	writeMu    sync.Mutex
+	remote     []byte
+}
+
+// RemoteStatic returns the authenticated static key of the remote peer.
+func (c *Conn) RemoteStatic() []byte {
+	return c.remote
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.buf) == 0 {
+		msg, err := readMsg(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.buf, err = c.recv.Decrypt(msg[:0], nil, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPlaintextLen {
+			chunk = chunk[:maxPlaintextLen]
+		}
+		msg, err := c.send.Encrypt(nil, nil, chunk)
+		if err != nil {
+			return n, err
+		}
+		if err = writeMsg(c.Conn, msg); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func readMsg(r io.Reader) ([]byte, error) {
+	var msgLen uint16
+	if err := binary.Read(r, binary.BigEndian, &msgLen); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func newHandshake(k *Keys, initiator bool) (*flynn.HandshakeState, error) {
+	return flynn.NewHandshakeState(flynn.Config{
+		CipherSuite:   cipherSuite,
+		Pattern:       flynn.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      []byte(NextProto),
+		StaticKeypair: k.Static})
+}
+
+// Initiate performs the XX handshake as initiator, requiring the
+// responder to authenticate with the expected static key.
+func Initiate(conn net.Conn, k *Keys, remote []byte) (*Conn, error) {
+	hs, err := newHandshake(k, true)
+	if err != nil {
+		return nil, err
+	}
+	// -> e
+	msg, _, _, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeMsg(conn, msg); err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	if msg, err = readMsg(conn); err != nil {
+		return nil, err
+	}
+	if _, _, _, err = hs.ReadMessage(nil, msg); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hs.PeerStatic(), remote) {
+		return nil, ErrUntrustedKey
+	}
+	// -> s, se
+	msg, send, recv, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeMsg(conn, msg); err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, send: send, recv: recv, remote: hs.PeerStatic()}, nil
+}
+
+// Respond performs the XX handshake as responder, requiring the
+// initiator to authenticate with a trusted static key.
+func Respond(conn net.Conn, k *Keys) (*Conn, error) {
+	hs, err := newHandshake(k, false)
+	if err != nil {
+		return nil, err
+	}
+	// -> e
+	msg, err := readMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err = hs.ReadMessage(nil, msg); err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	if msg, _, _, err = hs.WriteMessage(nil, nil); err != nil {
+		return nil, err
+	}
+	if err = writeMsg(conn, msg); err != nil {
+		return nil, err
+	}
+	// -> s, se
+	if msg, err = readMsg(conn); err != nil {
+		return nil, err
+	}
+	_, recv, send, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !k.isTrusted(hs.PeerStatic()) {
+		return nil, ErrUntrustedKey
+	}
+	return &Conn{Conn: conn, send: send, recv: recv, remote: hs.PeerStatic()}, nil
+}
@@ -0,0 +1,227 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package noise runs the recon protocol over a Noise XX channel, giving
+// peers mutually authenticated encryption from static Curve25519 keys
+// rather than X.509 certificates.
+//
+// The local private key is read from conflux.recon.noise.privateKey.
+// Partners are addressed as noise://<hex public key>@host:port, and
+// incoming sessions are accepted only from the keys of such partners
+// or those listed in conflux.recon.noise.trustedKeys.
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cmars/conflux/recon"
+	flynn "github.com/flynn/noise"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const NOISE = "noise:"
+
+// NextProto identifies the recon protocol in the handshake prologue.
+const NextProto = "conflux-recon"
+
+var cipherSuite = flynn.NewCipherSuite(flynn.DH25519, flynn.CipherChaChaPoly, flynn.HashBLAKE2b)
+
+var ErrNoPrivateKey error = errors.New("conflux.recon.noise.privateKey not set")
+var ErrUntrustedKey error = errors.New("remote static key is not trusted")
+
+// Keys holds the local static keypair and the remote static keys
+// trusted by this peer.
+type Keys struct {
+	Static  flynn.DHKey
+	trusted map[string]bool
+	mu      sync.RWMutex
+}
+
+// GenerateKey creates a new static keypair.
+func GenerateKey() (flynn.DHKey, error) {
+	return cipherSuite.GenerateKeypair(nil)
+}
+
+// NewKeys creates Keys for the given private key.
+func NewKeys(private []byte) (*Keys, error) {
+	if len(private) != 32 {
+		return nil, errors.New(fmt.Sprintf("invalid private key length %d", len(private)))
+	}
+	static, err := cipherSuite.GenerateKeypair(bytes.NewReader(private))
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{Static: static, trusted: make(map[string]bool)}, nil
+}
+
+// LoadKeys reads the local private key and trusted remote keys from settings.
+func LoadKeys(s *recon.Settings) (*Keys, error) {
+	privHex := s.GetString("conflux.recon.noise.privateKey", "")
+	if privHex == "" {
+		return nil, ErrNoPrivateKey
+	}
+	private, err := hex.DecodeString(privHex)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := NewKeys(private)
+	if err != nil {
+		return nil, err
+	}
+	for _, partner := range s.Partners() {
+		if recon.PartnerScheme(partner) != "noise" {
+			continue
+		}
+		remote, _, err := parsePartner(partner)
+		if err != nil {
+			return nil, err
+		}
+		keys.Trust(remote)
+	}
+	for _, keyHex := range s.GetStrings("conflux.recon.noise.trustedKeys") {
+		remote, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, err
+		}
+		keys.Trust(remote)
+	}
+	return keys, nil
+}
+
+// Trust accepts incoming sessions from the given remote static key.
+func (k *Keys) Trust(remote []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.trusted[string(remote)] = true
+}
+
+func (k *Keys) isTrusted(remote []byte) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.trusted[string(remote)]
+}
+
+// parsePartner splits noise://<hex public key>@host:port into
+// the partner's static key and network address.
+func parsePartner(partner string) (remote []byte, addr string, err error) {
+	spec := strings.TrimPrefix(partner, "noise://")
+	at := strings.LastIndex(spec, "@")
+	if at < 0 {
+		return nil, "", errors.New(fmt.Sprintf("missing public key in partner %s", partner))
+	}
+	remote, err = hex.DecodeString(spec[:at])
+	if err != nil {
+		return nil, "", err
+	}
+	if len(remote) != 32 {
+		return nil, "", errors.New(fmt.Sprintf("invalid public key length %d in partner %s", len(remote), partner))
+	}
+	return remote, spec[at+1:], nil
+}
+
+// Register makes noise:// partners dialable with these keys.
+func Register(k *Keys) {
+	recon.RegisterTransport("noise", k.Dial)
+}
+
+// Dial connects to a partner addressed as noise://<hex public key>@host:port
+// and performs the handshake as initiator.
+func (k *Keys) Dial(partner string, timeout time.Duration) (net.Conn, error) {
+	remote, addr, err := parsePartner(partner)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	nc, err := Initiate(conn, k, remote)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+// Server accepts recon sessions over Noise.
+type Server struct {
+	peer *recon.Peer
+	keys *Keys
+	ln   net.Listener
+}
+
+// Listen creates a Noise recon server for the peer on the TCP address addr.
+func Listen(p *recon.Peer, addr string, k *Keys) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{peer: p, keys: k, ln: ln}, nil
+}
+
+func (s *Server) Addr() net.Addr { return s.ln.Addr() }
+
+func (s *Server) Close() error { return s.ln.Close() }
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	limited, err := s.peer.AcquireConn(conn)
+	if err != nil {
+		log.Println(NOISE, err, "dropping:", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn = limited
+	defer conn.Close()
+	log.Println(NOISE, "connection from:", conn.RemoteAddr())
+	if s.peer.HandshakeTimeout() > 0 {
+		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(s.peer.HandshakeTimeout())))
+	}
+	nc, err := Respond(conn, s.keys)
+	if err != nil {
+		log.Println(NOISE, conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if err = s.peer.Accept(nc); err != nil {
+		log.Println(NOISE, err)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package noise
+
+import (
+	"encoding/hex"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPeer starts a peer holding elements, with settings changed
+// by configure, if given, before the peer reads them.
+func startPeer(t *testing.T, configure func(*recon.Settings), elements ...int) *recon.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	p := recon.NewMemPeer()
+	p.Settings.Set("conflux.recon.reconPort", port)
+	p.Settings.Set("conflux.recon.connTimeout", 1)
+	p.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	if configure != nil {
+		configure(p.Settings)
+	}
+	for _, n := range elements {
+		p.PrefixTree.Insert(Zi(P_SKS, n))
+	}
+	p.Start()
+	return p
+}
+
+func newKeys(t *testing.T) *Keys {
+	static, err := GenerateKey()
+	assert.Equal(t, nil, err)
+	keys, err := NewKeys(static.Private)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, static.Public, keys.Static.Public)
+	return keys
+}
+
+func TestNoiseRecon(t *testing.T) {
+	server := startPeer(t, nil, 65537, 65539)
+	defer server.Stop()
+	client := startPeer(t, nil, 65537, 65541)
+	defer client.Stop()
+	serverKeys, clientKeys := newKeys(t), newKeys(t)
+	serverKeys.Trust(clientKeys.Static.Public)
+	s, err := Listen(server, "127.0.0.1:0", serverKeys)
+	assert.Equal(t, nil, err)
+	defer s.Close()
+	go s.Serve()
+	partner := "noise://" + hex.EncodeToString(serverKeys.Static.Public) + "@" + s.Addr().String()
+	conn, err := clientKeys.Dial(partner, time.Second)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	clientErr := make(chan error)
+	go func() {
+		_, err := client.ReconcileWith(conn, recon.RoleClient)
+		clientErr <- err
+	}()
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, <-clientErr)
+}
+
+func TestNoiseFollowerRefused(t *testing.T) {
+	server := startPeer(t, func(s *recon.Settings) {
+		s.Set("conflux.recon.follower", true)
+		s.Set("conflux.recon.followerAccept", false)
+	}, 65537)
+	defer server.Stop()
+	client := startPeer(t, nil, 65539)
+	defer client.Stop()
+	serverKeys, clientKeys := newKeys(t), newKeys(t)
+	serverKeys.Trust(clientKeys.Static.Public)
+	s, err := Listen(server, "127.0.0.1:0", serverKeys)
+	assert.Equal(t, nil, err)
+	defer s.Close()
+	go s.Serve()
+	partner := "noise://" + hex.EncodeToString(serverKeys.Static.Public) + "@" + s.Addr().String()
+	conn, err := clientKeys.Dial(partner, time.Second)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	_, err = client.ReconcileWith(conn, recon.RoleClient)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestUntrustedKey(t *testing.T) {
+	serverKeys, clientKeys := newKeys(t), newKeys(t)
+	serverConn, clientConn := net.Pipe()
+	serverErr := make(chan error)
+	go func() {
+		_, err := Respond(serverConn, serverKeys)
+		serverConn.Close()
+		serverErr <- err
+	}()
+	Initiate(clientConn, clientKeys, serverKeys.Static.Public)
+	assert.Equal(t, ErrUntrustedKey, <-serverErr)
+	// Initiator rejects a responder with an unexpected key.
+	serverConn, clientConn = net.Pipe()
+	go func() {
+		Respond(serverConn, serverKeys)
+		serverConn.Close()
+	}()
+	_, err := Initiate(clientConn, clientKeys, clientKeys.Static.Public)
+	clientConn.Close()
+	assert.Equal(t, ErrUntrustedKey, err)
+}
+
+func TestLoadKeys(t *testing.T) {
+	serverKeys, clientKeys := newKeys(t), newKeys(t)
+	s := recon.DefaultSettings()
+	s.Set("conflux.recon.noise.privateKey", hex.EncodeToString(clientKeys.Static.Private))
+	s.Set("conflux.recon.partners", []interface{}{
+		"noise://" + hex.EncodeToString(serverKeys.Static.Public) + "@localhost:11370",
+		"localhost:11371"})
+	keys, err := LoadKeys(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, clientKeys.Static.Public, keys.Static.Public)
+	assert.T(t, keys.isTrusted(serverKeys.Static.Public))
+	assert.T(t, !keys.isTrusted(clientKeys.Static.Public))
+}
@@ -0,0 +1,90 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+// Options configures a peer in code, for programs which embed conflux
+// without a settings file. Fields left at their zero value take the
+// default setting.
+type Options struct {
+	Version            string
+	LogName            string
+	HttpPort           int
+	ReconPort          int
+	Partners           []string
+	Filters            []string
+	ThreshMult         int
+	BitQuantum         int
+	MBar               int
+	GossipIntervalSecs int
+	ReadTimeout        int
+	WriteTimeout       int
+	IdleTimeout        int
+	// Partners configured individually
+	PartnerConfigs []*PartnerConfig
+	// Other settings by key, such as "conflux.recon.leveldb.path"
+	Extra map[string]interface{}
+}
+
+// Settings returns the settings described by the options.
+func (o *Options) Settings() *Settings {
+	s := DefaultSettings()
+	setString := func(key, value string) {
+		if value != "" {
+			s.Set(key, value)
+		}
+	}
+	setInt := func(key string, value int) {
+		if value != 0 {
+			s.Set(key, value)
+		}
+	}
+	setStrings := func(key string, values []string) {
+		if len(values) > 0 {
+			var list []interface{}
+			for _, v := range values {
+				list = append(list, v)
+			}
+			s.Set(key, list)
+		}
+	}
+	setString("conflux.recon.version", o.Version)
+	setString("conflux.recon.logname", o.LogName)
+	setInt("conflux.recon.httpPort", o.HttpPort)
+	setInt("conflux.recon.reconPort", o.ReconPort)
+	setStrings("conflux.recon.partners", o.Partners)
+	setStrings("conflux.recon.filters", o.Filters)
+	setInt("conflux.recon.threshMult", o.ThreshMult)
+	setInt("conflux.recon.bitQuantum", o.BitQuantum)
+	setInt("conflux.recon.mBar", o.MBar)
+	setInt("conflux.recon.gossipIntervalSecs", o.GossipIntervalSecs)
+	setInt("conflux.recon.readTimeout", o.ReadTimeout)
+	setInt("conflux.recon.writeTimeout", o.WriteTimeout)
+	setInt("conflux.recon.idleTimeout", o.IdleTimeout)
+	for _, pc := range o.PartnerConfigs {
+		s.SetPartnerConfig(pc)
+	}
+	for key, value := range o.Extra {
+		s.Set(key, value)
+	}
+	s.UpdateDerived()
+	return s
+}
@@ -0,0 +1,222 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PartnerConfig holds settings for a single recon partner, given in a
+// named block under conflux.recon.partner:
+//
+//	[conflux.recon.partner.example]
+//	addr = "keys.example.com:11370"
+//	httpPort = 11371
+//	readTimeout = 30
+//	bandwidth = 65536
+//	priority = 2
+//	windows = ["Mon-Fri 22:00-06:00", "Sat,Sun 00:00-24:00"]
+//
+// Settings left unset in the block fall back to the global settings.
+type PartnerConfig struct {
+	// Name of the partner block
+	Name string
+	// Partner address, in any form accepted in conflux.recon.partners
+	Addr string
+	// HKP port of the partner, for fetching recovered elements
+	HttpPort int
+	// Filters expected of the partner
+	Filters []string
+	// Timeouts in seconds, overriding the global setting if not zero
+	ReadTimeout  int
+	WriteTimeout int
+	IdleTimeout  int
+	// Bandwidth cap in bytes per second in each direction; zero is unlimited
+	Bandwidth int
+	// Weight of the partner in priority partner selection; zero is 1
+	Priority int
+	// Times at which to gossip with the partner, as parsed by
+	// ParseReconWindow; always if none are given
+	Windows []string
+	// SOCKS5 proxy URL, or "direct" to bypass the global proxy
+	Proxy string
+	// Credentials for HTTP transports
+	Username string
+	Password string
+}
+
+func (s *Settings) partnerKey(name, field string) string {
+	return fmt.Sprintf("conflux.recon.partner.%s.%s", name, field)
+}
+
+// partnerStrings reads a list setting from a partner block, which may
+// also be given as a single comma-separated string.
+func (s *Settings) partnerStrings(key string) (values []string) {
+	if str, is := s.Get(key).(string); is {
+		for _, v := range strings.Split(str, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return
+	}
+	return s.GetStrings(key)
+}
+
+// partnerWindows reads the recon windows of a partner, which may also
+// be given as a single string separated by semicolons, since windows
+// may contain commas.
+func (s *Settings) partnerWindows(key string) (values []string) {
+	if str, is := s.Get(key).(string); is {
+		for _, v := range strings.Split(str, ";") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return
+	}
+	return s.GetStrings(key)
+}
+
+// PartnerConfigs returns the configuration of each partner. Partners
+// listed in conflux.recon.partners are included with only their
+// address set, unless also configured in a block.
+func (s *Settings) PartnerConfigs() (configs []*PartnerConfig) {
+	var names []string
+	if tree, is := s.Get("conflux.recon.partner").(*toml.TomlTree); is {
+		names = tree.Keys()
+	}
+	sort.Strings(names)
+	configured := make(map[string]bool)
+	for _, name := range names {
+		pc := &PartnerConfig{
+			Name:         name,
+			Addr:         s.GetString(s.partnerKey(name, "addr"), ""),
+			HttpPort:     s.GetInt(s.partnerKey(name, "httpPort"), 0),
+			Filters:      s.partnerStrings(s.partnerKey(name, "filters")),
+			ReadTimeout:  s.GetInt(s.partnerKey(name, "readTimeout"), 0),
+			WriteTimeout: s.GetInt(s.partnerKey(name, "writeTimeout"), 0),
+			IdleTimeout:  s.GetInt(s.partnerKey(name, "idleTimeout"), 0),
+			Bandwidth:    s.GetInt(s.partnerKey(name, "bandwidth"), 0),
+			Priority:     s.GetInt(s.partnerKey(name, "priority"), 0),
+			Windows:      s.partnerWindows(s.partnerKey(name, "windows")),
+			Proxy:        s.GetString(s.partnerKey(name, "proxy"), ""),
+			Username:     s.GetString(s.partnerKey(name, "username"), ""),
+			Password:     s.GetString(s.partnerKey(name, "password"), "")}
+		if pc.Addr == "" {
+			continue
+		}
+		configured[pc.Addr] = true
+		configs = append(configs, pc)
+	}
+	for _, partner := range s.GetStrings("conflux.recon.partners") {
+		if partner != "" && !configured[partner] {
+			configs = append(configs, &PartnerConfig{Addr: partner})
+		}
+	}
+	return
+}
+
+// PartnerConfig returns the configuration of the partner at addr,
+// or nil if it is not a partner.
+func (s *Settings) PartnerConfig(addr string) *PartnerConfig {
+	for _, pc := range s.PartnerConfigs() {
+		if pc.Addr == addr {
+			return pc
+		}
+	}
+	return nil
+}
+
+// SetPartnerConfig writes a partner block into the settings.
+func (s *Settings) SetPartnerConfig(pc *PartnerConfig) {
+	setString := func(field, value string) {
+		if value != "" {
+			s.Set(s.partnerKey(pc.Name, field), value)
+		}
+	}
+	setInt := func(field string, value int) {
+		if value != 0 {
+			s.Set(s.partnerKey(pc.Name, field), value)
+		}
+	}
+	setString("addr", pc.Addr)
+	setInt("httpPort", pc.HttpPort)
+	if len(pc.Filters) > 0 {
+		var filters []interface{}
+		for _, filter := range pc.Filters {
+			filters = append(filters, filter)
+		}
+		s.Set(s.partnerKey(pc.Name, "filters"), filters)
+	}
+	setInt("readTimeout", pc.ReadTimeout)
+	setInt("writeTimeout", pc.WriteTimeout)
+	setInt("idleTimeout", pc.IdleTimeout)
+	setInt("bandwidth", pc.Bandwidth)
+	setInt("priority", pc.Priority)
+	if len(pc.Windows) > 0 {
+		var windows []interface{}
+		for _, window := range pc.Windows {
+			windows = append(windows, window)
+		}
+		s.Set(s.partnerKey(pc.Name, "windows"), windows)
+	}
+	setString("proxy", pc.Proxy)
+	setString("username", pc.Username)
+	setString("password", pc.Password)
+}
+
+// dialAddr returns the address to dial for the partner, with
+// credentials added to the URL of HTTP partners.
+func (pc *PartnerConfig) dialAddr() string {
+	switch PartnerScheme(pc.Addr) {
+	case "http", "https":
+		if pc.Username == "" {
+			break
+		}
+		u, err := url.Parse(pc.Addr)
+		if err != nil {
+			break
+		}
+		u.User = url.UserPassword(pc.Username, pc.Password)
+		return u.String()
+	}
+	return pc.Addr
+}
+
+// withPartnerLimits applies the partner's timeouts and bandwidth cap
+// to a connection, falling back to the global timeouts.
+func (p *Peer) withPartnerLimits(conn net.Conn, pc *PartnerConfig) net.Conn {
+	idleTimeout, writeTimeout := p.IdleTimeout(), p.WriteTimeout()
+	if pc.IdleTimeout != 0 {
+		idleTimeout = pc.IdleTimeout
+	}
+	if pc.WriteTimeout != 0 {
+		writeTimeout = pc.WriteTimeout
+	}
+	return p.withLimits(conn, idleTimeout, writeTimeout, pc.Bandwidth)
+}
@@ -0,0 +1,196 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"log"
+	"strconv"
+)
+
+// PayloadStore holds the data which the elements of a prefix tree
+// digest, so that it can be transferred in recon sessions along with
+// the elements, rather than fetched from the remote peer afterwards.
+type PayloadStore interface {
+	// Payload returns the data digested by an element,
+	// or nil if it is not held.
+	Payload(z *Zp) ([]byte, error)
+	// StorePayload stores the data received for an element
+	// recovered from a remote peer.
+	StorePayload(z *Zp, data []byte) error
+}
+
+// PayloadMaxSize is the size in bytes of the largest payload the peer
+// transfers in a recon session. If both peers enable payloads and
+// have a PayloadStore, each requests the payloads of the elements it
+// recovers once the elements are reconciled, and receives those up
+// to the smaller of their sizes. Elements whose payloads are not
+// transferred must be fetched as before. Zero, the default, disables
+// payloads.
+func (s *Settings) PayloadMaxSize() int {
+	return s.GetInt("conflux.recon.payloadMaxSize", 0)
+}
+
+// PayloadChunkSize is the size in bytes of the chunks in which
+// payloads are sent.
+func (s *Settings) PayloadChunkSize() int {
+	return s.GetInt("conflux.recon.payloadChunkSize", 65536)
+}
+
+// PayloadSessionMax limits the bytes of payloads sent to a remote
+// peer in each session. Payloads beyond it are not sent.
+func (s *Settings) PayloadSessionMax() int {
+	return s.GetInt("conflux.recon.payloadSessionMax", 64<<20)
+}
+
+// payloadSize returns the size of the largest payload the peer
+// announces that it transfers, or zero if it does not.
+func (p *Peer) payloadSize() int {
+	if p.Payloads == nil {
+		return 0
+	}
+	return p.PayloadMaxSize()
+}
+
+// payloadLimit returns the size of the largest payload to transfer
+// with a remote peer, or zero if either peer does not transfer them.
+func (p *Peer) payloadLimit(remoteConfig *Config) int {
+	limit := p.payloadSize()
+	remote, err := strconv.Atoi(remoteConfig.Custom["payloads"])
+	if err != nil || remote < limit {
+		limit = remote
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+var ErrPayloadTooLarge error = errors.New("Payload exceeds the maximum size")
+
+// exchangePayloads transfers the payloads of the elements recovered in
+// a session once they are reconciled. The server requests the payloads
+// it recovered first, then the client does. Payloads received are
+// stored, and listed in the session's held recovery.
+func (p *Peer) exchangePayloads(conn *sessionConn, role Role, limit int) (err error) {
+	var want []*Zp
+	if conn.recover != nil {
+		want = conn.recover.RemoteElements
+	}
+	var received []*Zp
+	switch role {
+	case RoleServer:
+		if received, err = p.requestPayloads(conn, want, limit); err != nil {
+			return
+		}
+		err = p.servePayloads(conn, limit)
+	case RoleClient:
+		if err = p.servePayloads(conn, limit); err != nil {
+			return
+		}
+		received, err = p.requestPayloads(conn, want, limit)
+	}
+	if conn.recover != nil {
+		conn.recover.Payloads = received
+	}
+	return
+}
+
+// requestPayloads requests the payloads of elements from the remote
+// peer, returning those received and stored.
+func (p *Peer) requestPayloads(conn *sessionConn, elements []*Zp, limit int) (received []*Zp, err error) {
+	wanted := NewZSet(elements...)
+	if err = WriteMsg(conn, &PayloadRqst{Elements: wanted}); err != nil {
+		return
+	}
+	var current *Zp
+	var pending []byte
+	for {
+		var msg ReconMsg
+		if msg, err = ReadMsg(conn); err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *Done:
+			return
+		case *Payload:
+			if !wanted.Has(m.Element) || (current != nil && current.Cmp(m.Element) != 0) {
+				return received, errors.New(fmt.Sprintf("Unexpected payload for %v", m.Element))
+			}
+			current = m.Element
+			if pending = append(pending, m.Data...); len(pending) > limit {
+				return received, ErrPayloadTooLarge
+			}
+			if m.More {
+				continue
+			}
+			if err = p.Payloads.StorePayload(m.Element, pending); err != nil {
+				log.Println("payload:", m.Element, err)
+			} else {
+				received = append(received, m.Element)
+			}
+			wanted.Remove(m.Element)
+			current, pending = nil, nil
+		default:
+			return received, errors.New(fmt.Sprintf("Expected payload, got %v", msg))
+		}
+	}
+}
+
+// servePayloads answers the remote peer's request for payloads with
+// those held which are within the size limits, in chunks.
+func (p *Peer) servePayloads(conn *sessionConn, limit int) (err error) {
+	var msg ReconMsg
+	if msg, err = ReadMsg(conn); err != nil {
+		return
+	}
+	rqst, is := msg.(*PayloadRqst)
+	if !is {
+		return errors.New(fmt.Sprintf("Expected payload request, got %v", msg))
+	}
+	chunkSize, sent := p.PayloadChunkSize(), 0
+	for _, z := range rqst.Elements.Items() {
+		data, err := p.Payloads.Payload(z)
+		if err != nil {
+			log.Println("payload:", z, err)
+			continue
+		}
+		if data == nil || len(data) > limit || p.Blacklisted(z) {
+			continue
+		}
+		if sent += len(data); sent > p.PayloadSessionMax() {
+			break
+		}
+		for len(data) > chunkSize {
+			if err = WriteMsg(conn, &Payload{Element: z, Data: data[:chunkSize], More: true}); err != nil {
+				return err
+			}
+			data = data[chunkSize:]
+		}
+		if err = WriteMsg(conn, &Payload{Element: z, Data: data}); err != nil {
+			return err
+		}
+	}
+	return WriteMsg(conn, &Done{})
+}
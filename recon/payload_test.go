@@ -0,0 +1,120 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"sync"
+	"testing"
+)
+
+type memPayloads struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemPayloads() *memPayloads {
+	return &memPayloads{data: make(map[string][]byte)}
+}
+
+func (m *memPayloads) Payload(z *Zp) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[z.String()], nil
+}
+
+func (m *memPayloads) StorePayload(z *Zp, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[z.String()] = data
+	return nil
+}
+
+// payloadSettings limits payloads so that tests cover both
+// chunked transfers and payloads too large to be sent.
+var payloadSettings = []interface{}{
+	"conflux.recon.payloadMaxSize", 100,
+	"conflux.recon.payloadChunkSize", 16,
+}
+
+func payloadFor(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, i)
+}
+
+func TestPayloads(t *testing.T) {
+	serverPayloads, clientPayloads := newMemPayloads(), newMemPayloads()
+	server, client := newTestPeer(payloadSettings...), newTestPeer(payloadSettings...)
+	server.Payloads, client.Payloads = serverPayloads, clientPayloads
+	for i := 1; i < 120; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 != 0 {
+			server.PrefixTree.Insert(z)
+			serverPayloads.StorePayload(z, payloadFor(i))
+		}
+		if i%4 != 0 {
+			client.PrefixTree.Insert(z)
+			clientPayloads.StorePayload(z, payloadFor(i))
+		}
+	}
+	s := reconcile(t, server, client)
+	sr, cr := s.serverRecovered[0], s.clientRecovered[0]
+	for _, r := range []*Recover{sr, cr} {
+		large := 0
+		for _, z := range r.RemoteElements {
+			if i := int(z.Int64() / 65537); i > 100 {
+				large++
+			}
+		}
+		// Payloads over the maximum size are not transferred
+		assert.Equal(t, len(r.RemoteElements)-large, len(r.Payloads))
+	}
+	for _, z := range cr.Payloads {
+		data, _ := clientPayloads.Payload(z)
+		assert.Equal(t, payloadFor(int(z.Int64()/65537)), data)
+	}
+	for _, z := range sr.Payloads {
+		data, _ := serverPayloads.Payload(z)
+		assert.Equal(t, payloadFor(int(z.Int64()/65537)), data)
+	}
+}
+
+func TestPayloadsUnsupported(t *testing.T) {
+	server, client := newTestPeer(payloadSettings...), newTestPeer()
+	server.Payloads = newMemPayloads()
+	for i := 1; i < 20; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 != 0 {
+			server.PrefixTree.Insert(z)
+		}
+		if i%4 != 0 {
+			client.PrefixTree.Insert(z)
+		}
+	}
+	assert.Equal(t, 0, client.payloadLimit(server.Config()))
+	assert.Equal(t, 0, server.payloadLimit(client.Config()))
+	s := reconcile(t, server, client)
+	sr, cr := s.serverRecovered[0], s.clientRecovered[0]
+	assert.Equal(t, 0, len(sr.Payloads))
+	assert.Equal(t, 0, len(cr.Payloads))
+}
@@ -28,6 +28,10 @@ import (
 	. "github.com/cmars/conflux"
 	"log"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +41,25 @@ type Recover struct {
 	RemoteAddr     net.Addr
 	RemoteConfig   *Config
 	RemoteElements []*Zp
+	// Namespace of the prefix tree missing the elements
+	Namespace string
+	// Elements whose payloads were received in the session
+	// and stored in the peer's PayloadStore
+	Payloads []*Zp
+	// Elements a trusted remote peer removed, caught up from its
+	// change log
+	RemoteRemoved []*Zp
+	// sent is told whether the recovery was delivered, once
+	sent func(delivered bool)
+}
+
+// done tells the session which made the recovery whether it was
+// delivered to RecoverChan.
+func (r *Recover) done(delivered bool) {
+	if r.sent != nil {
+		r.sent(delivered)
+		r.sent = nil
+	}
 }
 
 func (r *Recover) String() string {
@@ -62,16 +85,43 @@ type Peer struct {
 	*Settings
 	PrefixTree
 	RecoverChan  RecoverChan
+	Journal      Journal
+	ChangeLog    ChangeLog
+	Payloads     PayloadStore
+	Expiry       ExpiryStore
+	SessionHooks []SessionHook
+	limiter      *connLimiter
+	history      reconHistory
+	sessions     sessionTable
+	recent       recentSessions
+	recovered    recoverDedup
+	spill        recoverSpill
+	blacklist    blacklist
+	changes      treeChanges
+	caughtUp     catchUpState
+	summaries    treeSummaries
+	webhook      *Webhook
+	webhookHook  int
+	pendingCmds  int32
+	partnerTurn  int
 	reconCmdReq  reconCmdReq
 	reconCmdResp reconCmdResp
+	namespace    string
+	namespaces   map[string]*Peer
+	// Peer hosting the namespace, if any
+	host         *Peer
 	serverEnable serverEnable
 	gossipEnable gossipEnable
 	stopped      stopped
+	sweepStop    chan struct{}
+	sweepDone    chan struct{}
+	spillStop    chan struct{}
+	spillDone    chan struct{}
 }
 
 func NewPeer(settings *Settings, tree PrefixTree) *Peer {
 	return &Peer{
-		RecoverChan: make(RecoverChan),
+		RecoverChan: make(RecoverChan, settings.RecoverBuffer()),
 		Settings:    settings,
 		PrefixTree:  tree}
 }
@@ -83,15 +133,105 @@ func NewMemPeer() *Peer {
 	return NewPeer(settings, tree)
 }
 
+// Config returns the configuration the peer announces to remote peers,
+// which includes the finite field of its prefix tree if not P_SKS, and
+// a digest of its sample points if they are not those used by SKS,
+// its derivation of element keys if not that of SKS, the capacity of
+// the sketches it exchanges, if enabled, and the strategies by which it
+// may reconcile if not only that of SKS. Peers catching up announce
+// their id, peers of a namespace name it, peers reconciling a prefix of
+// element keys announce it, as do followers, peers transferring payloads
+// announce the largest they transfer, and peers sending keepalive
+// messages announce their period.
+func (p *Peer) Config() *Config {
+	config := p.Settings.Config()
+	custom := make(map[string]string)
+	if prime := p.prime(); prime.Cmp(P_SKS) != 0 {
+		custom["prime"] = prime.String()
+	}
+	if points := p.pointsId(); points != sksPointsId {
+		custom["points"] = points
+	}
+	if keys := p.keysName(); keys != SksKeys.Name() {
+		custom["keys"] = keys
+	}
+	if capacity := p.SketchCapacity(); capacity > 0 {
+		custom["sketch"] = strconv.Itoa(capacity)
+	}
+	if names := p.strategyNames(); len(names) != 1 || names[0] != PtreeStrategy.Name() {
+		custom["strategies"] = strings.Join(names, ",")
+	}
+	if id := p.NodeId(); id != "" && p.CatchUp() {
+		custom["node"] = id
+	}
+	if p.namespace != "" {
+		custom["namespace"] = p.namespace
+	}
+	if prefix := p.ReconPrefix(); prefix != nil {
+		custom["prefix"] = prefix.String()
+	}
+	if p.Follower() {
+		custom["follower"] = "true"
+	}
+	if size := p.payloadSize(); size > 0 {
+		custom["payloads"] = strconv.Itoa(size)
+	}
+	if keepAlive := p.KeepAlive(); keepAlive > 0 {
+		custom["keepalive"] = strconv.Itoa(keepAlive)
+	}
+	if len(custom) > 0 {
+		config.Custom = custom
+	}
+	return config
+}
+
 func (p *Peer) Start() {
+	if err := p.Settings.Validate(); err != nil {
+		log.Println(SERVE, "Invalid settings:", err)
+	}
 	p.serverEnable = make(serverEnable)
 	p.gossipEnable = make(gossipEnable)
 	p.stopped = make(stopped)
 	p.reconCmdReq = make(reconCmdReq)
 	p.reconCmdResp = make(reconCmdResp)
+	p.limiter = newConnLimiter(p.MaxConns(), p.MaxConnsPerHost())
+	if p.Trace() {
+		SetTrace(true)
+	}
+	if p.Journal == nil && p.JournalPath() != "" {
+		journal, err := OpenFileJournal(p.JournalPath())
+		if err != nil {
+			log.Println(SERVE, "journal:", err)
+		} else {
+			p.Journal = journal
+		}
+	}
+	if p.ChangeLog == nil && p.ChangeLogPath() != "" {
+		changeLog, err := OpenFileChangeLog(p.ChangeLogPath())
+		if err != nil {
+			log.Println(SERVE, "change log:", err)
+		} else {
+			if p.CatchUp() {
+				// Older changes are never caught up on
+				changeLog.Keep = p.CatchUpMax()
+			}
+			p.ChangeLog = changeLog
+		}
+	}
+	if p.Expiry == nil {
+		p.Expiry = NewMemExpiryStore()
+	}
+	p.sweepStop = make(chan struct{})
+	p.sweepDone = make(chan struct{})
+	p.spillStop = make(chan struct{})
+	p.spillDone = make(chan struct{})
+	p.startWebhook()
+	p.startNamespaces()
+	go p.sweep(p.sweepStop, p.sweepDone)
+	go p.replaySpill(p.spillStop, p.spillDone)
 	go p.Serve()
 	go p.Gossip()
-	go p.handleCmds()
+	go p.handleCmds(p.reconCmdReq, p.reconCmdResp)
 }
 
 func (p *Peer) Stop() {
@@ -100,47 +240,105 @@ func (p *Peer) Stop() {
 		return
 	}
 	log.Println(SERVE, "Stopping")
+	// Stop replaying spilled recoveries before RecoverChan is drained,
+	// so that they are left in the spill file
+	close(p.spillStop)
+	<-p.spillDone
 	go func() { p.serverEnable <- false }()
 	go func() { p.gossipEnable <- false }()
 	// Drain recovery channel
-	go func() {
-		for _ = range p.RecoverChan {
+	go func(rc RecoverChan) {
+		for _ = range rc {
 		}
-	}()
+	}(p.RecoverChan)
 	// Acknowledged stop of server & gossip client
 	<-p.stopped
 	<-p.stopped
+	// The sweeper removes elements through the command channels
+	close(p.sweepStop)
+	<-p.sweepDone
+	// No more sessions complete, so the webhook can post what is queued
+	p.stopWebhook()
 	// Close channels
 	close(p.stopped)
 	close(p.reconCmdReq)
 	close(p.reconCmdResp)
 	close(p.RecoverChan)
-	// Re-init
+	// Re-init. RecoverChan is left closed rather than cleared, since
+	// the application may still be ranging over it.
 	p.serverEnable = nil
 	p.gossipEnable = nil
 	p.stopped = nil
+	p.sweepStop = nil
+	p.sweepDone = nil
+	p.spillStop = nil
+	p.spillDone = nil
 	p.reconCmdReq = nil
 	p.reconCmdResp = nil
-	p.RecoverChan = nil
 	log.Println(SERVE, "Stopped")
 }
 
+// StartCmds starts executing prefix tree commands, without serving or
+// gossiping, so that the caller may drive recon sessions itself with
+// ReconcileWith. It is undone with StopCmds.
+func (p *Peer) StartCmds() {
+	p.reconCmdReq = make(reconCmdReq)
+	p.reconCmdResp = make(reconCmdResp)
+	go p.handleCmds(p.reconCmdReq, p.reconCmdResp)
+}
+
+// StopCmds stops executing prefix tree commands started by StartCmds.
+func (p *Peer) StopCmds() {
+	close(p.reconCmdReq)
+	close(p.reconCmdResp)
+	p.reconCmdReq = nil
+	p.reconCmdResp = nil
+}
+
 // handleCmds executes recon cmds in a single goroutine.
 // This forces sequential reads and writes to the prefix
-// tree.
-func (p *Peer) handleCmds() {
+// tree. The channels are passed in, rather than read from
+// the peer, since Stop clears them once they are closed.
+func (p *Peer) handleCmds(req reconCmdReq, resp reconCmdResp) {
 	for {
 		select {
-		case cmd, ok := <-p.reconCmdReq:
+		case cmd, ok := <-req:
 			if !ok {
 				return
 			}
-			p.reconCmdResp <- cmd()
+			resp <- runCmd(cmd)
 		}
 	}
 }
 
+// PanicError reports a panic recovered from a recon session or command,
+// so that it fails only that session rather than the whole peer.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Recovered panic: %v", e.Value)
+}
+
+// recoverPanic converts a panic into an error. It must be deferred.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		stack := debug.Stack()
+		log.Println("Recovered panic:", r, "\n", string(stack))
+		*err = &PanicError{Value: r, Stack: stack}
+	}
+}
+
+func runCmd(cmd reconCmd) (err error) {
+	defer recoverPanic(&err)
+	return cmd()
+}
+
 func (p *Peer) ExecCmd(cmd reconCmd) (err error) {
+	atomic.AddInt32(&p.pendingCmds, 1)
+	defer atomic.AddInt32(&p.pendingCmds, -1)
 	p.reconCmdReq <- cmd
 	err = <-p.reconCmdResp
 	if err != nil {
@@ -150,24 +348,70 @@ func (p *Peer) ExecCmd(cmd reconCmd) (err error) {
 }
 
 func (p *Peer) Insert(z *Zp) (err error) {
-	return p.ExecCmd(func() error {
-		return p.PrefixTree.Insert(z)
+	if p.Blacklisted(z) {
+		return ErrBlacklisted
+	}
+	err = p.ExecCmd(func() error {
+		if err := p.changeTree(z, 1, p.PrefixTree.Insert); err != nil {
+			return err
+		}
+		p.logChange(ChangeInsert, z)
+		return nil
 	})
+	if err == nil {
+		p.changes.notify()
+	}
+	return
 }
 
 func (p *Peer) Remove(z *Zp) (err error) {
-	return p.ExecCmd(func() error {
-		return p.PrefixTree.Remove(z)
+	err = p.ExecCmd(func() error {
+		if err := p.changeTree(z, -1, p.PrefixTree.Remove); err != nil {
+			return err
+		}
+		p.logChange(ChangeRemove, z)
+		return nil
 	})
+	if err == nil {
+		if p.Expiry != nil {
+			p.Expiry.ClearExpiry(z)
+		}
+		p.changes.notify()
+	}
+	return
 }
 
 func (p *Peer) Serve() {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p.ReconPort()))
+	if p.refuseConns() {
+		log.Println(SERVE, "follower not accepting connections")
+		for {
+			if enabled, isOpen := <-p.serverEnable; !enabled || !isOpen {
+				close(p.serverEnable)
+				p.stopped <- true
+				return
+			}
+		}
+	}
+	listeners, err := p.listen()
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	defer ln.Close()
+	if p.limiter == nil {
+		p.limiter = newConnLimiter(p.MaxConns(), p.MaxConnsPerHost())
+	}
+	conns := make(chan net.Conn)
+	done := make(chan interface{})
+	defer func() {
+		close(done)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		log.Println(SERVE, "listening on", ln.Addr())
+		go acceptConns(ln, p.limiter, conns, done)
+	}
 	for {
 		select {
 		case enabled, isOpen := <-p.serverEnable:
@@ -176,30 +420,19 @@ func (p *Peer) Serve() {
 				p.stopped <- true
 				return
 			}
-		default:
-		}
-		if p.ConnTimeout() > 0 {
-			ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * time.Duration(p.ConnTimeout())))
-		}
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(SERVE, err)
-			continue
-		}
-		if p.ReadTimeout() > 0 {
-			conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(p.ReadTimeout())))
-		}
-		err = p.accept(conn)
-		if err != nil {
-			log.Println(SERVE, err)
+		case conn := <-conns:
+			err = p.Accept(p.withTimeouts(conn))
+			if err != nil {
+				log.Println(SERVE, err)
+			}
 		}
 	}
 }
 
-func (p *Peer) handleConfig(conn net.Conn, role string) (remoteConfig *Config, err error) {
+func (p *Peer) handleConfig(conn net.Conn, role Role, config *Config) (remoteConfig *Config, err error) {
 	// Send config to server on connect
-	log.Println(role, "writing config:", p.Config())
-	err = WriteMsg(conn, p.Config())
+	log.Println(role, "writing config:", config)
+	err = WriteMsg(conn, config)
 	if err != nil {
 		return
 	}
@@ -218,6 +451,16 @@ func (p *Peer) handleConfig(conn net.Conn, role string) (remoteConfig *Config, e
 		return
 	}
 	log.Println(role, "remote config:", remoteConfig)
+	if remoteNamespace(remoteConfig) != p.namespace {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "mismatched namespace")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: namespace remote=", remoteNamespace(remoteConfig),
+			"!=", p.namespace)
+		err = IncompatiblePeerError
+		return
+	}
 	if remoteConfig.BitQuantum != p.Config().BitQuantum {
 		bufw := bufio.NewWriter(conn)
 		WriteString(bufw, RemoteConfigFailed)
@@ -228,6 +471,56 @@ func (p *Peer) handleConfig(conn net.Conn, role string) (remoteConfig *Config, e
 		err = IncompatiblePeerError
 		return
 	}
+	if remotePrime(remoteConfig) != p.prime().String() {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "mismatched prime")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: prime remote=", remotePrime(remoteConfig),
+			"!=", p.prime())
+		err = IncompatiblePeerError
+		return
+	}
+	if remotePoints(remoteConfig) != p.pointsId() {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "mismatched points")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: points remote=", remotePoints(remoteConfig),
+			"!=", p.pointsId())
+		err = IncompatiblePeerError
+		return
+	}
+	if remoteKeys(remoteConfig) != p.keysName() {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "mismatched keys")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: keys remote=", remoteKeys(remoteConfig),
+			"!=", p.keysName())
+		err = IncompatiblePeerError
+		return
+	}
+	if _, err = p.sessionScope(remoteConfig); err != nil {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "disjoint prefix")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: prefix remote=", remoteConfig.Custom["prefix"],
+			"local=", p.ReconPrefix(), ":", err)
+		err = IncompatiblePeerError
+		return
+	}
+	if _, err = p.negotiateStrategy(role, remoteConfig); err != nil {
+		bufw := bufio.NewWriter(conn)
+		WriteString(bufw, RemoteConfigFailed)
+		WriteString(bufw, "no common strategy")
+		bufw.Flush()
+		log.Println(role, "Cannot peer: strategies remote=", remoteStrategies(remoteConfig),
+			"local=", p.strategyNames())
+		err = IncompatiblePeerError
+		return
+	}
 	if remoteConfig.MBar != p.Config().MBar {
 		bufw := bufio.NewWriter(conn)
 		WriteString(bufw, RemoteConfigFailed)
@@ -259,17 +552,206 @@ func (p *Peer) handleConfig(conn net.Conn, role string) (remoteConfig *Config, e
 	return
 }
 
-func (p *Peer) accept(conn net.Conn) error {
+// Accept serves a recon session on an incoming connection, such as one
+// accepted by a transport other than the peer's listeners, closing it
+// when done. Followers which do not accept connections refuse it, and
+// sessions naming a namespace are served by its peer.
+func (p *Peer) Accept(conn net.Conn) error {
+	defer conn.Close()
 	log.Println(SERVE, "connection from:", conn.RemoteAddr())
-	remoteConfig, err := p.handleConfig(conn, SERVE)
+	if p.refuseConns() {
+		return ErrFollowerRefused
+	}
+	target, conn, err := p.routeNamespace(conn)
 	if err != nil {
 		return err
 	}
-	return p.ExecCmd(func() error {
-		err := p.interactWithClient(conn, remoteConfig, NewBitstring(0))
-		defer conn.Close()
-		return err
+	_, err = target.ReconcileWith(conn, RoleServer)
+	return err
+}
+
+// recoverElements sends elements recovered from a remote peer to RecoverChan.
+// Nothing is recovered from followers, nor by push-only peers. Sessions
+// transferring payloads hold the recovery until they are received.
+func (p *Peer) recoverElements(conn net.Conn, remoteConfig *Config, elements []*Zp) {
+	if len(elements) == 0 || !p.recovers(remoteConfig) {
+		return
+	}
+	if elements = p.dedupRecovered(elements); len(elements) == 0 {
+		return
+	}
+	p.recover(conn, &Recover{
+		RemoteAddr:     conn.RemoteAddr(),
+		RemoteConfig:   remoteConfig,
+		RemoteElements: elements,
+		Namespace:      p.namespace})
+}
+
+// recover sends a recovery to RecoverChan, or holds it in the session
+// until payloads are transferred. Blacklisted elements are not recovered.
+func (p *Peer) recover(conn net.Conn, r *Recover) {
+	r.RemoteElements = p.withoutBlacklisted(r.RemoteElements)
+	if len(r.RemoteElements) == 0 && len(r.RemoteRemoved) == 0 {
+		r.done(true)
+		return
+	}
+	if sc, is := conn.(*sessionConn); is && sc.payloadLimit > 0 {
+		sc.recover = r
+		return
+	}
+	p.sendRecover(r)
+}
+
+// Role is the part a peer plays in a recon session.
+type Role int
+
+const (
+	// RoleServer drives the session, requesting comparisons of
+	// prefix tree nodes from the remote peer.
+	RoleServer = Role(iota)
+	// RoleClient answers the remote peer's comparison requests.
+	RoleClient = Role(iota)
+)
+
+// Name returns the role as "server" or "client".
+func (r Role) Name() string {
+	switch r {
+	case RoleServer:
+		return "server"
+	case RoleClient:
+		return "client"
+	}
+	return "unknown"
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.Name()), nil
+}
+
+// UnmarshalText decodes a role encoded by MarshalText,
+// such as in a webhook notification.
+func (r *Role) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "server":
+		*r = RoleServer
+	case "client":
+		*r = RoleClient
+	default:
+		return errors.New(fmt.Sprintf("unknown role %q", text))
+	}
+	return nil
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleServer:
+		return SERVE
+	case RoleClient:
+		return GOSSIP
+	}
+	return "Unknown"
+}
+
+// Stats summarizes the outcome of a recon session.
+type Stats struct {
+	// Configuration announced by the remote peer
+	RemoteConfig *Config `json:"remoteConfig,omitempty"`
+	// Number of elements recovered from the remote peer
+	Recovered int `json:"recovered"`
+	// Elements recovered from the remote peer
+	Elements []*Zp `json:"-"`
+	// Elements sent to the remote peer, which it lacks. A Merkle client
+	// sends the whole of differing subtrees, which are not included.
+	Offered []*Zp `json:"-"`
+}
+
+// ReconcileWith runs the recon protocol over an established connection,
+// which may be any transport the caller manages. The peer must be started.
+// Elements recovered from the remote peer are sent to RecoverChan.
+// The caller is responsible for closing the connection.
+func (p *Peer) ReconcileWith(conn net.Conn, role Role) (stats SessionStats, err error) {
+	return p.reconcileWith(conn, role, p.ReadTimeout())
+}
+
+// reconcileWith runs a recon session, limiting reads to readTimeout
+// seconds after the configuration exchange.
+func (p *Peer) reconcileWith(conn net.Conn, role Role, readTimeout int) (stats SessionStats, err error) {
+	if p.CaptureDir() != "" {
+		if cc, err := p.withCapture(conn, role); err != nil {
+			log.Println(role, "capture:", err)
+		} else {
+			defer cc.finish()
+			conn = cc
+		}
+	}
+	stats.Role = role
+	stats.Start = time.Now()
+	if addr := conn.RemoteAddr(); addr != nil {
+		stats.Partner = addr.String()
+	}
+	sc := &sessionConn{Conn: conn, stats: &stats, p: p.prime()}
+	conn = sc
+	defer func() {
+		stats.Duration = time.Since(stats.Start)
+		p.sessionDone(&stats, err)
+	}()
+	defer p.sessions.end(p.sessions.begin(role, conn.RemoteAddr()))
+	defer recoverPanic(&err)
+	config := p.withSyncSummary(p.Config())
+	if p.HandshakeTimeout() > 0 {
+		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(p.HandshakeTimeout())))
+	}
+	stats.RemoteConfig, err = p.handleConfig(conn, role, config)
+	if err != nil {
+		return
+	}
+	if inSync(config, stats.RemoteConfig) {
+		log.Println(role, "already in sync with", conn.RemoteAddr())
+		stats.InSync = true
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(readTimeout)))
+	}
+	strategy, err := p.negotiateStrategy(role, stats.RemoteConfig)
+	if err != nil {
+		return
+	}
+	stats.Strategy = strategy.Name()
+	if keepAlive := p.KeepAlive(); keepAlive > 0 && remoteKeepAlive(stats.RemoteConfig) {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sc.keepAlive(time.Second*time.Duration(keepAlive), stop)
+	}
+	sc.payloadLimit = p.payloadLimit(stats.RemoteConfig)
+	err = p.ExecCmd(func() (err error) {
+		switch role {
+		case RoleServer:
+			stats.Elements, err = strategy.Serve(p, conn, stats.RemoteConfig)
+		case RoleClient:
+			stats.Elements, err = strategy.Initiate(p, conn, stats.RemoteConfig)
+		default:
+			err = errors.New(fmt.Sprintf("Unknown role: %v", role))
+		}
+		return
 	})
+	if err == nil && sc.payloadLimit > 0 {
+		if perr := p.exchangePayloads(sc, role, sc.payloadLimit); perr != nil {
+			log.Println(role, "payloads:", perr)
+			if sc.recover != nil {
+				sc.recover.done(false)
+			}
+		}
+	}
+	if sc.recover != nil {
+		p.sendRecover(sc.recover)
+	}
+	if !p.recovers(stats.RemoteConfig) {
+		stats.Elements = nil
+	}
+	stats.Recovered = len(stats.Elements)
+	return
 }
 
 type requestEntry struct {
@@ -323,6 +805,7 @@ type reconWithClient struct {
 	flushing bool
 	conn     net.Conn
 	messages []ReconMsg
+	scope    *Bitstring
 }
 
 func (rwc *reconWithClient) pushBottom(bottom *bottomEntry) {
@@ -362,21 +845,38 @@ func (rwc *reconWithClient) isDone() bool {
 	return len(rwc.requestQ) == 0 && len(rwc.bottomQ) == 0
 }
 
-func (rwc *reconWithClient) sendRequest(p *Peer, req *requestEntry) {
+// fullRequest tests if the difference with a subtree should be found by
+// exchanging its elements directly. A leaf cannot be divided further, and
+// a subtree with no more elements than there are samples is as cheap to
+// send whole, so there is no need for interpolation, which may fail.
+func (p *Peer) fullRequest(node PrefixNode) bool {
+	return node.IsLeaf() || node.Size() <= p.Settings.NumSamples()
+}
+
+func (rwc *reconWithClient) sendRequest(p *Peer, req *requestEntry) error {
 	var msg ReconMsg
-	if req.node.IsLeaf() || (req.node.Size() < p.MBar()) {
+	if p.fullRequest(req.node) {
+		elements, err := req.node.Elements()
+		if err != nil {
+			return err
+		}
 		msg = &ReconRqstFull{
 			Prefix:   req.key,
-			Elements: NewZSet(req.node.Elements()...)}
+			Elements: p.stripBlacklisted(NewZSet(elements...))}
 	} else {
+		svalues, err := req.node.SValues()
+		if err != nil {
+			return err
+		}
 		msg = &ReconRqstPoly{
 			Prefix:  req.key,
 			Size:    req.node.Size(),
-			Samples: req.node.SValues()}
+			Samples: svalues}
 	}
 	log.Println(SERVE, "sendRequest:", msg)
 	rwc.messages = append(rwc.messages, msg)
 	rwc.pushBottom(&bottomEntry{requestEntry: req})
+	return nil
 }
 
 func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry) (err error) {
@@ -387,17 +887,38 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 			return errors.New("Syncfail received at leaf node")
 		}
 		log.Println(SERVE, "SyncFail: pushing children")
-		for _, childNode := range req.node.Children() {
-			log.Println(SERVE, "push:", childNode.Key())
-			rwc.pushRequest(&requestEntry{key: childNode.Key(), node: childNode})
+		var children []PrefixNode
+		if children, err = req.node.Children(); err != nil {
+			return
+		}
+		for _, childNode := range children {
+			var key *Bitstring
+			if key, err = childNode.Key(); err != nil {
+				return
+			}
+			if !inScope(key, rwc.scope) {
+				continue
+			}
+			log.Println(SERVE, "push:", key)
+			rwc.pushRequest(&requestEntry{key: key, node: childNode})
 		}
 	case *Elements:
+		if err = p.checkRemoteP(m.Items()...); err != nil {
+			return
+		}
 		rwc.rcvrSet.AddAll(m.ZSet)
 	case *FullElements:
-		local := NewZSet(req.node.Elements()...)
-		localdiff := ZSetDiff(local, m.ZSet)
-		remotediff := ZSetDiff(m.ZSet, local)
-		elementsMsg := &Elements{ZSet: localdiff}
+		if err = p.checkRemoteP(m.Items()...); err != nil {
+			return
+		}
+		var elements []*Zp
+		if elements, err = req.node.Elements(); err != nil {
+			return
+		}
+		local := NewZSet(elements...)
+		localdiff := local.Difference(m.ZSet)
+		remotediff := m.ZSet.Difference(local)
+		elementsMsg := &Elements{ZSet: p.serveElements(localdiff)}
 		log.Println(SERVE, "handleReply:", "sending:", elementsMsg)
 		rwc.messages = append(rwc.messages, elementsMsg)
 		rwc.rcvrSet.AddAll(remotediff)
@@ -419,15 +940,25 @@ func (rwc *reconWithClient) flushQueue() {
 	rwc.flushing = true
 }
 
-func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring *Bitstring) (err error) {
+// interactWithClient reconciles the subtree containing the elements
+// with keys in scope, or the whole tree if scope is nil.
+func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, scope *Bitstring) (recovered []*Zp, err error) {
 	log.Println(SERVE, "interacting with client")
-	recon := reconWithClient{Peer: p, conn: conn, rcvrSet: NewZSet()}
+	recon := reconWithClient{Peer: p, conn: conn, rcvrSet: NewZSet(), scope: scope}
 	var root PrefixNode
-	root, err = p.Root()
+	if scope != nil {
+		root, err = p.scopeRoot(scope)
+	} else {
+		root, err = p.Root()
+	}
+	if err != nil {
+		return
+	}
+	rootKey, err := root.Key()
 	if err != nil {
 		return
 	}
-	recon.pushRequest(&requestEntry{node: root, key: bitstring})
+	recon.pushRequest(&requestEntry{node: root, key: rootKey})
 	for !recon.isDone() {
 		bottom := recon.topBottom()
 		log.Println(SERVE, "interact: bottom:", bottom)
@@ -435,7 +966,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 		case bottom == nil:
 			req := recon.popRequest()
 			log.Println(SERVE, "interact: popRequest:", req, "sending...")
-			recon.sendRequest(p, req)
+			err = recon.sendRequest(p, req)
 		case bottom.state == reconStateFlushEnded:
 			log.Println(SERVE, "interact: flush ended, popBottom")
 			recon.popBottom()
@@ -451,7 +982,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 			msg, err = ReadMsg(conn)
 			hasMsg = (err == nil)
 			// Restore blocking I/O
-			if err = conn.SetReadDeadline(time.Unix(int64(0), int64(0))); err != nil {
+			if err = conn.SetReadDeadline(time.Time{}); err != nil {
 				return
 			}
 			if hasMsg {
@@ -471,7 +1002,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 				}
 			} else {
 				req := recon.popRequest()
-				recon.sendRequest(p, req)
+				err = recon.sendRequest(p, req)
 			}
 		default:
 			log.Println("failed to match expected patterns")
@@ -480,13 +1011,9 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 			return
 		}
 	}
-	WriteMsg(conn, &Done{})
-	items := recon.rcvrSet.Items()
-	if len(items) > 0 {
-		p.RecoverChan <- &Recover{
-			RemoteAddr:     conn.RemoteAddr(),
-			RemoteConfig:   remoteConfig,
-			RemoteElements: items}
-	}
-	return
+	// Send any elements queued by the last replies along with Done
+	WriteMsg(conn, append(recon.messages, &Done{})...)
+	items := p.scopeElements(scope, recon.rcvrSet.Items())
+	p.recoverElements(conn, remoteConfig, items)
+	return items, nil
 }
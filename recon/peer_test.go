@@ -0,0 +1,297 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net"
+	"testing"
+)
+
+// startCmds runs the peer's command handler without
+// starting its listener or gossip client.
+func startCmds(p *Peer) {
+	p.reconCmdReq = make(reconCmdReq)
+	p.reconCmdResp = make(reconCmdResp)
+	go p.handleCmds(p.reconCmdReq, p.reconCmdResp)
+}
+
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		assert.Equal(t, nil, err)
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	assert.Equal(t, nil, err)
+	return <-accepted, dialed
+}
+
+// newTestPeer creates a peer with an in-memory prefix tree, applying
+// settings, given as pairs of keys and values, before the tree is
+// built from them. Lists of strings are set as lists of settings.
+func newTestPeer(settings ...interface{}) *Peer {
+	s := DefaultSettings()
+	for i := 0; i+1 < len(settings); i += 2 {
+		value := settings[i+1]
+		if strs, is := value.([]string); is {
+			var list []interface{}
+			for _, str := range strs {
+				list = append(list, str)
+			}
+			value = list
+		}
+		s.Set(settings[i].(string), value)
+	}
+	s.UpdateDerived()
+	return NewPeer(s, NewMemPrefixTree(s))
+}
+
+// session is the outcome of a recon session run by runSession.
+type session struct {
+	ss, cs               SessionStats
+	serverErr, clientErr error
+	// The recoveries delivered to each peer, and their elements.
+	serverRecovered, clientRecovered []*Recover
+	serverSet, clientSet             *ZSet
+}
+
+// runSession reconciles client with server over a local connection,
+// collecting what each peer recovers. The server side is run by serve,
+// or by ReconcileWith if serve is nil.
+func runSession(t *testing.T, server, client *Peer, serve func(net.Conn) (SessionStats, error)) *session {
+	for _, p := range []*Peer{server, client} {
+		if p.reconCmdReq == nil {
+			startCmds(p)
+		}
+	}
+	if serve == nil {
+		serve = func(conn net.Conn) (SessionStats, error) {
+			return server.ReconcileWith(conn, RoleServer)
+		}
+	}
+	serverConn, clientConn := connPair(t)
+	defer serverConn.Close()
+	defer clientConn.Close()
+	s := &session{serverSet: NewZSet(), clientSet: NewZSet()}
+	stop := make(chan bool)
+	collect := func(p *Peer, rs *[]*Recover, set *ZSet, done chan bool) {
+		defer close(done)
+		add := func(r *Recover) {
+			*rs = append(*rs, r)
+			set.AddSlice(r.RemoteElements)
+		}
+		for {
+			select {
+			case r := <-p.RecoverChan:
+				add(r)
+			case <-stop:
+				// Take what was buffered before the session ended
+				for {
+					select {
+					case r := <-p.RecoverChan:
+						add(r)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}
+	serverCollected, clientCollected := make(chan bool), make(chan bool)
+	go collect(server, &s.serverRecovered, s.serverSet, serverCollected)
+	go collect(client, &s.clientRecovered, s.clientSet, clientCollected)
+	served := make(chan bool)
+	go func() {
+		defer close(served)
+		if s.ss, s.serverErr = serve(serverConn); s.serverErr != nil {
+			serverConn.Close()
+		}
+	}()
+	if s.cs, s.clientErr = client.ReconcileWith(clientConn, RoleClient); s.clientErr != nil {
+		clientConn.Close()
+	}
+	<-served
+	close(stop)
+	<-serverCollected
+	<-clientCollected
+	return s
+}
+
+// reconcile runs a session between server and client
+// which is expected to succeed.
+func reconcile(t *testing.T, server, client *Peer) *session {
+	s := runSession(t, server, client, nil)
+	assert.Equal(t, nil, s.serverErr)
+	assert.Equal(t, nil, s.clientErr)
+	return s
+}
+
+func TestReconcileWith(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	startCmds(server)
+	startCmds(client)
+	serverConn, clientConn := connPair(t)
+	defer serverConn.Close()
+	defer clientConn.Close()
+	type result struct {
+		stats SessionStats
+		err   error
+	}
+	serverResult, clientResult := make(chan result), make(chan result)
+	go func() {
+		stats, err := server.ReconcileWith(serverConn, RoleServer)
+		serverResult <- result{stats, err}
+	}()
+	go func() {
+		stats, err := client.ReconcileWith(clientConn, RoleClient)
+		clientResult <- result{stats, err}
+	}()
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 1, len(serverRecover.RemoteElements))
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	sr := <-serverResult
+	assert.Equal(t, nil, sr.err)
+	assert.Equal(t, 1, sr.stats.Recovered)
+	assert.Equal(t, server.MBar(), sr.stats.RemoteConfig.MBar)
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 1, len(clientRecover.RemoteElements))
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+	cr := <-clientResult
+	assert.Equal(t, nil, cr.err)
+	assert.Equal(t, 1, cr.stats.Recovered)
+}
+
+func TestReconcileNow(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	_, err := client.ReconcileNow("127.0.0.1:11370")
+	assert.Equal(t, ErrPeerNotStarted, err)
+	startCmds(server)
+	startCmds(client)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		server.ReconcileWith(conn, RoleServer)
+	}()
+	go func() {
+		for _ = range server.RecoverChan {
+		}
+	}()
+	go func() {
+		for _ = range client.RecoverChan {
+		}
+	}()
+	stats, err := client.ReconcileNow(ln.Addr().String())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ln.Addr().String(), stats.Partner)
+	assert.Equal(t, 0, stats.Recovered)
+	assert.T(t, !stats.Start.IsZero())
+	assert.T(t, stats.Duration > 0)
+}
+
+func TestCmdPanic(t *testing.T) {
+	p := NewMemPeer()
+	startCmds(p)
+	err := p.ExecCmd(func() error {
+		var node PrefixNode
+		node.Size()
+		return nil
+	})
+	_, is := err.(*PanicError)
+	assert.T(t, is)
+	// The command handler keeps running after a panic.
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65537)))
+}
+
+type panicConn struct {
+	net.Conn
+}
+
+func (c *panicConn) Write(b []byte) (int, error) {
+	panic("write")
+}
+
+func TestReconcilePanic(t *testing.T) {
+	p := NewMemPeer()
+	startCmds(p)
+	serverConn, clientConn := connPair(t)
+	defer serverConn.Close()
+	defer clientConn.Close()
+	_, err := p.ReconcileWith(&panicConn{serverConn}, RoleServer)
+	_, is := err.(*PanicError)
+	assert.T(t, is)
+}
+
+func TestReconRqstPolyUntrusted(t *testing.T) {
+	p := NewMemPeer()
+	resp := p.handleReconRqstPoly(&ReconRqstPoly{
+		Prefix: NewBitstring(0), Samples: []*Zp{Zi(P_SKS, 1)}})
+	assert.NotEqual(t, nil, resp.err)
+	samples := Zarray(P_128, p.Settings.NumSamples(), Zi(P_128, 1))
+	resp = p.handleReconRqstPoly(&ReconRqstPoly{
+		Prefix: NewBitstring(0), Samples: samples})
+	_, is := resp.err.(*MismatchedPError)
+	assert.T(t, is)
+}
+
+func TestFullRequest(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.threshMult", 1)
+	s.UpdateDerived()
+	p := NewPeer(s, NewMemPrefixTree(s))
+	for i := 0; i <= s.NumSamples(); i++ {
+		p.PrefixTree.Insert(Zi(P_SKS, 65537*(i+1)))
+	}
+	// A subtree with more elements than samples is compared by its samples
+	root, err := p.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, !root.IsLeaf())
+	assert.T(t, !p.fullRequest(root))
+	// Removing one leaves as many elements as samples, above the join threshold
+	p.PrefixTree.Remove(Zi(P_SKS, 65537))
+	root, err = p.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, !root.IsLeaf())
+	assert.T(t, p.fullRequest(root))
+	rwc := &reconWithClient{Peer: p, rcvrSet: NewZSet()}
+	rwc.sendRequest(p, &requestEntry{node: root, key: NewBitstring(0)})
+	assert.Equal(t, 1, len(rwc.messages))
+	full, is := rwc.messages[0].(*ReconRqstFull)
+	assert.T(t, is)
+	assert.Equal(t, s.NumSamples(), full.Elements.Len())
+}
@@ -0,0 +1,50 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer kept for reuse. Larger ones,
+// from the occasional big message or node, are left to the collector
+// rather than pinning their memory in the pool.
+const maxPooledBuffer = 1 << 16
+
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// GetBuffer returns an empty buffer for serializing messages or tree
+// nodes, reusing one released by PutBuffer where possible.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer releases a buffer from GetBuffer for reuse. Its contents
+// must no longer be referenced.
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
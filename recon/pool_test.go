@@ -0,0 +1,61 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	buf := GetBuffer()
+	buf.WriteString("in use")
+	PutBuffer(buf)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, 0, GetBuffer().Len())
+	// Oversized buffers are not kept, nor reset
+	big := bytes.NewBuffer(make([]byte, maxPooledBuffer+1))
+	PutBuffer(big)
+	assert.Equal(t, maxPooledBuffer+1, big.Len())
+}
+
+// Test that reusing element vectors, across inserts, removes and the
+// splits and joins they cause, leaves every node's sample values
+// consistent with its elements.
+func TestReusedVectors(t *testing.T) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 1; i <= 1000; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	for i := 1; i <= 1000; i += 2 {
+		assert.Equal(t, nil, tree.Remove(Zi(P_SKS, 65537*i)))
+	}
+	var bulk []*Zp
+	for i := 1001; i <= 2000; i++ {
+		bulk = append(bulk, Zi(P_SKS, 65537*i))
+	}
+	assert.Equal(t, nil, tree.InsertAll(bulk))
+	assert.Equal(t, nil, VerifyTree(tree))
+}
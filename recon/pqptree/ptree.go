@@ -31,6 +31,8 @@ import (
 	"github.com/cmars/conflux/recon"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"math/big"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
@@ -57,6 +59,7 @@ type pqPrefixTree struct {
 	db                       *sqlx.DB
 	points                   []*Zp
 	selectPNodeByNodeKey     string
+	selectPNodeKeys          string
 	selectPElementsByNodeKey string
 	deletePNode              string
 	deletePElements          string
@@ -86,10 +89,12 @@ func mustEncodeBitstring(bs *Bitstring) string {
 	return buf.String()
 }
 
+func decodeBitstring(enc string) (*Bitstring, error) {
+	return recon.ReadBitstring(ascii85.NewDecoder(bytes.NewBufferString(enc)))
+}
+
 func mustDecodeBitstring(enc string) *Bitstring {
-	buf := bytes.NewBufferString(enc)
-	r := ascii85.NewDecoder(buf)
-	bs, err := recon.ReadBitstring(r)
+	bs, err := decodeBitstring(enc)
 	if err != nil {
 		panic(err)
 	}
@@ -110,22 +115,42 @@ func mustEncodeZZarray(arr []*Zp) []byte {
 	return buf.Bytes()
 }
 
-func mustDecodeZZarray(enc []byte) []*Zp {
-	buf := bytes.NewBuffer(enc)
-	r := ascii85.NewDecoder(buf)
-	arr, err := recon.ReadZZarray(r)
+func decodeZZarray(enc []byte, p *big.Int) ([]*Zp, error) {
+	return recon.ReadZZarray(recon.NewFieldReader(ascii85.NewDecoder(bytes.NewBuffer(enc)), p))
+}
+
+func mustDecodeZZarray(enc []byte, p *big.Int) []*Zp {
+	arr, err := decodeZZarray(enc, p)
 	if err != nil {
 		panic(err)
 	}
 	return arr
 }
 
+var namespacePattern *regexp.Regexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// maxNamespaceLen keeps the longest name derived from a namespace,
+// that of the index of elements by node, within the 63 bytes which
+// PostgreSQL keeps of an identifier.
+const maxNamespaceLen = 63 - len("_pelement_node_key")
+
+// ValidNamespace tests if a namespace can prefix the names of the
+// tables of a tree, which may share a database with other trees
+// and applications.
+func ValidNamespace(namespace string) bool {
+	return len(namespace) <= maxNamespaceLen && namespacePattern.MatchString(namespace)
+}
+
 func New(namespace string, db *sqlx.DB, settings *Settings) (ptree recon.PrefixTree, err error) {
+	if !ValidNamespace(namespace) {
+		return nil, errors.New(fmt.Sprintf(
+			"Invalid namespace %q: expect a SQL identifier of at most %d characters", namespace, maxNamespaceLen))
+	}
 	tree := &pqPrefixTree{
 		Settings:  settings,
 		Namespace: namespace,
 		db:        db,
-		points:    Zpoints(P_SKS, settings.NumSamples())}
+		points:    Zpoints(settings.Prime(), settings.NumSamples())}
 	err = tree.createTables()
 	if err != nil {
 		return
@@ -140,8 +165,14 @@ func New(namespace string, db *sqlx.DB, settings *Settings) (ptree recon.PrefixT
 }
 
 func (t *pqPrefixTree) SqlTemplate(sql string) string {
+	return sqlTemplate(sql, t)
+}
+
+// sqlTemplate expands a SQL statement template, such as a table name
+// prefixed by {{.Namespace}}.
+func sqlTemplate(sql string, data interface{}) string {
 	result := bytes.NewBuffer(nil)
-	err := template.Must(template.New("sql").Parse(sql)).Execute(result, t)
+	err := template.Must(template.New("sql").Parse(sql)).Execute(result, data)
 	if err != nil {
 		panic(err)
 	}
@@ -162,6 +193,8 @@ func (t *pqPrefixTree) createTables() (err error) {
 func (t *pqPrefixTree) prepareStatements() {
 	t.selectPNodeByNodeKey = t.SqlTemplate(
 		"SELECT * FROM {{.Namespace}}_pnode WHERE node_key = $1")
+	t.selectPNodeKeys = t.SqlTemplate(
+		"SELECT node_key FROM {{.Namespace}}_pnode")
 	t.selectPElementsByNodeKey = t.SqlTemplate(
 		"SELECT * FROM {{.Namespace}}_pelement WHERE node_key = $1")
 	t.deletePNode = t.SqlTemplate(
@@ -201,6 +234,10 @@ func (t *pqPrefixTree) ensureRoot() (err error) {
 
 func (t *pqPrefixTree) Points() []*Zp { return t.points }
 
+// Keys returns SKS keys, by which the tree locates elements
+// regardless of the keys setting.
+func (t *pqPrefixTree) Keys() KeyStrategy { return SksKeys }
+
 func (t *pqPrefixTree) Root() (recon.PrefixNode, error) {
 	return t.Node(NewBitstring(0))
 }
@@ -233,6 +270,28 @@ func encodeIntArray(iarr []int) string {
 	return b.String()
 }
 
+// NodeKeys returns the keys of all the nodes stored in the database.
+func (t *pqPrefixTree) NodeKeys() (keys []*Bitstring, err error) {
+	var nodeKeys []string
+	if err = t.db.Select(&nodeKeys, t.selectPNodeKeys); err != nil {
+		return
+	}
+	for _, nodeKey := range nodeKeys {
+		keys = append(keys, mustDecodeBitstring(nodeKey))
+	}
+	return
+}
+
+// DeleteNode deletes the node stored with a key, and its elements.
+func (t *pqPrefixTree) DeleteNode(bs *Bitstring) error {
+	nodeKey := mustEncodeBitstring(bs)
+	if _, err := t.db.Execv(t.deletePElements, nodeKey); err != nil {
+		return err
+	}
+	_, err := t.db.Execv(t.deletePNode, nodeKey)
+	return err
+}
+
 func (t *pqPrefixTree) Node(bs *Bitstring) (recon.PrefixNode, error) {
 	nodeKey := mustEncodeBitstring(bs)
 	node := &pqPrefixNode{PNode: &PNode{}, pqPrefixTree: t}
@@ -293,12 +352,26 @@ func (ch *changeElement) insert() (done bool, err error) {
 		}
 	}
 	ch.cur.upsertNode()
-	childIndex := recon.NextChild(ch.cur, ch.target, ch.depth)
-	ch.cur = ch.cur.Children()[childIndex].(*pqPrefixNode)
+	if ch.cur, err = ch.cur.nextChild(ch.target, ch.depth); err != nil {
+		return
+	}
 	ch.depth++
 	return false, err
 }
 
+// nextChild returns the child whose key is a prefix of bs.
+func (n *pqPrefixNode) nextChild(bs *Bitstring, depth int) (*pqPrefixNode, error) {
+	childIndex, err := recon.NextChild(n, bs, depth)
+	if err != nil {
+		return nil, err
+	}
+	children, err := n.Children()
+	if err != nil {
+		return nil, err
+	}
+	return children[childIndex].(*pqPrefixNode), nil
+}
+
 func (n *pqPrefixNode) deleteNode() error {
 	err := n.deleteElements()
 	if err != nil {
@@ -362,12 +435,14 @@ func (ch *changeElement) split() (err error) {
 	}
 	// Move elements into child nodes
 	for _, element := range ch.cur.elements {
-		bs := NewBitstring(P_SKS.BitLen())
-		bs.SetBytes(ReverseBytes(element.Element))
-		childIndex := recon.NextChild(ch.cur, bs, ch.depth)
+		z := Zb(recon.TreePrime(ch.cur), element.Element)
+		bs := ZpBitstring(z)
+		var childIndex int
+		if childIndex, err = recon.NextChild(ch.cur, bs, ch.depth); err != nil {
+			return
+		}
 		child := children[childIndex]
 		_, err = child.db.Execv(child.updatePElement, child.NodeKey, element.Element)
-		z := Zb(P_SKS, element.Element)
 		child.updateSvalues(z, recon.AddElementArray(child, z))
 	}
 	for _, child := range children {
@@ -392,8 +467,9 @@ func (ch *changeElement) remove() (done bool, err error) {
 			if err != nil {
 				return
 			}
-			childIndex := recon.NextChild(ch.cur, ch.target, ch.depth)
-			ch.cur = ch.cur.Children()[childIndex].(*pqPrefixNode)
+			if ch.cur, err = ch.cur.nextChild(ch.target, ch.depth); err != nil {
+				return
+			}
 			ch.depth++
 			return false, err
 		}
@@ -406,16 +482,26 @@ func (ch *changeElement) remove() (done bool, err error) {
 }
 
 func (ch *changeElement) join() error {
-	var elements []PElement
-	for _, child := range ch.cur.Children() {
-		elements = append(elements, child.(*pqPrefixNode).elements...)
-		for _, element := range child.(*pqPrefixNode).elements {
+	children, err := ch.cur.Children()
+	if err != nil {
+		return err
+	}
+	for len(children) > 0 {
+		child := children[0].(*pqPrefixNode)
+		grandchildren, err := child.Children()
+		if err != nil {
+			return err
+		}
+		children = append(children[1:], grandchildren...)
+		for _, element := range child.elements {
 			_, err := ch.cur.db.Execv(ch.cur.updatePElement, ch.cur.NodeKey, element.Element)
 			if err != nil {
 				return err
 			}
+			ch.cur.elements = append(ch.cur.elements,
+				PElement{NodeKey: ch.cur.NodeKey, Element: element.Element})
 		}
-		err := child.(*pqPrefixNode).deleteNode()
+		err = child.deleteNode()
 		if err != nil {
 			return err
 		}
@@ -424,30 +510,12 @@ func (ch *changeElement) join() error {
 	return ch.cur.upsertNode()
 }
 
-func (t *pqPrefixTree) hasElement(z *Zp) (bool, error) {
-	var result struct {
-		Count int
-	}
-	err := t.db.Get(&result, t.SqlTemplate(`
-SELECT COUNT(*) FROM {{.Namespace}}_pelement WHERE element = $1`), z.Bytes())
-	if err != nil {
-		return false, err
-	}
-	return result.Count > 0, nil
-}
-
-func ErrDuplicateElement(z *Zp) error {
-	return errors.New(fmt.Sprintf("Attempt to insert duplicate element %v", z))
-}
-
 func (t *pqPrefixTree) Insert(z *Zp) error {
-	if has, err := t.hasElement(z); has {
-		return ErrDuplicateElement(z)
-	} else if err != nil {
+	bs := ZpBitstring(z)
+	// Nodes are written on the way down, so the leaf is checked first
+	if err := t.checkLeafInsert(z, bs); err != nil {
 		return err
 	}
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
 	root, err := t.Root()
 	if err != nil {
 		return err
@@ -460,9 +528,30 @@ func (t *pqPrefixTree) Insert(z *Zp) error {
 	return ch.descend(ch.insert)
 }
 
+// checkLeafInsert returns a *recon.CollisionError if the leaf
+// which would hold z cannot.
+func (t *pqPrefixTree) checkLeafInsert(z *Zp, bs *Bitstring) error {
+	leaf, err := recon.Find(t, z)
+	if err != nil {
+		return err
+	}
+	key, err := leaf.Key()
+	if err != nil {
+		return err
+	}
+	elements, err := leaf.Elements()
+	if err != nil {
+		return err
+	}
+	return recon.CheckLeafInsert(t, elements, z, bs, key.BitLen()/t.BitQuantum())
+}
+
 func (t *pqPrefixTree) Remove(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
+	// Nodes are written on the way down, so the leaf is checked first
+	if err := recon.CheckRemove(t, z); err != nil {
+		return err
+	}
+	bs := ZpBitstring(z)
 	root, err := t.Root()
 	if err != nil {
 		return err
@@ -479,23 +568,15 @@ func (t *pqPrefixTree) newChildNode(parent *pqPrefixNode, childIndex int) *pqPre
 	n := &pqPrefixNode{pqPrefixTree: t, PNode: &PNode{}}
 	var key *Bitstring
 	if parent != nil {
-		parentKey := parent.Key()
-		key = NewBitstring(parentKey.BitLen() + t.BitQuantum())
-		key.SetBytes(parentKey.Bytes())
-		for j := 0; j < parent.BitQuantum(); j++ {
-			if (childIndex>>uint(j))&0x1 == 1 {
-				key.Set(parentKey.BitLen() + j)
-			} else {
-				key.Unset(parentKey.BitLen() + j)
-			}
-		}
+		parentKey := mustDecodeBitstring(parent.NodeKey)
+		key = parentKey.AppendUint(uint(childIndex), parent.BitQuantum())
 	} else {
 		key = NewBitstring(0)
 	}
 	n.PNode.NodeKey = mustEncodeBitstring(key)
 	svalues := make([]*Zp, t.NumSamples())
 	for i := 0; i < len(svalues); i++ {
-		svalues[i] = Zi(P_SKS, 1)
+		svalues[i] = Zi(recon.TreePrime(t), 1)
 	}
 	n.PNode.SValues = mustEncodeZZarray(svalues)
 	return n
@@ -523,63 +604,76 @@ func (n *pqPrefixNode) IsLeaf() bool {
 	return len(n.childKeys) == 0
 }
 
-func (n *pqPrefixNode) Children() (result []recon.PrefixNode) {
-	key := n.Key()
+func (n *pqPrefixNode) Children() ([]recon.PrefixNode, error) {
+	key, err := n.Key()
+	if err != nil {
+		return nil, err
+	}
+	var result []recon.PrefixNode
 	for _, i := range n.childKeys {
-		childKey := NewBitstring(key.BitLen() + n.BitQuantum())
-		childKey.SetBytes(key.Bytes())
-		for j := 0; j < n.BitQuantum(); j++ {
-			if (i>>uint(j))&0x1 == 1 {
-				childKey.Set(key.BitLen() + j)
-			} else {
-				childKey.Unset(key.BitLen() + j)
-			}
-		}
+		childKey := key.AppendUint(uint(i), n.BitQuantum())
 		child, err := n.Node(childKey)
 		if err != nil {
-			panic(fmt.Sprintf("Children failed on child#%v, key=%v: %v", i, childKey, err))
+			return nil, errors.New(fmt.Sprintf("Children failed on child#%v, key=%v: %v", i, childKey, err))
 		}
 		result = append(result, child)
 	}
-	return
+	return result, nil
 }
 
-func (n *pqPrefixNode) Elements() (result []*Zp) {
+func (n *pqPrefixNode) Elements() ([]*Zp, error) {
+	var result []*Zp
+	if !n.IsLeaf() {
+		children, err := n.Children()
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			elements, err := child.Elements()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, elements...)
+		}
+		return result, nil
+	}
 	for _, element := range n.elements {
-		result = append(result, Zb(P_SKS, element.Element))
+		result = append(result, Zb(recon.TreePrime(n), element.Element))
 	}
-	return
+	return result, nil
 }
 
 func (n *pqPrefixNode) Size() int { return n.NumElements }
 
-func (n *pqPrefixNode) SValues() []*Zp {
-	return mustDecodeZZarray(n.PNode.SValues)
+func (n *pqPrefixNode) SValues() ([]*Zp, error) {
+	return decodeZZarray(n.PNode.SValues, recon.TreePrime(n))
 }
 
-func (n *pqPrefixNode) Key() *Bitstring {
-	return mustDecodeBitstring(n.NodeKey)
+func (n *pqPrefixNode) Key() (*Bitstring, error) {
+	return decodeBitstring(n.NodeKey)
 }
 
-func (n *pqPrefixNode) Parent() (recon.PrefixNode, bool) {
-	key := n.Key()
+func (n *pqPrefixNode) Parent() (recon.PrefixNode, bool, error) {
+	key, err := n.Key()
+	if err != nil {
+		return nil, false, err
+	}
 	if key.BitLen() == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	parentKey := NewBitstring(key.BitLen() - n.BitQuantum())
-	parentKey.SetBytes(key.Bytes())
+	parentKey := key.Prefix(key.BitLen() - n.BitQuantum())
 	parent, err := n.Node(parentKey)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to get parent: %v", err))
+		return nil, false, errors.New(fmt.Sprintf("Failed to get parent: %v", err))
 	}
-	return parent, true
+	return parent, true, nil
 }
 
 func (n *pqPrefixNode) updateSvalues(z *Zp, marray []*Zp) {
 	if len(marray) != len(n.points) {
 		panic("Inconsistent NumSamples size")
 	}
-	svalues := mustDecodeZZarray(n.PNode.SValues)
+	svalues := mustDecodeZZarray(n.PNode.SValues, z.P)
 	for i := 0; i < len(marray); i++ {
 		svalues[i] = Z(z.P).Mul(svalues[i], marray[i])
 	}
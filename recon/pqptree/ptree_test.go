@@ -27,7 +27,9 @@ import (
 	"github.com/bmizerany/assert"
 	. "github.com/cmars/conflux"
 	"github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/storetest"
 	"github.com/jmoiron/sqlx"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +55,15 @@ func destroyTestPeer(peer *recon.Peer) {
 	peer.PrefixTree.(*pqPrefixTree).db.Close()
 }
 
+func TestValidNamespace(t *testing.T) {
+	assert.T(t, ValidNamespace("conflux"))
+	assert.T(t, ValidNamespace("app_keys_2"))
+	assert.T(t, !ValidNamespace(""))
+	assert.T(t, !ValidNamespace("2keys"))
+	assert.T(t, !ValidNamespace("keys; DROP TABLE keys"))
+	assert.T(t, !ValidNamespace(strings.Repeat("n", maxNamespaceLen+1)))
+}
+
 func TestInsertNodesNoSplit(t *testing.T) {
 	peer := createTestPeer(t)
 	defer destroyTestPeer(peer)
@@ -61,7 +72,7 @@ func TestInsertNodesNoSplit(t *testing.T) {
 	peer.PrefixTree.Insert(Zi(P_SKS, 500))
 	root, err := peer.PrefixTree.Root()
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, len(root.Elements()))
+	assert.Equal(t, 3, len(storetest.MustElements(t, root)))
 	assert.T(t, root.IsLeaf())
 	var result struct{ Count int }
 	// Should be 3 elements
@@ -72,8 +83,8 @@ func TestInsertNodesNoSplit(t *testing.T) {
 	peer.PrefixTree.Remove(Zi(P_SKS, 300))
 	peer.PrefixTree.Remove(Zi(P_SKS, 500))
 	root, err = peer.PrefixTree.Root()
-	assert.Equal(t, 0, len(root.Elements()))
-	for _, sv := range root.SValues() {
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
 	// Should be 0 elements
@@ -102,7 +113,7 @@ func TestJustOneKey(t *testing.T) {
 	}
 	assert.Equal(t, err, nil)
 	root, err = tree.Root()
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Tf(t, expect.Has(sv), "Unexpected svalue: %v", sv)
 		expect.Remove(sv)
 	}
@@ -129,14 +140,40 @@ func TestInsertNodeSplit(t *testing.T) {
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
 	// Insert/Remove reversible after splitting & joining?
-	for _, sv := range root.SValues() {
+	for _, sv := range storetest.MustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
-	assert.Equal(t, 0, len(root.Children()))
-	assert.Equal(t, 0, len(root.Elements()))
+	assert.Equal(t, 0, len(storetest.MustChildren(t, root)))
+	assert.Equal(t, 0, len(storetest.MustElements(t, root)))
 	//destroyTestPeer(peer)
 }
 
+// Test that nodes unreachable from the root are collected
+func TestCollectOrphans(t *testing.T) {
+	peer := createTestPeer(t)
+	defer destroyTestPeer(peer)
+	tree := peer.PrefixTree.(*pqPrefixTree)
+	for i := 1; i < 10; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	root, err := tree.Root()
+	assert.Equal(t, nil, err)
+	assert.T(t, root.IsLeaf())
+	// A child stored without its parent being split is an orphan
+	assert.Equal(t, nil, tree.newChildNode(root.(*pqPrefixNode), 2).upsertNode())
+	key := storetest.MustKey(t, root).AppendUint(2, root.BitQuantum())
+	_, err = tree.Node(key)
+	assert.Equal(t, nil, err)
+	n, err := recon.CollectOrphans(tree)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, n)
+	_, err = tree.Node(key)
+	assert.Equal(t, recon.PNodeNotFound, err)
+	root, err = tree.Root()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 9, root.Size())
+}
+
 /*
 // Test key consistency
 func TestKeyMatch(t *testing.T) {
@@ -166,10 +203,10 @@ func TestKeyMatch(t *testing.T) {
 		assert.Equal(t, err, nil)
 		node2, err := Find(tree2, zi)
 		assert.Equal(t, err, nil)
-		t.Logf("node1=%v, node2=%v (%b) full=%v", node1.Key(), node2.Key(), zi.Int64(), bs)
+		t.Logf("node1=%v, node2=%v (%b) full=%v", storetest.MustKey(t, node1), storetest.MustKey(t, node2), zi.Int64(), bs)
 		// If keys are different, one must prefix the other.
-		assert.T(t, strings.HasPrefix(node1.Key().String(), node2.Key().String()) ||
-			strings.HasPrefix(node2.Key().String(), node1.Key().String()))
+		assert.T(t, storetest.MustKey(t, node1).HasPrefix(storetest.MustKey(t, node2)) ||
+			storetest.MustKey(t, node2).HasPrefix(storetest.MustKey(t, node1)))
 	}
 }
 */
@@ -19,3 +19,19 @@ FOREIGN KEY (node_key) REFERENCES {{.Namespace}}_pnode(node_key))`
 
 const CreateIndex_PElement_NodeKey = `
 CREATE INDEX {{.Namespace}}_pelement_node_key ON {{.Namespace}}_pelement (node_key)`
+
+const CreateTable_Session = `
+CREATE TABLE IF NOT EXISTS {{.Namespace}}_session (
+session_id SERIAL,
+role TEXT NOT NULL,
+partner TEXT NOT NULL,
+start_time TIMESTAMP WITH TIME ZONE NOT NULL,
+end_time TIMESTAMP WITH TIME ZONE NOT NULL,
+recovered INTEGER NOT NULL DEFAULT 0,
+error TEXT,
+entry TEXT NOT NULL,
+--
+PRIMARY KEY (session_id))`
+
+const CreateIndex_Session_StartTime = `
+CREATE INDEX {{.Namespace}}_session_start_time ON {{.Namespace}}_session (start_time)`
@@ -0,0 +1,84 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pqptree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cmars/conflux/recon"
+	"github.com/jmoiron/sqlx"
+)
+
+// SessionLog is a recon.Journal recording sessions in the table
+// {{.Namespace}}_session, in the same database as the tree. It may
+// be capped to the most recent sessions, deleting older ones.
+type SessionLog struct {
+	Namespace string
+	db        *sqlx.DB
+	max       int
+	insert    string
+	trim      string
+}
+
+// NewSessionLog creates the session log table if necessary. It keeps
+// at most max of the most recent sessions, or all if max is zero.
+func NewSessionLog(namespace string, db *sqlx.DB, max int) (*SessionLog, error) {
+	if !ValidNamespace(namespace) {
+		return nil, errors.New(fmt.Sprintf("Invalid namespace %q", namespace))
+	}
+	l := &SessionLog{Namespace: namespace, db: db, max: max}
+	if _, err := db.Execv(sqlTemplate(CreateTable_Session, l)); err != nil {
+		return nil, err
+	}
+	db.Execv(sqlTemplate(CreateIndex_Session_StartTime, l))
+	l.insert = sqlTemplate(`
+INSERT INTO {{.Namespace}}_session (role, partner, start_time, end_time, recovered, error, entry)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING session_id`, l)
+	l.trim = sqlTemplate(`
+DELETE FROM {{.Namespace}}_session WHERE session_id <= $1`, l)
+	return l, nil
+}
+
+// Record adds a session to the log, deleting the sessions
+// beyond the most recent kept.
+func (l *SessionLog) Record(entry *recon.JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var errMsg *string
+	if entry.Error != "" {
+		errMsg = &entry.Error
+	}
+	var id int
+	err = l.db.QueryRow(l.insert, entry.Role, entry.Partner, entry.Start, entry.End,
+		len(entry.Recovered), errMsg, string(data)).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if l.max > 0 && id > l.max {
+		_, err = l.db.Execv(l.trim, id-l.max)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pqptree
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/bmizerany/assert"
+	"github.com/cmars/conflux/recon"
+	"github.com/jmoiron/sqlx"
+	"testing"
+	"time"
+)
+
+func TestSessionLog(t *testing.T) {
+	db, err := sqlx.Connect("postgres", "dbname=pqptree_test host=/var/run/postgresql sslmode=disable")
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	tag := make([]byte, 16)
+	rand.Read(tag)
+	namespace := "test_" + hex.EncodeToString(tag)
+	log, err := NewSessionLog(namespace, db, 2)
+	assert.Equal(t, err, nil)
+	defer db.Execf("DROP TABLE " + namespace + "_session")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		entry := &recon.JournalEntry{
+			Role:      "client",
+			Partner:   "192.0.2.1:11370",
+			Start:     start,
+			End:       start.Add(time.Second),
+			Recovered: []string{"00", "01"}}
+		if i == 2 {
+			entry.Error = "fail"
+		}
+		assert.Equal(t, nil, log.Record(entry))
+	}
+	// Only the two most recent sessions are kept
+	var count int
+	assert.Equal(t, nil, db.QueryRow("SELECT count(*) FROM "+namespace+"_session").Scan(&count))
+	assert.Equal(t, 2, count)
+	var recovered int
+	var errMsg string
+	assert.Equal(t, nil, db.QueryRow("SELECT recovered, error FROM "+namespace+
+		"_session ORDER BY session_id DESC LIMIT 1").Scan(&recovered, &errMsg))
+	assert.Equal(t, 2, recovered)
+	assert.Equal(t, "fail", errMsg)
+}
@@ -22,6 +22,7 @@ package pqptree
 
 import (
 	"github.com/cmars/conflux/recon"
+	"github.com/jmoiron/sqlx"
 )
 
 type Settings struct {
@@ -36,10 +37,35 @@ func (s *Settings) DSN() string {
 	return s.GetString("conflux.recon.sql.dsn", "dbname=conflux host=/var/run/postgresql sslmode=disable")
 }
 
+// Namespace prefixes the names of the tree's tables, so that several
+// trees can share a database.
 func (s *Settings) Namespace() string {
 	return s.GetString("conflux.recon.sql.ns", "conflux")
 }
 
+// MaxOpenConns limits the connections open to the database, which are
+// shared by concurrent recon sessions and inserts. Zero is unlimited.
+func (s *Settings) MaxOpenConns() int {
+	return s.GetInt("conflux.recon.sql.maxOpenConns", 0)
+}
+
+// MaxIdleConns is the number of idle connections kept for reuse.
+func (s *Settings) MaxIdleConns() int {
+	return s.GetInt("conflux.recon.sql.maxIdleConns", 2)
+}
+
+// SessionLog enables recording recon sessions in a table beside
+// the tree's, when the postgres backend is used.
+func (s *Settings) SessionLog() bool {
+	return s.GetBool("conflux.recon.sql.sessionLog", false)
+}
+
+// SessionLogMax is the number of most recent sessions kept in the
+// session log. Older sessions are deleted. Zero keeps all of them.
+func (s *Settings) SessionLogMax() int {
+	return s.GetInt("conflux.recon.sql.sessionLogMax", 10000)
+}
+
 func NewSettings(reconSettings *recon.Settings) *Settings {
 	return &Settings{reconSettings}
 }
@@ -47,3 +73,15 @@ func NewSettings(reconSettings *recon.Settings) *Settings {
 func DefaultSettings() *Settings {
 	return NewSettings(recon.DefaultSettings())
 }
+
+// Connect opens the database, with its connection pool limited
+// as configured.
+func Connect(settings *Settings) (*sqlx.DB, error) {
+	db, err := sqlx.Connect(settings.Driver(), settings.DSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(settings.MaxOpenConns())
+	db.SetMaxIdleConns(settings.MaxIdleConns())
+	return db, nil
+}
@@ -0,0 +1,63 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pqptree
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/cmars/conflux/recon"
+	"github.com/cmars/conflux/recon/storetest"
+	"github.com/jmoiron/sqlx"
+	"testing"
+)
+
+type pqTreeManager struct{}
+
+func (m pqTreeManager) CreateTree(settings *recon.Settings) (recon.PrefixTree, error) {
+	db, err := sqlx.Connect("postgres", "dbname=pqptree_test host=/var/run/postgresql sslmode=disable")
+	if err != nil {
+		return nil, err
+	}
+	tag := make([]byte, 16)
+	rand.Read(tag)
+	return New("test_"+hex.EncodeToString(tag), db, NewSettings(settings))
+}
+
+func (m pqTreeManager) DestroyTree(tree recon.PrefixTree) {
+	tree.(*pqPrefixTree).db.Close()
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, pqTreeManager{})
+}
+
+func BenchmarkInsert(b *testing.B) {
+	storetest.BenchmarkInsert(b, pqTreeManager{})
+}
+
+func BenchmarkRemove(b *testing.B) {
+	storetest.BenchmarkRemove(b, pqTreeManager{})
+}
+
+func BenchmarkFind(b *testing.B) {
+	storetest.BenchmarkFind(b, pqTreeManager{})
+}
@@ -0,0 +1,194 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io"
+	"log"
+	"math/big"
+	"strings"
+)
+
+// Primes are the finite fields which may be named in the
+// conflux.recon.prime setting. Elements must be smaller than the
+// prime, so the field should suit the length of the element digests.
+var Primes map[string]*big.Int = map[string]*big.Int{
+	"sks": P_SKS,
+	"128": P_128,
+	"160": P_160,
+	"256": P_256,
+	"512": P_512,
+}
+
+// PrimeByName returns the prime of a finite field named in Primes.
+// Any other name is read as a prime given in decimal, or hexadecimal
+// prefixed with 0x, which must pass CheckPrime.
+func PrimeByName(name string) (*big.Int, error) {
+	if p, has := Primes[strings.ToLower(name)]; has {
+		return p, nil
+	}
+	if _, ok := big.NewInt(0).SetString(name, 0); !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown prime: %q", name))
+	}
+	return ParsePrime(name, 0)
+}
+
+// PrimeName names the finite field of the prefix tree elements, one
+// of the Primes or a prime number of the caller's own choosing for
+// elements of other sizes. Peers must use the same field to reconcile.
+func (s *Settings) PrimeName() string {
+	return s.GetString("conflux.recon.prime", "sks")
+}
+
+// Prime returns the prime of the finite field named in the settings.
+// A name which is not valid, which Validate reports, is logged and
+// read as P_SKS.
+func (s *Settings) Prime() *big.Int {
+	p, err := PrimeByName(s.PrimeName())
+	if err != nil {
+		log.Println("conflux.recon.prime:", err, "using sks")
+		return P_SKS
+	}
+	return p
+}
+
+// KeysByName returns the derivation of element keys named "sks",
+// "bigendian", or "salted", which is salted with salt.
+func KeysByName(name string, salt string) (KeyStrategy, error) {
+	switch strings.ToLower(name) {
+	case "sks":
+		return SksKeys, nil
+	case "bigendian":
+		return BigEndianKeys, nil
+	case "salted":
+		if salt == "" {
+			return nil, errors.New("Salted keys require a salt")
+		}
+		return &SaltedKeys{Salt: []byte(salt)}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown keys: %q", name))
+}
+
+// KeysName names the derivation of element keys in the prefix tree.
+// Peers must derive keys the same way to reconcile.
+func (s *Settings) KeysName() string {
+	return s.GetString("conflux.recon.keys", "sks")
+}
+
+// KeySalt is the salt of element keys when KeysName is "salted".
+func (s *Settings) KeySalt() string {
+	return s.GetString("conflux.recon.keySalt", "")
+}
+
+// Keys returns the derivation of element keys named in the settings.
+// A name which is not valid, which Validate reports, is logged and
+// read as SksKeys.
+func (s *Settings) Keys() KeyStrategy {
+	keys, err := KeysByName(s.KeysName(), s.KeySalt())
+	if err != nil {
+		log.Println("conflux.recon.keys:", err, "using sks")
+		return SksKeys
+	}
+	return keys
+}
+
+// FieldConn is implemented by connections carrying recon messages
+// with integers in a finite field other than P_SKS.
+type FieldConn interface {
+	Prime() *big.Int
+}
+
+// fieldReader reads the integers in a message in the finite field p.
+type fieldReader struct {
+	io.Reader
+	p *big.Int
+}
+
+func (r *fieldReader) Prime() *big.Int { return r.p }
+
+// NewFieldReader returns a reader of the integers written to r in the
+// finite field p, such as those a prefix tree stores in a field other
+// than P_SKS.
+func NewFieldReader(r io.Reader, p *big.Int) io.Reader {
+	return &fieldReader{Reader: r, p: p}
+}
+
+// prime returns the finite field of the peer's prefix tree.
+func (p *Peer) prime() *big.Int {
+	return TreePrime(p.PrefixTree)
+}
+
+// keysName names the derivation of element keys in the peer's prefix tree.
+func (p *Peer) keysName() string {
+	return TreeKeys(p.PrefixTree).Name()
+}
+
+// remoteKeys returns the derivation of element keys announced by a
+// remote peer, which is that of SKS if none was given.
+func remoteKeys(config *Config) string {
+	if keys, has := config.Custom["keys"]; has {
+		return keys
+	}
+	return SksKeys.Name()
+}
+
+const sksPointsId = "sks"
+
+// pointsId identifies the points at which the peer's prefix tree is
+// sampled: "sks" for those generated by Zpoints, or else a digest.
+func (p *Peer) pointsId() string {
+	points := p.Points()
+	sks := Zpoints(p.prime(), len(points))
+	same := true
+	h := sha256.New()
+	for i, z := range points {
+		same = same && z.Cmp(sks[i]) == 0
+		h.Write([]byte(z.String() + ","))
+	}
+	if same {
+		return sksPointsId
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// remotePoints returns the sample points announced by a remote peer,
+// which are the points used by SKS if none were given.
+func remotePoints(config *Config) string {
+	if points, has := config.Custom["points"]; has {
+		return points
+	}
+	return sksPointsId
+}
+
+// remotePrime returns the prime announced by a remote peer,
+// which is P_SKS if none was given.
+func remotePrime(config *Config) string {
+	if prime, has := config.Custom["prime"]; has {
+		return prime
+	}
+	return P_SKS.String()
+}
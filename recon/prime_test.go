@@ -0,0 +1,182 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestPrimeByName(t *testing.T) {
+	p, err := PrimeByName("SKS")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, p.Cmp(P_SKS))
+	p, err = PrimeByName("256")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, p.Cmp(P_256))
+	_, err = PrimeByName("p257")
+	assert.NotEqual(t, nil, err)
+	// Caller-provided primes
+	p, err = PrimeByName(P_SKS.String())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, p.Cmp(P_SKS))
+	p, err = PrimeByName("0x" + P_160.Text(16))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, p.Cmp(P_160))
+	_, err = PrimeByName("257")
+	_, is := err.(*PrimeSizeError)
+	assert.T(t, is)
+	_, err = PrimeByName("1000000000000000000000000000000")
+	assert.Equal(t, ErrNotPrime, err)
+	s := DefaultSettings()
+	assert.Equal(t, 0, s.Prime().Cmp(P_SKS))
+	s.Set("conflux.recon.prime", "1000000000000000000000000000000")
+	assert.Equal(t, 0, s.Prime().Cmp(P_SKS))
+	assert.NotEqual(t, nil, s.Validate())
+}
+
+func TestReadZpField(t *testing.T) {
+	z := Zb(P_256, bytes.Repeat([]byte{0xab}, 30))
+	buf := bytes.NewBuffer(nil)
+	err := WriteZp(buf, z)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, zpNbytes(P_256), buf.Len())
+	z2, err := ReadZp(&fieldReader{Reader: buf, p: P_256})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, z.Cmp(z2))
+	assert.Equal(t, 0, z2.P.Cmp(P_256))
+}
+
+func TestReconcilePrime(t *testing.T) {
+	server := newTestPeer("conflux.recon.prime", "256")
+	client := newTestPeer("conflux.recon.prime", "256")
+	assert.Equal(t, P_256.String(), server.Config().Custom["prime"])
+	// Elements larger than P_SKS
+	big1 := Zb(P_256, bytes.Repeat([]byte{0x11}, 30))
+	big2 := Zb(P_256, bytes.Repeat([]byte{0x22}, 30))
+	big3 := Zb(P_256, bytes.Repeat([]byte{0x33}, 30))
+	assert.T(t, big1.Int.Cmp(P_SKS) > 0)
+	server.PrefixTree.Insert(big1)
+	server.PrefixTree.Insert(big2)
+	client.PrefixTree.Insert(big1)
+	client.PrefixTree.Insert(big3)
+	assert.NotEqual(t, nil, client.PrefixTree.Insert(Zi(P_SKS, 65537)))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, len(s.clientRecovered))
+	clientRecover := s.clientRecovered[0]
+	assert.Equal(t, 1, len(clientRecover.RemoteElements))
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(big2))
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].P.Cmp(P_256))
+}
+
+func TestCustomPrimeConfig(t *testing.T) {
+	p := newTestPeer("conflux.recon.prime", P_160.String())
+	assert.Equal(t, 0, p.prime().Cmp(P_160))
+	assert.Equal(t, P_160.String(), p.Config().Custom["prime"])
+	assert.Equal(t, nil, p.Settings.Validate())
+}
+
+func TestMismatchedPrime(t *testing.T) {
+	server, client := newTestPeer("conflux.recon.prime", "256"), NewMemPeer()
+	s := runSession(t, server, client, nil)
+	assert.NotEqual(t, nil, s.clientErr)
+	assert.Equal(t, IncompatiblePeerError, s.serverErr)
+}
+
+func TestReconcilePoints(t *testing.T) {
+	server, client := newTestPeer(), newTestPeer()
+	server.PrefixTree = NewMemPrefixTreePoints(server.Settings, &HashPoints{Seed: []byte("test")})
+	client.PrefixTree = NewMemPrefixTreePoints(client.Settings, &HashPoints{Seed: []byte("test")})
+	assert.Equal(t, sksPointsId, NewMemPeer().pointsId())
+	assert.NotEqual(t, sksPointsId, server.pointsId())
+	assert.Equal(t, server.pointsId(), server.Config().Custom["points"])
+	// Small elements, which would be sample points of SKS
+	server.PrefixTree.Insert(Zi(P_SKS, 1))
+	server.PrefixTree.Insert(Zi(P_SKS, 2))
+	client.PrefixTree.Insert(Zi(P_SKS, 1))
+	client.PrefixTree.Insert(Zi(P_SKS, 3))
+	assert.Equal(t, nil, VerifyTree(server.PrefixTree))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, len(s.clientRecovered))
+	clientRecover := s.clientRecovered[0]
+	assert.Equal(t, 1, len(clientRecover.RemoteElements))
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 2)))
+}
+
+func TestMismatchedPoints(t *testing.T) {
+	server, client := newTestPeer(), newTestPeer()
+	server.PrefixTree = NewMemPrefixTreePoints(server.Settings, &HashPoints{Seed: []byte("test")})
+	client.PrefixTree = NewMemPrefixTreePoints(client.Settings, &HashPoints{Seed: []byte("other")})
+	s := runSession(t, server, client, nil)
+	assert.NotEqual(t, nil, s.clientErr)
+	assert.Equal(t, IncompatiblePeerError, s.serverErr)
+}
+
+func TestKeysByName(t *testing.T) {
+	keys, err := KeysByName("SKS", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, SksKeys, keys)
+	keys, err = KeysByName("bigendian", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, BigEndianKeys, keys)
+	keys, err = KeysByName("salted", "pepper")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (&SaltedKeys{Salt: []byte("pepper")}).Name(), keys.Name())
+	_, err = KeysByName("salted", "")
+	assert.NotEqual(t, nil, err)
+	_, err = KeysByName("reversed", "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestReconcileKeys(t *testing.T) {
+	server := newTestPeer("conflux.recon.keys", "salted", "conflux.recon.keySalt", "test")
+	client := newTestPeer("conflux.recon.keys", "salted", "conflux.recon.keySalt", "test")
+	assert.Equal(t, SksKeys.Name(), NewMemPeer().keysName())
+	assert.Equal(t, server.keysName(), server.Config().Custom["keys"])
+	// Enough elements to split the tree by the salted keys
+	for i := 1; i <= 200; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		if i != 100 {
+			client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		}
+	}
+	assert.Equal(t, nil, VerifyTree(server.PrefixTree))
+	node, err := Find(server.PrefixTree, Zi(P_SKS, 65537*100))
+	assert.Equal(t, nil, err)
+	assert.T(t, mustKey(t, node).BitLen() > 0)
+	assert.T(t, NewZSet(mustElements(t, node)...).Has(Zi(P_SKS, 65537*100)))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, len(s.clientRecovered))
+	clientRecover := s.clientRecovered[0]
+	assert.Equal(t, 1, len(clientRecover.RemoteElements))
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65537*100)))
+}
+
+func TestMismatchedKeys(t *testing.T) {
+	server := newTestPeer("conflux.recon.keys", "salted", "conflux.recon.keySalt", "test")
+	client := newTestPeer("conflux.recon.keys", "salted", "conflux.recon.keySalt", "other")
+	s := runSession(t, server, client, nil)
+	assert.NotEqual(t, nil, s.clientErr)
+	assert.Equal(t, IncompatiblePeerError, s.serverErr)
+}
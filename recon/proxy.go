@@ -0,0 +1,100 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NoProxy in conflux.recon.partnerProxies dials a partner directly,
+// bypassing the global proxy.
+const NoProxy = "direct"
+
+// Proxy is the URL of the SOCKS5 proxy used to reach TCP partners,
+// such as socks5://127.0.0.1:9050 for a local Tor daemon.
+func (s *Settings) Proxy() string {
+	return s.GetString("conflux.recon.proxy", "")
+}
+
+// ProxyTimeout is the number of seconds allowed to connect to a partner
+// through a proxy.
+func (s *Settings) ProxyTimeout() int {
+	return s.GetInt("conflux.recon.proxyTimeout", 30)
+}
+
+// PartnerProxy returns the proxy URL for a partner. The proxy in the
+// partner's block, or an entry in conflux.recon.partnerProxies of the
+// form "partner proxy-url", overrides the global proxy for that partner.
+func (s *Settings) PartnerProxy(partner string) string {
+	if pc := s.PartnerConfig(partner); pc != nil && pc.Proxy != "" {
+		if pc.Proxy == NoProxy {
+			return ""
+		}
+		return pc.Proxy
+	}
+	for _, entry := range s.GetStrings("conflux.recon.partnerProxies") {
+		fields := strings.Fields(entry)
+		if len(fields) == 2 && fields[0] == partner {
+			if fields[1] == NoProxy {
+				return ""
+			}
+			return fields[1]
+		}
+	}
+	return s.Proxy()
+}
+
+func ErrOnionRequiresProxy(partner string) error {
+	return errors.New(fmt.Sprintf("Partner %s is an onion address and requires a proxy", partner))
+}
+
+func isOnion(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// dialProxy connects to addr through a SOCKS5 proxy. Host names are
+// resolved by the proxy, so onion addresses reach the Tor network.
+func dialProxy(proxyUrl string, addr string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Proxy %s: %v", u.Host, err))
+	}
+	return conn, nil
+}
@@ -0,0 +1,107 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/binary"
+	"github.com/bmizerany/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPartnerProxy(t *testing.T) {
+	s := DefaultSettings()
+	assert.Equal(t, "", s.PartnerProxy("a.example.com:11370"))
+	s.Set("conflux.recon.proxy", "socks5://127.0.0.1:9050")
+	s.Set("conflux.recon.partnerProxies", []interface{}{
+		"b.example.com:11370 socks5://127.0.0.1:1080",
+		"c.example.com:11370 direct"})
+	assert.Equal(t, "socks5://127.0.0.1:9050", s.PartnerProxy("a.example.com:11370"))
+	assert.Equal(t, "socks5://127.0.0.1:1080", s.PartnerProxy("b.example.com:11370"))
+	assert.Equal(t, "", s.PartnerProxy("c.example.com:11370"))
+}
+
+func TestOnionRequiresProxy(t *testing.T) {
+	p := NewMemPeer()
+	_, err := p.dialPartner("exampleonionaddress.onion:11370")
+	assert.Equal(t, ErrOnionRequiresProxy("exampleonionaddress.onion:11370"), err)
+}
+
+// serveSocks5 accepts a single no-auth SOCKS5 CONNECT request and
+// records the requested destination, which it dials on the loopback.
+func serveSocks5(t *testing.T, ln net.Listener, port int, dest chan string) {
+	conn, err := ln.Accept()
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	buf := make([]byte, 256)
+	// Greeting: version, nmethods, methods
+	io.ReadFull(conn, buf[:2])
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{5, 0})
+	// Request: version, CONNECT, reserved, domain name address type
+	io.ReadFull(conn, buf[:4])
+	assert.Equal(t, byte(3), buf[3])
+	io.ReadFull(conn, buf[:1])
+	host := make([]byte, buf[0])
+	io.ReadFull(conn, host)
+	io.ReadFull(conn, buf[:2])
+	dest <- net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.Equal(t, nil, err)
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestDialProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	dest := make(chan string, 1)
+	go serveSocks5(t, ln, target.Addr().(*net.TCPAddr).Port, dest)
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.proxy", "socks5://"+ln.Addr().String())
+	conn, err := p.dialPartner("exampleonionaddress.onion:11370")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Equal(t, "exampleonionaddress.onion:11370", <-dest)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := ioutil.ReadAll(conn)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(msg))
+}
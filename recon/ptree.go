@@ -23,7 +23,11 @@ package recon
 
 import (
 	"errors"
+	"fmt"
 	. "github.com/cmars/conflux"
+	"math/big"
+	"sort"
+	"sync"
 )
 
 type PrefixTree interface {
@@ -39,14 +43,17 @@ type PrefixTree interface {
 	Remove(z *Zp) error
 }
 
+// PrefixNode is a node of a prefix tree. Methods which may read from
+// a backend return its errors, rather than panicking.
 type PrefixNode interface {
 	BitQuantum() int
-	Parent() (PrefixNode, bool)
-	Key() *Bitstring
-	Elements() []*Zp
+	// Parent returns the node's parent, and false if it is the root.
+	Parent() (PrefixNode, bool, error)
+	Key() (*Bitstring, error)
+	Elements() ([]*Zp, error)
 	Size() int
-	Children() []PrefixNode
-	SValues() []*Zp
+	Children() ([]PrefixNode, error)
+	SValues() ([]*Zp, error)
 	IsLeaf() bool
 }
 
@@ -64,18 +71,131 @@ type MemPrefixTree struct {
 	bitQuantum     int
 	mBar           int
 	numSamples     int
+	maxDepth       int
+	// Finite field of the elements
+	prime *big.Int
 	// Sample data points for interpolation
-	points []*Zp
+	points   []*Zp
+	pointGen PointGenerator
+	// Derivation of element keys
+	keys KeyStrategy
+	// Incremental digest of the elements
+	digest *MultisetHash
 	// Tree's root node
 	root *MemPrefixNode
+	// Scratch space for sample value arithmetic
+	ctx *ZpContext
+	// Element vectors of a bulk insert in progress, by element
+	vectors map[string]*ZVector
+	// Element vectors no longer in use, for reuse
+	vectorPool sync.Pool
+}
+
+// NewMemPrefixTree creates an in-memory prefix tree
+// with the structure given by settings.
+func NewMemPrefixTree(s *Settings) *MemPrefixTree {
+	t := &MemPrefixTree{
+		splitThreshold: s.SplitThreshold(),
+		joinThreshold:  s.JoinThreshold(),
+		bitQuantum:     s.BitQuantum(),
+		mBar:           s.MBar(),
+		numSamples:     s.NumSamples(),
+		maxDepth:       s.MaxDepth(),
+		prime:          s.Prime(),
+		keys:           s.Keys()}
+	t.Init()
+	return t
+}
+
+// NewMemPrefixTreePoints creates an in-memory prefix tree with the
+// structure given by settings, sampled at points from gen rather than
+// the points used by SKS.
+func NewMemPrefixTreePoints(s *Settings, gen PointGenerator) *MemPrefixTree {
+	t := NewMemPrefixTree(s)
+	t.pointGen = gen
+	t.Init()
+	return t
 }
 
 func (t *MemPrefixTree) SplitThreshold() int       { return t.splitThreshold }
 func (t *MemPrefixTree) JoinThreshold() int        { return t.joinThreshold }
 func (t *MemPrefixTree) BitQuantum() int           { return t.bitQuantum }
 func (t *MemPrefixTree) NumSamples() int           { return t.numSamples }
+func (t *MemPrefixTree) MaxDepth() int             { return t.maxDepth }
 func (t *MemPrefixTree) Points() []*Zp             { return t.points }
 func (t *MemPrefixTree) Root() (PrefixNode, error) { return t.root, nil }
+func (t *MemPrefixTree) Keys() KeyStrategy         { return t.keys }
+func (t *MemPrefixTree) Digest() *MultisetHash     { return t.digest.Copy() }
+
+// KeyedTree is implemented by prefix trees which locate elements
+// by keys other than those used by SKS.
+type KeyedTree interface {
+	Keys() KeyStrategy
+}
+
+// TreeKeys returns the derivation of element keys in a prefix tree.
+func TreeKeys(t PrefixTree) KeyStrategy {
+	if kt, is := t.(KeyedTree); is && kt.Keys() != nil {
+		return kt.Keys()
+	}
+	return SksKeys
+}
+
+// TreePrime returns the finite field of the elements in a prefix tree,
+// that of its sample points.
+func TreePrime(t PrefixTree) *big.Int {
+	if points := t.Points(); len(points) > 0 {
+		return points[0].P
+	}
+	return P_SKS
+}
+
+// TreeKeyBits returns the length in bits of the keys of elements
+// in a prefix tree, beyond which no node key may extend.
+func TreeKeyBits(t PrefixTree) int {
+	return TreeKeys(t).Key(Z(TreePrime(t))).BitLen()
+}
+
+// DigestTree is implemented by prefix trees which maintain
+// a digest of their elements as they are inserted and removed.
+type DigestTree interface {
+	Digest() *MultisetHash
+}
+
+// TreeDigest returns the digest of the elements in a prefix tree,
+// computing it from the elements if the tree does not maintain one.
+func TreeDigest(t PrefixTree) (*MultisetHash, error) {
+	if dt, is := t.(DigestTree); is {
+		return dt.Digest(), nil
+	}
+	root, err := t.Root()
+	if err != nil {
+		return nil, err
+	}
+	elements, err := root.Elements()
+	if err != nil {
+		return nil, err
+	}
+	return MultisetDigest(elements...), nil
+}
+
+// DepthLimitedTree is implemented by prefix trees configured
+// with a maximum depth.
+type DepthLimitedTree interface {
+	MaxDepth() int
+}
+
+// TreeMaxDepth returns the depth at which the leaves of a prefix tree
+// no longer split, for elements with keys of keyBits bits. Each level
+// consumes BitQuantum bits of the keys, so that the tree may be no
+// deeper than the keys are long, nor than its configured limit, if any.
+func TreeMaxDepth(t PrefixTree, keyBits int) int {
+	depth := keyBits / t.BitQuantum()
+	if dt, is := t.(DepthLimitedTree); is && dt.MaxDepth() > 0 && dt.MaxDepth() < depth {
+		return dt.MaxDepth()
+	}
+	return depth
+}
 
 // Init configures the tree with default settings if not already set,
 // and initializes the internal state with sample data points, root node, etc.
@@ -95,15 +215,45 @@ func (t *MemPrefixTree) Init() {
 	if t.numSamples == 0 {
 		t.numSamples = DefaultNumSamples
 	}
-	t.points = Zpoints(P_SKS, t.numSamples)
+	if t.prime == nil {
+		t.prime = P_SKS
+	}
+	if t.pointGen == nil {
+		t.pointGen = SksPoints
+	}
+	if t.keys == nil {
+		t.keys = SksKeys
+	}
+	t.points = t.pointGen.Points(t.prime, t.numSamples)
+	t.ctx = NewZpContext(t.prime)
+	prime, numPoints := t.prime, len(t.points)
+	t.vectorPool.New = func() interface{} { return NewZVector(prime, numPoints) }
+	t.digest = NewMultisetHash()
 	t.root = new(MemPrefixNode)
 	t.root.init(t)
 }
 
+// Find returns the leaf node which holds, or would hold, an element.
+// The tree is descended from the root one node at a time, since
+// backends only look up nodes by their exact key.
 func Find(t PrefixTree, z *Zp) (PrefixNode, error) {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
-	return t.Node(bs)
+	bs := TreeKeys(t).Key(z)
+	node, err := t.Root()
+	if err != nil {
+		return nil, err
+	}
+	nbq := t.BitQuantum()
+	for depth := 0; !node.IsLeaf() && (depth+1)*nbq <= bs.BitLen(); depth++ {
+		key, err := node.Key()
+		if err != nil {
+			return nil, err
+		}
+		node, err = t.Node(key.AppendUint(uint(childIndex(bs, depth, nbq)), nbq))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
 }
 
 func AddElementArray(t PrefixTree, z *Zp) (marray []*Zp) {
@@ -118,6 +268,150 @@ func AddElementArray(t PrefixTree, z *Zp) (marray []*Zp) {
 	return
 }
 
+// ElementArrays holds the element arrays of elements inserted in bulk,
+// so that each is computed once for the element's whole path through
+// the tree, rather than again when a split moves the element down.
+type ElementArrays struct {
+	t      PrefixTree
+	arrays map[string][]*Zp
+}
+
+// NewElementArrays computes the element arrays of elements.
+func NewElementArrays(t PrefixTree, elements []*Zp) *ElementArrays {
+	a := &ElementArrays{t: t, arrays: make(map[string][]*Zp, len(elements))}
+	for _, z := range elements {
+		a.arrays[z.String()] = AddElementArray(t, z)
+	}
+	return a
+}
+
+// Get returns the element array of z, computing it if z was not
+// inserted in bulk. A nil ElementArrays computes every array.
+func (a *ElementArrays) Get(t PrefixTree, z *Zp) []*Zp {
+	if a != nil {
+		if marray, has := a.arrays[z.String()]; has {
+			return marray
+		}
+	}
+	return AddElementArray(t, z)
+}
+
+// BulkTree is implemented by prefix trees which insert many elements
+// at once more efficiently than one at a time.
+type BulkTree interface {
+	InsertAll(elements []*Zp) error
+}
+
+// InsertAll inserts elements into a prefix tree, in bulk if the tree
+// supports it.
+func InsertAll(t PrefixTree, elements []*Zp) error {
+	if bt, is := t.(BulkTree); is {
+		return bt.InsertAll(elements)
+	}
+	for _, z := range elements {
+		if err := t.Insert(z); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LevelTree is implemented by prefix trees which can find the nodes
+// at a depth directly, such as by a range scan of their keys, rather
+// than by descending from the root.
+type LevelTree interface {
+	// NodesAtDepth returns the nodes depth levels below the root,
+	// in key order.
+	NodesAtDepth(depth int) ([]PrefixNode, error)
+}
+
+// NodesAtDepth returns the nodes of a prefix tree depth levels below
+// the root, in key order. Trees which are not LevelTrees are descended
+// from the root a level at a time.
+func NodesAtDepth(t PrefixTree, depth int) ([]PrefixNode, error) {
+	if depth < 0 {
+		return nil, nil
+	}
+	if lt, is := t.(LevelTree); is {
+		return lt.NodesAtDepth(depth)
+	}
+	root, err := t.Root()
+	if err != nil {
+		return nil, err
+	}
+	level := []PrefixNode{root}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		if level, err = childLevel(level); err != nil {
+			return nil, err
+		}
+	}
+	return level, nil
+}
+
+// childLevel returns the children of the nodes of a level, in key order.
+func childLevel(level []PrefixNode) ([]PrefixNode, error) {
+	var children []PrefixNode
+	for _, node := range level {
+		if node.IsLeaf() {
+			continue
+		}
+		nodeChildren, err := node.Children()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, nodeChildren...)
+	}
+	return children, sortNodes(children)
+}
+
+// sortNodes sorts nodes in the order of their keys. Children are
+// numbered from the least significant bit of their key suffix, so
+// this is not the order of their child numbers.
+func sortNodes(nodes []PrefixNode) error {
+	keys := make([]*Bitstring, len(nodes))
+	for i, node := range nodes {
+		key, err := node.Key()
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+	}
+	sort.Sort(&nodesByKey{nodes, keys})
+	return nil
+}
+
+type nodesByKey struct {
+	nodes []PrefixNode
+	keys  []*Bitstring
+}
+
+func (s *nodesByKey) Len() int           { return len(s.nodes) }
+func (s *nodesByKey) Less(i, j int) bool { return s.keys[i].Cmp(s.keys[j]) < 0 }
+func (s *nodesByKey) Swap(i, j int) {
+	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// WalkLevels visits the nodes of a prefix tree in level order, calling
+// visit with each level's depth and nodes, in key order, from the root
+// down to the deepest leaves. The walk stops at the first error visit
+// returns.
+func WalkLevels(t PrefixTree, visit func(depth int, nodes []PrefixNode) error) error {
+	_, isLevelTree := t.(LevelTree)
+	level, err := NodesAtDepth(t, 0)
+	for depth := 0; err == nil && len(level) > 0; depth++ {
+		if err = visit(depth, level); err != nil {
+			break
+		}
+		if isLevelTree {
+			level, err = NodesAtDepth(t, depth+1)
+		} else {
+			level, err = childLevel(level)
+		}
+	}
+	return err
+}
+
 func DelElementArray(t PrefixTree, z *Zp) (marray []*Zp) {
 	points := t.Points()
 	marray = make([]*Zp, len(points))
@@ -148,16 +442,92 @@ func (t *MemPrefixTree) Node(bs *Bitstring) (PrefixNode, error) {
 
 // Insert a Z/Zp integer into the prefix tree
 func (t *MemPrefixTree) Insert(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
-	return t.root.insert(z, AddElementArray(t, z), bs, 0)
+	if err := t.points[0].CheckP(z); err != nil {
+		return err
+	}
+	marray := t.elementVector(z, false)
+	defer t.vectorPool.Put(marray)
+	return t.insert(z, marray)
+}
+
+// InsertAll inserts elements into the prefix tree, computing the
+// vector of each once, for its whole path and any splits along it.
+func (t *MemPrefixTree) InsertAll(elements []*Zp) error {
+	if err := t.points[0].CheckP(elements...); err != nil {
+		return err
+	}
+	t.vectors = make(map[string]*ZVector, len(elements))
+	defer func() {
+		for _, v := range t.vectors {
+			t.vectorPool.Put(v)
+		}
+		t.vectors = nil
+	}()
+	for _, z := range elements {
+		t.vectors[z.String()] = t.elementVector(z, false)
+	}
+	for _, z := range elements {
+		if err := t.insert(z, t.vectors[z.String()]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *MemPrefixTree) insert(z *Zp, marray *ZVector) error {
+	bs := t.keys.Key(z)
+	// Nodes are updated on the way down, so the leaf is checked first
+	leaf, depth := t.leaf(bs)
+	if err := CheckLeafInsert(t, leaf.elements, z, bs, depth); err != nil {
+		return err
+	}
+	t.root.insert(z, marray, bs, 0)
+	t.digest.Add(z)
+	return nil
+}
+
+// leaf returns the leaf whose key is a prefix of bs, and its depth.
+func (t *MemPrefixTree) leaf(bs *Bitstring) (*MemPrefixNode, int) {
+	leaf, depth := t.root, 0
+	for ; !leaf.IsLeaf(); depth++ {
+		leaf = leaf.children[childIndex(bs, depth, t.bitQuantum)]
+	}
+	return leaf, depth
 }
 
 // Remove a Z/Zp integer from the prefix tree
 func (t *MemPrefixTree) Remove(z *Zp) error {
-	bs := NewBitstring(P_SKS.BitLen())
-	bs.SetBytes(ReverseBytes(z.Bytes()))
-	return t.root.remove(z, DelElementArray(t, z), bs, 0)
+	if err := t.points[0].CheckP(z); err != nil {
+		return err
+	}
+	bs := t.keys.Key(z)
+	// Nodes are updated on the way down, so the leaf is checked first
+	leaf, _ := t.leaf(bs)
+	if err := CheckLeafRemove(leaf.elements, z); err != nil {
+		return err
+	}
+	marray := t.elementVector(z, true)
+	defer t.vectorPool.Put(marray)
+	t.root.remove(z, marray, bs, 0)
+	t.digest.Remove(z)
+	return nil
+}
+
+// elementVector returns the factors by which adding z to a node
+// multiplies its sample values, or divides them if removing z. The
+// vector is taken from the pool, to which the caller returns it.
+func (t *MemPrefixTree) elementVector(z *Zp, remove bool) *ZVector {
+	v := t.vectorPool.Get().(*ZVector)
+	for i, point := range t.points {
+		m := t.ctx.Sub(v.Get(i), point, z)
+		if m.IsZero() {
+			panic("Sample point added to elements")
+		}
+		if remove {
+			m.Inv()
+		}
+	}
+	return v
 }
 
 type MemPrefixNode struct {
@@ -175,81 +545,77 @@ type MemPrefixNode struct {
 	// Number of total elements at or below this node
 	numElements int
 	// Sample values at this node
-	svalues []*Zp
+	svalues *ZVector
 }
 
-func (n *MemPrefixNode) Parent() (PrefixNode, bool) { return n.parent, n.parent != nil }
+func (n *MemPrefixNode) Parent() (PrefixNode, bool, error) {
+	if n.parent == nil {
+		return nil, false, nil
+	}
+	return n.parent, true, nil
+}
 
-func (n *MemPrefixNode) Key() *Bitstring {
+func (n *MemPrefixNode) Key() (*Bitstring, error) {
 	var keys []int
 	for cur := n; cur != nil && cur.parent != nil; cur = cur.parent {
 		keys = append([]int{cur.key}, keys...)
 	}
-	bs := NewBitstring(len(keys) * n.BitQuantum())
-	for i := len(keys) - 1; i >= 0; i-- {
-		for j := 0; j < n.BitQuantum(); j++ {
-			if ((keys[i] >> uint(j)) & 0x01) == 1 {
-				bs.Set(i*n.BitQuantum() + j)
-			} else {
-				bs.Unset(i*n.BitQuantum() + j)
-			}
-		}
+	bs := NewBitstring(0)
+	for _, key := range keys {
+		bs = bs.AppendUint(uint(key), n.BitQuantum())
 	}
-	return bs
+	return bs, nil
 }
 
-func (n *MemPrefixNode) Children() (result []PrefixNode) {
+func (n *MemPrefixNode) Children() ([]PrefixNode, error) {
+	var result []PrefixNode
 	for _, child := range n.children {
 		result = append(result, child)
 	}
-	return
+	return result, nil
 }
 
-func (n *MemPrefixNode) Elements() []*Zp {
+func (n *MemPrefixNode) Elements() ([]*Zp, error) {
+	return n.allElements(), nil
+}
+
+// allElements returns the elements at or below the node.
+func (n *MemPrefixNode) allElements() []*Zp {
 	if n.IsLeaf() {
 		return n.elements
 	}
 	var result []*Zp
 	for _, child := range n.children {
-		result = append(result, child.Elements()...)
+		result = append(result, child.allElements()...)
 	}
 	return result
 }
 
-func (n *MemPrefixNode) Size() int      { return n.numElements }
-func (n *MemPrefixNode) SValues() []*Zp { return n.svalues }
+func (n *MemPrefixNode) Size() int               { return n.numElements }
+func (n *MemPrefixNode) SValues() ([]*Zp, error) { return n.svalues.Slice(), nil }
 
 func (n *MemPrefixNode) init(t *MemPrefixTree) {
 	n.MemPrefixTree = t
-	n.svalues = make([]*Zp, t.NumSamples())
-	for i := 0; i < len(n.svalues); i++ {
-		n.svalues[i] = Zi(P_SKS, 1)
-	}
+	n.svalues = NewZVector(t.prime, t.NumSamples()).Fill(Zi(t.prime, 1))
 }
 
 func (n *MemPrefixNode) IsLeaf() bool {
 	return len(n.children) == 0
 }
 
-func (n *MemPrefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) error {
+func (n *MemPrefixNode) insert(z *Zp, marray *ZVector, bs *Bitstring, depth int) {
 	n.updateSvalues(z, marray)
 	n.numElements++
 	if n.IsLeaf() {
 		if len(n.elements) > n.SplitThreshold() {
 			n.split(depth)
 		} else {
-			for _, nz := range n.elements {
-				if nz.Cmp(z) == 0 {
-					panic("Duplicate: " + z.String())
-				}
-			}
 			n.elements = append(n.elements, z)
-			return nil
+			return
 		}
 	}
-	childIndex := NextChild(n, bs, depth)
-	child := n.Children()[childIndex].(*MemPrefixNode)
-	return child.insert(z, marray, bs, depth+1)
+	child := n.children[childIndex(bs, depth, n.BitQuantum())]
+	child.insert(z, marray, bs, depth+1)
 }
 
 func (n *MemPrefixNode) split(depth int) {
@@ -263,53 +629,171 @@ func (n *MemPrefixNode) split(depth int) {
 	}
 	// Move elements into child nodes
 	for _, element := range n.elements {
-		bs := NewBitstring(P_SKS.BitLen())
-		bs.SetBytes(ReverseBytes(element.Bytes()))
-		childIndex := NextChild(n, bs, depth)
-		child := n.children[childIndex]
-		child.insert(element, AddElementArray(n.MemPrefixTree, element), bs, depth+1)
+		bs := n.keys.Key(element)
+		child := n.children[childIndex(bs, depth, n.BitQuantum())]
+		if marray, bulk := n.vectors[element.String()]; bulk {
+			child.insert(element, marray, bs, depth+1)
+			continue
+		}
+		marray := n.elementVector(element, false)
+		child.insert(element, marray, bs, depth+1)
+		n.vectorPool.Put(marray)
 	}
 	n.elements = nil
 }
 
-func NextChild(n PrefixNode, bs *Bitstring, depth int) int {
+var ErrLeafNode error = errors.New("Cannot dereference child of leaf node")
+
+// NextChild returns the index of the child of n, at depth, whose key
+// is a prefix of bs. It returns ErrLeafNode if n has no children.
+func NextChild(n PrefixNode, bs *Bitstring, depth int) (int, error) {
 	if n.IsLeaf() {
-		panic("Cannot dereference child of leaf node")
-	}
-	childIndex := 0
-	nbq := n.BitQuantum()
-	for i := 0; i < nbq; i++ {
-		mask := 1 << uint(i)
-		if bs.Get(depth*nbq+i) == 1 {
-			childIndex |= mask
+		return 0, ErrLeafNode
+	}
+	return childIndex(bs, depth, n.BitQuantum()), nil
+}
+
+// childIndex returns the index of the child at depth whose key is a
+// prefix of bs.
+func childIndex(bs *Bitstring, depth, nbq int) int {
+	return int(bs.Uint(depth*nbq, nbq))
+}
+
+// CollisionError is returned when an element cannot be inserted into
+// a prefix tree, because the leaf which would hold it cannot. Either
+// the element is already there, or the leaf is full and cannot split,
+// since more elements than a leaf may hold have identical keys, or
+// share a key prefix as deep as the tree may grow.
+type CollisionError struct {
+	// Element is the element inserted.
+	Element *Zp
+	// Key is the key or key prefix which the elements share.
+	Key *Bitstring
+	// Depth is the depth of the node which cannot hold them.
+	Depth int
+	// Duplicate is set if the keys are identical.
+	Duplicate bool
+}
+
+func (e *CollisionError) Error() string {
+	if e.Duplicate {
+		return fmt.Sprintf("Cannot insert %v: duplicate key %v at depth %d", e.Element, e.Key, e.Depth)
+	}
+	return fmt.Sprintf("Cannot insert %v: key prefix %v shared beyond maximum depth %d",
+		e.Element, e.Key, e.Depth)
+}
+
+// NotFoundError is returned when removing an element
+// which is not in a prefix tree.
+type NotFoundError struct {
+	Element *Zp
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("Cannot remove %v: not in prefix tree", e.Element)
+}
+
+// CheckLeafRemove returns a *NotFoundError if z is not among the
+// elements of the leaf which would hold it. Backends check before
+// changing the tree, so that removing an unknown element leaves the
+// sample values and sizes along its path as they were.
+func CheckLeafRemove(elements []*Zp, z *Zp) error {
+	for _, element := range elements {
+		if element.Cmp(z) == 0 {
+			return nil
 		}
 	}
-	return childIndex
+	return &NotFoundError{Element: z}
 }
 
-func (n *MemPrefixNode) updateSvalues(z *Zp, marray []*Zp) {
-	if len(marray) != len(n.points) {
-		panic("Inconsistent NumSamples size")
+// CheckRemove returns a *NotFoundError if z is not in t, finding the
+// leaf which would hold it from the root.
+func CheckRemove(t PrefixTree, z *Zp) error {
+	leaf, err := Find(t, z)
+	if err != nil {
+		return err
+	}
+	elements, err := leaf.Elements()
+	if err != nil {
+		return err
+	}
+	return CheckLeafRemove(elements, z)
+}
+
+// CheckLeafInsert returns a *CollisionError if z, with key bs, cannot
+// be added to the leaf of t at depth holding elements. Backends check
+// before changing the tree, so that a full leaf which cannot split is
+// reported, rather than splitting without end.
+func CheckLeafInsert(t PrefixTree, elements []*Zp, z *Zp, bs *Bitstring, depth int) error {
+	for _, nz := range elements {
+		if nz.Cmp(z) == 0 {
+			return &CollisionError{Element: z, Key: bs, Depth: depth, Duplicate: true}
+		}
+	}
+	if len(elements) <= t.SplitThreshold() {
+		return nil
 	}
-	for i := 0; i < len(marray); i++ {
-		n.svalues[i] = Z(z.P).Mul(n.svalues[i], marray[i])
+	keys := TreeKeys(t)
+	bss := []*Bitstring{bs}
+	for _, element := range elements {
+		bss = append(bss, keys.Key(element))
+	}
+	return checkSplit(t, z, bss, depth)
+}
+
+// checkSplit follows the splits of a node at depth which receives
+// elements with the keys bss, down to leaves which may hold them.
+func checkSplit(t PrefixTree, z *Zp, bss []*Bitstring, depth int) error {
+	if len(bss) <= t.SplitThreshold()+1 {
+		return nil
+	}
+	identical, keyBits := true, bss[0].BitLen()
+	for _, bs := range bss[1:] {
+		identical = identical && bs.Cmp(bss[0]) == 0
+		if bs.BitLen() < keyBits {
+			keyBits = bs.BitLen()
+		}
+	}
+	if identical {
+		return &CollisionError{Element: z, Key: bss[0], Depth: depth, Duplicate: true}
+	}
+	nbq := t.BitQuantum()
+	if depth >= TreeMaxDepth(t, keyBits) {
+		return &CollisionError{Element: z, Key: bss[0].Prefix(depth * nbq), Depth: depth}
+	}
+	children := make([][]*Bitstring, 1<<uint(nbq))
+	for _, bs := range bss {
+		i := childIndex(bs, depth, nbq)
+		children[i] = append(children[i], bs)
 	}
+	for _, child := range children {
+		if err := checkSplit(t, z, child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *MemPrefixNode) updateSvalues(z *Zp, marray *ZVector) {
+	if marray.Len() != len(n.points) {
+		panic("Inconsistent NumSamples size")
+	}
+	n.svalues.Mul(n.svalues, marray)
 }
 
-func (n *MemPrefixNode) remove(z *Zp, marray []*Zp, bs *Bitstring, depth int) error {
+func (n *MemPrefixNode) remove(z *Zp, marray *ZVector, bs *Bitstring, depth int) {
 	n.updateSvalues(z, marray)
 	n.numElements--
 	if !n.IsLeaf() {
 		if n.numElements <= n.JoinThreshold() {
 			n.join()
 		} else {
-			childIndex := NextChild(n, bs, depth)
-			child := n.Children()[childIndex].(*MemPrefixNode)
-			return child.remove(z, marray, bs, depth+1)
+			child := n.children[childIndex(bs, depth, n.BitQuantum())]
+			child.remove(z, marray, bs, depth+1)
+			return
 		}
 	}
 	n.elements = withRemoved(n.elements, z)
-	return nil
 }
 
 func (n *MemPrefixNode) join() {
@@ -323,17 +807,13 @@ func (n *MemPrefixNode) join() {
 	n.children = nil
 }
 
+// withRemoved returns elements without z, which has been checked
+// to be among them.
 func withRemoved(elements []*Zp, z *Zp) (result []*Zp) {
-	var has bool
 	for _, element := range elements {
 		if element.Cmp(z) != 0 {
 			result = append(result, element)
-		} else {
-			has = true
 		}
 	}
-	if !has {
-		panic("Remove non-existent element from node")
-	}
 	return
 }
@@ -22,9 +22,9 @@
 package recon
 
 import (
+	"errors"
 	"github.com/bmizerany/assert"
 	. "github.com/cmars/conflux"
-	"strings"
 	"testing"
 )
 
@@ -36,13 +36,13 @@ func TestInsertNodesNoSplit(t *testing.T) {
 	tree.Insert(Zi(P_SKS, 500))
 	root, err := tree.Root()
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, len(root.Elements()))
+	assert.Equal(t, 3, len(mustElements(t, root)))
 	assert.T(t, root.IsLeaf())
 	tree.Remove(Zi(P_SKS, 100))
 	tree.Remove(Zi(P_SKS, 300))
 	tree.Remove(Zi(P_SKS, 500))
-	assert.Equal(t, 0, len(root.Elements()))
-	for _, sv := range root.SValues() {
+	assert.Equal(t, 0, len(mustElements(t, root)))
+	for _, sv := range mustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
 }
@@ -63,7 +63,7 @@ func TestJustOneKey(t *testing.T) {
 	}
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
-	for _, sv := range root.SValues() {
+	for _, sv := range mustSValues(t, root) {
 		assert.T(t, expect.Has(sv))
 		expect.Remove(sv)
 	}
@@ -84,7 +84,7 @@ func TestInsertNodeSplit(t *testing.T) {
 	root, err := tree.Root()
 	assert.Equal(t, err, nil)
 	// Insert/Remove reversible after splitting & joining?
-	for _, sv := range root.SValues() {
+	for _, sv := range mustSValues(t, root) {
 		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
 	}
 	assert.Equal(t, 0, len(tree.root.children))
@@ -119,9 +119,176 @@ func TestKeyMatch(t *testing.T) {
 		assert.Equal(t, err, nil)
 		node2, err := Find(tree2, zi)
 		assert.Equal(t, err, nil)
-		t.Logf("node1=%v, node2=%v (%b) full=%v", node1.Key(), node2.Key(), zi.Int64(), bs)
+		t.Logf("node1=%v, node2=%v (%b) full=%v", mustKey(t, node1), mustKey(t, node2), zi.Int64(), bs)
 		// If keys are different, one must prefix the other.
-		assert.T(t, strings.HasPrefix(node1.Key().String(), node2.Key().String()) ||
-			strings.HasPrefix(node2.Key().String(), node1.Key().String()))
+		assert.T(t, mustKey(t, node1).HasPrefix(mustKey(t, node2)) ||
+			mustKey(t, node2).HasPrefix(mustKey(t, node1)))
 	}
 }
+
+func TestNewMemPrefixTree(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.mBar", 7)
+	s.UpdateDerived()
+	tree := NewMemPrefixTree(s)
+	assert.Equal(t, 8, tree.NumSamples())
+	assert.Equal(t, 8, len(tree.Points()))
+	for i := 1; i < 200; i++ {
+		tree.Insert(Zi(P_SKS, 65537*i))
+	}
+	assert.Equal(t, nil, VerifyTree(tree))
+	// Corrupt a sample value
+	root, _ := tree.Root()
+	mustSValues(t, root)[0] = Zi(P_SKS, 2)
+	assert.NotEqual(t, nil, VerifyTree(tree))
+}
+
+func TestNodesAtDepth(t *testing.T) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 1; i < 1000; i++ {
+		tree.Insert(Zi(P_SKS, 65537*i))
+	}
+	root, _ := tree.Root()
+	nodes, err := NodesAtDepth(tree, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []PrefixNode{root}, nodes)
+	assert.Equal(t, len(mustChildren(t, root)), len(mustNodesAtDepth(t, tree, 1)))
+	// Levels are visited in order, each node in key order, the
+	// children of each level's split nodes making up the next.
+	var visited, leaves int
+	err = WalkLevels(tree, func(depth int, nodes []PrefixNode) error {
+		assert.Equal(t, nodes, mustNodesAtDepth(t, tree, depth))
+		for i, node := range nodes {
+			assert.Equal(t, depth*tree.BitQuantum(), mustKey(t, node).BitLen())
+			if i > 0 {
+				assert.T(t, mustKey(t, nodes[i-1]).Cmp(mustKey(t, node)) < 0)
+			}
+			if node.IsLeaf() {
+				leaves += node.Size()
+			}
+		}
+		visited += len(nodes)
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, traverse(root), visited)
+	assert.Equal(t, root.Size(), leaves)
+	// The walk stops at the first error
+	stop := errors.New("stop")
+	err = WalkLevels(tree, func(depth int, nodes []PrefixNode) error {
+		assert.Equal(t, 0, depth)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+}
+
+func mustNodesAtDepth(t *testing.T, tree PrefixTree, depth int) []PrefixNode {
+	nodes, err := NodesAtDepth(tree, depth)
+	assert.Equal(t, nil, err)
+	return nodes
+}
+
+// mustKey, mustElements, mustSValues and mustChildren read a node,
+// failing the test if the tree cannot.
+func mustKey(t testing.TB, node PrefixNode) *Bitstring {
+	key, err := node.Key()
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	return key
+}
+
+func mustElements(t testing.TB, node PrefixNode) []*Zp {
+	elements, err := node.Elements()
+	if err != nil {
+		t.Fatalf("elements: %v", err)
+	}
+	return elements
+}
+
+func mustSValues(t testing.TB, node PrefixNode) []*Zp {
+	svalues, err := node.SValues()
+	if err != nil {
+		t.Fatalf("sample values: %v", err)
+	}
+	return svalues
+}
+
+func mustChildren(t testing.TB, node PrefixNode) []PrefixNode {
+	children, err := node.Children()
+	if err != nil {
+		t.Fatalf("children: %v", err)
+	}
+	return children
+}
+
+func TestTreeDigest(t *testing.T) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	empty := tree.Digest()
+	for i := 1; i < 200; i++ {
+		tree.Insert(Zi(P_SKS, 65537*i))
+	}
+	tree.Remove(Zi(P_SKS, 65537*100))
+	root, _ := tree.Root()
+	computed, err := TreeDigest(&plainTree{tree})
+	assert.Equal(t, nil, err)
+	assert.T(t, computed.Equal(MultisetDigest(mustElements(t, root)...)))
+	assert.T(t, tree.Digest().Equal(computed))
+	assert.T(t, !tree.Digest().Equal(empty))
+	for i := 1; i < 200; i++ {
+		if i != 100 {
+			tree.Remove(Zi(P_SKS, 65537*i))
+		}
+	}
+	assert.T(t, tree.Digest().Equal(empty))
+}
+
+// lowByteKeys keys elements by their least significant byte,
+// so that elements congruent modulo 256 collide.
+type lowByteKeys struct{}
+
+func (k lowByteKeys) Key(z *Zp) *Bitstring {
+	bs := NewBitstring(8)
+	bs.SetBytes([]byte{byte(z.Int.Int64())})
+	return bs
+}
+
+func (k lowByteKeys) Name() string { return "lowbyte" }
+
+func TestKeyCollision(t *testing.T) {
+	tree := &MemPrefixTree{keys: lowByteKeys{}}
+	tree.Init()
+	// Distinct keys are split apart down to the depth the keys allow
+	for i := 0; i < 256; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65536+i)))
+	}
+	assert.Equal(t, nil, VerifyTree(tree))
+	digest := tree.Digest()
+	// A leaf holds elements with the same key, until it would split
+	var dups []*Zp
+	var err error
+	for {
+		z := Zi(P_SKS, 65536*(len(dups)+2)+7)
+		if err = tree.Insert(z); err != nil {
+			break
+		}
+		dups = append(dups, z)
+	}
+	assert.Equal(t, tree.SplitThreshold(), len(dups))
+	collision, is := err.(*CollisionError)
+	assert.T(t, is)
+	assert.T(t, collision.Duplicate)
+	assert.Equal(t, 4, collision.Depth)
+	assert.Equal(t, nil, VerifyTree(tree))
+	for _, z := range dups {
+		assert.Equal(t, nil, tree.Remove(z))
+	}
+	assert.T(t, tree.Digest().Equal(digest))
+	// Inserting an element twice is a collision with itself
+	err = tree.Insert(Zi(P_SKS, 65536+7))
+	collision, is = err.(*CollisionError)
+	assert.T(t, is)
+	assert.T(t, collision.Duplicate)
+}
@@ -0,0 +1,36 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+// PushOnly tests if the peer only offers its elements to partners,
+// as an authoritative source feeding replicas does, never recovering
+// the elements it learns from them.
+func (s *Settings) PushOnly() bool {
+	return s.GetBool("conflux.recon.pushOnly", false)
+}
+
+// recovers tests if the peer recovers the elements it learns from a
+// remote peer, which it does unless it only pushes elements or the
+// remote peer is a follower.
+func (p *Peer) recovers(remoteConfig *Config) bool {
+	return !p.PushOnly() && !remoteFollower(remoteConfig)
+}
@@ -0,0 +1,45 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestPushOnly(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	client.Settings.Set("conflux.recon.pushOnly", true)
+	for i := 1; i < 100; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%3 != 0 {
+			server.PrefixTree.Insert(z)
+		}
+		if i%4 != 0 {
+			client.PrefixTree.Insert(z)
+		}
+	}
+	s := reconcile(t, server, client)
+	assert.Equal(t, 99/3-99/12, s.ss.Recovered)
+	assert.Equal(t, 0, s.cs.Recovered)
+}
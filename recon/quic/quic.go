@@ -0,0 +1,161 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package quic runs the recon protocol over QUIC, which holds up better
+// than TCP on lossy long-haul links and survives NAT rebinding.
+// Partners are addressed as quic://host:port.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/cmars/conflux/recon"
+	quicgo "github.com/quic-go/quic-go"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// NextProto is the ALPN protocol identifier for recon over QUIC.
+const NextProto = "conflux-recon"
+
+const QUIC = "quic:"
+
+// ClientTLSConfig is used when dialing QUIC partners.
+var ClientTLSConfig = &tls.Config{}
+
+// closeTimeout bounds how long closing a session waits for the
+// remote peer to finish reading.
+const closeTimeout = 5 * time.Second
+
+func init() {
+	recon.RegisterTransport("quic", Dial)
+}
+
+func withNextProto(tlsConf *tls.Config) *tls.Config {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{NextProto}
+	return tlsConf
+}
+
+func quicConfig(s *recon.Settings) *quicgo.Config {
+	return &quicgo.Config{
+		MaxIdleTimeout:  time.Second * time.Duration(s.IdleTimeout()),
+		KeepAlivePeriod: time.Second * time.Duration(s.KeepAlive())}
+}
+
+// streamConn runs a recon session over a QUIC stream.
+type streamConn struct {
+	*quicgo.Stream
+	conn *quicgo.Conn
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *streamConn) Close() error {
+	err := c.Stream.Close()
+	// Let the remote peer read the rest of the session
+	// before tearing down the connection.
+	c.Stream.SetReadDeadline(time.Now().Add(closeTimeout))
+	io.Copy(ioutil.Discard, c.Stream)
+	c.conn.CloseWithError(0, "")
+	return err
+}
+
+// Dial connects to a partner addressed as quic://host:port.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := quicgo.DialAddr(ctx, strings.TrimPrefix(addr, "quic://"),
+		withNextProto(ClientTLSConfig), nil)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &streamConn{Stream: stream, conn: conn}, nil
+}
+
+// Server accepts recon sessions over QUIC.
+type Server struct {
+	peer *recon.Peer
+	ln   *quicgo.Listener
+}
+
+// Listen creates a QUIC recon server for the peer on the UDP address addr.
+func Listen(p *recon.Peer, addr string, tlsConf *tls.Config) (*Server, error) {
+	ln, err := quicgo.ListenAddr(addr, withNextProto(tlsConf), quicConfig(p.Settings))
+	if err != nil {
+		return nil, err
+	}
+	return &Server{peer: p, ln: ln}, nil
+}
+
+func (s *Server) Addr() net.Addr { return s.ln.Addr() }
+
+func (s *Server) Close() error { return s.ln.Close() }
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn *quicgo.Conn) {
+	log.Println(QUIC, "connection from:", conn.RemoteAddr())
+	ctx := context.Background()
+	if timeout := s.peer.HandshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(timeout))
+		defer cancel()
+	}
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		log.Println(QUIC, err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	sc, err := s.peer.AcquireConn(&streamConn{Stream: stream, conn: conn})
+	if err != nil {
+		log.Println(QUIC, err, "dropping:", conn.RemoteAddr())
+		conn.CloseWithError(0, err.Error())
+		return
+	}
+	if err = s.peer.Accept(sc); err != nil {
+		log.Println(QUIC, err)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package quic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startPeer(t *testing.T, elements ...int) *recon.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	p := recon.NewMemPeer()
+	p.Settings.Set("conflux.recon.reconPort", port)
+	p.Settings.Set("conflux.recon.connTimeout", 1)
+	p.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	for _, n := range elements {
+		p.PrefixTree.Insert(Zi(P_SKS, n))
+	}
+	p.Start()
+	return p
+}
+
+func TestQuicRecon(t *testing.T) {
+	server := startPeer(t, 65537, 65539)
+	defer server.Stop()
+	client := startPeer(t, 65537, 65541)
+	defer client.Stop()
+	s, err := Listen(server, "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert(t)}})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+	go s.Serve()
+	ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	conn, err := Dial("quic://"+s.Addr().String(), time.Second)
+	assert.Equal(t, nil, err)
+	clientErr := make(chan error)
+	go func() {
+		_, err := client.ReconcileWith(conn, recon.RoleClient)
+		conn.Close()
+		clientErr <- err
+	}()
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, <-clientErr)
+}
@@ -0,0 +1,110 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+)
+
+var ErrNoSettingsSource error = errors.New("Settings were not loaded from a file and cannot be reloaded")
+
+// immutableKeys are settings which determine the structure of the
+// prefix tree, and so cannot change while it is in use.
+var immutableKeys = map[string]func(*Settings) interface{}{
+	"conflux.recon.bitQuantum": func(s *Settings) interface{} { return s.BitQuantum() },
+	"conflux.recon.mBar":       func(s *Settings) interface{} { return s.MBar() },
+	"conflux.recon.threshMult": func(s *Settings) interface{} { return s.ThreshMult() },
+	"conflux.recon.prime":      func(s *Settings) interface{} { return s.PrimeName() },
+	"conflux.recon.keys":       func(s *Settings) interface{} { return s.KeysName() },
+	"conflux.recon.keySalt":    func(s *Settings) interface{} { return s.KeySalt() },
+}
+
+// Reload re-reads the settings from the file they were loaded from,
+// notifying watchers of the keys changed. Settings which determine the
+// prefix tree structure keep their current values; a change to them is
+// logged and takes effect on restart.
+func (s *Settings) Reload() error {
+	if s.source == nil {
+		return ErrNoSettingsSource
+	}
+	loaded, err := s.source()
+	if err != nil {
+		return err
+	}
+	for key, get := range immutableKeys {
+		if current, reloaded := get(s), get(loaded); reloaded != current {
+			log.Println("Reload:", key, "changed to", reloaded, "requires a restart, keeping", current)
+			loaded.Set(key, current)
+		}
+	}
+	tree := loaded.tree()
+	changed := changedKeys(s.tree(), tree)
+	s.mu.Lock()
+	s.TomlTree = tree
+	s.mu.Unlock()
+	s.notify(changed)
+	return nil
+}
+
+// Reload re-reads the peer's settings and applies those which may
+// change at runtime. Partners, intervals and timeouts are read as they
+// are used; connection limits and tracing are updated here. Listen
+// addresses and ports take effect on restart.
+func (p *Peer) Reload() error {
+	if err := p.Settings.Reload(); err != nil {
+		return err
+	}
+	SetTrace(p.Trace())
+	if p.limiter != nil {
+		p.limiter.setLimits(p.MaxConns(), p.MaxConnsPerHost())
+	}
+	log.Println(SERVE, "Settings reloaded")
+	return nil
+}
+
+// ReloadOnSignal reloads the peer's settings whenever one of the given
+// signals, such as syscall.SIGHUP, is received. Calling the returned
+// function stops reloading on signals.
+func (p *Peer) ReloadOnSignal(sigs ...os.Signal) (stop func()) {
+	sigChan := make(chan os.Signal, 1)
+	done := make(chan interface{})
+	signal.Notify(sigChan, sigs...)
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				if err := p.Reload(); err != nil {
+					log.Println(SERVE, "Reload:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
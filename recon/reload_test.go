@@ -0,0 +1,66 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.toml", `
+[conflux.recon]
+partners = ["a.example.com:11370"]
+gossipIntervalSecs = 60
+mBar = 7
+maxConns = 10
+`)
+	defer cleanup()
+	settings, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	tree := new(MemPrefixTree)
+	tree.Init()
+	p := NewPeer(settings, tree)
+	p.limiter = newConnLimiter(p.MaxConns(), p.MaxConnsPerHost())
+
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(`
+[conflux.recon]
+partners = ["a.example.com:11370", "b.example.com:11370"]
+gossipIntervalSecs = 30
+mBar = 9
+maxConns = 20
+prime = "128"
+`), 0644))
+	assert.Equal(t, nil, p.Reload())
+	assert.Equal(t, []string{"a.example.com:11370", "b.example.com:11370"}, p.Partners())
+	assert.Equal(t, 30, p.GossipIntervalSecs())
+	// Prefix tree parameters are not reloaded
+	assert.Equal(t, 7, p.MBar())
+	assert.Equal(t, 8, p.Settings.NumSamples())
+	assert.Equal(t, "sks", p.PrimeName())
+	assert.Equal(t, 20, p.limiter.maxTotal)
+}
+
+func TestReloadNoSource(t *testing.T) {
+	assert.Equal(t, ErrNoSettingsSource, DefaultSettings().Reload())
+}
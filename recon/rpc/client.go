@@ -0,0 +1,154 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rpc
+
+import (
+	"context"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"strings"
+	"time"
+)
+
+func init() {
+	recon.RegisterTransport("grpc", Dial)
+}
+
+// Client calls the recon service of a remote peer.
+type Client struct {
+	cc *grpc.ClientConn
+}
+
+// NewClient creates a client for the recon service at target,
+// a host:port address.
+func NewClient(target string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	opts = append(opts, grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	cc, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cc: cc}, nil
+}
+
+func (c *Client) Close() error {
+	return c.cc.Close()
+}
+
+// GetNode looks up a node in the remote peer's prefix tree.
+func (c *Client) GetNode(ctx context.Context, key *Bitstring) (*Node, error) {
+	node := new(Node)
+	err := c.cc.Invoke(ctx, "/"+serviceName+"/GetNode", &NodeRequest{Key: key}, node)
+	return node, err
+}
+
+// Stats summarizes the remote peer's configuration and prefix tree.
+func (c *Client) Stats(ctx context.Context) (*StatsReply, error) {
+	reply := new(StatsReply)
+	err := c.cc.Invoke(ctx, "/"+serviceName+"/Stats", &StatsRequest{}, reply)
+	return reply, err
+}
+
+// Reconcile opens a recon session with the remote peer, returning
+// a connection to run it over with the client role. Closing the
+// connection ends the stream.
+func (c *Client) Reconcile(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Reconcile")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newStreamConn(stream, rpcAddr(c.cc.Target()), func() {
+		stream.CloseSend()
+		cancel()
+	}), nil
+}
+
+// RecoveryStream receives recoveries from a remote peer's
+// Recoveries service.
+type RecoveryStream struct {
+	stream grpc.ClientStream
+}
+
+// Recv waits for the next recovery.
+func (s *RecoveryStream) Recv() (*Recovery, error) {
+	r := new(Recovery)
+	err := s.stream.RecvMsg(r)
+	return r, err
+}
+
+// Subscribe receives the elements recovered by the remote peer as
+// consumer, starting at offset, or after the consumer's last
+// acknowledged offset if offset is zero. Cancel ctx to unsubscribe.
+func (c *Client) Subscribe(ctx context.Context, consumer string, offset uint64) (*RecoveryStream, error) {
+	stream, err := c.cc.NewStream(ctx, &recoveriesServiceDesc.Streams[0], "/"+recoveriesServiceName+"/Subscribe")
+	if err != nil {
+		return nil, err
+	}
+	err = stream.SendMsg(&SubscribeRequest{Consumer: consumer, Offset: offset})
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &RecoveryStream{stream: stream}, nil
+}
+
+// Ack acknowledges that consumer has processed the remote peer's
+// recoveries up to and including offset.
+func (c *Client) Ack(ctx context.Context, consumer string, offset uint64) error {
+	return c.cc.Invoke(ctx, "/"+recoveriesServiceName+"/Ack",
+		&AckRequest{Consumer: consumer, Offset: offset}, new(AckReply))
+}
+
+// Dial connects to a partner addressed as grpc://host:port.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	var opts []grpc.DialOption
+	if timeout > 0 {
+		opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: timeout}))
+	}
+	client, err := NewClient(strings.TrimPrefix(addr, "grpc://"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Reconcile(context.Background())
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	sc := conn.(*streamConn)
+	onClose := sc.onClose
+	sc.onClose = func() {
+		onClose()
+		client.Close()
+	}
+	return sc, nil
+}
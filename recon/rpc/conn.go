@@ -0,0 +1,154 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rpc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// stream is the part of a gRPC stream needed to carry recon chunks.
+type stream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+type recvResult struct {
+	data []byte
+	err  error
+}
+
+// streamConn adapts a Reconcile stream to a net.Conn, so the recon
+// protocol can run over it unchanged. Read deadlines are supported,
+// since the recon server polls for replies with short deadlines.
+type streamConn struct {
+	stream     stream
+	remoteAddr net.Addr
+	onClose    func()
+	recv       chan recvResult
+	closed     chan struct{}
+	closeOnce  sync.Once
+	pending    []byte
+	mu         sync.Mutex
+	deadline   time.Time
+}
+
+func newStreamConn(s stream, remoteAddr net.Addr, onClose func()) *streamConn {
+	c := &streamConn{
+		stream:     s,
+		remoteAddr: remoteAddr,
+		onClose:    onClose,
+		recv:       make(chan recvResult),
+		closed:     make(chan struct{})}
+	go c.pump()
+	return c
+}
+
+func (c *streamConn) pump() {
+	for {
+		chunk := new(Chunk)
+		err := c.stream.RecvMsg(chunk)
+		select {
+		case c.recv <- recvResult{data: chunk.Data, err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(deadline.Sub(time.Now()))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case r := <-c.recv:
+			if r.err != nil {
+				return 0, r.err
+			}
+			c.pending = r.data
+		case <-timeout:
+			return 0, timeoutError{}
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	err := c.stream.SendMsg(&Chunk{Data: append([]byte(nil), b...)})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return rpcAddr("local") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// rpcAddr is the address of a gRPC peer.
+type rpcAddr string
+
+func (a rpcAddr) Network() string { return "grpc" }
+func (a rpcAddr) String() string  { return string(a) }
@@ -0,0 +1,455 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math/big"
+)
+
+// message is a protocol buffer message defined in recon.proto,
+// encoded by hand so that no generated code is required.
+type message interface {
+	marshal() []byte
+	unmarshal(buf []byte) error
+}
+
+// codec encodes messages in the protocol buffer wire format. It is
+// registered under its own name, rather than replacing the "proto"
+// codec, so that servers hosting the recon services may host others.
+type codec struct{}
+
+const codecName = "conflux"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+func (c codec) Name() string { return codecName }
+
+func (c codec) Marshal(v interface{}) ([]byte, error) {
+	m, is := v.(message)
+	if !is {
+		return nil, errors.New(fmt.Sprintf("Cannot marshal %T", v))
+	}
+	return m.marshal(), nil
+}
+
+func (c codec) Unmarshal(buf []byte, v interface{}) error {
+	m, is := v.(message)
+	if !is {
+		return errors.New(fmt.Sprintf("Cannot unmarshal %T", v))
+	}
+	return m.unmarshal(buf)
+}
+
+// field is called with each field number, wire type and value
+// consumed from a message.
+type field func(num protowire.Number, typ protowire.Type, buf []byte) (int, error)
+
+func consumeFields(buf []byte, f field) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		n, err := f(num, typ, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func consumeBytes(typ protowire.Type, buf []byte) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, ErrWireType
+	}
+	v, n := protowire.ConsumeBytes(buf)
+	if n < 0 {
+		return nil, 0, protowire.ParseError(n)
+	}
+	return append([]byte(nil), v...), n, nil
+}
+
+func consumeVarint(typ protowire.Type, buf []byte) (uint64, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, ErrWireType
+	}
+	v, n := protowire.ConsumeVarint(buf)
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	return v, n, nil
+}
+
+var ErrWireType = errors.New("Unexpected wire type")
+
+// readKey creates the bitstring of keyBits bits packed in key,
+// which must be exactly as long as needed to hold them, so that
+// a message cannot claim a key longer than it carries.
+func readKey(keyBits uint64, key []byte) (*Bitstring, error) {
+	if (keyBits+7)/8 != uint64(len(key)) {
+		return nil, errors.New(fmt.Sprintf("Key of %d bits given in %d bytes", keyBits, len(key)))
+	}
+	bs := NewBitstring(int(keyBits))
+	bs.SetBytes(key)
+	return bs, nil
+}
+
+func appendBytes(buf []byte, num protowire.Number, v []byte) []byte {
+	buf = protowire.AppendTag(buf, num, protowire.BytesType)
+	return protowire.AppendBytes(buf, v)
+}
+
+func appendVarint(buf []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = protowire.AppendTag(buf, num, protowire.VarintType)
+	return protowire.AppendVarint(buf, v)
+}
+
+// Chunk is a piece of the recon protocol byte stream.
+type Chunk struct {
+	Data []byte
+}
+
+func (m *Chunk) marshal() []byte {
+	return appendBytes(nil, 1, m.Data)
+}
+
+func (m *Chunk) unmarshal(buf []byte) error {
+	return consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		if num == 1 {
+			m.Data, n, err = consumeBytes(typ, buf)
+		}
+		return
+	})
+}
+
+// NodeRequest requests the prefix tree node with the given key.
+type NodeRequest struct {
+	Key *Bitstring
+}
+
+func (m *NodeRequest) marshal() []byte {
+	buf := appendVarint(nil, 1, uint64(m.Key.BitLen()))
+	return appendBytes(buf, 2, m.Key.Bytes())
+}
+
+func (m *NodeRequest) unmarshal(buf []byte) error {
+	var keyBits uint64
+	var key []byte
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			keyBits, n, err = consumeVarint(typ, buf)
+		case 2:
+			key, n, err = consumeBytes(typ, buf)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	m.Key, err = readKey(keyBits, key)
+	return err
+}
+
+// Node describes a prefix tree node, whose sample values and
+// elements are in the finite field Prime, or P_SKS if nil.
+type Node struct {
+	Key      *Bitstring
+	Size     int
+	SValues  []*Zp
+	Elements []*Zp
+	Leaf     bool
+	Prime    *big.Int
+}
+
+func (m *Node) marshal() []byte {
+	buf := appendVarint(nil, 1, uint64(m.Key.BitLen()))
+	buf = appendBytes(buf, 2, m.Key.Bytes())
+	buf = appendVarint(buf, 3, uint64(m.Size))
+	for _, sv := range m.SValues {
+		buf = appendBytes(buf, 4, sv.Bytes())
+	}
+	for _, element := range m.Elements {
+		buf = appendBytes(buf, 5, element.Bytes())
+	}
+	if m.Leaf {
+		buf = appendVarint(buf, 6, 1)
+	}
+	return appendPrime(buf, 7, m.Prime)
+}
+
+func (m *Node) unmarshal(buf []byte) error {
+	var keyBits, size, leaf uint64
+	var key, v, prime []byte
+	var svalues, elements [][]byte
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			keyBits, n, err = consumeVarint(typ, buf)
+		case 2:
+			key, n, err = consumeBytes(typ, buf)
+		case 3:
+			size, n, err = consumeVarint(typ, buf)
+		case 4:
+			if v, n, err = consumeBytes(typ, buf); err == nil {
+				svalues = append(svalues, v)
+			}
+		case 5:
+			if v, n, err = consumeBytes(typ, buf); err == nil {
+				elements = append(elements, v)
+			}
+		case 6:
+			leaf, n, err = consumeVarint(typ, buf)
+		case 7:
+			prime, n, err = consumeBytes(typ, buf)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if m.Key, err = readKey(keyBits, key); err != nil {
+		return err
+	}
+	m.Prime = readPrime(prime)
+	m.SValues = zpsFromBytes(m.Prime, svalues)
+	m.Elements = zpsFromBytes(m.Prime, elements)
+	m.Size = int(size)
+	m.Leaf = leaf != 0
+	return nil
+}
+
+// appendPrime adds the finite field p to a message, unless it is P_SKS,
+// which receivers assume when it is absent.
+func appendPrime(buf []byte, num protowire.Number, p *big.Int) []byte {
+	if p == nil || p.Cmp(P_SKS) == 0 {
+		return buf
+	}
+	return appendBytes(buf, num, p.Bytes())
+}
+
+func readPrime(buf []byte) *big.Int {
+	if len(buf) == 0 {
+		return P_SKS
+	}
+	return big.NewInt(0).SetBytes(buf)
+}
+
+// zpsFromBytes reads integers in the finite field p, reduced
+// modulo p should the sender have given any larger.
+func zpsFromBytes(p *big.Int, bufs [][]byte) []*Zp {
+	var result []*Zp
+	for _, buf := range bufs {
+		result = append(result, Zb(p, buf))
+	}
+	return result
+}
+
+// StatsRequest requests a summary of the peer's configuration and tree.
+type StatsRequest struct{}
+
+func (m *StatsRequest) marshal() []byte { return nil }
+
+func (m *StatsRequest) unmarshal(buf []byte) error {
+	return consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (int, error) {
+		return 0, nil
+	})
+}
+
+// StatsReply summarizes the peer's configuration and tree.
+type StatsReply struct {
+	Version    string
+	BitQuantum int
+	MBar       int
+	Size       int
+}
+
+func (m *StatsReply) marshal() []byte {
+	buf := appendBytes(nil, 1, []byte(m.Version))
+	buf = appendVarint(buf, 2, uint64(m.BitQuantum))
+	buf = appendVarint(buf, 3, uint64(m.MBar))
+	return appendVarint(buf, 4, uint64(m.Size))
+}
+
+func (m *StatsReply) unmarshal(buf []byte) error {
+	var version []byte
+	var bitQuantum, mBar, size uint64
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			version, n, err = consumeBytes(typ, buf)
+		case 2:
+			bitQuantum, n, err = consumeVarint(typ, buf)
+		case 3:
+			mBar, n, err = consumeVarint(typ, buf)
+		case 4:
+			size, n, err = consumeVarint(typ, buf)
+		}
+		return
+	})
+	m.Version = string(version)
+	m.BitQuantum, m.MBar, m.Size = int(bitQuantum), int(mBar), int(size)
+	return err
+}
+
+// SubscribeRequest subscribes a consumer to recovered elements,
+// starting at Offset, or after the consumer's last acknowledged
+// offset if Offset is zero.
+type SubscribeRequest struct {
+	Consumer string
+	Offset   uint64
+}
+
+func (m *SubscribeRequest) marshal() []byte {
+	buf := appendBytes(nil, 1, []byte(m.Consumer))
+	return appendVarint(buf, 2, m.Offset)
+}
+
+func (m *SubscribeRequest) unmarshal(buf []byte) error {
+	var consumer []byte
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			consumer, n, err = consumeBytes(typ, buf)
+		case 2:
+			m.Offset, n, err = consumeVarint(typ, buf)
+		}
+		return
+	})
+	m.Consumer = string(consumer)
+	return err
+}
+
+// Recovery is a set of elements recovered from a remote peer, and
+// those the remote peer removed, in the finite field Prime, or P_SKS
+// if nil.
+type Recovery struct {
+	Offset     uint64
+	RemoteAddr string
+	Namespace  string
+	Elements   []*Zp
+	Prime      *big.Int
+	Removed    []*Zp
+}
+
+func (m *Recovery) marshal() []byte {
+	buf := appendVarint(nil, 1, m.Offset)
+	buf = appendBytes(buf, 2, []byte(m.RemoteAddr))
+	if m.Namespace != "" {
+		buf = appendBytes(buf, 3, []byte(m.Namespace))
+	}
+	for _, element := range m.Elements {
+		buf = appendBytes(buf, 4, element.Bytes())
+	}
+	buf = appendPrime(buf, 5, m.Prime)
+	for _, element := range m.Removed {
+		buf = appendBytes(buf, 6, element.Bytes())
+	}
+	return buf
+}
+
+func (m *Recovery) unmarshal(buf []byte) error {
+	var remoteAddr, namespace, v, prime []byte
+	var elements, removed [][]byte
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			m.Offset, n, err = consumeVarint(typ, buf)
+		case 2:
+			remoteAddr, n, err = consumeBytes(typ, buf)
+		case 3:
+			namespace, n, err = consumeBytes(typ, buf)
+		case 4:
+			if v, n, err = consumeBytes(typ, buf); err == nil {
+				elements = append(elements, v)
+			}
+		case 5:
+			prime, n, err = consumeBytes(typ, buf)
+		case 6:
+			if v, n, err = consumeBytes(typ, buf); err == nil {
+				removed = append(removed, v)
+			}
+		}
+		return
+	})
+	m.RemoteAddr, m.Namespace = string(remoteAddr), string(namespace)
+	m.Prime = readPrime(prime)
+	m.Elements = zpsFromBytes(m.Prime, elements)
+	m.Removed = zpsFromBytes(m.Prime, removed)
+	return err
+}
+
+// AckRequest acknowledges that a consumer has processed all
+// recoveries up to and including Offset.
+type AckRequest struct {
+	Consumer string
+	Offset   uint64
+}
+
+func (m *AckRequest) marshal() []byte {
+	buf := appendBytes(nil, 1, []byte(m.Consumer))
+	return appendVarint(buf, 2, m.Offset)
+}
+
+func (m *AckRequest) unmarshal(buf []byte) error {
+	var consumer []byte
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (n int, err error) {
+		switch num {
+		case 1:
+			consumer, n, err = consumeBytes(typ, buf)
+		case 2:
+			m.Offset, n, err = consumeVarint(typ, buf)
+		}
+		return
+	})
+	m.Consumer = string(consumer)
+	return err
+}
+
+// AckReply confirms an acknowledgement.
+type AckReply struct{}
+
+func (m *AckReply) marshal() []byte { return nil }
+
+func (m *AckReply) unmarshal(buf []byte) error {
+	return consumeFields(buf, func(num protowire.Number, typ protowire.Type, buf []byte) (int, error) {
+		return 0, nil
+	})
+}
@@ -0,0 +1,251 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/cmars/conflux/recon"
+	"google.golang.org/grpc"
+	"log"
+	"sync"
+)
+
+const recoveriesServiceName = "conflux.recon.Recoveries"
+
+// DefaultRecoveryCapacity is the number of unacknowledged recoveries
+// a RecoveryLog retains before discarding the oldest.
+const DefaultRecoveryCapacity = 10000
+
+var ErrRecoveryLogClosed error = errors.New("Recovery log closed")
+
+// RecoveryLog consumes a peer's recovered elements, and those removed
+// by remote peers when catching up, numbering each recovery with an
+// offset so that subscribers can resume after the last one they
+// acknowledged. Recoveries are retained until every
+// known consumer has acknowledged them, or Capacity is exceeded.
+type RecoveryLog struct {
+	Capacity int
+	mu       sync.Mutex
+	entries  []*Recovery
+	next     uint64
+	acked    map[string]uint64
+	changed  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRecoveryLog creates a log of the recoveries sent on rc, which
+// it then consumes in place of the application.
+func NewRecoveryLog(rc recon.RecoverChan) *RecoveryLog {
+	l := &RecoveryLog{
+		Capacity: DefaultRecoveryCapacity,
+		next:     1,
+		acked:    make(map[string]uint64),
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{})}
+	go l.consume(rc)
+	return l
+}
+
+func (l *RecoveryLog) consume(rc recon.RecoverChan) {
+	for {
+		select {
+		case r, ok := <-rc:
+			if !ok {
+				l.Close()
+				return
+			}
+			l.append(r)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close stops consuming recoveries and ends all subscriptions.
+func (l *RecoveryLog) Close() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+func (l *RecoveryLog) append(r *recon.Recover) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := &Recovery{
+		Offset:    l.next,
+		Namespace: r.Namespace,
+		Elements:  r.RemoteElements,
+		Removed:   r.RemoteRemoved}
+	if len(r.RemoteElements) > 0 {
+		entry.Prime = r.RemoteElements[0].P
+	} else if len(r.RemoteRemoved) > 0 {
+		entry.Prime = r.RemoteRemoved[0].P
+	}
+	if r.RemoteAddr != nil {
+		entry.RemoteAddr = r.RemoteAddr.String()
+	}
+	l.next++
+	l.entries = append(l.entries, entry)
+	if over := len(l.entries) - l.Capacity; l.Capacity > 0 && over > 0 {
+		log.Println("Recovery log full, discarding", over, "unacknowledged recoveries")
+		l.entries = l.entries[over:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Ack records that consumer has processed all recoveries up to and
+// including offset, and discards those every consumer has processed.
+func (l *RecoveryLog) Ack(consumer string, offset uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset >= l.next {
+		offset = l.next - 1
+	}
+	if offset > l.acked[consumer] {
+		l.acked[consumer] = offset
+	}
+	l.trim()
+}
+
+// Acked returns the last offset acknowledged by consumer.
+func (l *RecoveryLog) Acked(consumer string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.acked[consumer]
+}
+
+func (l *RecoveryLog) trim() {
+	if len(l.acked) == 0 {
+		return
+	}
+	min := l.next
+	for _, offset := range l.acked {
+		if offset < min {
+			min = offset
+		}
+	}
+	n := 0
+	for n < len(l.entries) && l.entries[n].Offset <= min {
+		n++
+	}
+	l.entries = l.entries[n:]
+}
+
+// since returns the retained recoveries starting at offset, and a
+// channel closed when more are appended.
+func (l *RecoveryLog) since(offset uint64) ([]*Recovery, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var result []*Recovery
+	for _, entry := range l.entries {
+		if entry.Offset >= offset {
+			result = append(result, entry)
+		}
+	}
+	return result, l.changed
+}
+
+// start returns the offset a subscription begins at, registering
+// the consumer so that recoveries are retained for it.
+func (l *RecoveryLog) start(consumer string, offset uint64) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	acked, known := l.acked[consumer]
+	if !known {
+		l.acked[consumer] = 0
+	}
+	if offset == 0 {
+		offset = acked + 1
+	}
+	return offset
+}
+
+// Subscribe sends recoveries to stream as they are recovered, until
+// the subscriber goes away or the log is closed.
+func (l *RecoveryLog) Subscribe(req *SubscribeRequest, stream grpc.ServerStream) error {
+	offset := l.start(req.Consumer, req.Offset)
+	for {
+		entries, changed := l.since(offset)
+		for _, entry := range entries {
+			if err := stream.SendMsg(entry); err != nil {
+				return err
+			}
+			offset = entry.Offset + 1
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-l.stop:
+			return ErrRecoveryLogClosed
+		}
+	}
+}
+
+type recoveriesService interface {
+	Subscribe(req *SubscribeRequest, stream grpc.ServerStream) error
+	Ack(ctx context.Context, req *AckRequest) (*AckReply, error)
+}
+
+// recoveriesServer adapts a RecoveryLog to the Recoveries service.
+type recoveriesServer struct {
+	*RecoveryLog
+}
+
+func (s recoveriesServer) Ack(ctx context.Context, req *AckRequest) (*AckReply, error) {
+	s.RecoveryLog.Ack(req.Consumer, req.Offset)
+	return &AckReply{}, nil
+}
+
+// RegisterRecoveries adds the Recoveries service for l to a gRPC server.
+func RegisterRecoveries(s *grpc.Server, l *RecoveryLog) {
+	s.RegisterService(&recoveriesServiceDesc, recoveriesServer{l})
+}
+
+var recoveriesServiceDesc = grpc.ServiceDesc{
+	ServiceName: recoveriesServiceName,
+	HandlerType: (*recoveriesService)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Ack",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(AckRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(recoveriesService).Ack(ctx, req.(*AckRequest))
+			}
+			return intercept(ctx, req, srv, "/"+recoveriesServiceName+"/Ack", handler, interceptor)
+		}}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Subscribe",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(SubscribeRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(recoveriesService).Subscribe(req, stream)
+		},
+		ServerStreams: true}},
+	Metadata: "recon.proto",
+}
@@ -0,0 +1,222 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rpc
+
+import (
+	"context"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"google.golang.org/grpc"
+	"math/big"
+	"net"
+	"testing"
+)
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func startPeer(t *testing.T, elements ...int) *recon.Peer {
+	p := recon.NewMemPeer()
+	p.Settings.Set("conflux.recon.reconPort", freePort(t))
+	p.Settings.Set("conflux.recon.connTimeout", 1)
+	p.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	for _, n := range elements {
+		p.PrefixTree.Insert(Zi(P_SKS, n))
+	}
+	p.Start()
+	return p
+}
+
+func serve(t *testing.T, p *recon.Peer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	s := NewServer(p)
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+	return ln.Addr().String()
+}
+
+func TestReconcile(t *testing.T) {
+	server := startPeer(t, 65537, 65539)
+	defer server.Stop()
+	client := startPeer(t, 65537, 65541)
+	defer client.Stop()
+	conn, err := Dial("grpc://"+serve(t, server), 0)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	clientErr := make(chan error)
+	go func() {
+		_, err := client.ReconcileWith(conn, recon.RoleClient)
+		clientErr <- err
+	}()
+	serverRecover := <-server.RecoverChan
+	assert.Equal(t, 0, serverRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65541)))
+	clientRecover := <-client.RecoverChan
+	assert.Equal(t, 0, clientRecover.RemoteElements[0].Cmp(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, <-clientErr)
+}
+
+func TestGetNodeStats(t *testing.T) {
+	server := startPeer(t, 65537, 65539)
+	defer server.Stop()
+	client, err := NewClient(serve(t, server))
+	assert.Equal(t, nil, err)
+	defer client.Close()
+	node, err := client.GetNode(context.Background(), NewBitstring(0))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, node.Size)
+	assert.T(t, node.Leaf)
+	assert.Equal(t, 2, len(node.Elements))
+	assert.Equal(t, server.Settings.NumSamples(), len(node.SValues))
+	root, _ := server.Root()
+	svalues, err := root.SValues()
+	assert.Equal(t, nil, err)
+	for i, sv := range svalues {
+		assert.Equal(t, 0, sv.Cmp(node.SValues[i]))
+	}
+	stats, err := client.Stats(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, stats.Size)
+	assert.Equal(t, server.MBar(), stats.MBar)
+	assert.Equal(t, server.Version(), stats.Version)
+}
+
+func TestRecoveries(t *testing.T) {
+	rc := make(recon.RecoverChan)
+	rlog := NewRecoveryLog(rc)
+	defer rlog.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	s := grpc.NewServer()
+	RegisterRecoveries(s, rlog)
+	go s.Serve(ln)
+	defer s.Stop()
+	client, err := NewClient(ln.Addr().String())
+	assert.Equal(t, nil, err)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Subscribe(ctx, "indexer", 0)
+	assert.Equal(t, nil, err)
+	for i := 1; i <= 3; i++ {
+		rc <- &recon.Recover{RemoteElements: []*Zp{Zi(P_SKS, 65536+i)}, Namespace: "keys"}
+	}
+	for i := 1; i <= 3; i++ {
+		r, err := stream.Recv()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint64(i), r.Offset)
+		assert.Equal(t, "keys", r.Namespace)
+		assert.Equal(t, 0, r.Elements[0].Cmp(Zi(P_SKS, 65536+i)))
+	}
+	cancel()
+	assert.Equal(t, nil, client.Ack(context.Background(), "indexer", 2))
+	assert.Equal(t, uint64(2), rlog.Acked("indexer"))
+	// Resubscribing resumes after the last acknowledged offset
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = client.Subscribe(ctx, "indexer", 0)
+	assert.Equal(t, nil, err)
+	r, err := stream.Recv()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(3), r.Offset)
+}
+
+func TestRecoveryLogTrim(t *testing.T) {
+	rc := make(recon.RecoverChan)
+	rlog := NewRecoveryLog(rc)
+	defer rlog.Close()
+	rlog.Capacity = 3
+	rlog.start("a", 0)
+	rlog.start("b", 0)
+	for i := 0; i < 6; i++ {
+		rlog.append(&recon.Recover{RemoteElements: []*Zp{Zi(P_SKS, i)}})
+	}
+	entries, _ := rlog.since(0)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, uint64(4), entries[0].Offset)
+	rlog.Ack("a", 5)
+	entries, _ = rlog.since(0)
+	assert.Equal(t, 3, len(entries))
+	rlog.Ack("b", 5)
+	entries, _ = rlog.since(0)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, uint64(6), entries[0].Offset)
+}
+
+func TestRecoveryRemoved(t *testing.T) {
+	rc := make(recon.RecoverChan)
+	rlog := NewRecoveryLog(rc)
+	defer rlog.Close()
+	rlog.append(&recon.Recover{RemoteRemoved: []*Zp{Zi(P_128, 65537)}})
+	entries, _ := rlog.since(0)
+	assert.Equal(t, 1, len(entries))
+	decoded := new(Recovery)
+	assert.Equal(t, nil, decoded.unmarshal(entries[0].marshal()))
+	assert.Equal(t, 0, len(decoded.Elements))
+	assert.Equal(t, 1, len(decoded.Removed))
+	assert.Equal(t, 0, decoded.Removed[0].Cmp(Zi(P_128, 65537)))
+	assert.Equal(t, 0, decoded.Prime.Cmp(P_128))
+}
+
+func TestInterceptor(t *testing.T) {
+	p := recon.NewMemPeer()
+	p.StartCmds()
+	defer p.StopCmds()
+	var method string
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method = info.FullMethod
+		return handler(ctx, req)
+	}
+	dec := func(v interface{}) error { return v.(message).unmarshal(nil) }
+	reply, err := serviceDesc.Methods[1].Handler(&Server{peer: p}, context.Background(), dec, interceptor)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/"+serviceName+"/Stats", method)
+	assert.Equal(t, p.Version(), reply.(*StatsReply).Version)
+}
+
+func TestNodeMessage(t *testing.T) {
+	key := NewBitstring(4)
+	key.Set(0)
+	node := &Node{
+		Key:      key,
+		Size:     1,
+		Elements: []*Zp{Zi(P_128, 65537)},
+		Leaf:     true,
+		Prime:    P_128}
+	decoded := new(Node)
+	assert.Equal(t, nil, decoded.unmarshal(node.marshal()))
+	assert.Equal(t, 0, decoded.Key.Cmp(key))
+	assert.Equal(t, 0, decoded.Prime.Cmp(P_128))
+	assert.Equal(t, 0, decoded.Elements[0].Cmp(Zi(P_128, 65537)))
+	// Elements beyond the field are reduced into it
+	buf := appendBytes(appendPrime(nil, 7, P_128), 5, big.NewInt(0).Add(P_128, big.NewInt(1)).Bytes())
+	decoded = new(Node)
+	assert.Equal(t, nil, decoded.unmarshal(append(appendBytes(appendVarint(nil, 1, 0), 2, nil), buf...)))
+	assert.Equal(t, 0, decoded.Elements[0].Cmp(Zi(P_128, 1)))
+	// Keys must be given in the bytes they claim
+	req := new(NodeRequest)
+	assert.NotEqual(t, nil, req.unmarshal(appendVarint(nil, 1, 1<<40)))
+}
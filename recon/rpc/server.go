@@ -0,0 +1,165 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package rpc provides a gRPC service for conflux peers, defined in
+// recon.proto, as an alternative to the SKS recon transport.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cmars/conflux/recon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+const serviceName = "conflux.recon.Recon"
+
+// Server implements the recon gRPC service for a peer.
+type Server struct {
+	peer *recon.Peer
+}
+
+// NewServer creates a gRPC server providing the recon service for p.
+func NewServer(p *recon.Peer, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	Register(s, p)
+	return s
+}
+
+// Register adds the recon service for p to a gRPC server. Clients
+// of the service select its codec by name, so that the server may
+// host services using other codecs too.
+func Register(s *grpc.Server, p *recon.Peer) {
+	s.RegisterService(&serviceDesc, &Server{peer: p})
+}
+
+// Reconcile runs a recon session with the calling peer.
+func (s *Server) Reconcile(stream grpc.ServerStream) error {
+	addr := rpcAddr("unknown")
+	if pr, ok := peer.FromContext(stream.Context()); ok {
+		addr = rpcAddr(pr.Addr.String())
+	}
+	return s.peer.Accept(newStreamConn(stream, addr, nil))
+}
+
+// GetNode looks up a prefix tree node.
+func (s *Server) GetNode(ctx context.Context, req *NodeRequest) (node *Node, err error) {
+	if keyBits := recon.TreeKeyBits(s.peer.PrefixTree); req.Key.BitLen() > keyBits {
+		return nil, errors.New(fmt.Sprintf("Key of %d bits exceeds the %d bits of element keys",
+			req.Key.BitLen(), keyBits))
+	}
+	err = s.peer.ExecCmd(func() error {
+		pnode, err := s.peer.Node(req.Key)
+		if err != nil {
+			return err
+		}
+		key, err := pnode.Key()
+		if err != nil {
+			return err
+		}
+		svalues, err := pnode.SValues()
+		if err != nil {
+			return err
+		}
+		node = &Node{
+			Key:     key,
+			Size:    pnode.Size(),
+			SValues: svalues,
+			Leaf:    pnode.IsLeaf(),
+			Prime:   recon.TreePrime(s.peer.PrefixTree)}
+		if node.Leaf {
+			node.Elements, err = pnode.Elements()
+		}
+		return err
+	})
+	return
+}
+
+// Stats summarizes the peer's configuration and prefix tree.
+func (s *Server) Stats(ctx context.Context, req *StatsRequest) (reply *StatsReply, err error) {
+	err = s.peer.ExecCmd(func() error {
+		root, err := s.peer.Root()
+		if err != nil {
+			return err
+		}
+		reply = &StatsReply{
+			Version:    s.peer.Version(),
+			BitQuantum: s.peer.Settings.BitQuantum(),
+			MBar:       s.peer.MBar(),
+			Size:       root.Size()}
+		return nil
+	})
+	return
+}
+
+type reconService interface {
+	Reconcile(stream grpc.ServerStream) error
+	GetNode(ctx context.Context, req *NodeRequest) (*Node, error)
+	Stats(ctx context.Context, req *StatsRequest) (*StatsReply, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*reconService)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "GetNode",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(NodeRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(reconService).GetNode(ctx, req.(*NodeRequest))
+			}
+			return intercept(ctx, req, srv, "/"+serviceName+"/GetNode", handler, interceptor)
+		}}, {
+		MethodName: "Stats",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(StatsRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(reconService).Stats(ctx, req.(*StatsRequest))
+			}
+			return intercept(ctx, req, srv, "/"+serviceName+"/Stats", handler, interceptor)
+		}}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Reconcile",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(reconService).Reconcile(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true}},
+	Metadata: "recon.proto",
+}
+
+// intercept calls the handler of a unary method through the server's
+// interceptor, if it has one.
+func intercept(ctx context.Context, req, srv interface{}, method string,
+	handler grpc.UnaryHandler, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+	return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: method}, handler)
+}
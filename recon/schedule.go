@@ -0,0 +1,159 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReconWindow is a time of day, on some days of the week, during which
+// gossip with a partner is allowed. Windows are given as
+//
+//	[days ]HH:MM-HH:MM
+//
+// where days is a comma-separated list of weekdays or ranges of them,
+// such as "Mon-Fri" or "Sat,Sun", and all days if omitted. A window
+// ending before it starts runs past midnight into the next day. Times
+// are in the peer's local time zone.
+type ReconWindow struct {
+	// Days of the week on which the window starts
+	Days [7]bool
+	// Start and end of the window in minutes after midnight
+	Start, End int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	if day, has := weekdays[strings.ToLower(s)]; has {
+		return day, nil
+	}
+	return 0, errors.New(fmt.Sprintf("invalid weekday %q", s))
+}
+
+func parseMinutes(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || h > 24 || m < 0 || m > 59 ||
+		(h == 24 && m != 0) {
+		return 0, errors.New(fmt.Sprintf("invalid time of day %q", s))
+	}
+	return h*60 + m, nil
+}
+
+// ParseReconWindow reads a window in the form described by ReconWindow.
+func ParseReconWindow(s string) (*ReconWindow, error) {
+	w := &ReconWindow{}
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		for _, days := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(days, "-", 2)
+			first, err := parseWeekday(bounds[0])
+			if err != nil {
+				return nil, err
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = parseWeekday(bounds[1]); err != nil {
+					return nil, err
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				w.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid recon window %q", s))
+	}
+	times := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(times) != 2 {
+		return nil, errors.New(fmt.Sprintf("invalid recon window %q: expect start-end", s))
+	}
+	var err error
+	if w.Start, err = parseMinutes(times[0]); err != nil {
+		return nil, err
+	}
+	if w.End, err = parseMinutes(times[1]); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Contains tests if the window is open at t.
+func (w *ReconWindow) Contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[day] && minutes >= w.Start && minutes < w.End
+	}
+	// The window runs past midnight
+	return (w.Days[day] && minutes >= w.Start) ||
+		(w.Days[(day+6)%7] && minutes < w.End)
+}
+
+// ReconWindows parses the partner's windows, skipping any which are invalid.
+func (pc *PartnerConfig) ReconWindows() (windows []*ReconWindow) {
+	for _, s := range pc.Windows {
+		if w, err := ParseReconWindow(s); err == nil {
+			windows = append(windows, w)
+		}
+	}
+	return
+}
+
+// Scheduled tests if gossip with the partner is allowed at t, which is
+// always if it has no windows.
+func (pc *PartnerConfig) Scheduled(t time.Time) bool {
+	if len(pc.Windows) == 0 {
+		return true
+	}
+	for _, w := range pc.ReconWindows() {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledPartners returns those of partners with which gossip
+// is allowed at t.
+func (p *Peer) scheduledPartners(partners []string, t time.Time) (result []string) {
+	for _, partner := range partners {
+		if pc := p.PartnerConfig(partner); pc == nil || pc.Scheduled(t) {
+			result = append(result, partner)
+		}
+	}
+	return
+}
@@ -0,0 +1,87 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconWindow(t *testing.T) {
+	// 2014-06-02 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2014, 6, 2+day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		window string
+		at     time.Time
+		open   bool
+	}{
+		{"09:00-17:00", at(0, 9, 0), true},
+		{"09:00-17:00", at(0, 17, 0), false},
+		{"09:00-17:00", at(6, 12, 30), true},
+		{"Mon-Fri 22:00-06:00", at(0, 23, 0), true},
+		{"Mon-Fri 22:00-06:00", at(1, 5, 59), true},
+		{"Mon-Fri 22:00-06:00", at(0, 5, 59), false},
+		{"Mon-Fri 22:00-06:00", at(5, 23, 0), false},
+		{"Mon-Fri 22:00-06:00", at(5, 1, 0), true},
+		{"Sat,Sun 00:00-24:00", at(6, 23, 59), true},
+		{"Sat,Sun 00:00-24:00", at(0, 0, 0), false},
+		{"Fri-Mon 12:00-13:00", at(0, 12, 0), true},
+		{"Fri-Mon 12:00-13:00", at(2, 12, 0), false},
+	} {
+		w, err := ParseReconWindow(tc.window)
+		assert.Equal(t, nil, err)
+		assert.Equalf(t, tc.open, w.Contains(tc.at), "%s at %v", tc.window, tc.at)
+	}
+	for _, s := range []string{"", "9-17", "Mon 09:00", "Someday 09:00-17:00", "09:00-25:00", "a b c"} {
+		_, err := ParseReconWindow(s)
+		assert.Tf(t, err != nil, "%q", s)
+	}
+}
+
+func TestScheduledPartners(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.toml", `
+[conflux.recon]
+partners = ["local.example.com:11370"]
+
+[conflux.recon.partner.overseas]
+addr = "overseas.example.com:11370"
+windows = "Mon-Fri 22:00-06:00; Sat,Sun 00:00-24:00"
+`)
+	defer cleanup()
+	s, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.Validate())
+	p := NewPeer(s, nil)
+	monday := time.Date(2014, 6, 2, 12, 0, 0, 0, time.Local)
+	partners := s.Partners()
+	assert.Equal(t, []string{"local.example.com:11370"}, p.scheduledPartners(partners, monday))
+	assert.Equal(t, partners, p.scheduledPartners(partners, monday.Add(11*time.Hour)))
+
+	s.Set("conflux.recon.partner.overseas.windows", "Mon 22:00")
+	err = s.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "conflux.recon.partner.overseas.windows:"))
+}
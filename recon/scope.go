@@ -0,0 +1,122 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+)
+
+// ReconPrefix is the subrange of element keys the peer is responsible
+// for, such as a shard of the key space, given as a string of 0s and
+// 1s or as a Bitstring formats it. Sessions with a prefix only
+// reconcile the elements whose keys have it. It is nil if not given
+// or invalid, for the whole tree.
+func (s *Settings) ReconPrefix() *Bitstring {
+	prefix, err := parsePrefix(s.GetString("conflux.recon.prefix", ""))
+	if err != nil {
+		return nil
+	}
+	return prefix
+}
+
+func parsePrefix(s string) (*Bitstring, error) {
+	if s == "" {
+		return nil, nil
+	}
+	prefix := NewBitstring(0)
+	if err := prefix.UnmarshalText([]byte(s)); err != nil {
+		return nil, err
+	}
+	if prefix.BitLen() == 0 {
+		return nil, nil
+	}
+	return prefix, nil
+}
+
+// remotePrefix returns the subrange of element keys announced
+// by a remote peer, which is nil for the whole tree.
+func remotePrefix(config *Config) (*Bitstring, error) {
+	return parsePrefix(config.Custom["prefix"])
+}
+
+var ErrDisjointPrefix error = errors.New("Remote peer reconciles a disjoint key prefix")
+
+// sessionScope returns the subrange of element keys reconciled with a
+// remote peer, the narrower of the prefixes announced by each, or nil
+// for the whole tree. Peers announcing disjoint prefixes have nothing
+// to reconcile.
+func (p *Peer) sessionScope(remoteConfig *Config) (*Bitstring, error) {
+	remote, err := remotePrefix(remoteConfig)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid remote prefix: %v", err))
+	}
+	local := p.ReconPrefix()
+	switch {
+	case local == nil:
+		return remote, nil
+	case remote == nil || local.HasPrefix(remote):
+		return local, nil
+	case remote.HasPrefix(local):
+		return remote, nil
+	}
+	return nil, ErrDisjointPrefix
+}
+
+// inScope tests if a subtree may hold elements with keys in scope.
+func inScope(key, scope *Bitstring) bool {
+	return scope == nil || key.HasPrefix(scope) || scope.HasPrefix(key)
+}
+
+// scopeRoot returns the deepest node whose key is a prefix of scope.
+// The tree is walked down from the root, since it may not reach the
+// depth of scope, and persistent trees store no node there.
+func (p *Peer) scopeRoot(scope *Bitstring) (PrefixNode, error) {
+	node, err := p.Root()
+	if err != nil {
+		return nil, err
+	}
+	nbq := p.PrefixTree.BitQuantum()
+	for bits := nbq; bits <= scope.BitLen() && !node.IsLeaf(); bits += nbq {
+		if node, err = p.Node(scope.Prefix(bits)); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// scopeElements returns the elements with keys in scope. Subtrees
+// containing scope hold others, which are not reconciled.
+func (p *Peer) scopeElements(scope *Bitstring, elements []*Zp) []*Zp {
+	if scope == nil {
+		return elements
+	}
+	keys := TreeKeys(p.PrefixTree)
+	var result []*Zp
+	for _, z := range elements {
+		if keys.Key(z).HasPrefix(scope) {
+			result = append(result, z)
+		}
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestSessionScope(t *testing.T) {
+	for _, tc := range []struct {
+		local, remote, scope string
+		err                  error
+	}{
+		{"", "", "", nil},
+		{"01", "", "01", nil},
+		{"", "01", "01", nil},
+		{"01", "011", "011", nil},
+		{"0110", "01", "0110", nil},
+		{"01", "00", "", ErrDisjointPrefix},
+	} {
+		local, remote := NewMemPeer(), NewMemPeer()
+		local.Settings.Set("conflux.recon.prefix", tc.local)
+		remote.Settings.Set("conflux.recon.prefix", tc.remote)
+		scope, err := local.sessionScope(remote.Config())
+		assert.Equal(t, tc.err, err)
+		if tc.scope == "" {
+			assert.Tf(t, scope == nil, "%v", tc)
+		} else {
+			assert.Equalf(t, tc.scope, scope.BinaryString(), "%v", tc)
+		}
+	}
+}
+
+func TestReconcilePrefix(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.prefix", "1")
+	keys := TreeKeys(server.PrefixTree)
+	var inside, outside int
+	for i := 1; i < 400; i++ {
+		z := Zi(P_SKS, 65537*i)
+		// Each peer holds elements the other lacks.
+		if i%3 == 0 {
+			server.PrefixTree.Insert(z)
+		} else {
+			client.PrefixTree.Insert(z)
+		}
+		if keys.Key(z).Get(0) == 1 {
+			inside++
+		} else {
+			outside++
+		}
+	}
+	assert.T(t, inside > 0)
+	assert.T(t, outside > 0)
+	s := reconcile(t, server, client)
+	assert.Equal(t, PtreeStrategy.Name(), s.ss.Strategy)
+	assert.T(t, s.ss.Recovered > 0)
+	assert.T(t, s.cs.Recovered > 0)
+	assert.Equal(t, inside, s.ss.Recovered+s.cs.Recovered)
+	for _, z := range append(s.ss.Elements, s.cs.Elements...) {
+		assert.Equal(t, 1, keys.Key(z).Get(0))
+	}
+}
+
+func TestReconcilePrefixClient(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	client.Settings.Set("conflux.recon.prefix", "0")
+	keys := TreeKeys(server.PrefixTree)
+	var inside int
+	for i := 1; i < 400; i++ {
+		z := Zi(P_SKS, 65537*i)
+		server.PrefixTree.Insert(z)
+		if keys.Key(z).Get(0) == 0 {
+			inside++
+		}
+	}
+	s := reconcile(t, server, client)
+	assert.Equal(t, 0, s.ss.Recovered)
+	assert.Equal(t, inside, s.cs.Recovered)
+}
+
+func TestDisjointPrefix(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.prefix", "10")
+	client.Settings.Set("conflux.recon.prefix", "11")
+	s := runSession(t, server, client, nil)
+	assert.Equal(t, IncompatiblePeerError, s.clientErr)
+}
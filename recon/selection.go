@@ -0,0 +1,118 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PartnerSelector chooses the partner with which to gossip next
+// from the configured partners, of which there is at least one.
+type PartnerSelector func(p *Peer, partners []string) string
+
+var selectorsMu sync.Mutex
+var selectors = map[string]PartnerSelector{
+	"random":     selectRandom,
+	"roundrobin": selectRoundRobin,
+	"lru":        selectLeastRecent,
+	"priority":   selectPriority,
+}
+
+// RegisterPartnerSelector makes a partner selector available to be
+// named in the conflux.recon.partnerSelection setting.
+func RegisterPartnerSelector(name string, sel PartnerSelector) {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	selectors[name] = sel
+}
+
+func lookupPartnerSelector(name string) (PartnerSelector, bool) {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	sel, has := selectors[name]
+	return sel, has
+}
+
+// PartnerSelection names the way gossip partners are chosen:
+// "random" as SKS does, "roundrobin" in turn, "lru" the partner
+// least recently reconciled with, or "priority" at random weighted
+// by the priority of each partner.
+func (s *Settings) PartnerSelection() string {
+	return s.GetString("conflux.recon.partnerSelection", "random")
+}
+
+// selectRandom chooses uniformly at random.
+func selectRandom(p *Peer, partners []string) string {
+	return partners[rand.Intn(len(partners))]
+}
+
+// selectRoundRobin chooses each partner in turn.
+func selectRoundRobin(p *Peer, partners []string) string {
+	partner := partners[p.partnerTurn%len(partners)]
+	p.partnerTurn++
+	return partner
+}
+
+// selectLeastRecent chooses the partner which has gone longest without
+// a recon session initiated by the peer, preferring those never tried.
+func selectLeastRecent(p *Peer, partners []string) string {
+	var oldest string
+	var oldestTime time.Time
+	for i, partner := range partners {
+		last := p.history.lastRecon(partner)
+		if i == 0 || last.Before(oldestTime) {
+			oldest, oldestTime = partner, last
+		}
+	}
+	return oldest
+}
+
+// selectPriority chooses at random, in proportion to the priority
+// configured for each partner, which is 1 if not given. Partners with
+// a negative priority are never chosen unless all are.
+func selectPriority(p *Peer, partners []string) string {
+	weights := make([]int, len(partners))
+	total := 0
+	for i, partner := range partners {
+		weights[i] = 1
+		if pc := p.PartnerConfig(partner); pc != nil && pc.Priority != 0 {
+			weights[i] = pc.Priority
+		}
+		if weights[i] < 0 {
+			weights[i] = 0
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return selectRandom(p, partners)
+	}
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return partners[i]
+		}
+		n -= w
+	}
+	return partners[len(partners)-1]
+}
@@ -0,0 +1,79 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+var testPartners = []string{"a.example.com:11370", "b.example.com:11370", "c.example.com:11370"}
+
+func TestSelectRoundRobin(t *testing.T) {
+	p := newTestPeer("conflux.recon.partners", testPartners, "conflux.recon.partnerSelection", "roundrobin")
+	for i := 0; i < 2*len(testPartners); i++ {
+		partner, err := p.choosePartner()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, testPartners[i%len(testPartners)], partner)
+	}
+}
+
+func TestSelectLeastRecent(t *testing.T) {
+	p := newTestPeer("conflux.recon.partners", testPartners, "conflux.recon.partnerSelection", "lru")
+	p.history.recordPartner(testPartners[0], 0, nil)
+	p.history.recordPartner(testPartners[2], 0, errors.New("unreachable"))
+	partner, err := p.choosePartner()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testPartners[1], partner)
+	p.history.recordPartner(testPartners[1], 0, nil)
+	partner, err = p.choosePartner()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testPartners[0], partner)
+}
+
+func TestSelectPriority(t *testing.T) {
+	p := newTestPeer("conflux.recon.partners", testPartners, "conflux.recon.partnerSelection", "priority")
+	p.Settings.SetPartnerConfig(&PartnerConfig{Name: "a", Addr: testPartners[0], Priority: 3})
+	p.Settings.SetPartnerConfig(&PartnerConfig{Name: "c", Addr: testPartners[2], Priority: -1})
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		partner, err := p.choosePartner()
+		assert.Equal(t, nil, err)
+		counts[partner]++
+	}
+	assert.Equal(t, 0, counts[testPartners[2]])
+	assert.Tf(t, counts[testPartners[0]] > 2*counts[testPartners[1]], "%v", counts)
+}
+
+func TestRegisterPartnerSelector(t *testing.T) {
+	RegisterPartnerSelector("last", func(p *Peer, partners []string) string {
+		return partners[len(partners)-1]
+	})
+	p := newTestPeer("conflux.recon.partners", testPartners, "conflux.recon.partnerSelection", "last")
+	assert.Equal(t, nil, p.Settings.Validate())
+	partner, err := p.choosePartner()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testPartners[2], partner)
+	p.Settings.Set("conflux.recon.partnerSelection", "nonesuch")
+	assert.NotEqual(t, nil, p.Settings.Validate())
+}
@@ -0,0 +1,292 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"expvar"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats describes a completed recon session.
+type SessionStats struct {
+	Stats
+	Role     Role          `json:"role"`
+	Strategy string        `json:"strategy"`
+	Partner  string        `json:"partner"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// Recon messages exchanged
+	MsgsSent     int `json:"msgsSent"`
+	MsgsReceived int `json:"msgsReceived"`
+	// Bytes exchanged on the connection
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+	// Number of subtrees compared, by polynomial or full element requests
+	Subtrees int `json:"subtrees"`
+	// Outcomes of the interpolations requested by polynomial comparisons
+	PolySucceeded int `json:"polySucceeded"`
+	PolyFailed    int `json:"polyFailed"`
+	// Number of elements sent to the remote peer. Elements which the
+	// remote peer recovers by interpolation are not sent.
+	ElementsSent int `json:"elementsSent"`
+	// Whether the session ended at the handshake because both
+	// peers announced the same tree summary
+	InSync bool `json:"inSync"`
+	// Outcome of the sketch exchanged at the start of the session,
+	// if the peers exchanged one
+	SketchDecoded bool `json:"sketchDecoded"`
+	SketchFailed  bool `json:"sketchFailed"`
+}
+
+// SessionHook is called with the stats of each completed recon session,
+// and the error which ended it, if any.
+type SessionHook func(stats *SessionStats, err error)
+
+// sessionConn measures the messages and bytes exchanged in a session.
+type sessionConn struct {
+	net.Conn
+	stats *SessionStats
+	p     *big.Int
+	// Held while counting a message, which the client's reader counts
+	// as received while replies are counted as sent
+	countMu sync.Mutex
+	polys   int
+	// Whether a sketch awaits its reply, and whether it was sent,
+	// the reply being the next message in the other direction
+	sketching, sketchSent bool
+	// Largest payload transferred in the session, if any
+	payloadLimit int
+	// Recovery held until payloads are transferred
+	recover *Recover
+	// Held while writing a message, which keepalives must not split
+	mu sync.Mutex
+	// Time of the last write, in Unix nanoseconds
+	lastWrite int64
+}
+
+func (c *sessionConn) Lock()   { c.mu.Lock() }
+func (c *sessionConn) Unlock() { c.mu.Unlock() }
+
+func (c *sessionConn) Prime() *big.Int { return c.p }
+
+func (c *sessionConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.stats.BytesReceived += int64(n)
+	return
+}
+
+func (c *sessionConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.stats.BytesSent += int64(n)
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	return
+}
+
+// keepAlive sends a KeepAlive message whenever the session has written
+// nothing for interval, until stop is closed, so that a remote peer
+// waiting on this one, such as while it interpolates, does not time out.
+func (c *sessionConn) keepAlive(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastWrite))) < interval {
+			continue
+		}
+		c.mu.Lock()
+		err := WriteMsg(c.Conn, &KeepAlive{})
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	}
+}
+
+func (c *sessionConn) MsgSent(msg ReconMsg) {
+	c.countMu.Lock()
+	defer c.countMu.Unlock()
+	c.stats.MsgsSent++
+	switch m := msg.(type) {
+	case *Elements:
+		c.stats.ElementsSent += m.Len()
+		c.stats.Offered = append(c.stats.Offered, m.Items()...)
+	case *MerkleLevel:
+		c.stats.Offered = append(c.stats.Offered, m.Elements.Items()...)
+	}
+	c.count(msg, true)
+}
+
+func (c *sessionConn) MsgReceived(msg ReconMsg) {
+	c.countMu.Lock()
+	defer c.countMu.Unlock()
+	c.stats.MsgsReceived++
+	c.count(msg, false)
+}
+
+// count tallies the subtree comparisons made by the session. Each
+// polynomial request is answered with elements if interpolation
+// succeeded, or with a SyncFail or the full elements if it failed.
+// A sketch is answered with the elements decoded from it, or with a
+// SyncFail if it could not be decoded, which is the next message going
+// the other way. Each Merkle digest compared is a subtree.
+func (c *sessionConn) count(msg ReconMsg, sent bool) {
+	if c.sketching && sent != c.sketchSent {
+		c.sketching = false
+		switch msg.(type) {
+		case *SyncFail:
+			c.stats.SketchFailed = true
+			return
+		case *Elements:
+			c.stats.SketchDecoded = true
+			return
+		}
+	}
+	switch m := msg.(type) {
+	case *ReconSketch:
+		c.sketching, c.sketchSent = true, sent
+	case *MerkleLevel:
+		c.stats.Subtrees += len(m.Nodes)
+	case *ReconRqstPoly:
+		c.stats.Subtrees++
+		c.polys++
+	case *ReconRqstFull:
+		c.stats.Subtrees++
+	case *SyncFail, *FullElements:
+		c.stats.PolyFailed++
+	}
+	c.stats.PolySucceeded = c.polys - c.stats.PolyFailed
+	if c.stats.PolySucceeded < 0 {
+		c.stats.PolySucceeded = 0
+	}
+}
+
+// sessionMetrics are the recon session totals published with expvar,
+// under the name "conflux.recon".
+var sessionMetrics *expvar.Map = expvar.NewMap("conflux.recon")
+
+// trafficMetrics are the bytes exchanged with each remote host,
+// published with expvar under the name "conflux.recon.traffic".
+var trafficMetrics *expvar.Map = expvar.NewMap("conflux.recon.traffic")
+var trafficMetricsMu sync.Mutex
+
+func publishSession(stats *SessionStats, err error) {
+	sessionMetrics.Add("sessions", 1)
+	if err != nil {
+		sessionMetrics.Add("sessionsFailed", 1)
+	}
+	sessionMetrics.Add("msgsSent", int64(stats.MsgsSent))
+	sessionMetrics.Add("msgsReceived", int64(stats.MsgsReceived))
+	sessionMetrics.Add("bytesSent", stats.BytesSent)
+	sessionMetrics.Add("bytesReceived", stats.BytesReceived)
+	sessionMetrics.Add("subtrees", int64(stats.Subtrees))
+	sessionMetrics.Add("polySucceeded", int64(stats.PolySucceeded))
+	sessionMetrics.Add("polyFailed", int64(stats.PolyFailed))
+	sessionMetrics.Add("elementsRecovered", int64(stats.Recovered))
+	sessionMetrics.Add("elementsSent", int64(stats.ElementsSent))
+	host := trafficHost(stats.Partner)
+	trafficMetricsMu.Lock()
+	hostMetrics, is := trafficMetrics.Get(host).(*expvar.Map)
+	if !is {
+		hostMetrics = new(expvar.Map).Init()
+		trafficMetrics.Set(host, hostMetrics)
+	}
+	trafficMetricsMu.Unlock()
+	hostMetrics.Add("bytesSent", stats.BytesSent)
+	hostMetrics.Add("bytesReceived", stats.BytesReceived)
+}
+
+// RecentSessions is the number of completed sessions
+// kept for the admin server.
+const RecentSessions = 50
+
+// recentSessions keeps the most recently completed sessions.
+// The zero value is ready to use.
+type recentSessions struct {
+	mu     sync.Mutex
+	recent []*SessionResult
+}
+
+// SessionResult is a completed session and the error which ended it.
+type SessionResult struct {
+	*SessionStats
+	Error string `json:"error,omitempty"`
+}
+
+// add records a completed session. The elements recovered and offered,
+// which are not shown, are not kept.
+func (r *recentSessions) add(stats *SessionStats, err error) {
+	kept := *stats
+	kept.Elements, kept.Offered = nil, nil
+	result := &SessionResult{SessionStats: &kept}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recent = append(r.recent, result)
+	if len(r.recent) > RecentSessions {
+		r.recent = r.recent[len(r.recent)-RecentSessions:]
+	}
+}
+
+// RecentSessions returns the last sessions completed by the peer,
+// most recent first.
+func (p *Peer) RecentSessions() (results []*SessionResult) {
+	p.recent.mu.Lock()
+	defer p.recent.mu.Unlock()
+	for i := len(p.recent.recent) - 1; i >= 0; i-- {
+		results = append(results, p.recent.recent[i])
+	}
+	return
+}
+
+// sessionDone reports a completed session to the stats page, journal,
+// metrics and session hooks.
+func (p *Peer) sessionDone(stats *SessionStats, err error) {
+	p.history.recordSession(stats.Recovered, err)
+	p.history.recordTraffic(trafficHost(stats.Partner), stats.BytesSent, stats.BytesReceived)
+	p.recent.add(stats, err)
+	publishSession(stats, err)
+	if p.Journal != nil {
+		p.record(stats, err)
+	}
+	for _, hook := range p.SessionHooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println(stats.Role, "session hook panic:", r)
+				}
+			}()
+			hook(stats, err)
+		}()
+	}
+}
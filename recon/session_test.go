@@ -0,0 +1,115 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSessionStats(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	client.PrefixTree.Insert(Zi(P_SKS, 65541))
+	client.PrefixTree.Insert(Zi(P_SKS, 65543))
+	hooked := make(chan *SessionStats, 1)
+	server.SessionHooks = append(server.SessionHooks, func(stats *SessionStats, err error) {
+		hooked <- stats
+	})
+	s := reconcile(t, server, client)
+	assert.Equal(t, 2, s.ss.Recovered)
+	assert.Equal(t, 1, s.cs.Recovered)
+	assert.Equal(t, 2, s.cs.ElementsSent)
+	assert.Equal(t, s.ss.MsgsSent, s.cs.MsgsReceived)
+	assert.Equal(t, s.ss.MsgsReceived, s.cs.MsgsSent)
+	assert.Equal(t, s.ss.BytesSent, s.cs.BytesReceived)
+	assert.Equal(t, s.ss.BytesReceived, s.cs.BytesSent)
+	assert.T(t, s.ss.Subtrees > 0)
+	assert.Equal(t, s.ss.Subtrees, s.cs.Subtrees)
+	assert.Equal(t, s.ss.PolySucceeded, s.cs.PolySucceeded)
+	assert.Equal(t, s.ss.PolyFailed, s.cs.PolyFailed)
+	assert.T(t, s.ss.Duration > 0)
+	assert.Equal(t, s.ss.Recovered, (<-hooked).Recovered)
+
+	recent := server.RecentSessions()
+	assert.Equal(t, 1, len(recent))
+	// Recent sessions do not hold on to the elements exchanged
+	assert.Equal(t, 2, len(s.ss.Elements))
+	assert.Equal(t, 0, len(recent[0].Elements))
+	assert.Equal(t, 0, len(recent[0].Offered))
+	data, err := json.Marshal(recent[0])
+	assert.Equal(t, nil, err)
+	var decoded map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "server", decoded["role"])
+	assert.Equal(t, float64(2), decoded["recovered"])
+}
+
+// Test that a client counts the messages its reader receives while it
+// sends replies, as the ptree client does. Run with -race.
+func TestSessionCountClient(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	n := 100
+	go func() {
+		msgs := []ReconMsg{&ReconSketch{Capacity: 2}}
+		for i := 0; i < n; i++ {
+			msgs = append(msgs, &Flush{})
+		}
+		WriteMsg(c2, msgs...)
+	}()
+	sc := &sessionConn{Conn: c1, stats: &SessionStats{}}
+	sketched, read := make(chan bool), make(chan bool)
+	go func() {
+		defer close(read)
+		for i := 0; i <= n; i++ {
+			_, err := ReadMsg(sc)
+			assert.Equal(t, nil, err)
+			if i == 0 {
+				close(sketched)
+			}
+		}
+	}()
+	<-sketched
+	// The reply to the sketch is the next message sent, whatever
+	// the reader has received meanwhile
+	assert.Equal(t, nil, WriteMsg(sc, &Elements{ZSet: NewZSet()}))
+	for i := 0; i < n; i++ {
+		assert.Equal(t, nil, WriteMsg(sc, &Flush{}))
+	}
+	<-read
+	assert.Equal(t, n+1, sc.stats.MsgsSent)
+	assert.Equal(t, n+1, sc.stats.MsgsReceived)
+	assert.T(t, sc.stats.SketchDecoded)
+	assert.T(t, !sc.stats.SketchFailed)
+}
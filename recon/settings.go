@@ -23,23 +23,68 @@ package recon
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+const DefaultReconPort = 11370
+
 type Settings struct {
 	*toml.TomlTree
 	splitThreshold int
 	joinThreshold  int
 	numSamples     int
+	// mu guards replacement of the tree on reload
+	mu sync.RWMutex
+	// source reloads the settings from where they were read
+	source      func() (*Settings, error)
+	sourcePaths []string
+	watch       settingsWatchers
+}
+
+func (s *Settings) tree() *toml.TomlTree {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.TomlTree
+}
+
+func (s *Settings) Get(key string) interface{} {
+	return s.tree().Get(key)
+}
+
+func (s *Settings) GetDefault(key string, defaultValue interface{}) interface{} {
+	return s.tree().GetDefault(key, defaultValue)
 }
 
+func (s *Settings) Set(key string, value interface{}) {
+	tree := s.tree()
+	if !s.hasWatchers() {
+		tree.Set(key, value)
+		return
+	}
+	before := fmt.Sprintf("%v", tree.Get(key))
+	tree.Set(key, value)
+	if after := fmt.Sprintf("%v", tree.Get(key)); after != before {
+		s.notify([]string{key})
+	}
+}
+
+// GetString returns a string setting. Numbers and booleans, as TOML
+// parses values which look like them, are given as strings.
 func (s *Settings) GetString(key string, defaultValue string) string {
-	if s, is := s.GetDefault(key, defaultValue).(string); is {
-		return s
+	switch v := s.GetDefault(key, defaultValue).(type) {
+	case string:
+		return v
+	case int, int64, float64, bool:
+		return fmt.Sprintf("%v", v)
 	}
 	return defaultValue
 }
@@ -55,6 +100,25 @@ func (s *Settings) GetStrings(key string) (value []string) {
 	return
 }
 
+// GetBool returns a boolean setting, which may also be given as a
+// string accepted by strconv.ParseBool, such as "1" or "false", or as
+// a number, which is true unless zero.
+func (s *Settings) GetBool(key string, defaultValue bool) bool {
+	switch v := s.GetDefault(key, defaultValue).(type) {
+	case bool:
+		return v
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	case int:
+		return v != 0
+	case int64:
+		return v != 0
+	}
+	return defaultValue
+}
+
 func (s *Settings) GetInt(key string, defaultValue int) int {
 	switch v := s.GetDefault(key, defaultValue).(type) {
 	case int:
@@ -85,11 +149,16 @@ func (s *Settings) HttpPort() int {
 }
 
 func (s *Settings) ReconPort() int {
-	return s.GetInt("conflux.recon.reconPort", 11370)
+	return s.GetInt("conflux.recon.reconPort", DefaultReconPort)
 }
 
-func (s *Settings) Partners() []string {
-	return s.GetStrings("conflux.recon.partners")
+// Partners returns the addresses of partners listed in
+// conflux.recon.partners and configured in partner blocks.
+func (s *Settings) Partners() (partners []string) {
+	for _, pc := range s.PartnerConfigs() {
+		partners = append(partners, pc.Addr)
+	}
+	return
 }
 
 func (s *Settings) Filters() []string {
@@ -108,6 +177,13 @@ func (s *Settings) MBar() int {
 	return s.GetInt("conflux.recon.mBar", DefaultMBar)
 }
 
+// MaxDepth is the depth at which the leaves of the prefix tree no
+// longer split. Zero, the default, limits the depth only by the length
+// of element keys, of which each level consumes bitQuantum bits.
+func (s *Settings) MaxDepth() int {
+	return s.GetInt("conflux.recon.maxDepth", 0)
+}
+
 func (s *Settings) SplitThreshold() int {
 	return s.splitThreshold
 }
@@ -136,6 +212,24 @@ func (s *Settings) ReadTimeout() int {
 	return s.GetInt("conflux.recon.readTimeout", 0)
 }
 
+func (s *Settings) WriteTimeout() int {
+	return s.GetInt("conflux.recon.writeTimeout", 60)
+}
+
+// IdleTimeout is the number of seconds a recon session may wait on
+// its peer before the connection is dropped.
+func (s *Settings) IdleTimeout() int {
+	return s.GetInt("conflux.recon.idleTimeout", 300)
+}
+
+// KeepAlive is the period in seconds of TCP keepalives on recon
+// connections, and of the keepalive messages sent to peers which
+// support them while a session has nothing else to send, so that a
+// peer kept waiting by a busy one is not dropped by its idle timeout.
+func (s *Settings) KeepAlive() int {
+	return s.GetInt("conflux.recon.keepAlive", 30)
+}
+
 func DefaultSettings() (settings *Settings) {
 	buf := bytes.NewBuffer(nil)
 	var tree *toml.TomlTree
@@ -147,7 +241,11 @@ func DefaultSettings() (settings *Settings) {
 }
 
 func NewSettings(tree *toml.TomlTree) (settings *Settings) {
-	settings = &Settings{tree, DefaultSplitThreshold, DefaultJoinThreshold, DefaultNumSamples}
+	settings = &Settings{
+		TomlTree:       tree,
+		splitThreshold: DefaultSplitThreshold,
+		joinThreshold:  DefaultJoinThreshold,
+		numSamples:     DefaultNumSamples}
 	settings.UpdateDerived()
 	return
 }
@@ -167,21 +265,73 @@ func (s *Settings) UpdateDerived() {
 	s.numSamples = s.MBar() + 1
 }
 
-func LoadSettings(path string) (*Settings, error) {
-	var tree *toml.TomlTree
-	var err error
-	if tree, err = toml.LoadFile(path); err != nil {
+// LoadSettings reads settings from a TOML file, or a YAML file
+// if the path ends in .yaml or .yml. Settings in the file are
+// overridden by CONFLUX_ environment variables.
+func LoadSettings(path string) (settings *Settings, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		settings, err = LoadYamlSettings(path)
+	default:
+		var tree *toml.TomlTree
+		if tree, err = toml.LoadFile(path); err == nil {
+			settings = NewSettings(tree)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings.ApplyProcessEnv()
+	settings.source = func() (*Settings, error) { return LoadSettings(path) }
+	settings.sourcePaths = []string{path}
+	return settings, nil
+}
+
+// LoadYamlSettings reads settings from a YAML file, with the same
+// structure and keys as the TOML settings file.
+func LoadYamlSettings(path string) (*Settings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[interface{}]interface{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
 		return nil, err
 	}
-	return NewSettings(tree), nil
+	settings := DefaultSettings()
+	if err = settings.setYaml("", doc); err != nil {
+		return nil, err
+	}
+	settings.UpdateDerived()
+	return settings, nil
+}
+
+func (s *Settings) setYaml(prefix string, doc map[interface{}]interface{}) error {
+	for k, v := range doc {
+		key, is := k.(string)
+		if !is {
+			return errors.New(fmt.Sprintf("Invalid settings key: %v", k))
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if subdoc, is := v.(map[interface{}]interface{}); is {
+			if err := s.setYaml(key, subdoc); err != nil {
+				return err
+			}
+		} else {
+			s.Set(key, v)
+		}
+	}
+	return nil
 }
 
 func (s *Settings) PartnerAddrs() (addrs []net.Addr, err error) {
 	for _, partner := range s.Partners() {
-		if partner == "" {
+		if partner == "" || PartnerScheme(partner) != "tcp" {
 			continue
 		}
-		addr, err := net.ResolveTCPAddr("tcp", partner)
+		addr, err := net.ResolveTCPAddr("tcp", s.PartnerAddr(partner))
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,91 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSettings(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	path := filepath.Join(dir, name)
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadTomlSettings(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.toml", `
+[conflux.recon]
+reconPort = 21370
+mBar = 7
+partners = ["a.example.com:11370", "b.example.com:11370"]
+`)
+	defer cleanup()
+	s, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 21370, s.ReconPort())
+	assert.Equal(t, 7, s.MBar())
+	assert.Equal(t, 8, s.NumSamples())
+	assert.Equal(t, []string{"a.example.com:11370", "b.example.com:11370"}, s.Partners())
+}
+
+func TestLoadYamlSettings(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.yaml", `
+conflux:
+  recon:
+    reconPort: 21370
+    mBar: 7
+    partners:
+      - a.example.com:11370
+      - b.example.com:11370
+    leveldb:
+      path: /tmp/ptree
+`)
+	defer cleanup()
+	s, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 21370, s.ReconPort())
+	assert.Equal(t, 7, s.MBar())
+	assert.Equal(t, 8, s.NumSamples())
+	assert.Equal(t, DefaultBitQuantum, s.BitQuantum())
+	assert.Equal(t, []string{"a.example.com:11370", "b.example.com:11370"}, s.Partners())
+	assert.Equal(t, "/tmp/ptree", s.GetString("conflux.recon.leveldb.path", ""))
+}
+
+func TestOptions(t *testing.T) {
+	s := (&Options{
+		ReconPort: 21370,
+		MBar:      7,
+		Partners:  []string{"a.example.com:11370"},
+		Extra:     map[string]interface{}{"conflux.recon.leveldb.path": "/tmp/ptree"}}).Settings()
+	assert.Equal(t, 21370, s.ReconPort())
+	assert.Equal(t, 11371, s.HttpPort())
+	assert.Equal(t, 7, s.MBar())
+	assert.Equal(t, 8, s.NumSamples())
+	assert.Equal(t, []string{"a.example.com:11370"}, s.Partners())
+	assert.Equal(t, "/tmp/ptree", s.GetString("conflux.recon.leveldb.path", ""))
+}
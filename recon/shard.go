@@ -0,0 +1,281 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+)
+
+// ShardedPrefixTree partitions the elements of a prefix tree by the
+// top-level prefix of their keys across shards, which may be kept in
+// separate stores, presenting them to the recon engine as one tree.
+// Shard i holds the elements of the root's child i, so there is a
+// shard for each child. The root is never a leaf.
+type ShardedPrefixTree struct {
+	shards []PrefixTree
+}
+
+// NewShardedPrefixTree creates a prefix tree from shards with the same
+// structure, one for each child of the root. The shards should be
+// empty or have been populated by a ShardedPrefixTree.
+func NewShardedPrefixTree(shards ...PrefixTree) (*ShardedPrefixTree, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("No shards given")
+	}
+	first := shards[0]
+	if n := 1 << uint(first.BitQuantum()); len(shards) != n {
+		return nil, errors.New(fmt.Sprintf(
+			"Expected %d shards for bitquantum %d, got %d", n, first.BitQuantum(), len(shards)))
+	}
+	for i, shard := range shards[1:] {
+		if shard.BitQuantum() != first.BitQuantum() ||
+			shard.SplitThreshold() != first.SplitThreshold() ||
+			shard.NumSamples() != first.NumSamples() ||
+			TreeKeys(shard).Name() != TreeKeys(first).Name() {
+			return nil, errors.New(fmt.Sprintf("Shard %d has a different structure than shard 0", i+1))
+		}
+		for j, z := range shard.Points() {
+			if z.Cmp(first.Points()[j]) != 0 {
+				return nil, errors.New(fmt.Sprintf("Shard %d has different sample points than shard 0", i+1))
+			}
+		}
+	}
+	return &ShardedPrefixTree{shards: shards}, nil
+}
+
+// Init does nothing, the shards being initialized when created.
+func (t *ShardedPrefixTree) Init() {}
+
+func (t *ShardedPrefixTree) SplitThreshold() int { return t.shards[0].SplitThreshold() }
+func (t *ShardedPrefixTree) JoinThreshold() int  { return t.shards[0].JoinThreshold() }
+func (t *ShardedPrefixTree) BitQuantum() int     { return t.shards[0].BitQuantum() }
+func (t *ShardedPrefixTree) NumSamples() int     { return t.shards[0].NumSamples() }
+func (t *ShardedPrefixTree) Points() []*Zp       { return t.shards[0].Points() }
+func (t *ShardedPrefixTree) Keys() KeyStrategy   { return TreeKeys(t.shards[0]) }
+
+// Shards returns the trees holding each top-level prefix.
+func (t *ShardedPrefixTree) Shards() []PrefixTree {
+	return t.shards
+}
+
+func (t *ShardedPrefixTree) Root() (PrefixNode, error) {
+	return &shardRoot{t}, nil
+}
+
+func (t *ShardedPrefixTree) Node(key *Bitstring) (PrefixNode, error) {
+	bq := t.BitQuantum()
+	if key.BitLen() < bq {
+		return t.Root()
+	}
+	i := int(key.Uint(0, bq))
+	node, err := t.shards[i].Node(key)
+	if err != nil {
+		return nil, err
+	}
+	nodeKey, err := node.Key()
+	if err != nil {
+		return nil, err
+	}
+	if nodeKey.BitLen() < bq {
+		return t.child(i)
+	}
+	return node, nil
+}
+
+// child returns the root's child i, the node of shard i
+// holding all of its elements.
+func (t *ShardedPrefixTree) child(i int) (PrefixNode, error) {
+	shard := t.shards[i]
+	key := NewBitstring(0).AppendUint(uint(i), t.BitQuantum())
+	node, err := shard.Root()
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsLeaf() {
+		if node, err = shard.Node(key); err != nil {
+			return nil, err
+		}
+	}
+	return &shardNode{PrefixNode: node, key: key, parent: &shardRoot{t}}, nil
+}
+
+// NodesAtDepth returns the nodes at a depth of the sharded tree, in key
+// order. Below the root's children, these are the nodes of each shard
+// at the same depth, the other children of a shard's root never being
+// split.
+func (t *ShardedPrefixTree) NodesAtDepth(depth int) ([]PrefixNode, error) {
+	if depth == 0 {
+		root, err := t.Root()
+		return []PrefixNode{root}, err
+	}
+	var result []PrefixNode
+	for i, shard := range t.shards {
+		var nodes []PrefixNode
+		var err error
+		if depth == 1 {
+			var child PrefixNode
+			child, err = t.child(i)
+			nodes = []PrefixNode{child}
+		} else {
+			nodes, err = NodesAtDepth(shard, depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nodes...)
+	}
+	if err := sortNodes(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// shard returns the shard holding z.
+func (t *ShardedPrefixTree) shard(z *Zp) PrefixTree {
+	return t.shards[t.Keys().Key(z).Uint(0, t.BitQuantum())]
+}
+
+func (t *ShardedPrefixTree) Insert(z *Zp) error {
+	return t.shard(z).Insert(z)
+}
+
+func (t *ShardedPrefixTree) Remove(z *Zp) error {
+	return t.shard(z).Remove(z)
+}
+
+// InsertAll divides elements among the shards, inserting each part in
+// bulk.
+func (t *ShardedPrefixTree) InsertAll(elements []*Zp) error {
+	parts := make(map[PrefixTree][]*Zp)
+	for _, z := range elements {
+		shard := t.shard(z)
+		parts[shard] = append(parts[shard], z)
+	}
+	for _, shard := range t.shards {
+		if err := InsertAll(shard, parts[shard]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardRoot is the root of a sharded tree, whose children are the shards.
+type shardRoot struct {
+	*ShardedPrefixTree
+}
+
+func (n *shardRoot) Parent() (PrefixNode, bool, error) { return nil, false, nil }
+func (n *shardRoot) Key() (*Bitstring, error)          { return NewBitstring(0), nil }
+func (n *shardRoot) IsLeaf() bool                      { return false }
+
+func (n *shardRoot) roots() ([]PrefixNode, error) {
+	var roots []PrefixNode
+	for i, shard := range n.shards {
+		root, err := shard.Root()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Root of shard %d failed: %v", i, err))
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+func (n *shardRoot) Children() ([]PrefixNode, error) {
+	var result []PrefixNode
+	for i := range n.shards {
+		child, err := n.child(i)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, child)
+	}
+	return result, nil
+}
+
+func (n *shardRoot) Elements() ([]*Zp, error) {
+	roots, err := n.roots()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Zp
+	for _, root := range roots {
+		elements, err := root.Elements()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, elements...)
+	}
+	return result, nil
+}
+
+// Size returns the number of elements in the shards. Size cannot fail,
+// so a shard whose root cannot be read panics.
+func (n *shardRoot) Size() (size int) {
+	roots, err := n.roots()
+	if err != nil {
+		panic(err)
+	}
+	for _, root := range roots {
+		size += root.Size()
+	}
+	return
+}
+
+// SValues returns the product of the sample values of the shards,
+// which are the products of the samples of their elements.
+func (n *shardRoot) SValues() ([]*Zp, error) {
+	roots, err := n.roots()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Zp
+	for _, root := range roots {
+		svalues, err := root.SValues()
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = make([]*Zp, len(svalues))
+			for i, z := range svalues {
+				result[i] = z.Copy()
+			}
+			continue
+		}
+		for i, z := range svalues {
+			result[i].Mul(result[i], z)
+		}
+	}
+	return result, nil
+}
+
+// shardNode is a child of the root of a sharded tree, presenting
+// the node of a shard holding all of its elements.
+type shardNode struct {
+	PrefixNode
+	key    *Bitstring
+	parent PrefixNode
+}
+
+func (n *shardNode) Parent() (PrefixNode, bool, error) { return n.parent, true, nil }
+func (n *shardNode) Key() (*Bitstring, error)          { return n.key, nil }
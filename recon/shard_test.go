@@ -0,0 +1,146 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func newShardedTree(t *testing.T) *ShardedPrefixTree {
+	var shards []PrefixTree
+	for i := 0; i < 1<<DefaultBitQuantum; i++ {
+		shards = append(shards, NewMemPrefixTree(DefaultSettings()))
+	}
+	tree, err := NewShardedPrefixTree(shards...)
+	assert.Equal(t, nil, err)
+	return tree
+}
+
+func assertSameNode(t *testing.T, expect, node PrefixNode) {
+	assert.Equal(t, mustKey(t, expect).String(), mustKey(t, node).String())
+	assert.Equal(t, expect.Size(), node.Size())
+	assert.T(t, NewZSet(mustElements(t, expect)...).Equal(NewZSet(mustElements(t, node)...)))
+	for i, z := range mustSValues(t, expect) {
+		assert.Equal(t, 0, z.Cmp(mustSValues(t, node)[i]))
+	}
+}
+
+func TestShardedTree(t *testing.T) {
+	sharded := newShardedTree(t)
+	whole := NewMemPrefixTree(DefaultSettings())
+	for i := 1; i < 1000; i++ {
+		z := Zi(P_SKS, 65537*i)
+		assert.Equal(t, nil, sharded.Insert(z))
+		assert.Equal(t, nil, whole.Insert(z))
+	}
+	for i := 1; i < 1000; i += 7 {
+		z := Zi(P_SKS, 65537*i)
+		assert.Equal(t, nil, sharded.Remove(z))
+		assert.Equal(t, nil, whole.Remove(z))
+	}
+	root, err := sharded.Root()
+	assert.Equal(t, nil, err)
+	wholeRoot, err := whole.Root()
+	assert.Equal(t, nil, err)
+	assertSameNode(t, wholeRoot, root)
+	for i, child := range mustChildren(t, root) {
+		assertSameNode(t, mustChildren(t, wholeRoot)[i], child)
+		parent, has, err := child.Parent()
+		assert.Equal(t, nil, err)
+		assert.T(t, has)
+		assert.Equal(t, 0, mustKey(t, parent).BitLen())
+	}
+	// Nodes found by element key hold the same elements
+	// where the trees have the same shape.
+	for i := 1; i < 1000; i += 13 {
+		z := Zi(P_SKS, 65537*i)
+		node, err := Find(sharded, z)
+		assert.Equal(t, nil, err)
+		expect, err := whole.Node(mustKey(t, node))
+		assert.Equal(t, nil, err)
+		if mustKey(t, expect).Cmp(mustKey(t, node)) == 0 {
+			assertSameNode(t, expect, node)
+		}
+	}
+	// Each shard holds a top-level prefix
+	for i, shard := range sharded.Shards() {
+		shardRoot, err := shard.Root()
+		assert.Equal(t, nil, err)
+		for _, z := range mustElements(t, shardRoot) {
+			assert.Equal(t, uint(i), SksKeys.Key(z).Uint(0, DefaultBitQuantum))
+		}
+	}
+}
+
+func TestShardedNodesAtDepth(t *testing.T) {
+	sharded := newShardedTree(t)
+	whole := NewMemPrefixTree(DefaultSettings())
+	for i := 1; i < 1000; i++ {
+		z := Zi(P_SKS, 65537*i)
+		assert.Equal(t, nil, sharded.Insert(z))
+		assert.Equal(t, nil, whole.Insert(z))
+	}
+	depths := 0
+	err := WalkLevels(whole, func(depth int, expect []PrefixNode) error {
+		nodes, err := sharded.NodesAtDepth(depth)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(expect), len(nodes))
+		for i := range expect {
+			assertSameNode(t, expect[i], nodes[i])
+		}
+		depths++
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.T(t, depths > 2)
+	nodes, err := sharded.NodesAtDepth(depths)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(nodes))
+}
+
+func TestShardedTreeShards(t *testing.T) {
+	_, err := NewShardedPrefixTree(NewMemPrefixTree(DefaultSettings()))
+	assert.NotEqual(t, nil, err)
+	s := DefaultSettings()
+	s.Set("conflux.recon.keys", "bigendian")
+	_, err = NewShardedPrefixTree(NewMemPrefixTree(DefaultSettings()), NewMemPrefixTree(DefaultSettings()),
+		NewMemPrefixTree(DefaultSettings()), NewMemPrefixTree(s))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestReconcileSharded(t *testing.T) {
+	server, client := NewMemPeer(), NewPeer(DefaultSettings(), newShardedTree(t))
+	for i := 1; i < 200; i++ {
+		z := Zi(P_SKS, 65537*i)
+		if i%5 != 0 {
+			server.PrefixTree.Insert(z)
+		}
+		if i%7 != 0 {
+			client.PrefixTree.Insert(z)
+		}
+	}
+	s := reconcile(t, server, client)
+	assert.Equal(t, 199/5-199/35, s.ss.Recovered)
+	assert.Equal(t, 199/7-199/35, s.cs.Recovered)
+}
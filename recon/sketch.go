@@ -0,0 +1,213 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"log"
+	"net"
+	"strconv"
+)
+
+// SketchCapacity is the number of differences which may be decoded
+// from a sketch of the prefix tree exchanged at the start of a recon
+// session. If both peers enable sketches, the server sends a sketch
+// of the smaller capacity, and sessions with no more differences end
+// in one round trip. Otherwise the peers fall back to reconciling
+// the prefix trees. Zero disables sketches.
+func (s *Settings) SketchCapacity() int {
+	return s.GetInt("conflux.recon.sketchCapacity", 0)
+}
+
+// MaxSketchCapacity limits the capacity of sketches,
+// which take time quadratic in capacity to decode.
+const MaxSketchCapacity = 256
+
+// sketchCapacity returns the capacity of the sketch to exchange with
+// a remote peer, or zero if either peer does not support sketches.
+func (p *Peer) sketchCapacity(remoteConfig *Config) int {
+	capacity := p.SketchCapacity()
+	remote, err := strconv.Atoi(remoteConfig.Custom["sketch"])
+	if err != nil || remote < capacity {
+		capacity = remote
+	}
+	if capacity <= 0 || capacity > MaxSketchCapacity {
+		return 0
+	}
+	return capacity
+}
+
+// rootSketch returns a sketch of the prefix tree, and the number of
+// elements sketched. The sketch is kept up to date as elements are
+// inserted and removed, at the largest capacity the peer exchanges.
+func (p *Peer) rootSketch(capacity int) (*Sketch, int, error) {
+	root, err := p.Root()
+	if err != nil {
+		return nil, 0, err
+	}
+	s := &p.summaries
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sketch == nil || s.sketchSize != root.Size() || s.sketch.Capacity() < capacity {
+		full := p.SketchCapacity()
+		if full > MaxSketchCapacity {
+			full = MaxSketchCapacity
+		}
+		if full < capacity {
+			full = capacity
+		}
+		sketch, err := NewSketch(p.prime(), full)
+		if err != nil {
+			return nil, 0, err
+		}
+		elements, err := root.Elements()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, z := range elements {
+			sketch.Add(z)
+		}
+		s.sketch, s.sketchSize = sketch, len(elements)
+	}
+	sketch, err := s.sketch.Truncated(capacity)
+	return sketch, s.sketchSize, err
+}
+
+// hasElements returns those of the elements which are in the prefix tree.
+func (p *Peer) hasElements(elements []*Zp) (*ZSet, error) {
+	result := NewZSet()
+	for _, z := range elements {
+		node, err := Find(p.PrefixTree, z)
+		if err != nil {
+			return nil, err
+		}
+		nodeElements, err := node.Elements()
+		if err != nil {
+			return nil, err
+		}
+		if NewZSet(nodeElements...).Has(z) {
+			result.Add(z)
+		}
+	}
+	return result, nil
+}
+
+// sketchWithClient offers a sketch of the prefix tree to the client,
+// and receives the elements the client decoded as missing from it.
+// It returns false if the client could not decode the sketch.
+func (p *Peer) sketchWithClient(conn net.Conn, remoteConfig *Config, capacity int) (recovered []*Zp, ok bool, err error) {
+	sketch, size, err := p.rootSketch(capacity)
+	if err != nil {
+		return
+	}
+	log.Println(SERVE, "sending sketch of capacity", capacity)
+	err = WriteMsg(conn, &ReconSketch{Size: size, Capacity: capacity, Sketch: sketch.Bytes()})
+	if err != nil {
+		return
+	}
+	msg, err := ReadMsg(conn)
+	if err != nil {
+		return
+	}
+	switch m := msg.(type) {
+	case *SyncFail:
+		log.Println(SERVE, "client could not decode sketch")
+		return nil, false, nil
+	case *Elements:
+		if err = p.checkRemoteP(m.Items()...); err != nil {
+			return
+		}
+		var local *ZSet
+		if local, err = p.hasElements(m.Items()); err != nil {
+			return
+		}
+		recovered = m.Difference(local).Items()
+	default:
+		err = errors.New(fmt.Sprintf("Unexpected reply to sketch: %v", msg))
+		return
+	}
+	if err = WriteMsg(conn, &Done{}); err != nil {
+		return
+	}
+	p.recoverElements(conn, remoteConfig, recovered)
+	return recovered, true, nil
+}
+
+// sketchWithServer decodes the differences between the server's
+// sketch and the prefix tree, recovering the server's elements and
+// sending the server its missing elements. It returns false, having
+// told the server, if the sketch could not be decoded.
+func (p *Peer) sketchWithServer(conn net.Conn, remoteConfig *Config, capacity int) (recovered []*Zp, ok bool, err error) {
+	msg, err := ReadMsg(conn)
+	if err != nil {
+		return
+	}
+	rs, is := msg.(*ReconSketch)
+	if !is {
+		err = errors.New(fmt.Sprintf("Expected sketch, got %v", msg))
+		return
+	}
+	if rs.Capacity != capacity {
+		err = errors.New(fmt.Sprintf(
+			"Expected sketch of capacity %d, got %d", capacity, rs.Capacity))
+		return
+	}
+	sketch, size, err := p.rootSketch(capacity)
+	if err != nil {
+		return
+	}
+	remote, err := NewSketch(p.prime(), capacity)
+	if err != nil {
+		return
+	}
+	if err = remote.SetBytes(rs.Sketch); err != nil {
+		return
+	}
+	sketch.Merge(remote)
+	diff, decodeErr := sketch.Decode()
+	localDiff, err := p.hasElements(diff)
+	if err != nil {
+		return
+	}
+	remoteDiff := NewZSet(diff...).Difference(localDiff)
+	// The decoded differences must account for the size of the remote set
+	if decodeErr != nil || rs.Size != size-localDiff.Len()+remoteDiff.Len() {
+		log.Println(GOSSIP, "could not decode sketch:", decodeErr)
+		return nil, false, WriteMsg(conn, &SyncFail{})
+	}
+	log.Println(GOSSIP, "decoded sketch: localDiff=", localDiff, "remoteDiff=", remoteDiff)
+	if err = WriteMsg(conn, &Elements{ZSet: p.serveElements(localDiff)}); err != nil {
+		return
+	}
+	if msg, err = ReadMsg(conn); err != nil {
+		return
+	}
+	if _, is := msg.(*Done); !is {
+		err = errors.New(fmt.Sprintf("Expected done, got %v", msg))
+		return
+	}
+	recovered = remoteDiff.Items()
+	p.recoverElements(conn, remoteConfig, recovered)
+	return recovered, true, nil
+}
@@ -0,0 +1,131 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"testing"
+)
+
+func TestSketchSession(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.sketchCapacity", 8)
+	client.Settings.Set("conflux.recon.sketchCapacity", 16)
+	for i := 1; i < 200; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	server.PrefixTree.Insert(Zi(P_SKS, 65541))
+	client.PrefixTree.Insert(Zi(P_SKS, 65543))
+	s := reconcile(t, server, client)
+	assert.T(t, s.ss.SketchDecoded)
+	assert.T(t, s.cs.SketchDecoded)
+	assert.Equal(t, 0, s.ss.Subtrees)
+	assert.Equal(t, 1, s.ss.Recovered)
+	assert.Equal(t, 2, s.cs.Recovered)
+	assert.Equal(t, "{65543}", s.serverSet.String())
+	assert.Equal(t, "{65539, 65541}", s.clientSet.String())
+	assert.Equal(t, 1, s.cs.ElementsSent)
+}
+
+func TestSketchFallback(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.sketchCapacity", 2)
+	client.Settings.Set("conflux.recon.sketchCapacity", 2)
+	for i := 1; i < 200; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	for i := 1; i <= 5; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i+2))
+	}
+	s := reconcile(t, server, client)
+	assert.T(t, s.ss.SketchFailed)
+	assert.T(t, s.cs.SketchFailed)
+	assert.T(t, !s.ss.SketchDecoded)
+	assert.T(t, s.ss.Subtrees > 0)
+	assert.Equal(t, 5, s.cs.Recovered)
+	assert.Equal(t, 5, s.clientSet.Len())
+}
+
+func TestSketchOneSided(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.Settings.Set("conflux.recon.sketchCapacity", 8)
+	assert.Equal(t, 0, server.sketchCapacity(client.Config()))
+	other := NewMemPeer()
+	other.Settings.Set("conflux.recon.sketchCapacity", 10)
+	assert.Equal(t, 8, server.sketchCapacity(other.Config()))
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65539))
+	s := reconcile(t, server, client)
+	assert.T(t, !s.ss.SketchDecoded && !s.ss.SketchFailed)
+	assert.T(t, s.ss.Subtrees > 0)
+	assert.Equal(t, 1, s.ss.Recovered)
+	assert.Equal(t, 1, s.cs.Recovered)
+}
+
+func TestRootSketchUpdated(t *testing.T) {
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.sketchCapacity", 8)
+	startCmds(p)
+	for i := 1; i < 20; i++ {
+		p.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	sketch, size, err := p.rootSketch(4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 19, size)
+	assert.Equal(t, 4, sketch.Capacity())
+	kept := p.summaries.sketch
+	assert.Equal(t, 8, kept.Capacity())
+	assert.Equal(t, nil, p.Insert(Zi(P_SKS, 65539)))
+	assert.Equal(t, nil, p.Remove(Zi(P_SKS, 65537)))
+	sketch, size, err = p.rootSketch(8)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 19, size)
+	// Updated in place, rather than sketched again
+	assert.T(t, kept == p.summaries.sketch)
+	expect, _ := NewSketch(P_SKS, 8)
+	root, _ := p.Root()
+	elements, _ := root.Elements()
+	for _, z := range elements {
+		expect.Add(z)
+	}
+	assert.Equal(t, expect.Bytes(), sketch.Bytes())
+	// Changes made other than through the peer are sketched again
+	p.PrefixTree.Insert(Zi(P_SKS, 65541))
+	_, size, err = p.rootSketch(8)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 20, size)
+	assert.T(t, kept != p.summaries.sketch)
+}
+
+func TestReconSketchMsg(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	msg := &ReconSketch{Size: 3, Capacity: 2, Sketch: []byte{1, 2, 3}}
+	assert.Equal(t, nil, WriteMsg(buf, msg))
+	read, err := ReadMsg(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, msg, read)
+}
@@ -0,0 +1,217 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stripComment removes a trailing # comment and surrounding space.
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// ParseMembership reads the partners listed in an SKS membership file.
+// Each line gives a partner's host and recon port, optionally followed
+// by a # comment.
+func ParseMembership(r io.Reader) (partners []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("membership line %d: expected host and port, got %q", lineNum, line))
+		}
+		if _, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, errors.New(fmt.Sprintf("membership line %d: invalid port %q", lineNum, fields[1]))
+		}
+		partners = append(partners, net.JoinHostPort(fields[0], fields[1]))
+	}
+	return partners, scanner.Err()
+}
+
+// sksconfIntKeys maps integer sksconf options to settings.
+var sksconfIntKeys = map[string]string{
+	"hkp_port":                       "conflux.recon.httpPort",
+	"recon_port":                     "conflux.recon.reconPort",
+	"mbar":                           "conflux.recon.mBar",
+	"bitquantum":                     "conflux.recon.bitQuantum",
+	"ptree_thresh_mult":              "conflux.recon.threshMult",
+	"max_outstanding_recon_requests": "conflux.recon.maxOutstandingReconRequests",
+}
+
+// ParseSksConf reads an SKS sksconf file into the settings. The options
+// which affect recon are applied: ports and addresses, the prefix tree
+// parameters, filters and the gossip interval. Others are ignored.
+func (s *Settings) ParseSksConf(r io.Reader) error {
+	var reconAddrs []string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return errors.New(fmt.Sprintf("sksconf line %d: expected option: value, got %q", lineNum, line))
+		}
+		option, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if key, has := sksconfIntKeys[option]; has {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.New(fmt.Sprintf("sksconf line %d: invalid %s %q", lineNum, option, value))
+			}
+			s.Set(key, n)
+			continue
+		}
+		switch option {
+		case "gossip_interval":
+			// SKS gives the gossip interval in minutes
+			minutes, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("sksconf line %d: invalid %s %q", lineNum, option, value))
+			}
+			s.Set("conflux.recon.gossipIntervalSecs", int(minutes*60))
+		case "filters":
+			var filters []interface{}
+			for _, filter := range strings.Split(value, ",") {
+				if filter = strings.TrimSpace(filter); filter != "" {
+					filters = append(filters, filter)
+				}
+			}
+			s.Set("conflux.recon.filters", filters)
+		case "recon_address":
+			reconAddrs = strings.Fields(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(reconAddrs) > 0 {
+		var listen []interface{}
+		for _, addr := range reconAddrs {
+			listen = append(listen, net.JoinHostPort(addr, strconv.Itoa(s.ReconPort())))
+		}
+		s.Set("conflux.recon.listen", listen)
+	}
+	s.UpdateDerived()
+	return nil
+}
+
+// LoadSksSettings reads settings from the sksconf and membership files
+// in an SKS data directory. Either file may be absent.
+func LoadSksSettings(dir string) (*Settings, error) {
+	s := DefaultSettings()
+	if f, err := os.Open(filepath.Join(dir, "sksconf")); err == nil {
+		defer f.Close()
+		if err = s.ParseSksConf(f); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, "membership")); err == nil {
+		defer f.Close()
+		partners, err := ParseMembership(f)
+		if err != nil {
+			return nil, err
+		}
+		var list []interface{}
+		for _, partner := range partners {
+			list = append(list, partner)
+		}
+		s.Set("conflux.recon.partners", list)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.source = func() (*Settings, error) { return LoadSksSettings(dir) }
+	s.sourcePaths = []string{filepath.Join(dir, "sksconf"), filepath.Join(dir, "membership")}
+	return s, nil
+}
+
+// SksHashSize is the size of the MD5 digests by which SKS identifies keys.
+const SksHashSize = 16
+
+// ReadSksHashes reads the key hashes of an SKS key database, calling f
+// with the element for each in the finite field p. The input is either
+// a list of hashes in hex, one per line, as given by SKS hashqueries,
+// or the output of db_dump for the KDB key database, whose keys are
+// the hashes. As in SKS, hashes are read as little-endian integers.
+func ReadSksHashes(r io.Reader, p *big.Int, f func(z *Zp) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	// db_dump alternates keys and values once the header ends
+	dbDump, inHeader, isKey := false, false, false
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case lineNum == 1 && strings.HasPrefix(line, "VERSION="):
+			dbDump, inHeader = true, true
+			continue
+		case dbDump && line == "HEADER=END":
+			inHeader = false
+			continue
+		case dbDump && line == "DATA=END":
+			return nil
+		case inHeader:
+			continue
+		case dbDump:
+			isKey = !isKey
+			if !isKey {
+				continue
+			}
+		default:
+			line = stripComment(line)
+			if line == "" {
+				continue
+			}
+		}
+		digest, err := hex.DecodeString(line)
+		if err == nil && len(digest) != SksHashSize {
+			err = errors.New(fmt.Sprintf("expected %d bytes, got %d", SksHashSize, len(digest)))
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid hash %q: %v", lineNum, line, err))
+		}
+		if err = f(ZpFromBytes(p, digest)); err != nil {
+			return errors.New(fmt.Sprintf("line %d: %v", lineNum, err))
+		}
+	}
+	return scanner.Err()
+}
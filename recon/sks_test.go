@@ -0,0 +1,127 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMembership = `
+# Gossip partners
+keys.example.com 11370 # Operator <op@example.com>
+2001:db8::1 11380
+	keys.example.net	11370
+`
+
+const testSksConf = `
+# SKS configuration
+hostname: keys.example.com
+hkp_port: 11381
+recon_port: 11380
+recon_address: 192.0.2.1 2001:db8::2
+gossip_interval: 5
+mbar: 7
+bitquantum: 2
+filters: yminsky.dedup, yminsky.merge
+disable_mailsync:
+`
+
+func TestParseMembership(t *testing.T) {
+	partners, err := ParseMembership(strings.NewReader(testMembership))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{
+		"keys.example.com:11370",
+		"[2001:db8::1]:11380",
+		"keys.example.net:11370"}, partners)
+	_, err = ParseMembership(strings.NewReader("keys.example.com\n"))
+	assert.NotEqual(t, nil, err)
+	_, err = ParseMembership(strings.NewReader("keys.example.com port\n"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseSksConf(t *testing.T) {
+	s := DefaultSettings()
+	assert.Equal(t, nil, s.ParseSksConf(strings.NewReader(testSksConf)))
+	assert.Equal(t, 11381, s.HttpPort())
+	assert.Equal(t, 11380, s.ReconPort())
+	assert.Equal(t, []string{"192.0.2.1:11380", "[2001:db8::2]:11380"}, s.Listen())
+	assert.Equal(t, 300, s.GossipIntervalSecs())
+	assert.Equal(t, 7, s.MBar())
+	assert.Equal(t, 8, s.NumSamples())
+	assert.Equal(t, []string{"yminsky.dedup", "yminsky.merge"}, s.Filters())
+	assert.NotEqual(t, nil, s.ParseSksConf(strings.NewReader("mbar: lots\n")))
+}
+
+func TestLoadSksSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	s, err := LoadSksSettings(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(s.Partners()))
+	ioutil.WriteFile(filepath.Join(dir, "sksconf"), []byte(testSksConf), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "membership"), []byte(testMembership), 0644)
+	s, err = LoadSksSettings(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 11380, s.ReconPort())
+	assert.Equal(t, 3, len(s.Partners()))
+}
+
+const testSksHashes = `
+# Key hashes
+0123456789ABCDEF0123456789ABCDEF
+00112233445566778899aabbccddeeff
+`
+
+const testKdbDump = `VERSION=3
+format=bytevalue
+type=btree
+HEADER=END
+ 0123456789abcdef0123456789abcdef
+ 99c6a0f1
+ 00112233445566778899aabbccddeeff
+ 99c6a0f2
+DATA=END
+`
+
+func TestReadSksHashes(t *testing.T) {
+	for _, input := range []string{testSksHashes, testKdbDump} {
+		var elements []*Zp
+		err := ReadSksHashes(strings.NewReader(input), P_SKS, func(z *Zp) error {
+			elements = append(elements, z)
+			return nil
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 2, len(elements))
+		digest, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+		assert.Equal(t, 0, ZpFromBytes(P_SKS, digest).Cmp(elements[0]))
+	}
+	err := ReadSksHashes(strings.NewReader("0123\n"), P_SKS, func(z *Zp) error { return nil })
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,302 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsHistoryDays is the number of days of recoveries
+// kept for the stats page.
+const StatsHistoryDays = 14
+
+// ReconStats summarizes the state of a peer for pool operators.
+type ReconStats struct {
+	Version   string            `json:"version"`
+	HttpPort  int               `json:"httpPort"`
+	ReconPort int               `json:"reconPort"`
+	Total     int               `json:"total"`
+	Partners  []*PartnerStatus  `json:"partners"`
+	Daily     []*DailyStats     `json:"daily"`
+	Traffic   []*PartnerTraffic `json:"traffic"`
+}
+
+// PartnerStatus is the outcome of the most recent
+// gossip session initiated with a partner.
+type PartnerStatus struct {
+	Addr      string    `json:"addr"`
+	LastRecon time.Time `json:"lastRecon"`
+	Recovered int       `json:"recovered"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// DailyStats counts the recon sessions and elements
+// recovered on a day, in UTC.
+type DailyStats struct {
+	Date          string `json:"date"`
+	Sessions      int    `json:"sessions"`
+	Failed        int    `json:"failed"`
+	Recovered     int    `json:"recovered"`
+	BytesSent     int64  `json:"bytesSent"`
+	BytesReceived int64  `json:"bytesReceived"`
+}
+
+// PartnerTraffic counts the bytes exchanged with a remote host
+// in recon sessions on a day, in UTC.
+type PartnerTraffic struct {
+	Date          string `json:"date"`
+	Host          string `json:"host"`
+	Sessions      int    `json:"sessions"`
+	BytesSent     int64  `json:"bytesSent"`
+	BytesReceived int64  `json:"bytesReceived"`
+}
+
+// reconHistory accumulates session outcomes for the stats page.
+// The zero value is ready to use.
+type reconHistory struct {
+	mu       sync.Mutex
+	daily    map[string]*DailyStats
+	partners map[string]*PartnerStatus
+	// Traffic by date, then by host
+	traffic map[string]map[string]*PartnerTraffic
+}
+
+// today returns the stats of the current day, expiring those of days
+// no longer kept. The caller must hold the lock.
+func (h *reconHistory) today() *DailyStats {
+	if h.daily == nil {
+		h.daily = make(map[string]*DailyStats)
+	}
+	now := time.Now().UTC()
+	date := now.Format("2006-01-02")
+	day, has := h.daily[date]
+	if !has {
+		day = &DailyStats{Date: date}
+		h.daily[date] = day
+		expired := now.AddDate(0, 0, -StatsHistoryDays).Format("2006-01-02")
+		for d := range h.daily {
+			if d <= expired {
+				delete(h.daily, d)
+				delete(h.traffic, d)
+			}
+		}
+	}
+	return day
+}
+
+func (h *reconHistory) recordSession(recovered int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	day := h.today()
+	day.Sessions++
+	if err != nil {
+		day.Failed++
+	}
+	day.Recovered += recovered
+}
+
+// recordTraffic counts the bytes exchanged with a remote host.
+func (h *reconHistory) recordTraffic(host string, sent, received int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	day := h.today()
+	day.BytesSent += sent
+	day.BytesReceived += received
+	if h.traffic == nil {
+		h.traffic = make(map[string]map[string]*PartnerTraffic)
+	}
+	hosts, has := h.traffic[day.Date]
+	if !has {
+		hosts = make(map[string]*PartnerTraffic)
+		h.traffic[day.Date] = hosts
+	}
+	traffic, has := hosts[host]
+	if !has {
+		traffic = &PartnerTraffic{Date: day.Date, Host: host}
+		hosts[host] = traffic
+	}
+	traffic.Sessions++
+	traffic.BytesSent += sent
+	traffic.BytesReceived += received
+}
+
+// trafficHost returns the host to which the traffic of a session
+// is attributed, the address of the remote peer without its port,
+// which differs between the connections of a peer.
+func trafficHost(partner string) string {
+	if host, _, err := net.SplitHostPort(partner); err == nil {
+		return host
+	}
+	return partner
+}
+
+func (h *reconHistory) recordPartner(addr string, recovered int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.partners == nil {
+		h.partners = make(map[string]*PartnerStatus)
+	}
+	status := &PartnerStatus{Addr: addr, LastRecon: time.Now(), Recovered: recovered}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	h.partners[addr] = status
+}
+
+// lastRecon returns the time of the last gossip session initiated
+// with a partner, which is zero if there has been none.
+func (h *reconHistory) lastRecon(addr string) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if status, has := h.partners[addr]; has {
+		return status.LastRecon
+	}
+	return time.Time{}
+}
+
+// ReconStats reports the peer's configuration, the size of its prefix
+// tree, the status of each partner and a daily history of recoveries.
+// The peer must be started.
+func (p *Peer) ReconStats() (*ReconStats, error) {
+	stats := &ReconStats{
+		Version:   p.Version(),
+		HttpPort:  p.HttpPort(),
+		ReconPort: p.ReconPort()}
+	err := p.ExecCmd(func() error {
+		root, err := p.Root()
+		if err != nil {
+			return err
+		}
+		stats.Total = root.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.history.mu.Lock()
+	defer p.history.mu.Unlock()
+	for _, partner := range p.Partners() {
+		if status, has := p.history.partners[partner]; has {
+			copied := *status
+			stats.Partners = append(stats.Partners, &copied)
+		} else {
+			stats.Partners = append(stats.Partners, &PartnerStatus{Addr: partner})
+		}
+	}
+	for _, day := range p.history.daily {
+		copied := *day
+		stats.Daily = append(stats.Daily, &copied)
+	}
+	sort.Sort(byDate(stats.Daily))
+	for _, hosts := range p.history.traffic {
+		for _, traffic := range hosts {
+			copied := *traffic
+			stats.Traffic = append(stats.Traffic, &copied)
+		}
+	}
+	sort.Sort(byDateHost(stats.Traffic))
+	return stats, nil
+}
+
+type byDate []*DailyStats
+
+func (d byDate) Len() int           { return len(d) }
+func (d byDate) Less(i, j int) bool { return d[i].Date > d[j].Date }
+func (d byDate) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+type byDateHost []*PartnerTraffic
+
+func (d byDateHost) Len() int { return len(d) }
+func (d byDateHost) Less(i, j int) bool {
+	if d[i].Date != d[j].Date {
+		return d[i].Date > d[j].Date
+	}
+	return d[i].Host < d[j].Host
+}
+func (d byDateHost) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+// StatsHandler returns an HTTP handler serving the peer's stats page,
+// in the manner of the SKS /pks/lookup?op=stats page. JSON is served
+// when requested with options=mr or an Accept header of
+// application/json, HTML otherwise.
+func (p *Peer) StatsHandler() http.Handler {
+	return http.HandlerFunc(p.serveStats)
+}
+
+func (p *Peer) serveStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := p.ReconStats()
+	if err != nil {
+		log.Println(SERVE, "stats:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if strings.Contains(r.FormValue("options"), "mr") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(stats); err != nil {
+			log.Println(SERVE, "stats:", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = statsTemplate.Execute(w, stats); err != nil {
+		log.Println(SERVE, "stats:", err)
+	}
+}
+
+var statsTemplate *template.Template = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Recon Server Statistics</title></head>
+<body>
+<h1>Recon Server Statistics</h1>
+<table>
+<tr><td>Version:</td><td>{{.Version}}</td></tr>
+<tr><td>HTTP port:</td><td>{{.HttpPort}}</td></tr>
+<tr><td>Recon port:</td><td>{{.ReconPort}}</td></tr>
+<tr><td>Total number of keys:</td><td>{{.Total}}</td></tr>
+</table>
+<h2>Gossip Peers</h2>
+<table>
+<tr><th>Partner</th><th>Last recon</th><th>Recovered</th><th>Error</th></tr>
+{{range .Partners}}<tr><td>{{.Addr}}</td><td>{{if not .LastRecon.IsZero}}{{.LastRecon.Format "2006-01-02 15:04:05 MST"}}{{end}}</td><td>{{.Recovered}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+<h2>Daily Recoveries</h2>
+<table>
+<tr><th>Date</th><th>Sessions</th><th>Failed</th><th>Recovered</th><th>Bytes sent</th><th>Bytes received</th></tr>
+{{range .Daily}}<tr><td>{{.Date}}</td><td>{{.Sessions}}</td><td>{{.Failed}}</td><td>{{.Recovered}}</td><td>{{.BytesSent}}</td><td>{{.BytesReceived}}</td></tr>
+{{end}}</table>
+<h2>Daily Traffic</h2>
+<table>
+<tr><th>Date</th><th>Host</th><th>Sessions</th><th>Bytes sent</th><th>Bytes received</th></tr>
+{{range .Traffic}}<tr><td>{{.Date}}</td><td>{{.Host}}</td><td>{{.Sessions}}</td><td>{{.BytesSent}}</td><td>{{.BytesReceived}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
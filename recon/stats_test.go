@@ -0,0 +1,102 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReconStats(t *testing.T) {
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.partners", []interface{}{"a.example.com:11370", "b.example.com:11370"})
+	p.PrefixTree.Insert(Zi(P_SKS, 65537))
+	p.PrefixTree.Insert(Zi(P_SKS, 65539))
+	startCmds(p)
+	p.history.recordSession(3, nil)
+	p.history.recordSession(0, errors.New("fail"))
+	p.history.recordPartner("a.example.com:11370", 3, nil)
+	stats, err := p.ReconStats()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, stats.Total)
+	assert.Equal(t, 2, len(stats.Partners))
+	assert.Equal(t, 3, stats.Partners[0].Recovered)
+	assert.T(t, !stats.Partners[0].LastRecon.IsZero())
+	assert.T(t, stats.Partners[1].LastRecon.IsZero())
+	assert.Equal(t, 1, len(stats.Daily))
+	assert.Equal(t, 2, stats.Daily[0].Sessions)
+	assert.Equal(t, 1, stats.Daily[0].Failed)
+	assert.Equal(t, 3, stats.Daily[0].Recovered)
+}
+
+func TestStatsHandler(t *testing.T) {
+	p := NewMemPeer()
+	p.PrefixTree.Insert(Zi(P_SKS, 65537))
+	startCmds(p)
+	ts := httptest.NewServer(p.StatsHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/pks/lookup?op=stats&options=mr")
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	var stats ReconStats
+	assert.Equal(t, nil, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 1, stats.Total)
+	assert.Equal(t, p.Version(), stats.Version)
+
+	resp, err = http.Get(ts.URL + "/pks/lookup?op=stats")
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.T(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+}
+
+func TestTrafficStats(t *testing.T) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	client.PrefixTree.Insert(Zi(P_SKS, 65539))
+	s := reconcile(t, server, client)
+	assert.T(t, s.ss.BytesSent > 0)
+	assert.Equal(t, s.ss.BytesSent, s.cs.BytesReceived)
+	server.history.recordTraffic("192.0.2.1", 100, 200)
+	stats, err := server.ReconStats()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(stats.Daily))
+	assert.Equal(t, s.ss.BytesSent+100, stats.Daily[0].BytesSent)
+	assert.Equal(t, s.ss.BytesReceived+200, stats.Daily[0].BytesReceived)
+	assert.Equal(t, 2, len(stats.Traffic))
+	assert.Equal(t, "127.0.0.1", stats.Traffic[0].Host)
+	assert.Equal(t, s.ss.BytesSent, stats.Traffic[0].BytesSent)
+	assert.Equal(t, s.ss.BytesReceived, stats.Traffic[0].BytesReceived)
+	assert.Equal(t, "192.0.2.1", stats.Traffic[1].Host)
+	assert.Equal(t, 1, stats.Traffic[1].Sessions)
+
+	hostMetrics, is := trafficMetrics.Get("127.0.0.1").(*expvar.Map)
+	assert.T(t, is)
+	assert.T(t, hostMetrics.Get("bytesSent") != nil)
+}
@@ -0,0 +1,101 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storetest
+
+import (
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"testing"
+)
+
+// BenchmarkInsert measures inserting elements into a backend's tree,
+// which splits its nodes as it grows.
+func BenchmarkInsert(b *testing.B, m TreeManager) {
+	tree, _ := createTree(b, m)
+	defer m.DestroyTree(tree)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tree.Insert(Zi(P_SKS, 65537*(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertAll measures inserting elements into a backend's
+// tree in bulk, 1000 at a time.
+func BenchmarkInsertAll(b *testing.B, m TreeManager) {
+	tree, _ := createTree(b, m)
+	defer m.DestroyTree(tree)
+	b.ReportAllocs()
+	const bulk = 1000
+	elements := make([]*Zp, 0, bulk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		elements = append(elements, Zi(P_SKS, 65537*(i+1)))
+		if len(elements) == bulk || i == b.N-1 {
+			if err := recon.InsertAll(tree, elements); err != nil {
+				b.Fatal(err)
+			}
+			elements = elements[:0]
+		}
+	}
+}
+
+// BenchmarkRemove measures removing elements from a backend's tree,
+// which joins its nodes as it shrinks.
+func BenchmarkRemove(b *testing.B, m TreeManager) {
+	tree, _ := createTree(b, m)
+	defer m.DestroyTree(tree)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := tree.Insert(Zi(P_SKS, 65537*(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tree.Remove(Zi(P_SKS, 65537*(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFind measures finding the leaf holding an element in a
+// backend's tree of 10000 elements, as recon does when serving.
+func BenchmarkFind(b *testing.B, m TreeManager) {
+	tree, _ := createTree(b, m)
+	defer m.DestroyTree(tree)
+	b.ReportAllocs()
+	const size = 10000
+	for i := 0; i < size; i++ {
+		if err := tree.Insert(Zi(P_SKS, 65537*(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := recon.Find(tree, Zi(P_SKS, 65537*(i%size+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
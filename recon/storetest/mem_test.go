@@ -0,0 +1,55 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storetest
+
+import (
+	"github.com/cmars/conflux/recon"
+	"testing"
+)
+
+type memTreeManager struct{}
+
+func (m *memTreeManager) CreateTree(settings *recon.Settings) (recon.PrefixTree, error) {
+	return recon.NewMemPrefixTree(settings), nil
+}
+
+func (m *memTreeManager) DestroyTree(tree recon.PrefixTree) {}
+
+func TestMemPrefixTree(t *testing.T) {
+	Run(t, &memTreeManager{})
+}
+
+func BenchmarkMemInsert(b *testing.B) {
+	BenchmarkInsert(b, &memTreeManager{})
+}
+
+func BenchmarkMemInsertAll(b *testing.B) {
+	BenchmarkInsertAll(b, &memTreeManager{})
+}
+
+func BenchmarkMemRemove(b *testing.B) {
+	BenchmarkRemove(b, &memTreeManager{})
+}
+
+func BenchmarkMemFind(b *testing.B) {
+	BenchmarkFind(b, &memTreeManager{})
+}
@@ -0,0 +1,349 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package storetest is a conformance suite and set of benchmarks
+// which any PrefixTree backend can run, to show that it splits,
+// joins and samples its nodes as the in-memory tree does.
+package storetest
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"github.com/cmars/conflux/recon"
+	"math/rand"
+	"testing"
+)
+
+// TreeManager creates prefix trees of a backend for the suite, and
+// destroys them when each test or benchmark is done with them.
+type TreeManager interface {
+	// CreateTree creates an empty prefix tree
+	// with the structure given by settings.
+	CreateTree(settings *recon.Settings) (recon.PrefixTree, error)
+	DestroyTree(tree recon.PrefixTree)
+}
+
+// Run runs each conformance test on the backend.
+func Run(t *testing.T, m TreeManager) {
+	RunInsertRemove(t, m)
+	RunSplit(t, m)
+	RunJoin(t, m)
+	RunMatchesMemory(t, m)
+	RunInsertAll(t, m)
+	RunNodesAtDepth(t, m)
+	RunCollisions(t, m)
+}
+
+func createTree(t testing.TB, m TreeManager) (recon.PrefixTree, *recon.Settings) {
+	settings := recon.DefaultSettings()
+	tree, err := m.CreateTree(settings)
+	if err != nil {
+		t.Fatalf("create tree: %v", err)
+	}
+	return tree, settings
+}
+
+// MustKey, MustElements, MustSValues and MustChildren read a node,
+// failing the test if the backend cannot.
+func MustKey(t testing.TB, node recon.PrefixNode) *Bitstring {
+	key, err := node.Key()
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	return key
+}
+
+func MustElements(t testing.TB, node recon.PrefixNode) []*Zp {
+	elements, err := node.Elements()
+	if err != nil {
+		t.Fatalf("elements: %v", err)
+	}
+	return elements
+}
+
+func MustSValues(t testing.TB, node recon.PrefixNode) []*Zp {
+	svalues, err := node.SValues()
+	if err != nil {
+		t.Fatalf("sample values: %v", err)
+	}
+	return svalues
+}
+
+func MustChildren(t testing.TB, node recon.PrefixNode) []recon.PrefixNode {
+	children, err := node.Children()
+	if err != nil {
+		t.Fatalf("children: %v", err)
+	}
+	return children
+}
+
+func root(t testing.TB, tree recon.PrefixTree) recon.PrefixNode {
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	return root
+}
+
+// RunInsertRemove checks that a leaf holds the elements inserted,
+// and that its sample values are restored when they are removed.
+// Removing an element which is not there fails, changing nothing.
+func RunInsertRemove(t *testing.T, m TreeManager) {
+	tree, _ := createTree(t, m)
+	defer m.DestroyTree(tree)
+	for _, i := range []int{100, 300, 500} {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, i)))
+	}
+	r := root(t, tree)
+	assert.T(t, r.IsLeaf())
+	assert.Equal(t, 3, r.Size())
+	assert.T(t, NewZSet(MustElements(t, r)...).Equal(NewZSet(Zi(P_SKS, 100), Zi(P_SKS, 300), Zi(P_SKS, 500))))
+	svalues := MustSValues(t, r)
+	// Removing an element not in the tree changes nothing
+	_, is := tree.Remove(Zi(P_SKS, 200)).(*recon.NotFoundError)
+	assert.T(t, is)
+	r = root(t, tree)
+	assert.Equal(t, 3, r.Size())
+	for i, sv := range MustSValues(t, r) {
+		assert.Equal(t, 0, sv.Cmp(svalues[i]))
+	}
+	for _, i := range []int{100, 300, 500} {
+		assert.Equal(t, nil, tree.Remove(Zi(P_SKS, i)))
+	}
+	r = root(t, tree)
+	assert.Equal(t, 0, r.Size())
+	assert.Equal(t, 0, len(MustElements(t, r)))
+	for _, sv := range MustSValues(t, r) {
+		assert.Equal(t, 0, sv.Cmp(Zi(P_SKS, 1)))
+	}
+}
+
+// RunSplit checks that a leaf holding more elements than the split
+// threshold splits into a child for each prefix, which together hold
+// its elements.
+func RunSplit(t *testing.T, m TreeManager) {
+	tree, _ := createTree(t, m)
+	defer m.DestroyTree(tree)
+	n := tree.SplitThreshold() + 2
+	for i := 1; i <= n; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	r := root(t, tree)
+	assert.T(t, !r.IsLeaf())
+	assert.Equal(t, n, r.Size())
+	children := MustChildren(t, r)
+	assert.Equal(t, 1<<uint(tree.BitQuantum()), len(children))
+	sum := 0
+	for _, child := range children {
+		assert.T(t, MustKey(t, child).HasPrefix(MustKey(t, r)))
+		sum += child.Size()
+	}
+	assert.Equal(t, n, sum)
+	for i := 1; i <= n; i++ {
+		z := Zi(P_SKS, 65537*i)
+		node, err := recon.Find(tree, z)
+		assert.Equal(t, nil, err)
+		assert.T(t, node.IsLeaf())
+		assert.T(t, NewZSet(MustElements(t, node)...).Has(z))
+	}
+}
+
+// RunJoin checks that a node whose size falls to the join threshold
+// becomes a leaf again, holding the remaining elements.
+func RunJoin(t *testing.T, m TreeManager) {
+	tree, _ := createTree(t, m)
+	defer m.DestroyTree(tree)
+	n := tree.SplitThreshold() + 2
+	for i := 1; i <= n; i++ {
+		assert.Equal(t, nil, tree.Insert(Zi(P_SKS, 65537*i)))
+	}
+	assert.T(t, !root(t, tree).IsLeaf())
+	for i := tree.JoinThreshold() + 1; i <= n; i++ {
+		assert.Equal(t, nil, tree.Remove(Zi(P_SKS, 65537*i)))
+	}
+	r := root(t, tree)
+	assert.T(t, r.IsLeaf())
+	assert.Equal(t, tree.JoinThreshold(), r.Size())
+	expect := NewZSet()
+	for i := 1; i <= tree.JoinThreshold(); i++ {
+		expect.Add(Zi(P_SKS, 65537*i))
+	}
+	assert.T(t, expect.Equal(NewZSet(MustElements(t, r)...)))
+}
+
+// RunMatchesMemory applies the same random inserts and removes to the
+// backend and to an in-memory tree, and checks that both trees have
+// the same nodes, sizes, sample values and elements.
+func RunMatchesMemory(t *testing.T, m TreeManager) {
+	tree, settings := createTree(t, m)
+	defer m.DestroyTree(tree)
+	mem := recon.NewMemPrefixTree(settings)
+	rnd := rand.New(rand.NewSource(1))
+	var present []*Zp
+	has := NewZSet()
+	for i := 0; i < 2000; i++ {
+		if len(present) > 0 && rnd.Intn(3) == 0 {
+			j := rnd.Intn(len(present))
+			z := present[j]
+			present[j] = present[len(present)-1]
+			present = present[:len(present)-1]
+			has.Remove(z)
+			assert.Equal(t, nil, tree.Remove(z))
+			assert.Equal(t, nil, mem.Remove(z))
+		} else {
+			z := Zi(P_SKS, rnd.Intn(1<<30)+1)
+			if has.Has(z) {
+				continue
+			}
+			present = append(present, z)
+			has.Add(z)
+			assert.Equal(t, nil, tree.Insert(z))
+			assert.Equal(t, nil, mem.Insert(z))
+		}
+	}
+	assert.Equal(t, nil, recon.VerifyTree(tree))
+	sameNode(t, root(t, mem), root(t, tree))
+}
+
+// RunInsertAll inserts elements in bulk, enough to split the tree
+// several levels deep, and checks that the tree matches one built by
+// inserting the elements one at a time.
+func RunInsertAll(t *testing.T, m TreeManager) {
+	tree, settings := createTree(t, m)
+	defer m.DestroyTree(tree)
+	mem := recon.NewMemPrefixTree(settings)
+	rnd := rand.New(rand.NewSource(1))
+	has := NewZSet()
+	var elements []*Zp
+	for len(elements) < 2000 {
+		z := Zi(P_SKS, rnd.Intn(1<<30)+1)
+		if !has.Has(z) {
+			has.Add(z)
+			elements = append(elements, z)
+		}
+	}
+	for _, z := range elements {
+		assert.Equal(t, nil, mem.Insert(z))
+	}
+	assert.Equal(t, nil, recon.InsertAll(tree, elements[:1000]))
+	assert.Equal(t, nil, recon.InsertAll(tree, elements[1000:]))
+	assert.Equal(t, nil, recon.VerifyTree(tree))
+	sameNode(t, root(t, mem), root(t, tree))
+}
+
+// RunCollisions checks that inserting an element already in the tree,
+// or more elements than a leaf may hold sharing a key prefix as deep as
+// the tree may grow, fails with a CollisionError, leaving the tree as
+// it was.
+func RunCollisions(t *testing.T, m TreeManager) {
+	settings := recon.DefaultSettings()
+	settings.Set("conflux.recon.maxDepth", 1)
+	tree, err := m.CreateTree(settings)
+	if err != nil {
+		t.Fatalf("create tree: %v", err)
+	}
+	defer m.DestroyTree(tree)
+	// Elements in the first child of the root, which cannot split
+	var elements []*Zp
+	for i := 1; len(elements) < tree.SplitThreshold()+2; i++ {
+		z := Zi(P_SKS, i)
+		if SksKeys.Key(z).Uint(0, tree.BitQuantum()) == 0 {
+			elements = append(elements, z)
+		}
+	}
+	last := len(elements) - 1
+	for _, z := range elements[:last] {
+		assert.Equal(t, nil, tree.Insert(z))
+	}
+	err = tree.Insert(elements[0])
+	collision, is := err.(*recon.CollisionError)
+	assert.T(t, is)
+	assert.T(t, collision.Duplicate)
+	assert.Equal(t, 0, collision.Element.Cmp(elements[0]))
+	err = tree.Insert(elements[last])
+	collision, is = err.(*recon.CollisionError)
+	assert.T(t, is)
+	assert.T(t, !collision.Duplicate)
+	assert.Equal(t, 1, collision.Depth)
+	r := root(t, tree)
+	assert.T(t, r.IsLeaf())
+	assert.Equal(t, last, r.Size())
+	assert.Equal(t, nil, recon.VerifyTree(tree))
+}
+
+// RunNodesAtDepth grows the tree several levels deep, then removes
+// most of its elements so that nodes are joined, and checks that the
+// nodes at each depth match those found by descending a tree in memory.
+func RunNodesAtDepth(t *testing.T, m TreeManager) {
+	tree, settings := createTree(t, m)
+	defer m.DestroyTree(tree)
+	mem := recon.NewMemPrefixTree(settings)
+	var elements []*Zp
+	for i := 1; i <= 2000; i++ {
+		elements = append(elements, Zi(P_SKS, 65537*i))
+	}
+	assert.Equal(t, nil, recon.InsertAll(tree, elements))
+	assert.Equal(t, nil, recon.InsertAll(mem, elements))
+	for i, z := range elements {
+		if i%4 != 0 {
+			assert.Equal(t, nil, tree.Remove(z))
+			assert.Equal(t, nil, mem.Remove(z))
+		}
+	}
+	for depth := 0; ; depth++ {
+		expect, err := recon.NodesAtDepth(mem, depth)
+		assert.Equal(t, nil, err)
+		nodes, err := recon.NodesAtDepth(tree, depth)
+		assert.Equal(t, nil, err)
+		assert.Equalf(t, len(expect), len(nodes), "nodes at depth %d", depth)
+		for i := range expect {
+			assert.Equal(t, MustKey(t, expect[i]).String(), MustKey(t, nodes[i]).String())
+			assert.Equal(t, expect[i].Size(), nodes[i].Size())
+			assert.Equal(t, expect[i].IsLeaf(), nodes[i].IsLeaf())
+		}
+		if len(expect) == 0 {
+			break
+		}
+	}
+	assert.Equal(t, nil, recon.VerifyTree(tree))
+}
+
+func sameNode(t *testing.T, expect, node recon.PrefixNode) {
+	expectKey, key := MustKey(t, expect), MustKey(t, node)
+	assert.Equalf(t, 0, expectKey.Cmp(key), "key %v != %v", expectKey, key)
+	assert.Equalf(t, expect.Size(), node.Size(), "size of %v", key)
+	assert.Equalf(t, expect.IsLeaf(), node.IsLeaf(), "leaf %v", key)
+	expectSvalues, svalues := MustSValues(t, expect), MustSValues(t, node)
+	assert.Equalf(t, len(expectSvalues), len(svalues), "svalues of %v", key)
+	for i := range expectSvalues {
+		assert.Equalf(t, 0, expectSvalues[i].Cmp(svalues[i]), "svalue %d of %v", i, key)
+	}
+	if expect.IsLeaf() {
+		assert.Tf(t, NewZSet(MustElements(t, expect)...).Equal(NewZSet(MustElements(t, node)...)),
+			"elements of %v", key)
+		return
+	}
+	expectChildren, children := MustChildren(t, expect), MustChildren(t, node)
+	assert.Equal(t, len(expectChildren), len(children))
+	for i := range expectChildren {
+		sameNode(t, expectChildren[i], children[i])
+	}
+}
@@ -0,0 +1,208 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	. "github.com/cmars/conflux"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ReconStrategy reconciles the prefix trees of two peers once they
+// have exchanged configs. Strategies run in the peer's command loop,
+// and send the elements they recover to the peer's RecoverChan.
+type ReconStrategy interface {
+	// Name identifies the strategy to remote peers.
+	Name() string
+	// Serve reconciles as the server, which leads the session.
+	Serve(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error)
+	// Initiate reconciles as the client.
+	Initiate(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error)
+}
+
+type reconStrategyFuncs struct {
+	name     string
+	serve    func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error)
+	initiate func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error)
+}
+
+func (s *reconStrategyFuncs) Name() string { return s.name }
+
+func (s *reconStrategyFuncs) Serve(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+	return s.serve(p, conn, remoteConfig)
+}
+
+func (s *reconStrategyFuncs) Initiate(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+	return s.initiate(p, conn, remoteConfig)
+}
+
+// PtreeStrategy reconciles prefix trees by interpolation,
+// as SKS does. All peers support it.
+var PtreeStrategy ReconStrategy = &reconStrategyFuncs{
+	name: "ptree",
+	serve: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		scope, err := p.sessionScope(remoteConfig)
+		if err != nil {
+			return nil, err
+		}
+		return p.interactWithClient(conn, remoteConfig, scope)
+	},
+	initiate: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		scope, err := p.sessionScope(remoteConfig)
+		if err != nil {
+			return nil, err
+		}
+		return p.clientRecon(conn, remoteConfig, scope)
+	}}
+
+// SketchStrategy exchanges a sketch of the prefix tree, falling
+// back to PtreeStrategy if the differences cannot be decoded.
+var SketchStrategy ReconStrategy = &reconStrategyFuncs{
+	name: "sketch",
+	serve: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		if capacity := p.sketchCapacity(remoteConfig); capacity > 0 {
+			recovered, decoded, err := p.sketchWithClient(conn, remoteConfig, capacity)
+			if err != nil || decoded {
+				return recovered, err
+			}
+		}
+		return PtreeStrategy.Serve(p, conn, remoteConfig)
+	},
+	initiate: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		if capacity := p.sketchCapacity(remoteConfig); capacity > 0 {
+			recovered, decoded, err := p.sketchWithServer(conn, remoteConfig, capacity)
+			if err != nil || decoded {
+				return recovered, err
+			}
+		}
+		return PtreeStrategy.Initiate(p, conn, remoteConfig)
+	}}
+
+// MerkleStrategy compares the digests of subtrees level by level.
+var MerkleStrategy ReconStrategy = &reconStrategyFuncs{
+	name: "merkle",
+	serve: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		return p.merkleWithClient(conn, remoteConfig)
+	},
+	initiate: func(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+		return p.merkleWithServer(conn, remoteConfig)
+	}}
+
+var strategiesMu sync.Mutex
+var strategies = map[string]ReconStrategy{
+	PtreeStrategy.Name():   PtreeStrategy,
+	SketchStrategy.Name():  SketchStrategy,
+	MerkleStrategy.Name():  MerkleStrategy,
+	CatchUpStrategy.Name(): CatchUpStrategy,
+}
+
+// RegisterStrategy makes a strategy available to be named
+// in the conflux.recon.strategies setting.
+func RegisterStrategy(s ReconStrategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[s.Name()] = s
+}
+
+func lookupStrategy(name string) (ReconStrategy, bool) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	s, has := strategies[name]
+	return s, has
+}
+
+// Strategies names the strategies by which the peer may reconcile,
+// most preferred first. If not given, the peer prefers catching up
+// from change logs if enabled, then comparing Merkle digests if
+// enabled, then exchanging sketches if enabled, and otherwise
+// reconciles as SKS does.
+func (s *Settings) Strategies() []string {
+	if names := s.GetStrings("conflux.recon.strategies"); len(names) > 0 {
+		return names
+	}
+	var names []string
+	if s.CatchUp() {
+		names = append(names, CatchUpStrategy.Name())
+	}
+	if s.Merkle() {
+		names = append(names, MerkleStrategy.Name())
+	}
+	if s.SketchCapacity() > 0 {
+		names = append(names, SketchStrategy.Name())
+	}
+	return append(names, PtreeStrategy.Name())
+}
+
+// strategyNames returns the strategies the peer announces, those
+// which are registered and, for sketches, have a capacity, and for
+// catching up, are enabled with a change log.
+func (p *Peer) strategyNames() (names []string) {
+	for _, name := range p.Strategies() {
+		if _, has := lookupStrategy(name); !has {
+			continue
+		}
+		if name == SketchStrategy.Name() && p.SketchCapacity() <= 0 {
+			continue
+		}
+		if name == CatchUpStrategy.Name() && (!p.CatchUp() || p.ChangeLog == nil) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+// remoteStrategies returns the strategies announced by a remote
+// peer, which is only PtreeStrategy if none were given.
+func remoteStrategies(config *Config) []string {
+	if names, has := config.Custom["strategies"]; has {
+		return strings.Split(names, ",")
+	}
+	return []string{PtreeStrategy.Name()}
+}
+
+var ErrNoCommonStrategy error = errors.New("No reconciliation strategy in common with remote peer")
+
+// negotiateStrategy chooses the strategy preferred by the server
+// which is supported by both peers. Sessions reconciling a prefix
+// use PtreeStrategy, which alone traverses a subtree.
+func (p *Peer) negotiateStrategy(role Role, remoteConfig *Config) (ReconStrategy, error) {
+	if scope, _ := p.sessionScope(remoteConfig); scope != nil {
+		return PtreeStrategy, nil
+	}
+	prefer, other := p.strategyNames(), remoteStrategies(remoteConfig)
+	if role == RoleClient {
+		prefer, other = other, prefer
+	}
+	for _, name := range prefer {
+		for _, supported := range other {
+			if name == supported {
+				if s, has := lookupStrategy(name); has {
+					return s, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNoCommonStrategy
+}
@@ -0,0 +1,117 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDefaultStrategies(t *testing.T) {
+	p := NewMemPeer()
+	assert.Equal(t, []string{"ptree"}, p.strategyNames())
+	_, has := p.Config().Custom["strategies"]
+	assert.T(t, !has)
+	p.Settings.Set("conflux.recon.merkle", true)
+	p.Settings.Set("conflux.recon.sketchCapacity", 4)
+	assert.Equal(t, []string{"merkle", "sketch", "ptree"}, p.strategyNames())
+	assert.Equal(t, "merkle,sketch,ptree", p.Config().Custom["strategies"])
+	// Sketches are not announced without a capacity
+	p.Settings.Set("conflux.recon.sketchCapacity", 0)
+	assert.Equal(t, []string{"merkle", "ptree"}, p.strategyNames())
+}
+
+func TestNegotiateStrategy(t *testing.T) {
+	server := newTestPeer("conflux.recon.strategies", []string{"merkle", "sketch", "ptree"},
+		"conflux.recon.sketchCapacity", 8)
+	client := newTestPeer("conflux.recon.strategies", []string{"sketch", "merkle", "ptree"},
+		"conflux.recon.sketchCapacity", 8)
+	// The server's preference is chosen by both peers
+	s, err := server.negotiateStrategy(RoleServer, client.Config())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MerkleStrategy, s)
+	s, err = client.negotiateStrategy(RoleClient, server.Config())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MerkleStrategy, s)
+	// Peers which announce no strategies support only ptree
+	s, err = server.negotiateStrategy(RoleServer, &Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, PtreeStrategy, s)
+	merkleOnly := newTestPeer("conflux.recon.strategies", []string{"merkle"})
+	_, err = merkleOnly.negotiateStrategy(RoleServer, &Config{})
+	assert.Equal(t, ErrNoCommonStrategy, err)
+}
+
+func TestStrategySession(t *testing.T) {
+	server := newTestPeer("conflux.recon.strategies", []string{"sketch", "ptree"},
+		"conflux.recon.sketchCapacity", 8)
+	client := newTestPeer("conflux.recon.strategies", []string{"merkle", "sketch", "ptree"},
+		"conflux.recon.sketchCapacity", 8)
+	for i := 1; i < 100; i++ {
+		server.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+		client.PrefixTree.Insert(Zi(P_SKS, 65537*i))
+	}
+	server.PrefixTree.Insert(Zi(P_SKS, 65539))
+	s := reconcile(t, server, client)
+	assert.Equal(t, "sketch", s.ss.Strategy)
+	assert.Equal(t, "sketch", s.cs.Strategy)
+	assert.T(t, s.cs.SketchDecoded)
+	assert.Equal(t, "{65539}", s.clientSet.String())
+}
+
+func TestNoCommonStrategy(t *testing.T) {
+	server, client := newTestPeer("conflux.recon.strategies", []string{"merkle"}), NewMemPeer()
+	s := runSession(t, server, client, nil)
+	assert.NotEqual(t, nil, s.clientErr)
+	assert.Equal(t, IncompatiblePeerError, s.serverErr)
+}
+
+// nullStrategy reconciles nothing.
+type nullStrategy struct{}
+
+func (s *nullStrategy) Name() string { return "null" }
+
+func (s *nullStrategy) Serve(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+	return nil, nil
+}
+
+func (s *nullStrategy) Initiate(p *Peer, conn net.Conn, remoteConfig *Config) ([]*Zp, error) {
+	return nil, nil
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	server := newTestPeer("conflux.recon.strategies", []string{"null", "ptree"})
+	client := newTestPeer("conflux.recon.strategies", []string{"null"})
+	err := client.Settings.Validate()
+	assert.T(t, err != nil && strings.Contains(err.Error(), `unknown strategy "null"`))
+	assert.Equal(t, []string{"ptree"}, server.strategyNames())
+	RegisterStrategy(&nullStrategy{})
+	assert.Equal(t, nil, client.Settings.Validate())
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	s := reconcile(t, server, client)
+	assert.Equal(t, "null", s.ss.Strategy)
+	assert.Equal(t, "null", s.cs.Strategy)
+	assert.Equal(t, 0, s.cs.Recovered)
+}
@@ -0,0 +1,86 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	. "github.com/cmars/conflux"
+	"sync"
+)
+
+// treeSummaries keeps summaries of the prefix tree exchanged in recon
+// sessions up to date as elements are inserted and removed through the
+// peer, rather than computing them from every element in each session.
+// Changes made to the tree other than through the peer are noticed by
+// the sizes of the summarized nodes, which are then summarized again.
+// The zero value is ready to use.
+type treeSummaries struct {
+	mu sync.Mutex
+	// Sketch of the root, and the number of elements sketched
+	sketch     *Sketch
+	sketchSize int
+	// Digests of the nodes compared in Merkle sessions holding more
+	// than the split threshold, by the binary string of their keys
+	merkle map[string]*merkleSummary
+}
+
+// merkleSummary is the number and multiset digest of the elements
+// under a node of the prefix tree.
+type merkleSummary struct {
+	size   int
+	digest *MultisetHash
+}
+
+// change updates the summaries for an element inserted, if delta is
+// 1, or removed, if -1. Nodes are summarized at keys of lengths which
+// are multiples of step.
+func (s *treeSummaries) change(z *Zp, key *Bitstring, step int, delta int) {
+	if s.sketch != nil {
+		s.sketch.Add(z)
+		s.sketchSize += delta
+	}
+	if len(s.merkle) == 0 {
+		return
+	}
+	bits := key.BinaryString()
+	for n := 0; n <= len(bits); n += step {
+		if summary, has := s.merkle[bits[:n]]; has {
+			summary.size += delta
+			if delta > 0 {
+				summary.digest.Add(z)
+			} else {
+				summary.digest.Remove(z)
+			}
+		}
+	}
+}
+
+// changeTree inserts or removes an element with change, updating the
+// summaries of the prefix tree as it does.
+func (p *Peer) changeTree(z *Zp, delta int, change func(*Zp) error) error {
+	p.summaries.mu.Lock()
+	defer p.summaries.mu.Unlock()
+	if err := change(z); err != nil {
+		return err
+	}
+	p.summaries.change(z, TreeKeys(p.PrefixTree).Key(z), p.Settings.BitQuantum(), delta)
+	return nil
+}
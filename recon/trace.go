@@ -0,0 +1,76 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+)
+
+const TRACE = "trace:"
+
+// TraceHexBytes is the number of bytes of each message payload
+// dumped in the protocol trace.
+var TraceHexBytes = 64
+
+var tracing int32
+
+// Trace reports whether protocol trace logging is enabled.
+func (s *Settings) Trace() bool {
+	return s.GetBool("conflux.recon.trace", false)
+}
+
+// SetTrace enables or disables logging of each recon message sent and
+// received. It may be called at any time.
+func SetTrace(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&tracing, 1)
+	} else {
+		atomic.StoreInt32(&tracing, 0)
+	}
+}
+
+// Tracing reports whether protocol trace logging is enabled.
+func Tracing() bool {
+	return atomic.LoadInt32(&tracing) != 0
+}
+
+// traceMsg logs a message frame, which starts with the message type
+// byte, with its payload dumped in hex.
+func traceMsg(dir string, frame []byte) {
+	if len(frame) == 0 {
+		log.Println(TRACE, dir, "empty frame")
+		return
+	}
+	payload := frame[1:]
+	dump := payload
+	if len(dump) > TraceHexBytes {
+		dump = dump[:TraceHexBytes]
+	}
+	suffix := ""
+	if len(dump) < len(payload) {
+		suffix = "..."
+	}
+	log.Printf("%s %s %v len=%d %s%s", TRACE, dir, MsgType(frame[0]), len(frame),
+		hex.EncodeToString(dump), suffix)
+}
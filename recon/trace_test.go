@@ -0,0 +1,60 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+	defer SetTrace(false)
+	buf := bytes.NewBuffer(nil)
+	WriteMsg(buf, &Done{})
+	assert.Equal(t, "", logBuf.String())
+
+	SetTrace(true)
+	assert.T(t, Tracing())
+	WriteMsg(buf, &Error{&textMsg{Text: strings.Repeat("x", 100)}})
+	_, err := ReadMsg(buf)
+	assert.Equal(t, nil, err)
+	_, err = ReadMsg(buf)
+	assert.Equal(t, nil, err)
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.T(t, strings.Contains(lines[0], "send Error len=105 00000064"))
+	assert.T(t, strings.HasSuffix(lines[0], strings.Repeat("78", TraceHexBytes-4)+"..."))
+	assert.T(t, strings.Contains(lines[1], "recv Done len=1 "))
+	assert.T(t, strings.Contains(lines[2], "recv Error len=105"))
+
+	SetTrace(false)
+	logBuf.Reset()
+	WriteMsg(buf, &Done{})
+	assert.Equal(t, "", logBuf.String())
+}
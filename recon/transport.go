@@ -0,0 +1,116 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc connects to the recon partner at addr.
+type DialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+var transportsMu sync.Mutex
+var transports = map[string]DialFunc{
+	"tcp":  dialTcp,
+	"unix": dialUnix,
+}
+
+// RegisterTransport makes a transport available to partners addressed
+// with a URL of the given scheme, such as "http://example.com/recon".
+// Partners addressed as a plain host:port use TCP.
+func RegisterTransport(scheme string, dial DialFunc) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[scheme] = dial
+}
+
+func lookupTransport(scheme string) (DialFunc, bool) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	dial, has := transports[scheme]
+	return dial, has
+}
+
+// PartnerScheme returns the transport scheme of a partner address.
+func PartnerScheme(partner string) string {
+	if i := strings.Index(partner, "://"); i > 0 {
+		return partner[:i]
+	}
+	return "tcp"
+}
+
+func ErrUnsupportedTransport(partner string) error {
+	return errors.New(fmt.Sprintf("Unsupported transport for partner %s", partner))
+}
+
+func (p *Peer) dialPartner(partner string) (net.Conn, error) {
+	if PartnerScheme(partner) == "tcp" {
+		addr := p.PartnerAddr(partner)
+		if proxyUrl := p.PartnerProxy(partner); proxyUrl != "" {
+			return dialProxy(proxyUrl, addr, time.Second*time.Duration(p.ProxyTimeout()))
+		} else if isOnion(addr) {
+			return nil, ErrOnionRequiresProxy(partner)
+		}
+		// Race IPv6 and IPv4 addresses of dual-stack partners.
+		dialer := &net.Dialer{
+			Timeout:       time.Second,
+			FallbackDelay: time.Millisecond * time.Duration(p.FallbackDelay())}
+		return dialer.Dial("tcp", addr)
+	}
+	dial, has := lookupTransport(PartnerScheme(partner))
+	if !has {
+		return nil, ErrUnsupportedTransport(partner)
+	}
+	return dial(partner, time.Second)
+}
+
+// PartnerAddr returns the host:port of a TCP partner. Partners may be
+// given without a port, in which case the default recon port is used,
+// and IPv6 literals may be given with or without brackets.
+func (s *Settings) PartnerAddr(partner string) string {
+	addr := strings.TrimPrefix(partner, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, fmt.Sprintf("%d", DefaultReconPort))
+}
+
+// FallbackDelay is the number of milliseconds to wait for the preferred
+// address family before also dialing the other address family of a
+// dual-stack partner.
+func (s *Settings) FallbackDelay() int {
+	return s.GetInt("conflux.recon.fallbackDelay", 300)
+}
+
+func dialTcp(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", strings.TrimPrefix(addr, "tcp://"), timeout)
+}
+
+func dialUnix(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", strings.TrimPrefix(addr, "unix://"), timeout)
+}
@@ -0,0 +1,247 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MaxBitQuantum is the largest supported number of key bits
+// consumed by each level of the prefix tree.
+const MaxBitQuantum = 8
+
+// ValidationErrors lists the problems found in settings.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(format string, args ...interface{}) {
+	*e = append(*e, errors.New(fmt.Sprintf(format, args...)))
+}
+
+// getInt reads an integer setting, recording an error
+// rather than panicking if it is not a number.
+func (e *ValidationErrors) getInt(key string, get func() int) (n int, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.add("%s: not an integer: %v", key, r)
+			ok = false
+		}
+	}()
+	return get(), true
+}
+
+// partners reads the partner addresses, recording an error rather
+// than panicking if a partner block is invalid.
+func (e *ValidationErrors) partners(s *Settings) (partners []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.add("conflux.recon.partner: %v", r)
+			partners = nil
+		}
+	}()
+	return s.Partners()
+}
+
+// partnerConfigs reads the partner blocks, which are
+// reported by partners if invalid.
+func (e *ValidationErrors) partnerConfigs(s *Settings) (configs []*PartnerConfig) {
+	defer func() {
+		if r := recover(); r != nil {
+			configs = nil
+		}
+	}()
+	return s.PartnerConfigs()
+}
+
+func (e *ValidationErrors) checkPort(key string, get func() int) {
+	if port, ok := e.getInt(key, get); ok && (port < 0 || port > 65535) {
+		e.add("%s: port %d out of range", key, port)
+	}
+}
+
+func (e *ValidationErrors) checkNonNegative(key string, get func() int) {
+	if n, ok := e.getInt(key, get); ok && n < 0 {
+		e.add("%s: must not be negative, got %d", key, n)
+	}
+}
+
+// Validate checks the settings for values which would prevent the peer
+// from working, returning ValidationErrors describing each problem
+// found, or nil if there are none.
+func (s *Settings) Validate() error {
+	var errs ValidationErrors
+	if s.Version() == "" {
+		errs.add("conflux.recon.version: must not be empty")
+	}
+	errs.checkPort("conflux.recon.httpPort", s.HttpPort)
+	errs.checkPort("conflux.recon.reconPort", s.ReconPort)
+	bitQuantum, bqOk := errs.getInt("conflux.recon.bitQuantum", s.BitQuantum)
+	if bqOk && (bitQuantum < 1 || bitQuantum > MaxBitQuantum) {
+		errs.add("conflux.recon.bitQuantum: must be between 1 and %d, got %d", MaxBitQuantum, bitQuantum)
+	}
+	mBar, mBarOk := errs.getInt("conflux.recon.mBar", s.MBar)
+	if mBarOk && mBar < 1 {
+		errs.add("conflux.recon.mBar: must be at least 1, got %d", mBar)
+	}
+	threshMult, tmOk := errs.getInt("conflux.recon.threshMult", s.ThreshMult)
+	if tmOk && threshMult < 1 {
+		errs.add("conflux.recon.threshMult: must be at least 1, got %d", threshMult)
+	}
+	if mBarOk && tmOk && mBar >= 1 && threshMult >= 1 && threshMult*mBar < mBar+1 {
+		errs.add("conflux.recon.mBar: %d sample points exceed the %d elements a leaf may hold; increase threshMult",
+			mBar+1, threshMult*mBar)
+	}
+	if _, err := PrimeByName(s.PrimeName()); err != nil {
+		errs.add("conflux.recon.prime: %v", err)
+	}
+	if _, err := KeysByName(s.KeysName(), s.KeySalt()); err != nil {
+		errs.add("conflux.recon.keys: %v", err)
+	}
+	if _, err := parsePrefix(s.GetString("conflux.recon.prefix", "")); err != nil {
+		errs.add("conflux.recon.prefix: %v", err)
+	}
+	if _, has := lookupPartnerSelector(s.PartnerSelection()); !has {
+		errs.add("conflux.recon.partnerSelection: unknown partner selection %q", s.PartnerSelection())
+	}
+	if webhook := s.WebhookURL(); webhook != "" {
+		if u, err := url.Parse(webhook); err != nil {
+			errs.add("conflux.recon.webhook: %v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs.add("conflux.recon.webhook: %q: expect an http or https URL", webhook)
+		}
+	}
+	if n, ok := errs.getInt("conflux.recon.webhookBatch", s.WebhookBatch); ok && n < 1 {
+		errs.add("conflux.recon.webhookBatch: must be at least 1, got %d", n)
+	}
+	switch s.RecoverPolicy() {
+	case "block", "drop":
+	case "spill":
+		if s.RecoverSpillPath() == "" {
+			errs.add("conflux.recon.recoverSpill: required by the spill recover policy")
+		}
+	default:
+		errs.add("conflux.recon.recoverPolicy: unknown policy %q", s.RecoverPolicy())
+	}
+	for _, name := range s.Strategies() {
+		if _, has := lookupStrategy(name); !has {
+			errs.add("conflux.recon.strategies: unknown strategy %q", name)
+		}
+	}
+	if n, ok := errs.getInt("conflux.recon.sketchCapacity", s.SketchCapacity); ok {
+		if n < 0 || n > MaxSketchCapacity {
+			errs.add("conflux.recon.sketchCapacity: must be between 0 and %d, got %d", MaxSketchCapacity, n)
+		} else if n > 0 && s.Prime().BitLen() > MaxSketchBits {
+			errs.add("conflux.recon.sketchCapacity: cannot sketch a %d-bit prime", s.Prime().BitLen())
+		}
+	}
+	if n, ok := errs.getInt("conflux.recon.payloadChunkSize", s.PayloadChunkSize); ok && n < 1 {
+		errs.add("conflux.recon.payloadChunkSize: must be at least 1, got %d", n)
+	}
+	if n, ok := errs.getInt("conflux.recon.gossipIntervalSecs", s.GossipIntervalSecs); ok && n < 1 {
+		errs.add("conflux.recon.gossipIntervalSecs: must be at least 1, got %d", n)
+	}
+	if n, ok := errs.getInt("conflux.recon.interpolationWorkers", s.InterpolationWorkers); ok && n < 1 {
+		errs.add("conflux.recon.interpolationWorkers: must be at least 1, got %d", n)
+	}
+	for key, get := range map[string]func() int{
+		"conflux.recon.readTimeout":       s.ReadTimeout,
+		"conflux.recon.writeTimeout":      s.WriteTimeout,
+		"conflux.recon.idleTimeout":       s.IdleTimeout,
+		"conflux.recon.keepAlive":         s.KeepAlive,
+		"conflux.recon.handshakeTimeout":  s.HandshakeTimeout,
+		"conflux.recon.maxConns":          s.MaxConns,
+		"conflux.recon.maxConnsPerHost":   s.MaxConnsPerHost,
+		"conflux.recon.recoverDedupSecs":  s.RecoverDedupSecs,
+		"conflux.recon.recoverBuffer":     s.RecoverBuffer,
+		"conflux.recon.expirySweepSecs":   s.ExpirySweepSecs,
+		"conflux.recon.catchUpMax":        s.CatchUpMax,
+		"conflux.recon.payloadMaxSize":    s.PayloadMaxSize,
+		"conflux.recon.payloadSessionMax": s.PayloadSessionMax,
+		"conflux.recon.maxDepth":          s.MaxDepth,
+	} {
+		errs.checkNonNegative(key, get)
+	}
+	if s.CatchUp() && s.NodeId() == "" {
+		errs.add("conflux.recon.nodeId: must be set to catch up with trusted peers")
+	}
+	for _, entry := range s.Blacklist() {
+		if _, err := hex.DecodeString(entry); err != nil {
+			errs.add("conflux.recon.blacklist: %q: %v", entry, err)
+		}
+	}
+	for _, addr := range s.Listen() {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs.add("conflux.recon.listen: %q: %v", addr, err)
+		}
+	}
+	for _, pc := range errs.partnerConfigs(s) {
+		for _, window := range pc.Windows {
+			if _, err := ParseReconWindow(window); err != nil {
+				errs.add("conflux.recon.partner.%s.windows: %v", pc.Name, err)
+			}
+		}
+	}
+	for _, partner := range errs.partners(s) {
+		if partner == "" {
+			continue
+		}
+		scheme := PartnerScheme(partner)
+		if _, has := lookupTransport(scheme); !has {
+			errs.add("conflux.recon.partners: %q: no transport registered for %s", partner, scheme)
+			continue
+		}
+		if scheme != "tcp" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(s.PartnerAddr(partner))
+		if err != nil {
+			errs.add("conflux.recon.partners: %q: %v", partner, err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errs.add("conflux.recon.partners: %q: invalid port %q", partner, port)
+		}
+		if proxyUrl := s.PartnerProxy(partner); proxyUrl != "" {
+			if u, err := url.Parse(proxyUrl); err != nil {
+				errs.add("conflux.recon.proxy: %q: %v", proxyUrl, err)
+			} else if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+				errs.add("conflux.recon.proxy: %q: unsupported proxy scheme %q", proxyUrl, u.Scheme)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
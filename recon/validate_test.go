@@ -0,0 +1,102 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	assert.Equal(t, nil, DefaultSettings().Validate())
+}
+
+func TestValidate(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.version", "")
+	s.Set("conflux.recon.bitQuantum", 0)
+	s.Set("conflux.recon.mBar", "lots")
+	s.Set("conflux.recon.reconPort", 70000)
+	s.Set("conflux.recon.idleTimeout", -1)
+	s.Set("conflux.recon.partners", []interface{}{
+		"keys.example.com:11370",
+		"keys.example.com:port",
+		"gopher://keys.example.com"})
+	err := s.Validate()
+	errs, is := err.(ValidationErrors)
+	assert.T(t, is)
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	assert.Equal(t, 7, len(msgs))
+	for _, expect := range []string{
+		"conflux.recon.version: must not be empty",
+		"conflux.recon.reconPort: port 70000 out of range",
+		"conflux.recon.bitQuantum: must be between 1 and 8, got 0",
+		"conflux.recon.mBar: not an integer",
+		"conflux.recon.idleTimeout: must not be negative, got -1",
+		`conflux.recon.partners: "keys.example.com:port": invalid port "port"`,
+		`conflux.recon.partners: "gopher://keys.example.com": no transport registered for gopher`,
+	} {
+		assert.Tf(t, strings.Contains(err.Error(), expect), "missing %q in %v", expect, err)
+	}
+}
+
+func TestValidateSamples(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.threshMult", 1)
+	err := s.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "increase threshMult"))
+}
+
+func TestValidatePartnerBlock(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.partner.alpha.addr", "a.example.com:11370")
+	s.Set("conflux.recon.partner.alpha.bandwidth", "fast")
+	err := s.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.HasPrefix(err.Error(), "conflux.recon.partner: "))
+}
+
+func TestValidateSketch(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.sketchCapacity", MaxSketchCapacity+1)
+	err := s.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "conflux.recon.sketchCapacity: must be between"))
+	s.Set("conflux.recon.sketchCapacity", 16)
+	assert.Equal(t, nil, s.Validate())
+}
+
+func TestValidatePrefix(t *testing.T) {
+	s := DefaultSettings()
+	s.Set("conflux.recon.prefix", "0120")
+	err := s.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "conflux.recon.prefix:"))
+	s.Set("conflux.recon.prefix", "0110")
+	assert.Equal(t, nil, s.Validate())
+	assert.Equal(t, "0110", s.ReconPrefix().BinaryString())
+}
@@ -0,0 +1,127 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/cmars/conflux"
+)
+
+// VerifyTree checks the consistency of a prefix tree: that each node's
+// size matches its elements or children, and that its sample values
+// match those computed from its elements. The tree is checked a level
+// at a time. It returns ValidationErrors describing each inconsistent
+// node, or nil if there are none, or the error reading a node.
+func VerifyTree(t PrefixTree) error {
+	var errs ValidationErrors
+	var parents []PrefixNode
+	err := WalkLevels(t, func(depth int, nodes []PrefixNode) error {
+		if err := verifySizes(t, parents, nodes, &errs); err != nil {
+			return err
+		}
+		parents = parents[:0]
+		for _, node := range nodes {
+			if err := verifyNode(t, node, &errs); err != nil {
+				return err
+			}
+			if !node.IsLeaf() {
+				parents = append(parents, node)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = verifySizes(t, parents, nil, &errs)
+	}
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// verifySizes checks that the size of each parent is the sum of the
+// sizes of its children, found in the level below.
+func verifySizes(t PrefixTree, parents []PrefixNode, level []PrefixNode, errs *ValidationErrors) error {
+	if len(parents) == 0 {
+		return nil
+	}
+	sums := make(map[string]int)
+	for _, node := range level {
+		key, err := node.Key()
+		if err != nil {
+			return err
+		}
+		sums[key.Prefix(key.BitLen()-t.BitQuantum()).String()] += node.Size()
+	}
+	for _, node := range parents {
+		key, err := node.Key()
+		if err != nil {
+			return err
+		}
+		if sum := sums[key.String()]; node.Size() != sum {
+			*errs = append(*errs, errors.New(fmt.Sprintf(
+				"node %v: size %d but children hold %d", key, node.Size(), sum)))
+		}
+	}
+	return nil
+}
+
+func verifyNode(t PrefixTree, node PrefixNode, errs *ValidationErrors) error {
+	key, err := node.Key()
+	if err != nil {
+		return err
+	}
+	elements, err := node.Elements()
+	if err != nil {
+		return err
+	}
+	if node.IsLeaf() && node.Size() != len(elements) {
+		*errs = append(*errs, errors.New(fmt.Sprintf(
+			"node %v: size %d but %d elements", key, node.Size(), len(elements))))
+	}
+	points := t.Points()
+	svalues, err := node.SValues()
+	if err != nil {
+		return err
+	}
+	if len(svalues) != len(points) {
+		*errs = append(*errs, errors.New(fmt.Sprintf(
+			"node %v: %d sample values for %d points", key, len(svalues), len(points))))
+		return nil
+	}
+	for i, point := range points {
+		expect := Zi(point.P, 1)
+		for _, z := range elements {
+			expect.Mul(expect, Z(point.P).Sub(point, z))
+		}
+		if expect.Cmp(svalues[i]) != 0 {
+			*errs = append(*errs, errors.New(fmt.Sprintf(
+				"node %v: sample value %d does not match elements", key, i)))
+			return nil
+		}
+	}
+	return nil
+}
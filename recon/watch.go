@@ -0,0 +1,154 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SettingsWatcher is called with the keys of settings which have
+// changed, whether by Reload or by Set.
+type SettingsWatcher func(s *Settings, changed []string)
+
+type settingsWatchers struct {
+	mu       sync.Mutex
+	nextId   int
+	watchers map[int]SettingsWatcher
+}
+
+// Watch calls fn each time the settings change. Watchers are called
+// synchronously by the goroutine making the change. Calling the
+// returned function removes the watcher.
+func (s *Settings) Watch(fn SettingsWatcher) (remove func()) {
+	s.watch.mu.Lock()
+	defer s.watch.mu.Unlock()
+	if s.watch.watchers == nil {
+		s.watch.watchers = make(map[int]SettingsWatcher)
+	}
+	id := s.watch.nextId
+	s.watch.nextId++
+	s.watch.watchers[id] = fn
+	return func() {
+		s.watch.mu.Lock()
+		defer s.watch.mu.Unlock()
+		delete(s.watch.watchers, id)
+	}
+}
+
+func (s *Settings) hasWatchers() bool {
+	s.watch.mu.Lock()
+	defer s.watch.mu.Unlock()
+	return len(s.watch.watchers) > 0
+}
+
+func (s *Settings) notify(changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+	s.watch.mu.Lock()
+	var watchers []SettingsWatcher
+	for _, fn := range s.watch.watchers {
+		watchers = append(watchers, fn)
+	}
+	s.watch.mu.Unlock()
+	for _, fn := range watchers {
+		fn(s, changed)
+	}
+}
+
+// flatten collects the values in a settings tree by full key.
+func flatten(prefix string, tree *toml.TomlTree, values map[string]string) {
+	for _, k := range tree.Keys() {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if subtree, is := tree.Get(k).(*toml.TomlTree); is {
+			flatten(key, subtree, values)
+		} else {
+			values[key] = fmt.Sprintf("%v", tree.Get(k))
+		}
+	}
+}
+
+// changedKeys returns the keys whose values differ between two trees.
+func changedKeys(before, after *toml.TomlTree) (changed []string) {
+	beforeValues, afterValues := make(map[string]string), make(map[string]string)
+	flatten("", before, beforeValues)
+	flatten("", after, afterValues)
+	for key, value := range afterValues {
+		if prev, has := beforeValues[key]; !has || prev != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range beforeValues {
+		if _, has := afterValues[key]; !has {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return
+}
+
+// ReloadOnChange polls the files the settings were loaded from, and
+// reloads the peer's settings when they are modified. Calling the
+// returned function stops polling.
+func (p *Peer) ReloadOnChange(interval time.Duration) (stop func()) {
+	done := make(chan interface{})
+	modTimes := func() (times []time.Time) {
+		for _, path := range p.Settings.sourcePaths {
+			if fi, err := os.Stat(path); err == nil {
+				times = append(times, fi.ModTime())
+			} else {
+				times = append(times, time.Time{})
+			}
+		}
+		return
+	}
+	last := modTimes()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				current := modTimes()
+				if fmt.Sprint(current) == fmt.Sprint(last) {
+					continue
+				}
+				last = current
+				if err := p.Reload(); err != nil {
+					log.Println(SERVE, "Reload:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,100 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchSet(t *testing.T) {
+	s := DefaultSettings()
+	var changes [][]string
+	remove := s.Watch(func(_ *Settings, changed []string) {
+		changes = append(changes, changed)
+	})
+	s.Set("conflux.recon.httpPort", 11381)
+	s.Set("conflux.recon.httpPort", 11381)
+	s.Set("conflux.recon.reconPort", 11380)
+	assert.Equal(t, [][]string{{"conflux.recon.httpPort"}, {"conflux.recon.reconPort"}}, changes)
+	remove()
+	s.Set("conflux.recon.httpPort", 11391)
+	assert.Equal(t, 2, len(changes))
+}
+
+func TestWatchReload(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.toml", `
+[conflux.recon]
+httpPort = 11371
+partners = ["a.example.com:11370"]
+`)
+	defer cleanup()
+	s, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	changes := make(chan []string, 1)
+	s.Watch(func(_ *Settings, changed []string) {
+		changes <- changed
+	})
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(`
+[conflux.recon]
+httpPort = 11381
+partners = ["a.example.com:11370"]
+gossipIntervalSecs = 30
+`), 0644))
+	assert.Equal(t, nil, s.Reload())
+	assert.Equal(t, []string{"conflux.recon.gossipIntervalSecs", "conflux.recon.httpPort"}, <-changes)
+}
+
+func TestReloadOnChange(t *testing.T) {
+	path, cleanup := writeSettings(t, "conflux.toml", `
+[conflux.recon]
+httpPort = 11371
+`)
+	defer cleanup()
+	settings, err := LoadSettings(path)
+	assert.Equal(t, nil, err)
+	tree := new(MemPrefixTree)
+	tree.Init()
+	p := NewPeer(settings, tree)
+	changes := make(chan []string, 1)
+	p.Settings.Watch(func(_ *Settings, changed []string) {
+		changes <- changed
+	})
+	stop := p.ReloadOnChange(10 * time.Millisecond)
+	defer stop()
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(`
+[conflux.recon]
+httpPort = 11381
+`), 0644))
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	select {
+	case changed := <-changes:
+		assert.Equal(t, []string{"conflux.recon.httpPort"}, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("settings not reloaded")
+	}
+	assert.Equal(t, 11381, p.HttpPort())
+}
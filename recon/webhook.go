@@ -0,0 +1,168 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WebhookURL is the URL to which JSON notifications of completed
+// sessions and the elements they recovered are posted. Webhooks are
+// disabled if empty.
+func (s *Settings) WebhookURL() string {
+	return s.GetString("conflux.recon.webhook", "")
+}
+
+// WebhookBatch is the largest number of recovered elements
+// posted in a single notification.
+func (s *Settings) WebhookBatch() int {
+	return s.GetInt("conflux.recon.webhookBatch", 1000)
+}
+
+// WebhookQueue is the number of notifications held for posting to
+// the webhook, beyond which they are dropped.
+const WebhookQueue = 256
+
+// WebhookEvent is a notification posted to a webhook. A session event
+// summarizes a completed recon session. The elements it recovered
+// follow in recovered events, as the hex digests of their bytes, in
+// batches of no more than WebhookBatch.
+type WebhookEvent struct {
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	Session  *SessionResult `json:"session,omitempty"`
+	Partner  string         `json:"partner,omitempty"`
+	Elements []string       `json:"elements,omitempty"`
+}
+
+// Webhook posts notifications of completed sessions to a URL.
+// Notifications are posted in the background, in the order the
+// sessions complete, and are dropped if the URL cannot keep up.
+type Webhook struct {
+	URL       string
+	BatchSize int
+	Client    *http.Client
+	events    chan *WebhookEvent
+}
+
+// NewWebhook creates a webhook posting to url, which
+// must be started before its hook is called.
+func NewWebhook(url string, batchSize int) *Webhook {
+	return &Webhook{
+		URL:       url,
+		BatchSize: batchSize,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		events:    make(chan *WebhookEvent, WebhookQueue)}
+}
+
+// Start posts queued notifications until Stop is called.
+func (w *Webhook) Start() {
+	go func() {
+		for event := range w.events {
+			if err := w.post(event); err != nil {
+				log.Println(SERVE, "webhook:", err)
+			}
+		}
+	}()
+}
+
+// Stop posts the notifications already queued, and no more.
+func (w *Webhook) Stop() {
+	close(w.events)
+}
+
+// Hook returns the session hook queueing the notifications
+// of each completed session.
+func (w *Webhook) Hook() SessionHook {
+	return func(stats *SessionStats, err error) {
+		result := &SessionResult{SessionStats: stats}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		now := time.Now()
+		w.queue(&WebhookEvent{Type: "session", Time: now, Session: result})
+		var batch []string
+		for i, z := range stats.Elements {
+			batch = append(batch, fmt.Sprintf("%x", z.Bytes()))
+			if len(batch) == w.BatchSize || i == len(stats.Elements)-1 {
+				w.queue(&WebhookEvent{Type: "recovered", Time: now, Partner: stats.Partner, Elements: batch})
+				batch = nil
+			}
+		}
+	}
+}
+
+func (w *Webhook) queue(event *WebhookEvent) {
+	select {
+	case w.events <- event:
+	default:
+		log.Println(SERVE, "webhook: queue full, dropping", event.Type, "notification")
+		sessionMetrics.Add("webhookDropped", 1)
+	}
+}
+
+func (w *Webhook) post(event *WebhookEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("%s: %s", w.URL, resp.Status))
+	}
+	return nil
+}
+
+// startWebhook posts notifications of the peer's sessions
+// to the webhook in its settings, if any.
+func (p *Peer) startWebhook() {
+	if p.webhook != nil || p.WebhookURL() == "" {
+		return
+	}
+	p.webhook = NewWebhook(p.WebhookURL(), p.WebhookBatch())
+	p.webhook.Start()
+	p.webhookHook = len(p.SessionHooks)
+	p.SessionHooks = append(p.SessionHooks, p.webhook.Hook())
+}
+
+// stopWebhook stops the peer's webhook and removes its hook, so that
+// the webhook is started again from the settings when the peer is.
+func (p *Peer) stopWebhook() {
+	if p.webhook == nil {
+		return
+	}
+	p.webhook.Stop()
+	// Copy the remaining hooks, since namespaces share the slice
+	i := p.webhookHook
+	p.SessionHooks = append(p.SessionHooks[:i:i], p.SessionHooks[i+1:]...)
+	p.webhook = nil
+}
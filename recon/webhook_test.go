@@ -0,0 +1,109 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bmizerany/assert"
+	. "github.com/cmars/conflux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func webhookServer(t *testing.T) (*httptest.Server, chan *WebhookEvent) {
+	events := make(chan *WebhookEvent, WebhookQueue)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, nil, json.NewDecoder(r.Body).Decode(&event))
+		events <- &event
+	}))
+	return ts, events
+}
+
+func TestWebhook(t *testing.T) {
+	ts, events := webhookServer(t)
+	defer ts.Close()
+	w := NewWebhook(ts.URL, 2)
+	w.Start()
+	defer w.Stop()
+	stats := &SessionStats{Role: RoleClient, Partner: "192.0.2.1:11370"}
+	stats.Elements = []*Zp{Zi(P_SKS, 65537), Zi(P_SKS, 65539), Zi(P_SKS, 65541)}
+	stats.Recovered = len(stats.Elements)
+	w.Hook()(stats, errors.New("fail"))
+	event := <-events
+	assert.Equal(t, "session", event.Type)
+	assert.Equal(t, 3, event.Session.Recovered)
+	assert.Equal(t, "fail", event.Session.Error)
+	event = <-events
+	assert.Equal(t, "recovered", event.Type)
+	assert.Equal(t, "192.0.2.1:11370", event.Partner)
+	assert.Equal(t, []string{"010001", "010003"}, event.Elements)
+	event = <-events
+	assert.Equal(t, []string{"010005"}, event.Elements)
+}
+
+func TestPeerWebhook(t *testing.T) {
+	ts, events := webhookServer(t)
+	defer ts.Close()
+	server, client := NewMemPeer(), NewMemPeer()
+	client.Settings.Set("conflux.recon.webhook", ts.URL)
+	assert.Equal(t, nil, client.Settings.Validate())
+	client.startWebhook()
+	defer client.webhook.Stop()
+	server.PrefixTree.Insert(Zi(P_SKS, 65537))
+	s := reconcile(t, server, client)
+	assert.Equal(t, 1, s.cs.Recovered)
+	event := <-events
+	assert.Equal(t, "session", event.Type)
+	assert.Equal(t, RoleClient, event.Session.Role)
+	event = <-events
+	assert.Equal(t, 1, len(event.Elements))
+
+	client.Settings.Set("conflux.recon.webhook", "ftp://example.com/")
+	assert.NotEqual(t, nil, client.Settings.Validate())
+}
+
+func TestPeerWebhookRestart(t *testing.T) {
+	p := NewMemPeer()
+	p.Settings.Set("conflux.recon.listen", []interface{}{"127.0.0.1:0"})
+	p.Settings.Set("conflux.recon.gossipIntervalSecs", 1)
+	p.Settings.Set("conflux.recon.webhook", "http://127.0.0.1:1/first")
+	p.Start()
+	w := p.webhook
+	assert.Equal(t, "http://127.0.0.1:1/first", w.URL)
+	assert.Equal(t, 1, len(p.SessionHooks))
+	p.Stop()
+	// The webhook stops posting with the peer
+	_, open := <-w.events
+	assert.T(t, !open)
+	assert.T(t, p.webhook == nil)
+	assert.Equal(t, 0, len(p.SessionHooks))
+	// and is started again from the settings
+	p.Settings.Set("conflux.recon.webhook", "http://127.0.0.1:1/second")
+	p.startWebhook()
+	defer p.stopWebhook()
+	assert.Equal(t, "http://127.0.0.1:1/second", p.webhook.URL)
+	assert.Equal(t, 1, len(p.SessionHooks))
+}
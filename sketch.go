@@ -0,0 +1,225 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Sketch is a PinSketch of a set of integers, the BCH syndromes
+// described by Dodis, Ostrovsky, Reyzin and Smith, as in Bitcoin's
+// minisketch. The sketches of two sets combine into a sketch of their
+// symmetric difference, which can be decoded if it has no more
+// elements than the capacity of the sketches. A sketch of capacity c
+// is c field elements, whatever the size of the set.
+//
+// The integers are taken as elements of the smallest binary field
+// GF(2^m) holding the finite field p. Zero cannot be sketched.
+type Sketch struct {
+	p     *big.Int
+	field *gf2m
+	// Odd power sums of the elements, s1, s3, ..., s(2c-1)
+	syndromes [][]uint64
+}
+
+var ErrSketchCapacity error = errors.New("Sketch difference exceeds capacity")
+
+// MaxSketchBits is the size of the largest finite field which can be sketched.
+const MaxSketchBits = 512
+
+// NewSketch creates an empty sketch of integers in the finite
+// field p, which can decode up to capacity differences.
+func NewSketch(p *big.Int, capacity int) (*Sketch, error) {
+	field := gf2FieldBits(p.BitLen())
+	if field == nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Cannot sketch a %d-bit field, at most %d bits", p.BitLen(), MaxSketchBits))
+	}
+	if capacity < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid sketch capacity: %d", capacity))
+	}
+	s := &Sketch{p: p, field: field, syndromes: make([][]uint64, capacity)}
+	for i := range s.syndromes {
+		s.syndromes[i] = field.zero()
+	}
+	return s, nil
+}
+
+// Capacity returns the number of differences the sketch can decode.
+func (s *Sketch) Capacity() int {
+	return len(s.syndromes)
+}
+
+// Truncated returns a copy of the sketch of lesser capacity. The
+// syndromes of a sketch begin with those of every smaller one, so
+// the copy sketches the same set.
+func (s *Sketch) Truncated(capacity int) (*Sketch, error) {
+	if capacity < 1 || capacity > len(s.syndromes) {
+		return nil, errors.New(fmt.Sprintf(
+			"Cannot truncate sketch of capacity %d to %d", len(s.syndromes), capacity))
+	}
+	syndromes := make([][]uint64, capacity)
+	copy(syndromes, s.syndromes)
+	return &Sketch{p: s.p, field: s.field, syndromes: syndromes}, nil
+}
+
+// Add adds an integer to the set, or removes it if already added.
+func (s *Sketch) Add(z *Zp) {
+	x := s.field.fromInt(z.Int)
+	x2 := s.field.sqr(x)
+	for i := range s.syndromes {
+		s.syndromes[i] = s.field.add(s.syndromes[i], x)
+		x = s.field.mul(x, x2)
+	}
+}
+
+// Merge combines another sketch of the same field and capacity into
+// this one, which then sketches the symmetric difference of the sets.
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.field != other.field || len(s.syndromes) != len(other.syndromes) {
+		return errors.New("Cannot merge sketches of different fields or capacities")
+	}
+	for i := range s.syndromes {
+		s.syndromes[i] = s.field.add(s.syndromes[i], other.syndromes[i])
+	}
+	return nil
+}
+
+// Decode returns the integers in the sketched set, or
+// ErrSketchCapacity if there are more than the capacity.
+func (s *Sketch) Decode() ([]*Zp, error) {
+	f := s.field
+	// All power sums s1...s(2c), where s(2i) = s(i)^2
+	sums := make([][]uint64, 2*len(s.syndromes))
+	for i := range sums {
+		if i%2 == 0 {
+			sums[i] = s.syndromes[i/2]
+		} else {
+			sums[i] = f.sqr(sums[i/2])
+		}
+	}
+	locator, ok := s.berlekampMassey(sums)
+	if !ok {
+		return nil, ErrSketchCapacity
+	}
+	degree := len(locator) - 1
+	if degree == 0 {
+		return nil, nil
+	}
+	// The integers are the roots of the reversed locator polynomial
+	poly := make([][]uint64, len(locator))
+	for i := range locator {
+		poly[degree-i] = locator[i]
+	}
+	if f.isZero(poly[0]) || !f.polySplits(poly) {
+		return nil, ErrSketchCapacity
+	}
+	roots, ok := f.polyRoots(poly, 0)
+	if !ok || len(roots) != degree {
+		return nil, ErrSketchCapacity
+	}
+	result := make([]*Zp, len(roots))
+	for i, root := range roots {
+		v := f.toInt(root)
+		if v.Cmp(s.p) >= 0 {
+			return nil, ErrSketchCapacity
+		}
+		result[i] = &Zp{Int: v, P: s.p}
+	}
+	return result, nil
+}
+
+// berlekampMassey returns the shortest linear recurrence, as the
+// connection polynomial with constant term 1, generating the power
+// sums. Subtraction is addition in characteristic 2. A polynomial of
+// lower degree than the recurrence cannot locate the integers.
+func (s *Sketch) berlekampMassey(sums [][]uint64) ([][]uint64, bool) {
+	f := s.field
+	c := [][]uint64{f.one()}
+	b := [][]uint64{f.one()}
+	bInv := f.one()
+	l, m := 0, 1
+	for n := range sums {
+		d := sums[n]
+		for i := 1; i <= l && i < len(c); i++ {
+			d = f.add(d, f.mul(c[i], sums[n-i]))
+		}
+		if f.isZero(d) {
+			m++
+			continue
+		}
+		coeff := f.mul(d, bInv)
+		t := c
+		next := make([][]uint64, len(c))
+		copy(next, c)
+		for len(next) < len(b)+m {
+			next = append(next, f.zero())
+		}
+		for i := range b {
+			next[i+m] = f.add(next[i+m], f.mul(coeff, b[i]))
+		}
+		c = next
+		if 2*l <= n {
+			l = n + 1 - l
+			b = t
+			bInv = f.inv(d)
+			m = 1
+		} else {
+			m++
+		}
+	}
+	c = f.polyTrim(c)
+	return c, len(c) == l+1
+}
+
+// Bytes returns the syndromes of the sketch, each in m/8 bytes.
+func (s *Sketch) Bytes() []byte {
+	size := s.field.m / 8
+	buf := make([]byte, 0, size*len(s.syndromes))
+	for _, syn := range s.syndromes {
+		b := make([]byte, size)
+		s.field.toInt(syn).FillBytes(b)
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+// SetBytes sets the syndromes of the sketch from Bytes.
+func (s *Sketch) SetBytes(buf []byte) error {
+	size := s.field.m / 8
+	if len(buf) != size*len(s.syndromes) {
+		return errors.New(fmt.Sprintf(
+			"Expected %d bytes of sketch, got %d", size*len(s.syndromes), len(buf)))
+	}
+	for i := range s.syndromes {
+		s.syndromes[i] = s.field.fromInt(big.NewInt(0).SetBytes(buf[i*size : (i+1)*size]))
+	}
+	return nil
+}
+
+// ByteLen returns the size of the sketch in bytes.
+func (s *Sketch) ByteLen() int {
+	return len(s.syndromes) * s.field.m / 8
+}
@@ -0,0 +1,221 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"math/big"
+	mrand "math/rand"
+	"testing"
+)
+
+// gf2Irreducible tests the field polynomial with Rabin's test over
+// GF(2)[x], holding polynomials as the bits of integers.
+func gf2Irreducible(f *gf2m) bool {
+	poly := big.NewInt(0).SetBit(big.NewInt(0), f.m, 1)
+	for _, e := range f.poly {
+		poly.SetBit(poly, e, 1)
+	}
+	mulmod := func(a, b *big.Int) *big.Int {
+		r, a := big.NewInt(0), big.NewInt(0).Set(a)
+		for i := 0; i < b.BitLen(); i++ {
+			if b.Bit(i) == 1 {
+				r.Xor(r, a)
+			}
+			a.Lsh(a, 1)
+			if a.Bit(f.m) == 1 {
+				a.Xor(a, poly)
+			}
+		}
+		return r
+	}
+	gcd := func(a, b *big.Int) *big.Int {
+		a, b = big.NewInt(0).Set(a), big.NewInt(0).Set(b)
+		for b.Sign() != 0 {
+			for a.BitLen() >= b.BitLen() && a.Sign() != 0 {
+				a.Xor(a, big.NewInt(0).Lsh(b, uint(a.BitLen()-b.BitLen())))
+			}
+			a, b = b, a
+		}
+		return a
+	}
+	xpow2k := func(k int) *big.Int {
+		x := big.NewInt(2)
+		for i := 0; i < k; i++ {
+			x = mulmod(x, x)
+		}
+		return x
+	}
+	if xpow2k(f.m).Cmp(big.NewInt(2)) != 0 {
+		return false
+	}
+	// m is a multiple of 64, so its prime factors are 2 and those of m/64
+	for _, q := range []int{2, 3, 5, 7} {
+		if f.m%q == 0 {
+			g := gcd(poly, big.NewInt(0).Xor(xpow2k(f.m/q), big.NewInt(2)))
+			if g.Cmp(big.NewInt(1)) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestGf2FieldsIrreducible(t *testing.T) {
+	for _, f := range gf2Fields {
+		assert.Tf(t, gf2Irreducible(f), "GF(2^%d)", f.m)
+	}
+}
+
+func TestGf2Inverse(t *testing.T) {
+	rnd := mrand.New(mrand.NewSource(1))
+	for _, f := range gf2Fields {
+		for i := 0; i < 4; i++ {
+			a := f.zero()
+			for j := range a {
+				a[j] = rnd.Uint64()
+			}
+			assert.T(t, f.equal(f.one(), f.mul(a, f.inv(a))))
+			assert.Equal(t, 0, f.toInt(a).Cmp(f.toInt(f.fromInt(f.toInt(a)))))
+		}
+	}
+}
+
+func randSketchSet(rnd *mrand.Rand, p *big.Int, n int) []*Zp {
+	set := NewZSet()
+	for set.Len() < n {
+		z := Zi(p, 0)
+		z.Int.Rand(rnd, p)
+		if !z.IsZero() {
+			set.Add(z)
+		}
+	}
+	return set.Items()
+}
+
+func testSketchDecode(t *testing.T, p *big.Int, capacity, common, diff int) {
+	rnd := mrand.New(mrand.NewSource(int64(capacity*1000 + diff)))
+	elements := randSketchSet(rnd, p, common+diff)
+	local, err := NewSketch(p, capacity)
+	assert.Equal(t, nil, err)
+	remote, err := NewSketch(p, capacity)
+	assert.Equal(t, nil, err)
+	expect := NewZSet()
+	for i, z := range elements {
+		switch {
+		case i < common:
+			local.Add(z)
+			remote.Add(z)
+		case i%2 == 0:
+			local.Add(z)
+			expect.Add(z)
+		default:
+			remote.Add(z)
+			expect.Add(z)
+		}
+	}
+	assert.Equal(t, nil, local.Merge(remote))
+	decoded, err := local.Decode()
+	if diff > capacity {
+		assert.Equal(t, ErrSketchCapacity, err)
+		return
+	}
+	assert.Equalf(t, nil, err, "p=%d bits capacity=%d diff=%d", p.BitLen(), capacity, diff)
+	assert.Equal(t, expect.String(), NewZSet(decoded...).String())
+}
+
+func TestSketchDecode(t *testing.T) {
+	for _, p := range []*big.Int{P_SKS, P_128} {
+		for _, diff := range []int{0, 1, 2, 7, 8} {
+			testSketchDecode(t, p, 8, 100, diff)
+		}
+	}
+}
+
+func TestSketchOverCapacity(t *testing.T) {
+	for _, diff := range []int{9, 12, 30} {
+		testSketchDecode(t, P_SKS, 8, 10, diff)
+	}
+}
+
+func TestSketchBytes(t *testing.T) {
+	s, err := NewSketch(P_SKS, 4)
+	assert.Equal(t, nil, err)
+	s.Add(Zi(P_SKS, 65537))
+	s.Add(Zi(P_SKS, 65539))
+	assert.Equal(t, 4*24, s.ByteLen())
+	copied, _ := NewSketch(P_SKS, 4)
+	assert.Equal(t, nil, copied.SetBytes(s.Bytes()))
+	decoded, err := copied.Decode()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{65537, 65539}", NewZSet(decoded...).String())
+	assert.NotEqual(t, nil, copied.SetBytes(s.Bytes()[1:]))
+	// Adding an element again removes it
+	s.Add(Zi(P_SKS, 65537))
+	decoded, err = s.Decode()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{65539}", NewZSet(decoded...).String())
+}
+
+func TestSketchTruncated(t *testing.T) {
+	s, err := NewSketch(P_SKS, 8)
+	assert.Equal(t, nil, err)
+	small, err := NewSketch(P_SKS, 3)
+	assert.Equal(t, nil, err)
+	for _, z := range []*Zp{Zi(P_SKS, 65537), Zi(P_SKS, 65539)} {
+		s.Add(z)
+		small.Add(z)
+	}
+	truncated, err := s.Truncated(3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, small.Bytes(), truncated.Bytes())
+	// Truncated copies are independent of the sketch
+	s.Add(Zi(P_SKS, 65541))
+	decoded, err := truncated.Decode()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{65537, 65539}", NewZSet(decoded...).String())
+	_, err = s.Truncated(9)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSketchField(t *testing.T) {
+	_, err := NewSketch(big.NewInt(0).Lsh(big.NewInt(1), MaxSketchBits+1), 4)
+	assert.NotEqual(t, nil, err)
+	_, err = NewSketch(P_SKS, 0)
+	assert.NotEqual(t, nil, err)
+	a, _ := NewSketch(P_SKS, 4)
+	b, _ := NewSketch(P_SKS, 5)
+	assert.NotEqual(t, nil, a.Merge(b))
+}
+
+func BenchmarkGf2Mul(b *testing.B) {
+	rnd := mrand.New(mrand.NewSource(1))
+	f := gf2FieldBits(P_SKS.BitLen())
+	x, y := f.zero(), f.zero()
+	for i := range x {
+		x[i], y[i] = rnd.Uint64(), rnd.Uint64()
+	}
+	for i := 0; i < b.N; i++ {
+		x = f.mul(x, y)
+	}
+}
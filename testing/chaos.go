@@ -0,0 +1,105 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package testing
+
+import (
+	"errors"
+	. "github.com/cmars/conflux"
+	. "github.com/cmars/conflux/recon"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrChaosBackend error = errors.New("Simulated prefix tree backend failure")
+
+// ChaosTree injects faults into the prefix tree it wraps, as a flaky
+// storage backend would. Lookups and updates fail at random, before
+// reaching the tree, and each is delayed by a random latency, which
+// is reported to Elapse rather than slept.
+type ChaosTree struct {
+	PrefixTree
+	// ErrorRate is the fraction of operations which fail.
+	ErrorRate float64
+	// MaxLatency is the greatest latency added to each operation.
+	MaxLatency time.Duration
+	// Elapse is called with the latency of each operation, if set.
+	Elapse func(time.Duration)
+	// Errors counts the failures injected.
+	Errors int
+	mu     sync.Mutex
+	rnd    *rand.Rand
+}
+
+// NewChaosTree wraps tree, drawing faults from a source seeded with seed.
+// No faults are injected until ErrorRate or MaxLatency is set.
+func NewChaosTree(tree PrefixTree, seed int64) *ChaosTree {
+	return &ChaosTree{PrefixTree: tree, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// fault delays an operation, and returns ErrChaosBackend if it fails.
+func (t *ChaosTree) fault() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	latency := time.Duration(t.rnd.Int63n(int64(t.MaxLatency) + 1))
+	if latency > 0 && t.Elapse != nil {
+		t.Elapse(latency)
+	}
+	if t.rnd.Float64() < t.ErrorRate {
+		t.Errors++
+		return ErrChaosBackend
+	}
+	return nil
+}
+
+func (t *ChaosTree) Root() (PrefixNode, error) {
+	if err := t.fault(); err != nil {
+		return nil, err
+	}
+	return t.PrefixTree.Root()
+}
+
+func (t *ChaosTree) Node(key *Bitstring) (PrefixNode, error) {
+	if err := t.fault(); err != nil {
+		return nil, err
+	}
+	return t.PrefixTree.Node(key)
+}
+
+func (t *ChaosTree) Insert(z *Zp) error {
+	if err := t.fault(); err != nil {
+		return err
+	}
+	return t.PrefixTree.Insert(z)
+}
+
+func (t *ChaosTree) Remove(z *Zp) error {
+	if err := t.fault(); err != nil {
+		return err
+	}
+	return t.PrefixTree.Remove(z)
+}
+
+// Keys returns the key derivation of the wrapped tree.
+func (t *ChaosTree) Keys() KeyStrategy {
+	return TreeKeys(t.PrefixTree)
+}
@@ -0,0 +1,218 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package testing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrSimDisconnected error = errors.New("Simulated disconnect")
+var ErrSimDropped error = errors.New("Simulated read timeout after a dropped message")
+
+// simTimeout is returned by a read whose deadline has passed.
+type simTimeout struct{}
+
+func (e simTimeout) Error() string   { return "Simulated read deadline exceeded" }
+func (e simTimeout) Timeout() bool   { return true }
+func (e simTimeout) Temporary() bool { return true }
+
+// simAddr is the address of a simulated peer.
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// simPipe is an in-process, full duplex connection. Unlike net.Pipe,
+// writes are buffered rather than waiting on the reader, as they would
+// be on a socket, since both peers write their config before reading.
+//
+// Deadlines are kept in virtual time: a read with a deadline times out
+// once the other end is also waiting to read, when nothing more could
+// arrive before the deadline, however long it is.
+type simPipe struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	bufs    [2]bytes.Buffer
+	waiting [2]bool
+	closed  bool
+	err     error
+}
+
+// Fault describes how a simulated session is interrupted.
+type Fault int
+
+const (
+	NoFault = Fault(iota)
+	// FaultDrop loses a message. The peer waiting for it times out,
+	// failing the session.
+	FaultDrop = Fault(iota)
+	// FaultDisconnect breaks the connection as a message is sent.
+	FaultDisconnect = Fault(iota)
+	// FaultCorrupt flips a bit in a message sent.
+	FaultCorrupt = Fault(iota)
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultDrop:
+		return "drop"
+	case FaultDisconnect:
+		return "disconnect"
+	case FaultCorrupt:
+		return "corrupt"
+	}
+	return "none"
+}
+
+// simConn is one end of a simPipe. Each message written is delayed by
+// a random latency, which is added to the session's virtual duration
+// rather than slept, and the fault planned for the session, if any, is
+// injected on this end's faultAt'th write.
+type simConn struct {
+	pipe          *simPipe
+	end           int
+	local, remote net.Addr
+	session       *SimSession
+	rnd           *rand.Rand
+	writes        int
+	fault         Fault
+	faultAt       int
+	deadline      bool
+}
+
+func newSimPipe() *simPipe {
+	p := &simPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// shutdown closes both ends of the pipe. Data already written may still
+// be read, unless err breaks the connection.
+func (p *simPipe) shutdown(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed, p.err = true, err
+	}
+	p.cond.Broadcast()
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	p := c.pipe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf := &p.bufs[1-c.end]
+	p.waiting[c.end] = true
+	p.cond.Broadcast()
+	defer func() { p.waiting[c.end] = false }()
+	for buf.Len() == 0 && !p.closed {
+		if c.deadline && p.waiting[1-c.end] && p.bufs[c.end].Len() == 0 {
+			return 0, simTimeout{}
+		}
+		p.cond.Wait()
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	if buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return buf.Read(b)
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	p := c.pipe
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	c.writes++
+	c.session.elapse(time.Duration(c.rnd.Int63n(int64(c.session.sim.MaxLatency) + 1)))
+	if c.fault != NoFault && c.writes == c.faultAt {
+		p.mu.Unlock()
+		c.session.Fault = c.fault
+		switch c.fault {
+		case FaultDrop:
+			c.session.elapse(c.session.sim.DropTimeout)
+			p.shutdown(ErrSimDropped)
+			return len(b), nil
+		case FaultCorrupt:
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.bufs[c.end].Write(c.corrupt(b))
+			p.cond.Broadcast()
+			return len(b), nil
+		default:
+			p.shutdown(ErrSimDisconnected)
+			return 0, ErrSimDisconnected
+		}
+	}
+	defer p.mu.Unlock()
+	p.bufs[c.end].Write(b)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+// corrupt returns a copy of b with a random bit flipped. The length
+// and type of the first message written are left intact, so that the
+// damage reaches the message decoders rather than the framing.
+func (c *simConn) corrupt(b []byte) []byte {
+	data := append([]byte(nil), b...)
+	start := 0
+	if len(data) > 5 {
+		start = 5
+	}
+	if len(data) > start {
+		i := start + c.rnd.Intn(len(data)-start)
+		data[i] ^= 1 << uint(c.rnd.Intn(8))
+	}
+	return data
+}
+
+func (c *simConn) Close() error {
+	c.pipe.shutdown(nil)
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr  { return c.local }
+func (c *simConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.pipe.mu.Lock()
+	defer c.pipe.mu.Unlock()
+	c.deadline = !t.IsZero()
+	return nil
+}
+
+// Writes never block, so write deadlines have no effect.
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
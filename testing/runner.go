@@ -86,7 +86,9 @@ POLLING:
 			peer1.ExecCmd(func() error {
 				root1, err := peer1.Root()
 				assert.Equal(t, err, nil)
-				zs1 = NewZSet(root1.Elements()...)
+				elements, err := root1.Elements()
+				assert.Equal(t, err, nil)
+				zs1 = NewZSet(elements...)
 				return err
 			})
 		case r2, ok := <-peer2.RecoverChan:
@@ -102,7 +104,9 @@ POLLING:
 			peer2.ExecCmd(func() error {
 				root2, err := peer2.Root()
 				assert.Equal(t, err, nil)
-				zs2 = NewZSet(root2.Elements()...)
+				elements, err := root2.Elements()
+				assert.Equal(t, err, nil)
+				zs2 = NewZSet(elements...)
 				return err
 			})
 		case _ = <-timer.C:
@@ -175,7 +179,9 @@ POLLING:
 			peer1.ExecCmd(func() error {
 				root1, err := peer1.Root()
 				assert.Equal(t, err, nil)
-				zs1 = NewZSet(root1.Elements()...)
+				elements, err := root1.Elements()
+				assert.Equal(t, err, nil)
+				zs1 = NewZSet(elements...)
 				return err
 			})
 		case r2, ok := <-peer2.RecoverChan:
@@ -191,7 +197,9 @@ POLLING:
 			peer2.ExecCmd(func() error {
 				root2, err := peer2.Root()
 				assert.Equal(t, err, nil)
-				zs2 = NewZSet(root2.Elements()...)
+				elements, err := root2.Elements()
+				assert.Equal(t, err, nil)
+				zs2 = NewZSet(elements...)
 				return err
 			})
 		case _ = <-timer.C:
@@ -257,7 +265,7 @@ POLLING:
 			peer1.ExecCmd(func() error {
 				root1, err := peer1.Root()
 				assert.Equal(t, err, nil)
-				log.Println("Peer1 has", len(root1.Elements()))
+				log.Println("Peer1 has", root1.Size())
 				return nil
 			})
 			items := r1.RemoteElements
@@ -270,7 +278,9 @@ POLLING:
 			peer1.ExecCmd(func() error {
 				root1, err := peer1.Root()
 				assert.Equal(t, err, nil)
-				zs1 = NewZSet(root1.Elements()...)
+				elements, err := root1.Elements()
+				assert.Equal(t, err, nil)
+				zs1 = NewZSet(elements...)
 				return err
 			})
 		case r2, ok := <-peer2.RecoverChan:
@@ -280,7 +290,7 @@ POLLING:
 			peer2.ExecCmd(func() error {
 				root2, err := peer2.Root()
 				assert.Equal(t, err, nil)
-				log.Println("Peer2 has", len(root2.Elements()))
+				log.Println("Peer2 has", root2.Size())
 				return nil
 			})
 			items := r2.RemoteElements
@@ -293,7 +303,9 @@ POLLING:
 			peer2.ExecCmd(func() error {
 				root2, err := peer2.Root()
 				assert.Equal(t, err, nil)
-				zs2 = NewZSet(root2.Elements()...)
+				elements, err := root2.Elements()
+				assert.Equal(t, err, nil)
+				zs2 = NewZSet(elements...)
 				return err
 			})
 		case _ = <-timer.C:
@@ -0,0 +1,351 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package testing
+
+import (
+	"fmt"
+	. "github.com/cmars/conflux"
+	. "github.com/cmars/conflux/recon"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultDropTimeout is the virtual time a simulated peer waits for a
+// dropped message before failing the session.
+const DefaultDropTimeout = 30 * time.Second
+
+// faultWindow bounds the write on which a planned fault is injected,
+// so that faults land early enough to interrupt short sessions.
+const faultWindow = 8
+
+// Clock is a virtual clock, advanced explicitly by a simulation.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sim is a deterministic simulation of recon peers gossiping over
+// in-process connections. All choices it makes, of partners, latencies
+// and faults, are drawn from a seeded random source, and sessions are
+// run one at a time, so a simulation is reproduced by its seed.
+type Sim struct {
+	Peers []*Peer
+	Clock *Clock
+	// MaxLatency is the greatest latency added to each message sent.
+	MaxLatency time.Duration
+	// DropRate is the fraction of sessions in which a message is lost.
+	DropRate float64
+	// DisconnectRate is the fraction of sessions which are broken off.
+	DisconnectRate float64
+	// CorruptRate is the fraction of sessions in which a message is
+	// corrupted.
+	CorruptRate float64
+	// DropTimeout is the virtual time a peer waits for a lost message.
+	DropTimeout time.Duration
+	// Sessions records the sessions run, in order.
+	Sessions []*SimSession
+	// Trees inject faults into each peer's prefix tree.
+	Trees   []*ChaosTree
+	peerMgr PeerManager
+	paths   []string
+	sets    []*ZSet
+	rnd     *rand.Rand
+	mu      sync.Mutex
+	current *SimSession
+}
+
+// SimSession describes a simulated recon session.
+type SimSession struct {
+	Server, Client int
+	Start          time.Time
+	// Duration is the virtual duration of the session.
+	Duration    time.Duration
+	Fault       Fault
+	ServerStats SessionStats
+	ClientStats SessionStats
+	ServerErr   error
+	ClientErr   error
+	sim         *Sim
+	mu          sync.Mutex
+}
+
+func (s *SimSession) elapse(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Duration += d
+}
+
+func (s *SimSession) String() string {
+	return fmt.Sprintf("peer%d<-peer%d fault=%v recovered=%d/%d",
+		s.Server, s.Client, s.Fault, s.ServerStats.Recovered, s.ClientStats.Recovered)
+}
+
+// NewSim creates a simulation of n peers, created by peerMgr, whose
+// random choices are seeded with seed. Each peer's prefix tree is
+// wrapped in a ChaosTree, which injects no faults until configured.
+func NewSim(peerMgr PeerManager, n int, seed int64) *Sim {
+	s := &Sim{
+		Clock:       NewClock(time.Unix(0, 0).UTC()),
+		DropTimeout: DefaultDropTimeout,
+		peerMgr:     peerMgr,
+		rnd:         rand.New(rand.NewSource(seed))}
+	for i := 0; i < n; i++ {
+		peer, path := peerMgr.CreatePeer()
+		peer.Settings.Set("conflux.recon.logname", fmt.Sprintf("peer%d", i))
+		tree := NewChaosTree(peer.PrefixTree, s.rnd.Int63())
+		tree.Elapse = s.elapse
+		peer.PrefixTree = tree
+		peer.StartCmds()
+		s.Peers = append(s.Peers, peer)
+		s.Trees = append(s.Trees, tree)
+		s.paths = append(s.paths, path)
+		s.sets = append(s.sets, NewZSet())
+	}
+	return s
+}
+
+// Stop stops and destroys the simulated peers.
+func (s *Sim) Stop() {
+	for i, peer := range s.Peers {
+		peer.StopCmds()
+		s.peerMgr.DestroyPeer(peer, s.paths[i])
+	}
+}
+
+// SetBackendFaults sets the rate at which every peer's prefix tree
+// fails, and the greatest latency added to each of its operations.
+// Set them once the peers are populated, since Insert fails with the
+// peer's tree.
+func (s *Sim) SetBackendFaults(errorRate float64, maxLatency time.Duration) {
+	for _, tree := range s.Trees {
+		tree.ErrorRate, tree.MaxLatency = errorRate, maxLatency
+	}
+}
+
+// elapse adds backend latency to the session running, or advances the
+// clock between sessions.
+func (s *Sim) elapse(d time.Duration) {
+	s.mu.Lock()
+	sess := s.current
+	s.mu.Unlock()
+	if sess != nil {
+		sess.elapse(d)
+	} else {
+		s.Clock.Advance(d)
+	}
+}
+
+func (s *Sim) setCurrent(sess *SimSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = sess
+}
+
+// Rand returns the simulation's random source.
+func (s *Sim) Rand() *rand.Rand { return s.rnd }
+
+// Insert adds an element to a peer, if it does not already hold it.
+func (s *Sim) Insert(i int, z *Zp) error {
+	if s.sets[i].Has(z) {
+		return nil
+	}
+	if err := s.Peers[i].Insert(z); err != nil {
+		return err
+	}
+	s.sets[i].Add(z)
+	return nil
+}
+
+// Populate inserts common random elements into every peer, and unique
+// random elements into each peer.
+func (s *Sim) Populate(common, unique int) error {
+	for i := 0; i < common; i++ {
+		z := s.randomElement()
+		for j := range s.Peers {
+			if err := s.Insert(j, z); err != nil {
+				return err
+			}
+		}
+	}
+	for j := range s.Peers {
+		for i := 0; i < unique; i++ {
+			if err := s.Insert(j, s.randomElement()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Sim) randomElement() *Zp {
+	return Zi(P_SKS, s.rnd.Intn(1<<30)+1)
+}
+
+// Elements returns the elements held by a peer's prefix tree. Faults
+// are not injected into the lookup.
+func (s *Sim) Elements(i int) (zs *ZSet, err error) {
+	err = s.Peers[i].ExecCmd(func() error {
+		root, err := s.Trees[i].PrefixTree.Root()
+		if err != nil {
+			return err
+		}
+		elements, err := root.Elements()
+		if err != nil {
+			return err
+		}
+		zs = NewZSet(elements...)
+		return nil
+	})
+	return
+}
+
+// Converged returns whether all peers hold the same elements.
+func (s *Sim) Converged() (bool, error) {
+	first, err := s.Elements(0)
+	if err != nil {
+		return false, err
+	}
+	for i := 1; i < len(s.Peers); i++ {
+		zs, err := s.Elements(i)
+		if err != nil {
+			return false, err
+		}
+		if !zs.Equal(first) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Round runs a gossip round, in which each peer in turn reconciles as
+// a client with a randomly chosen partner. The clock then advances by
+// the gossip interval.
+func (s *Sim) Round() {
+	for i := range s.Peers {
+		j := s.rnd.Intn(len(s.Peers) - 1)
+		if j >= i {
+			j++
+		}
+		s.Session(j, i)
+	}
+	s.Clock.Advance(time.Duration(s.Peers[0].GossipIntervalSecs()) * time.Second)
+}
+
+// Run runs gossip rounds until the peers converge, for at most
+// maxRounds. It returns the number of rounds run, and whether the peers
+// converged.
+func (s *Sim) Run(maxRounds int) (int, bool, error) {
+	for round := 1; round <= maxRounds; round++ {
+		s.Round()
+		converged, err := s.Converged()
+		if err != nil || converged {
+			return round, converged, err
+		}
+	}
+	return maxRounds, false, nil
+}
+
+// Session runs a recon session between two peers. Elements each peer
+// recovers are inserted into it once the session is over, as an
+// application reading RecoverChan would.
+func (s *Sim) Session(server, client int) *SimSession {
+	sess := &SimSession{Server: server, Client: client, Start: s.Clock.Now(), sim: s}
+	// Plan the session's fault, drawing the same random values whether
+	// or not there is one, so that plans don't perturb later choices.
+	dropDraw, disconnectDraw, corruptDraw := s.rnd.Float64(), s.rnd.Float64(), s.rnd.Float64()
+	faultEnd, faultAt := s.rnd.Intn(2), s.rnd.Intn(faultWindow)+1
+	serverAddr := simAddr(fmt.Sprintf("peer%d", server))
+	clientAddr := simAddr(fmt.Sprintf("peer%d", client))
+	pipe := newSimPipe()
+	conns := []*simConn{
+		&simConn{pipe: pipe, end: 0, local: serverAddr, remote: clientAddr, session: sess,
+			rnd: rand.New(rand.NewSource(s.rnd.Int63()))},
+		&simConn{pipe: pipe, end: 1, local: clientAddr, remote: serverAddr, session: sess,
+			rnd: rand.New(rand.NewSource(s.rnd.Int63()))}}
+	if dropDraw < s.DropRate {
+		conns[faultEnd].fault, conns[faultEnd].faultAt = FaultDrop, faultAt
+	} else if disconnectDraw < s.DisconnectRate {
+		conns[faultEnd].fault, conns[faultEnd].faultAt = FaultDisconnect, faultAt
+	} else if corruptDraw < s.CorruptRate {
+		conns[faultEnd].fault, conns[faultEnd].faultAt = FaultCorrupt, faultAt
+	}
+	serverRecovered := drainRecovered(s.Peers[server])
+	clientRecovered := drainRecovered(s.Peers[client])
+	s.setCurrent(sess)
+	done := make(chan struct{})
+	go func() {
+		sess.ServerStats, sess.ServerErr = s.Peers[server].ReconcileWith(conns[0], RoleServer)
+		conns[0].Close()
+		close(done)
+	}()
+	sess.ClientStats, sess.ClientErr = s.Peers[client].ReconcileWith(conns[1], RoleClient)
+	conns[1].Close()
+	<-done
+	s.setCurrent(nil)
+	s.recover(server, serverRecovered)
+	s.recover(client, clientRecovered)
+	s.Clock.Advance(sess.Duration)
+	s.Sessions = append(s.Sessions, sess)
+	return sess
+}
+
+// drainRecovered reads a peer's recoveries during a session. Sending
+// nil on RecoverChan once the session is over ends the drain, and
+// receives the elements recovered.
+func drainRecovered(peer *Peer) chan []*Zp {
+	result := make(chan []*Zp)
+	go func() {
+		var elements []*Zp
+		for r := range peer.RecoverChan {
+			if r == nil {
+				break
+			}
+			elements = append(elements, r.RemoteElements...)
+		}
+		result <- elements
+	}()
+	return result
+}
+
+func (s *Sim) recover(i int, recovered chan []*Zp) {
+	s.Peers[i].RecoverChan <- nil
+	for _, z := range <-recovered {
+		s.Insert(i, z)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package testing
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestSimConverges(t *testing.T) {
+	sim := NewSim(memPeerMgr, 5, 1)
+	defer sim.Stop()
+	assert.Equal(t, nil, sim.Populate(200, 20))
+	rounds, converged, err := sim.Run(20)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, converged, "not converged after %d rounds", rounds)
+	zs, err := sim.Elements(0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 300, zs.Len())
+}
+
+func newFaultySim(seed int64) *Sim {
+	sim := NewSim(memPeerMgr, 6, seed)
+	sim.MaxLatency = 50 * time.Millisecond
+	sim.DropRate = 0.3
+	sim.DisconnectRate = 0.3
+	return sim
+}
+
+func TestSimFaults(t *testing.T) {
+	sim := newFaultySim(1)
+	defer sim.Stop()
+	assert.Equal(t, nil, sim.Populate(100, 10))
+	rounds, converged, err := sim.Run(50)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, converged, "not converged after %d rounds", rounds)
+	faults := map[Fault]int{}
+	for _, sess := range sim.Sessions {
+		faults[sess.Fault]++
+	}
+	assert.T(t, faults[FaultDrop] > 0)
+	assert.T(t, faults[FaultDisconnect] > 0)
+	assert.T(t, sim.Clock.Now().After(time.Unix(0, 0).Add(time.Duration(rounds)*time.Minute)))
+}
+
+// Test that a simulation is reproduced by its seed.
+func TestSimDeterministic(t *testing.T) {
+	run := func() (sessions []string, rounds int, now time.Time) {
+		sim := newFaultySim(7)
+		defer sim.Stop()
+		assert.Equal(t, nil, sim.Populate(100, 10))
+		rounds, _, err := sim.Run(50)
+		assert.Equal(t, nil, err)
+		for _, sess := range sim.Sessions {
+			sessions = append(sessions, sess.String())
+		}
+		return sessions, rounds, sim.Clock.Now()
+	}
+	sessions1, rounds1, now1 := run()
+	sessions2, rounds2, now2 := run()
+	assert.Equal(t, rounds1, rounds2)
+	assert.Equal(t, now1, now2)
+	assert.Equal(t, sessions1, sessions2)
+}
+
+// Test that peers converge despite failing backends and corrupt
+// messages, and that the failures leave their trees intact.
+func TestSimChaos(t *testing.T) {
+	sim := newFaultySim(3)
+	defer sim.Stop()
+	sim.CorruptRate = 0.5
+	assert.Equal(t, nil, sim.Populate(100, 10))
+	sim.SetBackendFaults(0.02, 10*time.Millisecond)
+	rounds, converged, err := sim.Run(100)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, converged, "not converged after %d rounds", rounds)
+	faults := map[Fault]int{}
+	for _, sess := range sim.Sessions {
+		faults[sess.Fault]++
+	}
+	assert.T(t, faults[FaultCorrupt] > 0)
+	var errors int
+	for _, tree := range sim.Trees {
+		errors += tree.Errors
+	}
+	assert.T(t, errors > 0)
+	// Bit flips may introduce elements, but none may be lost.
+	zs, err := sim.Elements(0)
+	assert.Equal(t, nil, err)
+	assert.T(t, zs.Len() >= 160)
+}
@@ -25,8 +25,12 @@ package conflux
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"sort"
 )
 
 // P for a finite field Z(P) that includes all 128-bit integers.
@@ -63,8 +67,12 @@ var P_SKS *big.Int
 
 var zero = big.NewInt(0)
 
+// Limb arithmetic for P_SKS, if supported
+var sksLimbs *limbField
+
 func init() {
 	P_SKS, _ = big.NewInt(0).SetString("530512889551602322505127520352579437339", 10)
+	sksLimbs = NewZpContext(P_SKS).limbs
 }
 
 // Zp represents a value in the finite field Z(p),
@@ -139,8 +147,30 @@ func randint(high *big.Int) *big.Int {
 	return rval
 }
 
+// RandZp creates an integer chosen uniformly at random from the finite
+// field p, using the cryptographically secure crypto/rand source.
+func RandZp(p *big.Int) (*Zp, error) {
+	return randZp(rand.Reader, p)
+}
+
+// randZp creates an integer chosen uniformly at random from the
+// finite field p, reading random bytes from r.
+func randZp(r io.Reader, p *big.Int) (*Zp, error) {
+	i, err := rand.Int(r, p)
+	if err != nil {
+		return nil, err
+	}
+	return &Zp{Int: i, P: p}, nil
+}
+
+// Zrand creates a random integer in the finite field p,
+// as RandZp does, panicking if randomness is unavailable.
 func Zrand(p *big.Int) *Zp {
-	return &Zp{Int: randint(p), P: p}
+	zp, err := RandZp(p)
+	if err != nil {
+		panic(err)
+	}
+	return zp
 }
 
 func Zarray(p *big.Int, n int, v *Zp) []*Zp {
@@ -189,16 +219,24 @@ func (zp *Zp) Sub(x, y *Zp) *Zp {
 	return zp
 }
 
-// Multiply two integers.
+// Multiply two integers. Reduced integers in P_SKS are multiplied
+// in fixed-width limbs, the most common case in recon.
 func (zp *Zp) Mul(x, y *Zp) *Zp {
 	zp.assertEqualP(x, y)
+	if sksLimbs != nil && zp.P.Cmp(P_SKS) == 0 && sksLimbs.mul(zp.Int, x.Int, y.Int) {
+		return zp
+	}
 	zp.Int.Mul(x.Int, y.Int)
 	zp.Norm()
 	return zp
 }
 
-// Set the multiplicative inverse in P.
+// Set the multiplicative inverse in P. Zero has no inverse, and
+// panics like an integer division by zero.
 func (zp *Zp) Inv() *Zp {
+	if zp.IsZero() {
+		panic(fmt.Sprintf("no multiplicative inverse of zero in Z(%v)", zp.P))
+	}
 	zp.Int.ModInverse(zp.Int, zp.P)
 	return zp
 }
@@ -206,10 +244,22 @@ func (zp *Zp) Inv() *Zp {
 // Exp calculates x**y ("x to the yth power")
 func (zp *Zp) Exp(x, y *Zp) *Zp {
 	zp.assertEqualP(x, y)
-	zp.Int.Exp(x.Int, y.Int, zp.P)
+	return zp.ExpInt(x, y.Int)
+}
+
+// ExpInt calculates x**k for an integer exponent k, which is not
+// reduced (mod P). A negative exponent raises the inverse of x.
+func (zp *Zp) ExpInt(x *Zp, k *big.Int) *Zp {
+	zp.assertEqualP(x)
+	if k.Sign() < 0 {
+		zp.Int.Exp(x.Int, big.NewInt(0).Neg(k), zp.P)
+		return zp.Inv()
+	}
+	zp.Int.Exp(x.Int, k, zp.P)
 	return zp
 }
 
+// Divide two integers, multiplying x by the inverse of y.
 func (zp *Zp) Div(x, y *Zp) *Zp {
 	return zp.Mul(x, Zzp(y).Inv())
 }
@@ -221,10 +271,91 @@ func (zp *Zp) Neg() *Zp {
 	return zp
 }
 
+// ByteLen returns the number of bytes needed to
+// represent any integer in the finite field P.
+func (zp *Zp) ByteLen() int {
+	return (zp.P.BitLen() + 7) / 8
+}
+
+// MarshalBinary encodes the integer as big-endian bytes,
+// fixed to the width of the finite field P.
+func (zp *Zp) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, zp.ByteLen())
+	b := zp.Int.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes an integer encoded by MarshalBinary. The
+// integer is decoded in its finite field P if set, otherwise P_SKS.
+func (zp *Zp) UnmarshalBinary(data []byte) error {
+	if zp.P == nil {
+		zp.P = P_SKS
+	}
+	if len(data) != zp.ByteLen() {
+		return errors.New(fmt.Sprintf(
+			"expect %d bytes for an integer in Z(%v), was %d", zp.ByteLen(), zp.P, len(data)))
+	}
+	if zp.Int == nil {
+		zp.Int = big.NewInt(0)
+	}
+	zp.Int.SetBytes(data)
+	if zp.Int.Cmp(zp.P) >= 0 {
+		return errors.New(fmt.Sprintf("integer %v out of range of Z(%v)", zp.Int, zp.P))
+	}
+	return nil
+}
+
+// MarshalText encodes the integer as the hex of its binary encoding.
+func (zp *Zp) MarshalText() ([]byte, error) {
+	buf, err := zp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(buf)), nil
+}
+
+// UnmarshalText decodes an integer encoded by MarshalText.
+func (zp *Zp) UnmarshalText(text []byte) error {
+	buf, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	return zp.UnmarshalBinary(buf)
+}
+
+// MismatchedPError reports an integer which is not in
+// the expected finite field.
+type MismatchedPError struct {
+	Expect *big.Int
+	Actual *big.Int
+}
+
+func (e *MismatchedPError) Error() string {
+	return fmt.Sprintf("expect finite field Z(%v), was Z(%v)", e.Expect, e.Actual)
+}
+
+// CheckP returns a MismatchedPError if any of the values are not in
+// the finite field P of this integer. Arithmetic on values from an
+// untrusted source should be checked first, since it panics on
+// mismatched fields.
+func (zp *Zp) CheckP(values ...*Zp) error {
+	for _, v := range values {
+		if v == nil || v.P == nil || zp.P.Cmp(v.P) != 0 {
+			actual := (*big.Int)(nil)
+			if v != nil {
+				actual = v.P
+			}
+			return &MismatchedPError{Expect: zp.P, Actual: actual}
+		}
+	}
+	return nil
+}
+
 // Assert an integer is in the expected finite field P.
 func (zp *Zp) assertP(p *big.Int) {
 	if zp.P.Cmp(p) != 0 {
-		panic(fmt.Sprintf("expect finite field Z(%v), was Z(%v)", p, zp.P))
+		panic((&MismatchedPError{Expect: p, Actual: zp.P}).Error())
 	}
 }
 
@@ -235,6 +366,8 @@ func (zp *Zp) assertEqualP(values ...*Zp) {
 	}
 }
 
+// ZSet is a set of integers in a finite field. Items and String
+// list the elements in ascending order.
 type ZSet struct {
 	s map[string]bool
 	p *big.Int
@@ -273,6 +406,37 @@ func (zs *ZSet) Has(v *Zp) bool {
 	return has
 }
 
+// Contains tests if v is an element of the set, as Has does.
+func (zs *ZSet) Contains(v *Zp) bool {
+	return zs.Has(v)
+}
+
+// Union returns a new set of the elements in either set.
+func (zs *ZSet) Union(other *ZSet) *ZSet {
+	result := NewZSet()
+	result.AddAll(zs)
+	result.AddAll(other)
+	return result
+}
+
+// Intersect returns a new set of the elements in both sets.
+func (zs *ZSet) Intersect(other *ZSet) *ZSet {
+	result := NewZSet()
+	result.p = zs.p
+	for k, _ := range zs.s {
+		if other.s[k] {
+			result.s[k] = true
+		}
+	}
+	return result
+}
+
+// Difference returns a new set of the elements
+// in this set which are not in other.
+func (zs *ZSet) Difference(other *ZSet) *ZSet {
+	return ZSetDiff(zs, other)
+}
+
 func (zs *ZSet) Equal(other *ZSet) bool {
 	if len(zs.s) != len(other.s) {
 		return false
@@ -310,25 +474,29 @@ func (zs *ZSet) Items() (result []*Zp) {
 		n.SetString(k, 10)
 		result = append(result, &Zp{Int: n, P: zs.p})
 	}
+	sort.Sort(zpByValue(result))
 	return
 }
 
 func (zs *ZSet) String() string {
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, "{")
-	first := true
-	for k, _ := range zs.s {
-		if first {
-			first = false
-		} else {
+	for i, v := range zs.Items() {
+		if i > 0 {
 			fmt.Fprintf(buf, ", ")
 		}
-		fmt.Fprintf(buf, "%v", k)
+		fmt.Fprintf(buf, "%v", v)
 	}
 	fmt.Fprintf(buf, "}")
 	return string(buf.Bytes())
 }
 
+type zpByValue []*Zp
+
+func (zps zpByValue) Len() int           { return len(zps) }
+func (zps zpByValue) Less(i, j int) bool { return zps[i].Cmp(zps[j]) < 0 }
+func (zps zpByValue) Swap(i, j int)      { zps[i], zps[j] = zps[j], zps[i] }
+
 type ZpSlice []*Zp
 
 func (zp ZpSlice) String() string {
@@ -100,6 +100,18 @@ func TestMismatchedP(t *testing.T) {
 	t.Fail()
 }
 
+func TestCheckP(t *testing.T) {
+	a := zp5(1)
+	assert.Equal(t, nil, a.CheckP(zp5(2), zp5(3)))
+	err := a.CheckP(zp5(2), zp7(3))
+	assert.NotEqual(t, nil, err)
+	mismatch, is := err.(*MismatchedPError)
+	assert.T(t, is)
+	assert.Equal(t, int64(5), mismatch.Expect.Int64())
+	assert.Equal(t, int64(7), mismatch.Actual.Int64())
+	assert.NotEqual(t, nil, a.CheckP(nil))
+}
+
 func TestNeg(t *testing.T) {
 	a := zp5(2)
 	a.Neg()
@@ -133,6 +145,96 @@ func TestSubRoll(t *testing.T) {
 	assert.Equal(t, int64(2), c.Int64()) // -3 == 2
 }
 
+func TestDivZero(t *testing.T) {
+	defer func() {
+		r := recover()
+		assert.T(t, r != nil)
+	}()
+	Z(p(5)).Div(zp5(1), zp5(0))
+	t.Fail()
+}
+
+// TestArithmeticReference checks field arithmetic
+// against the same operations on big.Int.
+func TestArithmeticReference(t *testing.T) {
+	ref := func(op func(r, x, y *big.Int) *big.Int, x, y *Zp) *big.Int {
+		r := op(big.NewInt(0), x.Int, y.Int)
+		return r.Mod(r, P_SKS)
+	}
+	for i := 0; i < 100; i++ {
+		x, y := Zrand(P_SKS), Zrand(P_SKS)
+		if y.IsZero() {
+			continue
+		}
+		assert.Equal(t, 0, ref((*big.Int).Add, x, y).Cmp(Z(P_SKS).Add(x, y).Int))
+		assert.Equal(t, 0, ref((*big.Int).Sub, x, y).Cmp(Z(P_SKS).Sub(x, y).Int))
+		assert.Equal(t, 0, ref((*big.Int).Mul, x, y).Cmp(Z(P_SKS).Mul(x, y).Int))
+		neg := big.NewInt(0).Neg(x.Int)
+		assert.Equal(t, 0, neg.Mod(neg, P_SKS).Cmp(x.Copy().Neg().Int))
+		// y * y^-1 = 1, and y^-1 = y^(p-2) by Fermat's little theorem
+		inv := y.Copy().Inv()
+		assert.Equal(t, int64(1), Z(P_SKS).Mul(y, inv).Int64())
+		fermat := big.NewInt(0).Exp(y.Int, big.NewInt(0).Sub(P_SKS, big.NewInt(2)), P_SKS)
+		assert.Equal(t, 0, fermat.Cmp(inv.Int))
+		// (x / y) * y = x
+		q := Z(P_SKS).Div(x, y)
+		assert.Equal(t, 0, x.Cmp(Z(P_SKS).Mul(q, y)))
+	}
+}
+
+func TestExp(t *testing.T) {
+	// in Z(7), 3**4 = 81 = 4
+	assert.Equal(t, int64(4), Z(p(7)).Exp(zp7(3), zp7(4)).Int64())
+	assert.Equal(t, int64(1), Z(p(7)).Exp(zp7(3), zp7(0)).Int64())
+	// exponents are not reduced (mod P): 3**7 = 3 by Fermat
+	assert.Equal(t, int64(3), Z(p(7)).ExpInt(zp7(3), big.NewInt(7)).Int64())
+	// 3**-1 = 5 because 3 * 5 = 1
+	assert.Equal(t, int64(5), Z(p(7)).ExpInt(zp7(3), big.NewInt(-1)).Int64())
+	for i := 0; i < 20; i++ {
+		x := Zrand(P_SKS)
+		k := randint(P_SKS)
+		expect := big.NewInt(0).Exp(x.Int, k, P_SKS)
+		assert.Equal(t, 0, expect.Cmp(Z(P_SKS).ExpInt(x, k).Int))
+	}
+}
+
+func TestZpMarshal(t *testing.T) {
+	z := Zi(P_SKS, 65537)
+	buf, err := z.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 17, len(buf))
+	assert.Equal(t, []byte{0x1, 0x0, 0x1}, buf[14:])
+	var z2 Zp
+	assert.Equal(t, nil, z2.UnmarshalBinary(buf))
+	assert.Equal(t, 0, z.Cmp(&z2))
+	text, err := z.MarshalText()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0000000000000000000000000000010001", string(text))
+	z3 := Z(P_SKS)
+	assert.Equal(t, nil, z3.UnmarshalText(text))
+	assert.Equal(t, 0, z.Cmp(z3))
+	// wrong width
+	assert.NotEqual(t, nil, Z(P_SKS).UnmarshalBinary(buf[1:]))
+	// out of range
+	assert.NotEqual(t, nil, Z(p(5)).UnmarshalBinary([]byte{7}))
+}
+
+func TestRandZp(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 200; i++ {
+		z, err := RandZp(p(7))
+		assert.Equal(t, nil, err)
+		assert.T(t, z.Int64() >= 0 && z.Int64() < 7)
+		seen[z.Int64()] = true
+	}
+	assert.Equal(t, 7, len(seen))
+	a, err := RandZp(P_SKS)
+	assert.Equal(t, nil, err)
+	b, err := RandZp(P_SKS)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, 0, a.Cmp(b))
+}
+
 func TestZSet(t *testing.T) {
 	a := NewZSet()
 	a.Add(zp5(1))
@@ -146,6 +248,29 @@ func TestZSet(t *testing.T) {
 	assert.T(t, a.Has(zp5(3)))
 }
 
+func TestZSetAlgebra(t *testing.T) {
+	zs1 := NewZSet(Zi(P_SKS, 65541), Zi(P_SKS, 65537), Zi(P_SKS, 65539))
+	zs2 := NewZSet(Zi(P_SKS, 65543), Zi(P_SKS, 65537), Zi(P_SKS, 65541))
+	assert.T(t, zs1.Contains(Zi(P_SKS, 65539)))
+	assert.T(t, !zs1.Contains(Zi(P_SKS, 65543)))
+	union := zs1.Union(zs2)
+	assert.Equal(t, "{65537, 65539, 65541, 65543}", union.String())
+	assert.Equal(t, "{65537, 65541}", zs1.Intersect(zs2).String())
+	assert.Equal(t, "{65539}", zs1.Difference(zs2).String())
+	assert.Equal(t, "{65543}", zs2.Difference(zs1).String())
+	assert.Equal(t, 0, NewZSet().Intersect(zs1).Len())
+	assert.T(t, zs1.Union(NewZSet()).Equal(zs1))
+	// Operands are unchanged
+	assert.Equal(t, 3, zs1.Len())
+	assert.Equal(t, 3, zs2.Len())
+	// Items are in ascending order
+	items := union.Items()
+	for i := 1; i < len(items); i++ {
+		assert.T(t, items[i-1].Cmp(items[i]) < 0)
+	}
+	assert.Equal(t, 0, items[0].P.Cmp(P_SKS))
+}
+
 func TestZsetDisjoint(t *testing.T) {
 	zs1 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65539))
 	zs2 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65541))
@@ -178,3 +303,34 @@ func TestZSetDiffEmpty(t *testing.T) {
 	assert.Equal(t, 2, len(zs3.Items()))
 	assert.Equal(t, 0, len(zs4.Items()))
 }
+
+func TestZpAddProperties(t *testing.T) {
+	checkQuick(t, func(x, y, z quickZp) bool {
+		p := x.P
+		return Z(p).Add(x.Zp, y.Zp).Cmp(Z(p).Add(y.Zp, x.Zp)) == 0 &&
+			Z(p).Add(Z(p).Add(x.Zp, y.Zp), z.Zp).Cmp(Z(p).Add(x.Zp, Z(p).Add(y.Zp, z.Zp))) == 0 &&
+			Z(p).Add(x.Zp, Z(p)).Cmp(x.Zp) == 0 &&
+			Z(p).Add(x.Zp, x.Copy().Neg()).IsZero() &&
+			Z(p).Add(Z(p).Sub(x.Zp, y.Zp), y.Zp).Cmp(x.Zp) == 0
+	})
+}
+
+func TestZpMulProperties(t *testing.T) {
+	checkQuick(t, func(x, y, z quickZp) bool {
+		p := x.P
+		return Z(p).Mul(x.Zp, y.Zp).Cmp(Z(p).Mul(y.Zp, x.Zp)) == 0 &&
+			Z(p).Mul(Z(p).Mul(x.Zp, y.Zp), z.Zp).Cmp(Z(p).Mul(x.Zp, Z(p).Mul(y.Zp, z.Zp))) == 0 &&
+			Z(p).Mul(x.Zp, Zi(p, 1)).Cmp(x.Zp) == 0 &&
+			Z(p).Mul(x.Zp, Z(p).Add(y.Zp, z.Zp)).Cmp(
+				Z(p).Add(Z(p).Mul(x.Zp, y.Zp), Z(p).Mul(x.Zp, z.Zp))) == 0
+	})
+}
+
+func TestZpInverseProperties(t *testing.T) {
+	checkQuick(t, func(x quickZp, y quickNonZeroZp) bool {
+		p := x.P
+		return Z(p).Mul(y.Zp, y.Copy().Inv()).Cmp(Zi(p, 1)) == 0 &&
+			Z(p).Mul(Z(p).Div(x.Zp, y.Zp), y.Zp).Cmp(x.Zp) == 0 &&
+			Z(p).ExpInt(y.Zp, big.NewInt(-1)).Cmp(y.Copy().Inv()) == 0
+	})
+}
@@ -0,0 +1,104 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+)
+
+// ZpContext performs arithmetic in a finite field using its own scratch
+// space, so that repeated operations reuse memory rather than allocating
+// temporaries. Results are stored in place in an existing integer, which
+// may be one of the operands. A context is not safe for concurrent use.
+//
+// Products are reduced (mod P) by Barrett reduction, which replaces
+// the division of a generic modulus with multiplications and shifts
+// by a constant precomputed for P. For primes of up to 190 bits, such
+// as P_SKS, this is done in fixed-width 64-bit limbs where the
+// platform allows, falling back to big.Int arithmetic elsewhere.
+type ZpContext struct {
+	P *big.Int
+	// Bit length of P
+	k uint
+	// Barrett constant, floor(4**k / P)
+	mu big.Int
+	// Limb arithmetic for P, if supported
+	limbs *limbField
+	// Scratch space
+	prod big.Int
+	q    big.Int
+	qp   big.Int
+}
+
+// NewZpContext creates a context for arithmetic in the finite field p.
+func NewZpContext(p *big.Int) *ZpContext {
+	c := &ZpContext{P: p, k: uint(p.BitLen())}
+	c.mu.Lsh(big.NewInt(1), 2*c.k)
+	c.mu.Quo(&c.mu, p)
+	c.limbs = newLimbField(p, &c.mu)
+	return c
+}
+
+// reduce sets z to x (mod P), for 0 <= x < P**2.
+// z must not be x.
+func (c *ZpContext) reduce(z, x *big.Int) {
+	c.q.Rsh(x, c.k-1)
+	c.qp.Mul(&c.q, &c.mu)
+	c.q.Rsh(&c.qp, c.k+1)
+	c.qp.Mul(&c.q, c.P)
+	z.Sub(x, &c.qp)
+	for z.Cmp(c.P) >= 0 {
+		z.Sub(z, c.P)
+	}
+}
+
+// Add sets z to x + y.
+func (c *ZpContext) Add(z, x, y *Zp) *Zp {
+	z.assertEqualP(x, y)
+	z.Int.Add(x.Int, y.Int)
+	if z.Int.Cmp(c.P) >= 0 {
+		z.Int.Sub(z.Int, c.P)
+	}
+	return z
+}
+
+// Sub sets z to x - y.
+func (c *ZpContext) Sub(z, x, y *Zp) *Zp {
+	z.assertEqualP(x, y)
+	z.Int.Sub(x.Int, y.Int)
+	if z.Int.Sign() < 0 {
+		z.Int.Add(z.Int, c.P)
+	}
+	return z
+}
+
+// Mul sets z to x * y.
+func (c *ZpContext) Mul(z, x, y *Zp) *Zp {
+	z.assertEqualP(x, y)
+	if c.limbs != nil && c.limbs.mul(z.Int, x.Int, y.Int) {
+		return z
+	}
+	c.prod.Mul(x.Int, y.Int)
+	c.reduce(z.Int, &c.prod)
+	return z
+}
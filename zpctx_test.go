@@ -0,0 +1,87 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestZpContext(t *testing.T) {
+	ctx := NewZpContext(P_SKS)
+	for i := 0; i < 100; i++ {
+		x, y := Zrand(P_SKS), Zrand(P_SKS)
+		assert.Equal(t, 0, Z(P_SKS).Add(x, y).Cmp(ctx.Add(Z(P_SKS), x, y)))
+		assert.Equal(t, 0, Z(P_SKS).Sub(x, y).Cmp(ctx.Sub(Z(P_SKS), x, y)))
+		assert.Equal(t, 0, Z(P_SKS).Mul(x, y).Cmp(ctx.Mul(Z(P_SKS), x, y)))
+		// in place
+		expect := Z(P_SKS).Mul(x, y)
+		assert.Equal(t, 0, expect.Cmp(ctx.Mul(x, x, y)))
+	}
+}
+
+func TestZpContextSmallP(t *testing.T) {
+	ctx := NewZpContext(p(7))
+	for x := 0; x < 7; x++ {
+		for y := 0; y < 7; y++ {
+			assert.Equal(t, int64((x*y)%7), ctx.Mul(Z(p(7)), zp7(x), zp7(y)).Int64())
+		}
+	}
+	ctx = NewZpContext(P_512)
+	for i := 0; i < 20; i++ {
+		x, y := Zrand(P_512), Zrand(P_512)
+		assert.Equal(t, 0, Z(P_512).Mul(x, y).Cmp(ctx.Mul(Z(P_512), x, y)))
+	}
+	// largest product
+	max := Z(P_SKS).Sub(Z(P_SKS), Zi(P_SKS, 1))
+	assert.Equal(t, int64(1), NewZpContext(P_SKS).Mul(Z(P_SKS), max, max).Int64())
+}
+
+func TestZpContextAllocs(t *testing.T) {
+	ctx := NewZpContext(P_SKS)
+	z, x := Zrand(P_SKS), Zrand(P_SKS)
+	ctx.Mul(z, z, x)
+	allocs := testing.AllocsPerRun(100, func() {
+		ctx.Mul(z, z, x)
+	})
+	generic := testing.AllocsPerRun(100, func() {
+		z = Z(P_SKS).Mul(z, x)
+	})
+	assert.Tf(t, allocs < generic, "context %v allocs, generic %v", allocs, generic)
+	assert.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkMul(b *testing.B) {
+	z, x := Zrand(P_SKS), Zrand(P_SKS)
+	for i := 0; i < b.N; i++ {
+		z = Z(P_SKS).Mul(z, x)
+	}
+}
+
+func BenchmarkContextMul(b *testing.B) {
+	ctx := NewZpContext(P_SKS)
+	z, x := Zrand(P_SKS), Zrand(P_SKS)
+	for i := 0; i < b.N; i++ {
+		ctx.Mul(z, z, x)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// limbField multiplies integers modulo a prime of at most 190 bits, such
+// as P_SKS, in fixed-width 64-bit limbs rather than big.Int arithmetic.
+// Products are reduced by Barrett reduction, as in ZpContext, unrolled
+// to three limbs per operand, so that nothing is allocated and no
+// general purpose division is done. It holds no scratch space, and so
+// is safe for concurrent use.
+type limbField struct {
+	// Modulus, least significant limb first
+	p [3]uint64
+	// Bit length of p
+	k uint
+	// Barrett constant, floor(4**k / p)
+	mu [3]uint64
+}
+
+// newLimbField returns a limb field for p, with the Barrett constant mu,
+// or nil where limbs cannot be used: for a larger p, or on platforms
+// whose big.Word is not 64 bits, which use big.Int arithmetic instead.
+func newLimbField(p, mu *big.Int) *limbField {
+	k := uint(p.BitLen())
+	if bits.UintSize != 64 || k < 2 || k > 190 {
+		return nil
+	}
+	f := &limbField{k: k}
+	if !loadLimbs(&f.p, p) || !loadLimbs(&f.mu, mu) {
+		return nil
+	}
+	return f
+}
+
+// loadLimbs sets l to the non-negative integer x, if it fits.
+func loadLimbs(l *[3]uint64, x *big.Int) bool {
+	w := x.Bits()
+	if x.Sign() < 0 || len(w) > len(l) {
+		return false
+	}
+	*l = [3]uint64{}
+	for i := range w {
+		l[i] = uint64(w[i])
+	}
+	return true
+}
+
+// mul sets z to x * y (mod p), returning false, and leaving z unchanged,
+// unless both operands are reduced (mod p). z may be x or y.
+func (f *limbField) mul(z, x, y *big.Int) bool {
+	var xl, yl [3]uint64
+	if !loadLimbs(&xl, x) || !loadLimbs(&yl, y) || !f.less(&xl) || !f.less(&yl) {
+		return false
+	}
+	r := f.reduce(mulLimbs(&xl, &yl))
+	w := z.Bits()
+	if cap(w) < len(r) {
+		w = make([]big.Word, len(r))
+	}
+	w = w[:len(r)]
+	for i := range r {
+		w[i] = big.Word(r[i])
+	}
+	z.SetBits(w)
+	return true
+}
+
+// reduce returns x (mod p), for 0 <= x < p**2.
+func (f *limbField) reduce(x [6]uint64) [3]uint64 {
+	// q estimates floor(x / p) from below, by at most 2
+	q1 := shrLimbs(&x, f.k-1)
+	q2 := mulLimbs(&q1, &f.mu)
+	q := shrLimbs(&q2, f.k+1)
+	// x - q*p < 3p < 2**192, so only the low limbs are needed
+	qp := mulLowLimbs(&q, &f.p)
+	var r [3]uint64
+	var borrow uint64
+	for i := range r {
+		r[i], borrow = bits.Sub64(x[i], qp[i], borrow)
+	}
+	for !f.less(&r) {
+		borrow = 0
+		for i := range r {
+			r[i], borrow = bits.Sub64(r[i], f.p[i], borrow)
+		}
+	}
+	return r
+}
+
+// less returns whether x < p.
+func (f *limbField) less(x *[3]uint64) bool {
+	for i := len(x) - 1; i >= 0; i-- {
+		if x[i] != f.p[i] {
+			return x[i] < f.p[i]
+		}
+	}
+	return false
+}
+
+// mulLimbs returns the product of x and y.
+func mulLimbs(x, y *[3]uint64) (z [6]uint64) {
+	for i := range x {
+		var carry uint64
+		for j := range y {
+			hi, lo := bits.Mul64(x[i], y[j])
+			var c uint64
+			lo, c = bits.Add64(lo, z[i+j], 0)
+			hi += c
+			lo, c = bits.Add64(lo, carry, 0)
+			hi += c
+			z[i+j], carry = lo, hi
+		}
+		z[i+len(y)] = carry
+	}
+	return
+}
+
+// mulLowLimbs returns the low three limbs of the product of x and y.
+func mulLowLimbs(x, y *[3]uint64) (z [3]uint64) {
+	for i := range x {
+		var carry uint64
+		for j := 0; i+j < len(z); j++ {
+			hi, lo := bits.Mul64(x[i], y[j])
+			var c uint64
+			lo, c = bits.Add64(lo, z[i+j], 0)
+			hi += c
+			lo, c = bits.Add64(lo, carry, 0)
+			hi += c
+			z[i+j], carry = lo, hi
+		}
+	}
+	return
+}
+
+// shrLimbs returns the low three limbs of x >> s.
+func shrLimbs(x *[6]uint64, s uint) (z [3]uint64) {
+	// Padded, so that limbs shifted in from beyond x are zero
+	var padded [8]uint64
+	copy(padded[:], x[:])
+	word, bit := s/64, s%64
+	src := padded[word : word+4]
+	if bit == 0 {
+		copy(z[:], src)
+		return
+	}
+	for i := range z {
+		z[i] = src[i]>>bit | src[i+1]<<(64-bit)
+	}
+	return
+}
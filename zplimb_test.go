@@ -0,0 +1,135 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/rand"
+	"github.com/bmizerany/assert"
+	"math/big"
+	"math/bits"
+	"testing"
+)
+
+func limbFieldOf(p *big.Int) *limbField {
+	return NewZpContext(p).limbs
+}
+
+func skipWithoutLimbs(t testing.TB) {
+	if bits.UintSize != 64 {
+		t.Skip("big.Word is not 64 bits")
+	}
+}
+
+// checkLimbMul compares a limb product with a big.Int product, and
+// computes it again in place.
+func checkLimbMul(t *testing.T, f *limbField, p, x, y *big.Int) {
+	expect := new(big.Int).Mul(x, y)
+	expect.Mod(expect, p)
+	z := new(big.Int)
+	assert.T(t, f.mul(z, x, y))
+	assert.Equalf(t, 0, expect.Cmp(z), "%v * %v (mod %v)", x, y, p)
+	z.Set(x)
+	assert.T(t, f.mul(z, z, y))
+	assert.Equalf(t, 0, expect.Cmp(z), "in place %v * %v (mod %v)", x, y, p)
+}
+
+func TestLimbMul(t *testing.T) {
+	skipWithoutLimbs(t)
+	f := limbFieldOf(P_SKS)
+	assert.T(t, f != nil)
+	max := new(big.Int).Sub(P_SKS, big.NewInt(1))
+	edges := []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(2), max,
+		new(big.Int).Lsh(big.NewInt(1), 64), new(big.Int).Lsh(big.NewInt(1), 128)}
+	for _, x := range edges {
+		for _, y := range edges {
+			checkLimbMul(t, f, P_SKS, x, y)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		x, y := Zrand(P_SKS), Zrand(P_SKS)
+		checkLimbMul(t, f, P_SKS, x.Int, y.Int)
+	}
+}
+
+// Test limb products in primes of every size limbs support, where
+// the Barrett shifts fall on and between limb boundaries.
+func TestLimbMulPrimes(t *testing.T) {
+	skipWithoutLimbs(t)
+	for _, bits := range []int{2, 3, 17, 63, 64, 65, 127, 128, 129, 130, 160, 189, 190} {
+		p, err := rand.Prime(rand.Reader, bits)
+		assert.Equal(t, nil, err)
+		f := limbFieldOf(p)
+		assert.Tf(t, f != nil, "%d bit prime", bits)
+		max := new(big.Int).Sub(p, big.NewInt(1))
+		checkLimbMul(t, f, p, max, max)
+		for i := 0; i < 100; i++ {
+			x, y := Zrand(p), Zrand(p)
+			checkLimbMul(t, f, p, x.Int, y.Int)
+		}
+	}
+	for _, bits := range []int{191, 256} {
+		p, err := rand.Prime(rand.Reader, bits)
+		assert.Equal(t, nil, err)
+		assert.Tf(t, limbFieldOf(p) == nil, "%d bit prime", bits)
+	}
+	assert.T(t, limbFieldOf(P_512) == nil)
+}
+
+// Test that operands which are not reduced are left to big.Int.
+func TestLimbMulUnreduced(t *testing.T) {
+	skipWithoutLimbs(t)
+	f := limbFieldOf(P_SKS)
+	z := big.NewInt(7)
+	for _, x := range []*big.Int{
+		P_SKS,
+		new(big.Int).Add(P_SKS, big.NewInt(1)),
+		new(big.Int).Lsh(big.NewInt(1), 200),
+		big.NewInt(-1)} {
+		assert.T(t, !f.mul(z, x, big.NewInt(2)))
+		assert.T(t, !f.mul(z, big.NewInt(2), x))
+	}
+	assert.Equal(t, int64(7), z.Int64())
+	// Zp.Mul reduces them as before
+	x := &Zp{Int: new(big.Int).Add(P_SKS, big.NewInt(3)), P: P_SKS}
+	assert.Equal(t, int64(6), Z(P_SKS).Mul(x, Zi(P_SKS, 2)).Int64())
+}
+
+func BenchmarkLimbMul(b *testing.B) {
+	skipWithoutLimbs(b)
+	f := limbFieldOf(P_SKS)
+	z, x := Zrand(P_SKS).Int, Zrand(P_SKS).Int
+	for i := 0; i < b.N; i++ {
+		f.mul(z, z, x)
+	}
+}
+
+// BenchmarkBarrettMul measures the big.Int products which limbs
+// replace for P_SKS.
+func BenchmarkBarrettMul(b *testing.B) {
+	ctx := NewZpContext(P_SKS)
+	ctx.limbs = nil
+	z, x := Zrand(P_SKS), Zrand(P_SKS)
+	for i := 0; i < b.N; i++ {
+		ctx.Mul(z, z, x)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+)
+
+// ZVector is a fixed-length vector of integers in a finite field,
+// allocated together and operated on element-wise in place.
+type ZVector struct {
+	ctx    *ZpContext
+	ints   []big.Int
+	values []Zp
+	ptrs   []*Zp
+}
+
+// NewZVector creates a vector of n zeros in the finite field p.
+func NewZVector(p *big.Int, n int) *ZVector {
+	v := &ZVector{
+		ctx:    NewZpContext(p),
+		ints:   make([]big.Int, n),
+		values: make([]Zp, n),
+		ptrs:   make([]*Zp, n)}
+	for i := 0; i < n; i++ {
+		v.values[i] = Zp{Int: &v.ints[i], P: p}
+		v.ptrs[i] = &v.values[i]
+	}
+	return v
+}
+
+// Len returns the number of elements in the vector.
+func (v *ZVector) Len() int {
+	return len(v.ptrs)
+}
+
+// Get returns the ith element, which is modified
+// by subsequent operations on the vector.
+func (v *ZVector) Get(i int) *Zp {
+	return v.ptrs[i]
+}
+
+// Slice returns the elements of the vector, which are
+// modified by subsequent operations on the vector.
+func (v *ZVector) Slice() []*Zp {
+	return v.ptrs
+}
+
+// Fill sets every element of the vector to z.
+func (v *ZVector) Fill(z *Zp) *ZVector {
+	for _, e := range v.ptrs {
+		e.assertEqualP(z)
+		e.Int.Set(z.Int)
+	}
+	return v
+}
+
+// Add sets each element of the vector to the sum of those in x and y.
+func (v *ZVector) Add(x, y *ZVector) *ZVector {
+	v.assertLen(x, y)
+	for i, e := range v.ptrs {
+		v.ctx.Add(e, x.ptrs[i], y.ptrs[i])
+	}
+	return v
+}
+
+// Sub sets each element of the vector to the difference
+// of those in x and y.
+func (v *ZVector) Sub(x, y *ZVector) *ZVector {
+	v.assertLen(x, y)
+	for i, e := range v.ptrs {
+		v.ctx.Sub(e, x.ptrs[i], y.ptrs[i])
+	}
+	return v
+}
+
+// Mul sets each element of the vector to the product of those in x and y.
+func (v *ZVector) Mul(x, y *ZVector) *ZVector {
+	v.assertLen(x, y)
+	for i, e := range v.ptrs {
+		v.ctx.Mul(e, x.ptrs[i], y.ptrs[i])
+	}
+	return v
+}
+
+// Div sets each element of the vector to the quotient of those in x and y.
+func (v *ZVector) Div(x, y *ZVector) *ZVector {
+	v.assertLen(x, y)
+	var inv Zp
+	inv.Int = big.NewInt(0)
+	for i, e := range v.ptrs {
+		inv.P = y.ptrs[i].P
+		inv.Int.Set(y.ptrs[i].Int)
+		inv.Inv()
+		v.ctx.Mul(e, x.ptrs[i], &inv)
+	}
+	return v
+}
+
+func (v *ZVector) assertLen(vectors ...*ZVector) {
+	for _, x := range vectors {
+		if x.Len() != v.Len() {
+			panic("vector lengths differ")
+		}
+	}
+}
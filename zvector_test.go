@@ -0,0 +1,64 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestZVector(t *testing.T) {
+	n := 8
+	x, y := NewZVector(P_SKS, n), NewZVector(P_SKS, n)
+	for i := 0; i < n; i++ {
+		x.Get(i).Int.Set(Zrand(P_SKS).Int)
+		y.Get(i).Int.Set(Zrand(P_SKS).Int)
+	}
+	sum := NewZVector(P_SKS, n).Add(x, y)
+	diff := NewZVector(P_SKS, n).Sub(x, y)
+	prod := NewZVector(P_SKS, n).Mul(x, y)
+	quo := NewZVector(P_SKS, n).Div(x, y)
+	for i := 0; i < n; i++ {
+		xi, yi := x.Get(i), y.Get(i)
+		assert.Equal(t, 0, Z(P_SKS).Add(xi, yi).Cmp(sum.Get(i)))
+		assert.Equal(t, 0, Z(P_SKS).Sub(xi, yi).Cmp(diff.Get(i)))
+		assert.Equal(t, 0, Z(P_SKS).Mul(xi, yi).Cmp(prod.Get(i)))
+		assert.Equal(t, 0, Z(P_SKS).Div(xi, yi).Cmp(quo.Get(i)))
+	}
+	// in place
+	x.Mul(x, y).Div(x, y)
+	for i := 0; i < n; i++ {
+		assert.Equal(t, 0, x.Get(i).Cmp(NewZVector(P_SKS, n).Sub(sum, y).Get(i)))
+	}
+	ones := NewZVector(P_SKS, n).Fill(Zi(P_SKS, 1))
+	assert.Equal(t, int64(1), ones.Slice()[n-1].Int64())
+}
+
+func TestZVectorLen(t *testing.T) {
+	defer func() {
+		r := recover()
+		assert.T(t, r != nil)
+	}()
+	NewZVector(P_SKS, 2).Add(NewZVector(P_SKS, 2), NewZVector(P_SKS, 3))
+	t.Fail()
+}